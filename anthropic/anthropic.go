@@ -0,0 +1,679 @@
+// anthropic package provides middleware for partial compatibility with the Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     *int            `json:"max_tokens"`
+	Messages      []Message       `json:"messages"`
+	System        json.RawMessage `json:"system"`
+	StopSequences []string        `json:"stop_sequences"`
+	Stream        bool            `json:"stream"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	TopK          *int            `json:"top_k"`
+	Tools         []Tool          `json:"tools"`
+	ToolChoice    *ToolChoice     `json:"tool_choice"`
+	Thinking      *Thinking       `json:"thinking"`
+}
+
+// Message is a message of a conversation, whose content is either a string or
+// a list of content blocks
+type Message struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// ContentBlock is a block of a message's content. Its type determines which
+// fields are set: text, image, tool_use, tool_result or thinking.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	Text *string `json:"text,omitempty"`
+
+	Source *ImageSource `json:"source,omitempty"`
+
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+
+	Thinking  *string `json:"thinking,omitempty"`
+	Signature *string `json:"signature,omitempty"`
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+type Thinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Delta is the change to a content block or, in a message_delta event, to
+// the message
+type Delta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	Thinking     string  `json:"thinking,omitempty"`
+	PartialJSON  string  `json:"partial_json,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+// Event is a server-sent event of a streamed message
+type Event struct {
+	Type         string            `json:"type"`
+	Message      *MessagesResponse `json:"message,omitempty"`
+	Index        *int              `json:"index,omitempty"`
+	ContentBlock *ContentBlock     `json:"content_block,omitempty"`
+	Delta        *Delta            `json:"delta,omitempty"`
+	Usage        *Usage            `json:"usage,omitempty"`
+	Error        *Error            `json:"error,omitempty"`
+}
+
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		etype = "request_too_large"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		etype = "overloaded_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+// newID returns a random id such as "msg_" followed by 24 hex digits
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b) //nolint:errcheck
+	return prefix + hex.EncodeToString(b)
+}
+
+// fromContent converts the content of a message, which is either a string or
+// a list of content blocks
+func fromContent(raw json.RawMessage) ([]ContentBlock, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []ContentBlock{{Type: "text", Text: &s}}, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, errors.New("invalid message content")
+	}
+
+	return blocks, nil
+}
+
+func fromImageSource(source *ImageSource) (api.ImageData, error) {
+	if source == nil || source.Type != "base64" {
+		return nil, errors.New("invalid image source: only base64 images are supported")
+	}
+
+	switch source.MediaType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+	default:
+		return nil, fmt.Errorf("unsupported image media type: %q", source.MediaType)
+	}
+
+	img, err := base64.StdEncoding.DecodeString(source.Data)
+	if err != nil {
+		return nil, errors.New("invalid image data")
+	}
+
+	return img, nil
+}
+
+// fromTextContent converts the content of a tool_result block or the system
+// prompt, which is either a string or a list of text blocks
+func fromTextContent(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	blocks, err := fromContent(raw)
+	if err != nil {
+		return "", err
+	}
+
+	var texts []string
+	for _, b := range blocks {
+		if b.Type != "text" || b.Text == nil {
+			return "", fmt.Errorf("unsupported content type: %q", b.Type)
+		}
+		texts = append(texts, *b.Text)
+	}
+
+	return strings.Join(texts, "\n"), nil
+}
+
+func fromMessages(r MessagesRequest) ([]api.Message, error) {
+	var messages []api.Message
+
+	if len(r.System) > 0 {
+		system, err := fromTextContent(r.System)
+		if err != nil {
+			return nil, errors.New("invalid system prompt")
+		}
+		messages = append(messages, api.Message{Role: "system", Content: system})
+	}
+
+	for _, msg := range r.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("invalid message role: %q", msg.Role)
+		}
+
+		blocks, err := fromContent(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		m := api.Message{Role: msg.Role}
+		var texts []string
+		for _, b := range blocks {
+			switch b.Type {
+			case "text":
+				if b.Text != nil {
+					texts = append(texts, *b.Text)
+				}
+			case "image":
+				img, err := fromImageSource(b.Source)
+				if err != nil {
+					return nil, err
+				}
+				m.Images = append(m.Images, img)
+			case "tool_use":
+				var tc api.ToolCall
+				tc.Function.Name = b.Name
+				if input, ok := b.Input.(map[string]any); ok {
+					tc.Function.Arguments = input
+				} else if b.Input != nil {
+					return nil, errors.New("invalid tool_use input")
+				}
+				m.ToolCalls = append(m.ToolCalls, tc)
+			case "tool_result":
+				// results come before any text the user sends along with them
+				content, err := fromTextContent(b.Content)
+				if err != nil {
+					return nil, err
+				}
+				messages = append(messages, api.Message{Role: "tool", Content: content})
+			case "thinking":
+				if b.Thinking != nil {
+					m.Thinking += *b.Thinking
+				}
+			case "redacted_thinking":
+			default:
+				return nil, fmt.Errorf("unsupported content block type: %q", b.Type)
+			}
+		}
+
+		m.Content = strings.Join(texts, "\n")
+		if m.Content != "" || m.Thinking != "" || len(m.Images) > 0 || len(m.ToolCalls) > 0 {
+			messages = append(messages, m)
+		}
+	}
+
+	return messages, nil
+}
+
+func fromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	messages, err := fromMessages(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.InputSchema) > 0 {
+			if err := json.Unmarshal(t.InputSchema, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("invalid input_schema for tool %q: %w", t.Name, err)
+			}
+		}
+		tools = append(tools, tool)
+	}
+
+	var toolChoice *api.ToolChoice
+	var parallel *bool
+	if r.ToolChoice != nil {
+		switch r.ToolChoice.Type {
+		case "auto":
+			toolChoice = &api.ToolChoice{Mode: api.ToolChoiceAuto}
+		case "any":
+			toolChoice = &api.ToolChoice{Mode: api.ToolChoiceRequired}
+		case "tool":
+			toolChoice = &api.ToolChoice{Function: r.ToolChoice.Name}
+		case "none":
+			toolChoice = &api.ToolChoice{Mode: api.ToolChoiceNone}
+		default:
+			return nil, fmt.Errorf("invalid tool_choice type: %q", r.ToolChoice.Type)
+		}
+
+		if r.ToolChoice.DisableParallelToolUse {
+			parallel = new(bool)
+		}
+	}
+
+	options := map[string]any{
+		"num_predict": *r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	} else {
+		options["temperature"] = 1.0
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	// the thinking budget isn't supported, so thinking is only toggled
+	var think *bool
+	if r.Thinking != nil {
+		switch r.Thinking.Type {
+		case "enabled":
+			think = new(bool)
+			*think = true
+		case "disabled":
+			think = new(bool)
+		default:
+			return nil, fmt.Errorf("invalid thinking type: %q", r.Thinking.Type)
+		}
+	}
+
+	return &api.ChatRequest{
+		Model:             r.Model,
+		Messages:          messages,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             tools,
+		ToolChoice:        toolChoice,
+		ParallelToolCalls: parallel,
+		Think:             think,
+	}, nil
+}
+
+// toStopReason returns the stop reason of r and, if it stopped on one of the
+// request's stop sequences, the sequence
+func toStopReason(r api.ChatResponse, toolUse bool) (*string, *string) {
+	reason := "end_turn"
+	var sequence *string
+	switch {
+	case toolUse:
+		reason = "tool_use"
+	case r.DoneReason == "length":
+		reason = "max_tokens"
+	case r.StopSequence != "":
+		reason = "stop_sequence"
+		sequence = &r.StopSequence
+	}
+
+	return &reason, sequence
+}
+
+// MessagesWriter converts chat responses to a message, or to the events of
+// a streamed message
+type MessagesWriter struct {
+	gin.ResponseWriter
+	stream bool
+
+	message MessagesResponse
+
+	// whether the last content block is still being streamed
+	open bool
+
+	started bool
+}
+
+func (w *MessagesWriter) event(e Event) error {
+	if !w.stream {
+		return nil
+	}
+
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", e.Type, d)))
+	return err
+}
+
+// startBlock closes the current content block and starts block, unless the
+// current block has the same type and can be continued
+func (w *MessagesWriter) startBlock(block ContentBlock) error {
+	if n := len(w.message.Content); w.open && w.message.Content[n-1].Type == block.Type && block.Type != "tool_use" {
+		return nil
+	}
+
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+
+	w.message.Content = append(w.message.Content, block)
+	w.open = true
+
+	// the block starts empty and its content is sent as deltas
+	start := block
+	switch block.Type {
+	case "text":
+		start.Text = new(string)
+	case "thinking":
+		start.Thinking = new(string)
+		start.Signature = new(string)
+	case "tool_use":
+		start.Input = map[string]any{}
+	}
+
+	index := len(w.message.Content) - 1
+	return w.event(Event{Type: "content_block_start", Index: &index, ContentBlock: &start})
+}
+
+func (w *MessagesWriter) stopBlock() error {
+	if !w.open {
+		return nil
+	}
+
+	w.open = false
+	index := len(w.message.Content) - 1
+	return w.event(Event{Type: "content_block_stop", Index: &index})
+}
+
+func (w *MessagesWriter) writeDelta(delta Delta) error {
+	index := len(w.message.Content) - 1
+	return w.event(Event{Type: "content_block_delta", Index: &index, Delta: &delta})
+}
+
+func (w *MessagesWriter) writeThinking(thinking string) error {
+	if err := w.startBlock(ContentBlock{Type: "thinking", Thinking: new(string), Signature: new(string)}); err != nil {
+		return err
+	}
+
+	block := &w.message.Content[len(w.message.Content)-1]
+	*block.Thinking += thinking
+	return w.writeDelta(Delta{Type: "thinking_delta", Thinking: thinking})
+}
+
+func (w *MessagesWriter) writeText(text string) error {
+	if err := w.startBlock(ContentBlock{Type: "text", Text: new(string)}); err != nil {
+		return err
+	}
+
+	block := &w.message.Content[len(w.message.Content)-1]
+	*block.Text += text
+	return w.writeDelta(Delta{Type: "text_delta", Text: text})
+}
+
+func (w *MessagesWriter) writeToolCall(tc api.ToolCall) error {
+	args := tc.Function.Arguments
+	if args == nil {
+		args = api.ToolCallFunctionArguments{}
+	}
+
+	if err := w.startBlock(ContentBlock{Type: "tool_use", ID: newID("toolu_"), Name: tc.Function.Name, Input: args}); err != nil {
+		return err
+	}
+
+	input, err := json.Marshal(args)
+	if err != nil {
+		slog.Error("could not marshal tool call arguments to json", "error", err)
+		return err
+	}
+
+	return w.writeDelta(Delta{Type: "input_json_delta", PartialJSON: string(input)})
+}
+
+func (w *MessagesWriter) writeResponse(data []byte) (int, error) {
+	var chatResponse struct {
+		api.ChatResponse
+		Error string `json:"error"`
+	}
+	err := json.Unmarshal(data, &chatResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	// errors after the stream has started are sent as an error event
+	if chatResponse.Error != "" {
+		e := NewError(http.StatusInternalServerError, chatResponse.Error).Error
+		if err := w.event(Event{Type: "error", Error: &e}); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	// the Anthropic API has no way to report the queue position
+	if chatResponse.QueuePosition > 0 {
+		return len(data), nil
+	}
+
+	if !w.started {
+		w.started = true
+		w.message.Usage.InputTokens = chatResponse.PromptEvalCount
+		if err := w.event(Event{Type: "message_start", Message: &w.message}); err != nil {
+			return 0, err
+		}
+	}
+
+	if chatResponse.Message.Thinking != "" {
+		if err := w.writeThinking(chatResponse.Message.Thinking); err != nil {
+			return 0, err
+		}
+	}
+
+	if chatResponse.Message.Content != "" {
+		if err := w.writeText(chatResponse.Message.Content); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, tc := range chatResponse.Message.ToolCalls {
+		if err := w.writeToolCall(tc); err != nil {
+			return 0, err
+		}
+	}
+
+	if !chatResponse.Done {
+		return len(data), nil
+	}
+
+	if err := w.stopBlock(); err != nil {
+		return 0, err
+	}
+
+	toolUse := false
+	for _, b := range w.message.Content {
+		if b.Type == "tool_use" {
+			toolUse = true
+		}
+	}
+
+	w.message.StopReason, w.message.StopSequence = toStopReason(chatResponse.ChatResponse, toolUse)
+	w.message.Usage = Usage{
+		InputTokens:  chatResponse.PromptEvalCount,
+		OutputTokens: chatResponse.EvalCount,
+	}
+
+	if w.stream {
+		if err := w.event(Event{Type: "message_delta", Delta: &Delta{StopReason: w.message.StopReason, StopSequence: w.message.StopSequence}, Usage: &w.message.Usage}); err != nil {
+			return 0, err
+		}
+		if err := w.event(Event{Type: "message_stop"}); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(w.message)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) writeError(data []byte) (int, error) {
+	var serr api.StatusError
+	err := json.Unmarshal(data, &serr)
+	if err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(w.ResponseWriter.Status(), serr.Error()))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// MessagesMiddleware serves the Anthropic Messages API with the chat handler
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if req.MaxTokens == nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "max_tokens: field required"))
+			return
+		}
+
+		if len(req.Messages) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "messages: at least one message is required"))
+			return
+		}
+
+		chatReq, err := fromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &MessagesWriter{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			message: MessagesResponse{
+				ID:      newID("msg_"),
+				Type:    "message",
+				Role:    "assistant",
+				Model:   req.Model,
+				Content: []ContentBlock{},
+			},
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
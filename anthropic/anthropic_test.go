@@ -0,0 +1,345 @@
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+const image = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNk+A8AAQUBAScY42YAAAAASUVORK5CYII=`
+
+var (
+	False = false
+	True  = true
+)
+
+func captureRequestMiddleware(capturedRequest any) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bodyBytes, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		err := json.Unmarshal(bodyBytes, capturedRequest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "failed to unmarshal request")
+		}
+		c.Next()
+	}
+}
+
+func TestMessagesMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.ChatRequest
+		err  string
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	img, _ := base64.StdEncoding.DecodeString(image)
+
+	testCases := []testCase{
+		{
+			name: "text",
+			body: `{"model": "test-model", "max_tokens": 100, "system": "Be brief", "messages": [{"role": "user", "content": "Hello"}], "stop_sequences": ["\n"], "top_k": 20}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Be brief"},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+					"stop":        []any{"\n"},
+					"temperature": 1.0,
+					"top_k":       20.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "content blocks",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"system": [{"type": "text", "text": "Use tools"}],
+				"messages": [
+					{"role": "user", "content": [{"type": "text", "text": "What's in this image?"}, {"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "` + image + `"}}]},
+					{"role": "assistant", "content": [{"type": "thinking", "thinking": "Checking", "signature": ""}, {"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}]},
+					{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": "sunny"}, {"type": "text", "text": "Thanks"}]}
+				],
+				"tools": [{"name": "get_weather", "input_schema": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}}],
+				"thinking": {"type": "enabled", "budget_tokens": 1024},
+				"stream": true
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Use tools"},
+					{Role: "user", Content: "What's in this image?", Images: []api.ImageData{img}},
+					{Role: "assistant", Thinking: "Checking", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+					{Role: "tool", Content: "sunny"},
+					{Role: "user", Content: "Thanks"},
+				},
+				Tools: []api.Tool{func() api.Tool {
+					var tool api.Tool
+					json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}}}`), &tool)
+					return tool
+				}()},
+				Options: map[string]any{
+					"num_predict": 100.0,
+					"temperature": 1.0,
+				},
+				Stream: &True,
+				Think:  &True,
+			},
+		},
+		{
+			name: "missing max_tokens",
+			body: `{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}]}`,
+			err:  "max_tokens: field required",
+		},
+		{
+			name: "image url",
+			body: `{"model": "test-model", "max_tokens": 100, "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "url", "url": "https://example.com/image.png"}}]}]}`,
+			err:  "invalid image source: only base64 images are supported",
+		},
+		{
+			name: "webp image",
+			body: `{"model": "test-model", "max_tokens": 100, "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/webp", "data": "` + image + `"}}]}]}`,
+			req: api.ChatRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Images: []api.ImageData{img}}},
+				Options: map[string]any{
+					"num_predict": 100.0,
+					"temperature": 1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "unsupported image type",
+			body: `{"model": "test-model", "max_tokens": 100, "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/bmp", "data": "` + image + `"}}]}]}`,
+			err:  `unsupported image media type: "image/bmp"`,
+		},
+		{
+			name: "invalid role",
+			body: `{"model": "test-model", "max_tokens": 100, "messages": [{"role": "system", "content": "Hello"}]}`,
+			err:  `invalid message role: "system"`,
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MessagesMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/v1/messages", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			defer func() { capturedRequest = nil }()
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if tc.err != "" {
+				var errResp ErrorResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Code != http.StatusBadRequest || errResp.Type != "error" || errResp.Error.Message != tc.err {
+					t.Fatalf("expected error %q, got %d %+v", tc.err, resp.Code, errResp)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(&tc.req, capturedRequest); diff != "" {
+				t.Fatalf("requests did not match: %+v", diff)
+			}
+		})
+	}
+}
+
+func TestMessagesWriter(t *testing.T) {
+	var responses []any
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		for _, r := range responses {
+			bts, _ := json.Marshal(r)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MessagesMiddleware())
+	router.Handle(http.MethodPost, "/v1/messages", endpoint)
+
+	post := func(t *testing.T, stream bool) *httptest.ResponseRecorder {
+		t.Helper()
+
+		body, _ := json.Marshal(map[string]any{
+			"model":      "test-model",
+			"max_tokens": 100,
+			"messages":   []map[string]any{{"role": "user", "content": "Hello"}},
+			"stream":     stream,
+		})
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		responses = []any{
+			api.ChatResponse{
+				Model: "test-model",
+				Message: api.Message{
+					Role:      "assistant",
+					Thinking:  "Weather",
+					Content:   "Let me check.",
+					ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}},
+				},
+				Done:       true,
+				DoneReason: "stop",
+				Metrics:    api.Metrics{PromptEvalCount: 5, EvalCount: 7},
+			},
+		}
+
+		resp := post(t, false)
+
+		var msg MessagesResponse
+		if err := json.Unmarshal(resp.Body.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.StopReason == nil || *msg.StopReason != "tool_use" {
+			t.Errorf("expected stop reason tool_use, got %s", resp.Body)
+		}
+
+		if msg.Usage != (Usage{InputTokens: 5, OutputTokens: 7}) {
+			t.Errorf("unexpected usage %+v", msg.Usage)
+		}
+
+		var types []string
+		for _, b := range msg.Content {
+			types = append(types, b.Type)
+		}
+
+		if diff := cmp.Diff([]string{"thinking", "text", "tool_use"}, types); diff != "" {
+			t.Fatalf("content mismatch (-want +got):\n%s", diff)
+		}
+
+		if *msg.Content[0].Thinking != "Weather" || *msg.Content[1].Text != "Let me check." || !strings.HasPrefix(msg.Content[2].ID, "toolu_") {
+			t.Errorf("unexpected content %s", resp.Body)
+		}
+
+		if diff := cmp.Diff(map[string]any{"city": "Paris"}, msg.Content[2].Input); diff != "" {
+			t.Errorf("input mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("stop sequence", func(t *testing.T) {
+		responses = []any{
+			api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}, Done: true, DoneReason: "stop", StopSequence: "\n"},
+		}
+
+		var msg MessagesResponse
+		if err := json.Unmarshal(post(t, false).Body.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.StopReason == nil || *msg.StopReason != "stop_sequence" || msg.StopSequence == nil || *msg.StopSequence != "\n" {
+			t.Errorf("expected stop sequence %q, got %+v", "\n", msg)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		responses = []any{
+			api.ChatResponse{Model: "test-model", QueuePosition: 1},
+			api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}, Metrics: api.Metrics{PromptEvalCount: 5}},
+			api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "!"}},
+			api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "length", Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}},
+		}
+
+		resp := post(t, true)
+
+		var events []Event
+		for _, e := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+			name, data, ok := strings.Cut(e, "\n")
+			if !ok {
+				t.Fatalf("invalid event %q", e)
+			}
+
+			var event Event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &event); err != nil {
+				t.Fatal(err)
+			}
+
+			if name != "event: "+event.Type {
+				t.Errorf("event name %q doesn't match type %q", name, event.Type)
+			}
+
+			events = append(events, event)
+		}
+
+		var types []string
+		for _, e := range events {
+			types = append(types, e.Type)
+		}
+
+		want := []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+		if diff := cmp.Diff(want, types); diff != "" {
+			t.Fatalf("events mismatch (-want +got):\n%s", diff)
+		}
+
+		if m := events[0].Message; m.Usage.InputTokens != 5 {
+			t.Errorf("expected 5 input tokens in message_start, got %+v", m.Usage)
+		}
+
+		if b := events[1].ContentBlock; b.Type != "text" || b.Text == nil || *b.Text != "" {
+			t.Errorf("expected an empty text block, got %+v", b)
+		}
+
+		if d := events[3].Delta; d.Type != "text_delta" || d.Text != "!" {
+			t.Errorf("unexpected delta %+v", d)
+		}
+
+		if d := events[5].Delta; d.StopReason == nil || *d.StopReason != "max_tokens" || events[5].Usage.OutputTokens != 2 {
+			t.Errorf("unexpected message delta %+v", events[5])
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		responses = []any{
+			api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			map[string]string{"error": "model crashed"},
+		}
+
+		resp := post(t, true)
+		if !strings.HasSuffix(strings.TrimSpace(resp.Body.String()), `event: error
+data: {"type":"error","error":{"type":"api_error","message":"model crashed"}}`) {
+			t.Errorf("expected an error event, got %s", resp.Body)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
@@ -69,7 +70,9 @@ type GenerateRequest struct {
 	// Raw set to true means that no formatting will be applied to the prompt.
 	Raw bool `json:"raw,omitempty"`
 
-	// Format specifies the format to return a response in.
+	// Format specifies the format to return a response in: "json", a JSON
+	// schema, or a regex or choice format such as
+	// {"type": "regex", "pattern": "..."} or {"type": "choice", "options": [...]}.
 	Format json.RawMessage `json:"format,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
@@ -83,6 +86,16 @@ type GenerateRequest struct {
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]any `json:"options"`
+
+	// Think controls whether thinking/reasoning models will think before
+	// responding. It is a pointer so that leaving it unset keeps the model's
+	// default behavior.
+	Think *bool `json:"think,omitempty"`
+
+	// N is the number of completions to generate for the prompt. The prompt
+	// is only processed once and responses are identified by their Index.
+	// Defaults to 1.
+	N int `json:"n,omitempty"`
 }
 
 // ChatRequest describes a request sent by [Client.Chat].
@@ -96,7 +109,8 @@ type ChatRequest struct {
 	// Stream enables streaming of returned responses; true by default.
 	Stream *bool `json:"stream,omitempty"`
 
-	// Format is the format to return the response in (e.g. "json").
+	// Format is the format to return the response in (e.g. "json"). It
+	// accepts the same formats as GenerateRequest.Format.
 	Format json.RawMessage `json:"format,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded into memory
@@ -106,8 +120,91 @@ type ChatRequest struct {
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// ToolChoice controls whether the model calls one of the tools. It is
+	// "auto" by default, which lets the model decide.
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+
+	// ParallelToolCalls controls whether the model can call more than one
+	// tool in a response; true by default.
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]any `json:"options"`
+
+	// Think controls whether thinking/reasoning models will think before
+	// responding, as in [GenerateRequest].
+	Think *bool `json:"think,omitempty"`
+
+	// N is the number of completions to generate, as in [GenerateRequest].
+	N int `json:"n,omitempty"`
+}
+
+const (
+	// ToolChoiceAuto lets the model decide whether to call tools
+	ToolChoiceAuto = "auto"
+	// ToolChoiceNone hides the tools from the model
+	ToolChoiceNone = "none"
+	// ToolChoiceRequired makes the model call at least one tool
+	ToolChoiceRequired = "required"
+)
+
+// ToolChoice is either a mode, such as "required", or the name of a function
+// that the model must call. In JSON, it is either the mode as a string or
+// an object of the form {"type": "function", "function": {"name": "..."}}.
+type ToolChoice struct {
+	Mode     string
+	Function string
+}
+
+func (t ToolChoice) MarshalJSON() ([]byte, error) {
+	if t.Function != "" {
+		var v struct {
+			Type     string `json:"type"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		}
+		v.Type = "function"
+		v.Function.Name = t.Function
+		return json.Marshal(v)
+	}
+
+	return json.Marshal(t.Mode)
+}
+
+func (t *ToolChoice) UnmarshalJSON(b []byte) error {
+	var mode string
+	if err := json.Unmarshal(b, &mode); err == nil {
+		switch mode {
+		case ToolChoiceAuto, ToolChoiceNone, ToolChoiceRequired:
+			*t = ToolChoice{Mode: mode}
+			return nil
+		default:
+			return fmt.Errorf("invalid tool_choice: %q", mode)
+		}
+	}
+
+	var v struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("invalid tool_choice: %w", err)
+	}
+
+	if v.Type != "function" || v.Function.Name == "" {
+		return errors.New(`invalid tool_choice: expected "auto", "none", "required" or a function`)
+	}
+
+	*t = ToolChoice{Function: v.Function.Name}
+	return nil
+}
+
+// Forced reports whether the model must call a tool
+func (t *ToolChoice) Forced() bool {
+	return t != nil && (t.Mode == ToolChoiceRequired || t.Function != "")
 }
 
 type Tools []Tool
@@ -126,10 +223,17 @@ func (t Tool) String() string {
 // role ("system", "user", or "assistant"), the content and an optional list
 // of images.
 type Message struct {
-	Role      string      `json:"role"`
-	Content   string      `json:"content"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Thinking contains the text that was inside thinking tags in the
+	// original model output when the request enabled thinking.
+	Thinking  string      `json:"thinking,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
+	// ToolCallDeltas contains the parts of tool calls that were generated
+	// since the last streamed response. Complete tool calls are also sent in
+	// ToolCalls once they're done.
+	ToolCallDeltas []ToolCallDelta `json:"tool_call_deltas,omitempty"`
 }
 
 func (m *Message) UnmarshalJSON(b []byte) error {
@@ -156,6 +260,16 @@ type ToolCallFunction struct {
 
 type ToolCallFunctionArguments map[string]any
 
+// ToolCallDelta is part of a tool call that is being streamed
+type ToolCallDelta struct {
+	// Index is the index of the tool call in the response
+	Index int `json:"index"`
+	// Name is the name of the function, sent with the first delta of a call
+	Name string `json:"name,omitempty"`
+	// Arguments is the next part of the JSON encoded arguments
+	Arguments string `json:"arguments"`
+}
+
 func (t *ToolCallFunctionArguments) String() string {
 	bts, _ := json.Marshal(t)
 	return string(bts)
@@ -231,6 +345,17 @@ func (t *ToolFunction) String() string {
 	return string(bts)
 }
 
+// ChatChoice is one of the completions of a [ChatResponse].
+type ChatChoice struct {
+	Index      int       `json:"index"`
+	Message    Message   `json:"message"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	Logprobs   []Logprob `json:"logprobs,omitempty"`
+
+	// EvalCount is the number of tokens generated for the completion.
+	EvalCount int `json:"eval_count,omitempty"`
+}
+
 // ChatResponse is the response returned by [Client.Chat]. Its fields are
 // similar to [GenerateResponse].
 type ChatResponse struct {
@@ -239,11 +364,45 @@ type ChatResponse struct {
 	Message    Message   `json:"message"`
 	DoneReason string    `json:"done_reason,omitempty"`
 
+	// StopSequence is the stop sequence that ended the response, if any.
+	StopSequence string `json:"stop_sequence,omitempty"`
+
 	Done bool `json:"done"`
 
+	// Index identifies the completion this response belongs to when more
+	// than one was requested with N.
+	Index int `json:"index,omitempty"`
+
+	// Choices holds every completion, ordered by index, when more than one
+	// was requested with N and the response isn't streamed. The other fields
+	// are those of the first completion.
+	Choices []ChatChoice `json:"choices,omitempty"`
+
+	// Logprobs contains log probability information for the generated
+	// tokens when the logprobs option is set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// QueuePosition is set while the request is waiting for other requests
+	// to finish, before any content is generated.
+	QueuePosition int `json:"queue_position,omitempty"`
+
 	Metrics
 }
 
+// TokenLogprob is the log probability of a single token.
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes,omitempty"`
+}
+
+// Logprob is the log probability of a generated token along with the most
+// likely alternatives at that position.
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -251,6 +410,21 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// DraftCount is the number of tokens proposed by the model's draft
+	// model, of which DraftAcceptedCount were accepted
+	DraftCount         int `json:"draft_count,omitempty"`
+	DraftAcceptedCount int `json:"draft_accepted_count,omitempty"`
+}
+
+// DraftAcceptanceRate returns the fraction of tokens proposed by the draft
+// model that were accepted, or 0 if the model has no draft model
+func (m *Metrics) DraftAcceptanceRate() float64 {
+	if m.DraftCount == 0 {
+		return 0
+	}
+
+	return float64(m.DraftAcceptedCount) / float64(m.DraftCount)
 }
 
 // Options specified in [GenerateRequest].  If you add a new option here, also
@@ -266,12 +440,51 @@ type Options struct {
 	TopP             float32  `json:"top_p,omitempty"`
 	MinP             float32  `json:"min_p,omitempty"`
 	TypicalP         float32  `json:"typical_p,omitempty"`
+	Mirostat         int      `json:"mirostat,omitempty"`
+	MirostatTau      float32  `json:"mirostat_tau,omitempty"`
+	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
 	Temperature      float32  `json:"temperature,omitempty"`
 	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
 	PresencePenalty  float32  `json:"presence_penalty,omitempty"`
 	FrequencyPenalty float32  `json:"frequency_penalty,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+	Logprobs         bool     `json:"logprobs,omitempty"`
+	TopLogprobs      int      `json:"top_logprobs,omitempty"`
+
+	// LogitBias maps token ids to a bias that is added to the token's logit
+	// before sampling. A large negative bias such as -100 effectively bans
+	// the token while a large positive bias forces it to be selected.
+	LogitBias map[int32]float32 `json:"logit_bias,omitempty"`
+
+	// DRY penalizes tokens that would extend text repeated from the last
+	// DryPenaltyLastN tokens, once it's at least DryAllowedLength tokens
+	// long. Repetitions don't extend across the sequence breakers.
+	DryMultiplier       float32  `json:"dry_multiplier,omitempty"`
+	DryBase             float32  `json:"dry_base,omitempty"`
+	DryAllowedLength    int      `json:"dry_allowed_length,omitempty"`
+	DryPenaltyLastN     int      `json:"dry_penalty_last_n,omitempty"`
+	DrySequenceBreakers []string `json:"dry_sequence_breakers,omitempty"`
+
+	// XTC removes the most likely tokens with a probability of at least
+	// XTCThreshold, except the least likely of them, with a probability of
+	// XTCProbability
+	XTCProbability float32 `json:"xtc_probability,omitempty"`
+	XTCThreshold   float32 `json:"xtc_threshold,omitempty"`
+
+	// Samplers is the order samplers are applied in, such as
+	// ["penalties", "top_k", "temperature", "top_p"]. Samplers that aren't
+	// listed aren't applied.
+	Samplers []string `json:"samplers,omitempty"`
+
+	// NumBeams is the number of hypotheses kept by beam search, which
+	// replaces sampling when it's more than 1. Finished hypotheses are scored
+	// by their log probability divided by their length to the power of
+	// LengthPenalty. EarlyStopping ends the search as soon as NumBeams
+	// hypotheses have finished, rather than once no others can score better.
+	NumBeams      int     `json:"num_beams,omitempty"`
+	LengthPenalty float32 `json:"length_penalty,omitempty"`
+	EarlyStopping bool    `json:"early_stopping,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -312,6 +525,54 @@ type EmbedResponse struct {
 	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
 }
 
+// RerankRequest is the request passed to [Client.Rerank].
+type RerankRequest struct {
+	// Model is the model name. It must be a reranking (cross-encoder) model.
+	Model string `json:"model"`
+
+	// Query is the text the documents are scored against.
+	Query string `json:"query"`
+
+	// Documents are the texts to score.
+	Documents []string `json:"documents"`
+
+	// TopN limits the response to the highest scoring documents. If it is
+	// zero, all documents are returned.
+	TopN int `json:"top_n,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded in memory following
+	// this request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	// Truncate truncates each document to fit within the context length
+	// along with the query. Defaults to true.
+	Truncate *bool `json:"truncate,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options"`
+}
+
+// RerankResponse is the response from [Client.Rerank].
+type RerankResponse struct {
+	Model string `json:"model"`
+
+	// Results are ordered from most to least relevant.
+	Results []RerankResult `json:"results"`
+
+	TotalDuration   time.Duration `json:"total_duration,omitempty"`
+	LoadDuration    time.Duration `json:"load_duration,omitempty"`
+	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+}
+
+// RerankResult is the relevance of a single document to the query.
+type RerankResult struct {
+	// Index is the position of the document in [RerankRequest.Documents].
+	Index int `json:"index"`
+
+	// RelevanceScore is between 0 and 1, with higher values being more relevant.
+	RelevanceScore float64 `json:"relevance_score"`
+}
+
 // EmbeddingRequest is the request passed to [Client.Embeddings].
 type EmbeddingRequest struct {
 	// Model is the model name.
@@ -333,6 +594,49 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// TokenizeRequest is the request passed to [Client.Tokenize].
+type TokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Prompt is the text to tokenize. It is tokenized as is, without applying
+	// the model's template.
+	Prompt string `json:"prompt,omitempty"`
+
+	// Messages, if set instead of Prompt, are rendered with the model's chat
+	// template before being tokenized, giving the number of tokens the same
+	// messages would use in a [ChatRequest]. Images are not counted.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Tools are rendered along with Messages, as in a [ChatRequest].
+	Tools []Tool `json:"tools,omitempty"`
+
+	// Think is passed to the template along with Messages, as in a
+	// [ChatRequest].
+	Think *bool `json:"think,omitempty"`
+}
+
+// TokenizeResponse is the response from [Client.Tokenize].
+type TokenizeResponse struct {
+	Model  string `json:"model"`
+	Tokens []int  `json:"tokens"`
+}
+
+// DetokenizeRequest is the request passed to [Client.Detokenize].
+type DetokenizeRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Tokens are the tokens to convert back into text.
+	Tokens []int `json:"tokens"`
+}
+
+// DetokenizeResponse is the response from [Client.Detokenize].
+type DetokenizeResponse struct {
+	Model   string `json:"model"`
+	Content string `json:"content"`
+}
+
 // CreateRequest is the request passed to [Client.Create].
 type CreateRequest struct {
 	Model    string `json:"model"`
@@ -342,6 +646,7 @@ type CreateRequest struct {
 	From       string            `json:"from,omitempty"`
 	Files      map[string]string `json:"files,omitempty"`
 	Adapters   map[string]string `json:"adapters,omitempty"`
+	Draft      string            `json:"draft,omitempty"`
 	Template   string            `json:"template,omitempty"`
 	License    any               `json:"license,omitempty"`
 	System     string            `json:"system,omitempty"`
@@ -362,6 +667,58 @@ type DeleteRequest struct {
 	Name string `json:"name"`
 }
 
+// PinRequest is the request passed to [Client.Pin].
+type PinRequest struct {
+	Model string `json:"model"`
+
+	// Options lists runner options, such as num_ctx, to load the model with.
+	// Requests for the model use these options instead of their own.
+	Options map[string]any `json:"options,omitempty"`
+
+	// NumParallel is the number of requests the model serves in parallel.
+	// The server default is used if it is zero.
+	NumParallel int `json:"num_parallel,omitempty"`
+}
+
+// UnpinRequest is the request passed to [Client.Unpin].
+type UnpinRequest struct {
+	Model string `json:"model"`
+}
+
+// WarmRequest is the request passed to [Client.Warm].
+type WarmRequest struct {
+	// Model is the model name.
+	Model string `json:"model"`
+
+	// Name identifies the prompt. Warming a prompt with the same name
+	// replaces the one that was warmed before.
+	Name string `json:"name"`
+
+	// Prompt is a prompt to warm as is, without applying the model's
+	// template. Either Prompt or Messages must be set.
+	Prompt string `json:"prompt,omitempty"`
+
+	// Messages are formatted with the model's template, as in [ChatRequest],
+	// to produce the prompt to warm.
+	Messages []Message `json:"messages,omitempty"`
+
+	// Tools are formatted along with Messages, as in [ChatRequest].
+	Tools []Tool `json:"tools,omitempty"`
+
+	// Options lists model-specific options.
+	Options map[string]any `json:"options,omitempty"`
+
+	// KeepAlive controls how long the model will stay loaded into memory
+	// following the request.
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
+// WarmResponse is the response from [Client.Warm].
+type WarmResponse struct {
+	// PromptEvalCount is the number of tokens in the warmed prompt.
+	PromptEvalCount int `json:"prompt_eval_count"`
+}
+
 // ShowRequest is the request passed to [Client.Show].
 type ShowRequest struct {
 	Model  string `json:"model"`
@@ -461,12 +818,26 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+	Pinned    bool         `json:"pinned,omitempty"`
 }
 
 type TokenResponse struct {
 	Token string `json:"token"`
 }
 
+// GenerateChoice is one of the completions of a [GenerateResponse].
+type GenerateChoice struct {
+	Index      int       `json:"index"`
+	Response   string    `json:"response"`
+	Thinking   string    `json:"thinking,omitempty"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	Context    []int     `json:"context,omitempty"`
+	Logprobs   []Logprob `json:"logprobs,omitempty"`
+
+	// EvalCount is the number of tokens generated for the completion.
+	EvalCount int `json:"eval_count,omitempty"`
+}
+
 // GenerateResponse is the response passed into [GenerateResponseFunc].
 type GenerateResponse struct {
 	// Model is the model name that generated the response.
@@ -478,16 +849,37 @@ type GenerateResponse struct {
 	// Response is the textual response itself.
 	Response string `json:"response"`
 
+	// Thinking contains the text that was inside thinking tags in the
+	// original model output when the request enabled thinking.
+	Thinking string `json:"thinking,omitempty"`
+
 	// Done specifies if the response is complete.
 	Done bool `json:"done"`
 
 	// DoneReason is the reason the model stopped generating text.
 	DoneReason string `json:"done_reason,omitempty"`
 
+	// Index identifies the completion this response belongs to when more
+	// than one was requested with N.
+	Index int `json:"index,omitempty"`
+
+	// Choices holds every completion, ordered by index, when more than one
+	// was requested with N and the response isn't streamed. The other fields
+	// are those of the first completion.
+	Choices []GenerateChoice `json:"choices,omitempty"`
+
 	// Context is an encoding of the conversation used in this response; this
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs contains log probability information for the generated
+	// tokens when the logprobs option is set.
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
+	// QueuePosition is set while the request is waiting for other requests
+	// to finish, before any content is generated.
+	QueuePosition int `json:"queue_position,omitempty"`
+
 	Metrics
 }
 
@@ -534,6 +926,11 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.DraftCount > 0 {
+		fmt.Fprintf(os.Stderr, "draft count:          %d token(s)\n", m.DraftCount)
+		fmt.Fprintf(os.Stderr, "draft acceptance:     %.2f%%\n", 100*m.DraftAcceptanceRate())
+	}
 }
 
 func (opts *Options) FromMap(m map[string]any) error {
@@ -608,6 +1005,26 @@ func (opts *Options) FromMap(m map[string]any) error {
 					slice[i] = str
 				}
 				field.Set(reflect.ValueOf(slice))
+			case reflect.Map:
+				// JSON unmarshals objects to map[string]any with string keys
+				val, ok := val.(map[string]any)
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+				// TODO: only token id to float maps are supported right now
+				bias := make(map[int32]float32, len(val))
+				for k, v := range val {
+					id, err := strconv.ParseInt(k, 10, 32)
+					if err != nil {
+						return fmt.Errorf("option %q must have integer token ids as keys", key)
+					}
+					f, ok := v.(float64)
+					if !ok {
+						return fmt.Errorf("option %q must have numeric values", key)
+					}
+					bias[int32(id)] = float32(f)
+				}
+				field.Set(reflect.ValueOf(bias))
 			case reflect.Pointer:
 				var b bool
 				if field.Type() == reflect.TypeOf(&b) {
@@ -641,12 +1058,22 @@ func DefaultOptions() Options {
 		TopK:             40,
 		TopP:             0.9,
 		TypicalP:         1.0,
+		MirostatTau:      5.0,
+		MirostatEta:      0.1,
 		RepeatLastN:      64,
 		RepeatPenalty:    1.1,
 		PresencePenalty:  0.0,
 		FrequencyPenalty: 0.0,
 		Seed:             -1,
 
+		DryBase:             1.75,
+		DryAllowedLength:    2,
+		DryPenaltyLastN:     -1,
+		DrySequenceBreakers: []string{"\n", ":", "\"", "*"},
+		XTCThreshold:        0.1,
+		NumBeams:            1,
+		LengthPenalty:       1.0,
+
 		Runner: Runner{
 			// options set when the model is loaded
 			NumCtx:    int(envconfig.ContextLength()),
@@ -749,6 +1176,28 @@ func FormatParams(params map[string][]string) (map[string]any, error) {
 				case reflect.Slice:
 					// TODO: only string slices are supported right now
 					out[key] = vals
+				case reflect.Map:
+					// each value is a token id and its bias, e.g. "128001 -100"
+					bias := make(map[string]any, len(vals))
+					for _, val := range vals {
+						fields := strings.Fields(val)
+						if len(fields) != 2 {
+							return nil, fmt.Errorf("invalid %s value %s", key, val)
+						}
+
+						if _, err := strconv.ParseInt(fields[0], 10, 32); err != nil {
+							return nil, fmt.Errorf("invalid token id %s", fields[0])
+						}
+
+						floatVal, err := strconv.ParseFloat(fields[1], 32)
+						if err != nil {
+							return nil, fmt.Errorf("invalid float value %s", fields[1])
+						}
+
+						bias[fields[0]] = floatVal
+					}
+
+					out[key] = bias
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
@@ -209,6 +209,80 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestLogitBiasParsingFromJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  map[int32]float32
+		err  string
+	}{
+		{
+			name: "Undefined",
+			req:  `{ }`,
+			exp:  nil,
+		},
+		{
+			name: "Bias",
+			req:  `{ "logit_bias": { "128001": -100, "15": 2.5 } }`,
+			exp:  map[int32]float32{128001: -100, 15: 2.5},
+		},
+		{
+			name: "Invalid token id",
+			req:  `{ "logit_bias": { "foo": -100 } }`,
+			err:  `option "logit_bias" must have integer token ids as keys`,
+		},
+		{
+			name: "Invalid bias",
+			req:  `{ "logit_bias": { "15": "high" } }`,
+			err:  `option "logit_bias" must have numeric values`,
+		},
+		{
+			name: "Invalid type",
+			req:  `{ "logit_bias": [15] }`,
+			err:  `option "logit_bias" must be of type object`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]any
+			err := json.Unmarshal([]byte(test.req), &oMap)
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			err = opts.FromMap(oMap)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, opts.LogitBias)
+		})
+	}
+}
+
+func TestLogitBiasFormatParams(t *testing.T) {
+	resp, err := FormatParams(map[string][]string{
+		"logit_bias": {"128001 -100", "15 2.5"},
+	})
+	require.NoError(t, err)
+
+	// round trip through JSON as the parameters are stored with the model
+	b, err := json.Marshal(resp)
+	require.NoError(t, err)
+
+	var oMap map[string]any
+	require.NoError(t, json.Unmarshal(b, &oMap))
+
+	opts := DefaultOptions()
+	require.NoError(t, opts.FromMap(oMap))
+	assert.Equal(t, map[int32]float32{128001: -100, 15: 2.5}, opts.LogitBias)
+
+	_, err = FormatParams(map[string][]string{
+		"logit_bias": {"128001"},
+	})
+	require.EqualError(t, err, "invalid logit_bias value 128001")
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -372,3 +446,66 @@ func TestPropertyType_MarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestToolChoice_JSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected ToolChoice
+		err      bool
+	}{
+		{
+			name:     "auto",
+			input:    `"auto"`,
+			expected: ToolChoice{Mode: ToolChoiceAuto},
+		},
+		{
+			name:     "required",
+			input:    `"required"`,
+			expected: ToolChoice{Mode: ToolChoiceRequired},
+		},
+		{
+			name:     "function",
+			input:    `{"type":"function","function":{"name":"get_weather"}}`,
+			expected: ToolChoice{Function: "get_weather"},
+		},
+		{
+			name:  "unknown mode",
+			input: `"any"`,
+			err:   true,
+		},
+		{
+			name:  "missing function name",
+			input: `{"type":"function","function":{}}`,
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tc ToolChoice
+			err := json.Unmarshal([]byte(test.input), &tc)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", tc)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if tc != test.expected {
+				t.Errorf("got %+v, expected %+v", tc, test.expected)
+			}
+
+			data, err := json.Marshal(tc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != test.input {
+				t.Errorf("Marshaled data mismatch: got %v, expected %v", string(data), test.input)
+			}
+		})
+	}
+}
@@ -536,7 +536,9 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 
 			var until string
 			delta := time.Since(m.ExpiresAt)
-			if delta > 0 {
+			if m.Pinned {
+				until = "Pinned"
+			} else if delta > 0 {
 				until = "Stopping..."
 			} else {
 				until = format.HumanTime(m.ExpiresAt, "Never")
@@ -845,6 +847,66 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func TokenizeHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	prompts := args[1:]
+	// prepend stdin to the prompt if provided
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		in, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		if len(in) > 0 {
+			prompts = append([]string{string(in)}, prompts...)
+		}
+	}
+
+	if len(prompts) == 0 {
+		return errors.New("no text to tokenize")
+	}
+
+	req := api.TokenizeRequest{Model: args[0]}
+	prompt := strings.Join(prompts, " ")
+
+	chat, err := cmd.Flags().GetBool("chat")
+	if err != nil {
+		return err
+	}
+
+	if chat {
+		req.Messages = []api.Message{{Role: "user", Content: prompt}}
+	} else {
+		req.Prompt = prompt
+	}
+
+	resp, err := client.Tokenize(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	count, err := cmd.Flags().GetBool("count")
+	if err != nil {
+		return err
+	}
+
+	if count {
+		fmt.Println(len(resp.Tokens))
+		return nil
+	}
+
+	tokens := make([]string, len(resp.Tokens))
+	for i, t := range resp.Tokens {
+		tokens[i] = strconv.Itoa(t)
+	}
+	fmt.Println(strings.Join(tokens, " "))
+	return nil
+}
+
 func PullHandler(cmd *cobra.Command, args []string) error {
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
@@ -1416,6 +1478,17 @@ func NewCLI() *cobra.Command {
 		RunE:    DeleteHandler,
 	}
 
+	tokenizeCmd := &cobra.Command{
+		Use:     "tokenize MODEL [TEXT]",
+		Short:   "Convert text into a model's tokens",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    TokenizeHandler,
+	}
+
+	tokenizeCmd.Flags().Bool("chat", false, "Apply the model's chat template to the text as a user message")
+	tokenizeCmd.Flags().Bool("count", false, "Only print the number of tokens")
+
 	runnerCmd := &cobra.Command{
 		Use:    "runner",
 		Hidden: true,
@@ -1430,7 +1503,7 @@ func NewCLI() *cobra.Command {
 
 	envVars := envconfig.AsMap()
 
-	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"]}
+	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_API_KEY"]}
 
 	for _, cmd := range []*cobra.Command{
 		createCmd,
@@ -1443,11 +1516,12 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		tokenizeCmd,
 		serveCmd,
 	} {
 		switch cmd {
 		case runCmd:
-			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_NOHISTORY"]})
+			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_API_KEY"], envVars["OLLAMA_NOHISTORY"]})
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["OLLAMA_DEBUG"],
@@ -1465,6 +1539,12 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_GPU_OVERHEAD"],
 				envVars["OLLAMA_LOAD_TIMEOUT"],
+				envVars["OLLAMA_METRICS"],
+				envVars["OTEL_TRACES_EXPORTER"],
+				envVars["OLLAMA_API_KEYS_FILE"],
+				envVars["OLLAMA_PRELOAD_FILE"],
+				envVars["OLLAMA_KV_CACHE_DIR"],
+				envVars["OLLAMA_BATCH_DIR"],
 			})
 		default:
 			appendEnvDocs(cmd, envs)
@@ -1483,6 +1563,7 @@ func NewCLI() *cobra.Command {
 		psCmd,
 		copyCmd,
 		deleteCmd,
+		tokenizeCmd,
 		runnerCmd,
 	)
 
@@ -660,6 +660,98 @@ func TestListHandler(t *testing.T) {
 	}
 }
 
+func TestTokenizeHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		flags          map[string]string
+		expectedReq    api.TokenizeRequest
+		expectedOutput string
+	}{
+		{
+			name:           "tokenize text",
+			args:           []string{"test-model", "hello", "world"},
+			expectedReq:    api.TokenizeRequest{Model: "test-model", Prompt: "hello world"},
+			expectedOutput: "1 2 3\n",
+		},
+		{
+			name:           "count tokens",
+			args:           []string{"test-model", "hello"},
+			flags:          map[string]string{"count": "true"},
+			expectedReq:    api.TokenizeRequest{Model: "test-model", Prompt: "hello"},
+			expectedOutput: "3\n",
+		},
+		{
+			name:  "apply chat template",
+			args:  []string{"test-model", "hello"},
+			flags: map[string]string{"chat": "true"},
+			expectedReq: api.TokenizeRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Content: "hello"}},
+			},
+			expectedOutput: "1 2 3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/tokenize" || r.Method != http.MethodPost {
+					t.Errorf("unexpected request to %s %s", r.Method, r.URL.Path)
+					http.Error(w, "not found", http.StatusNotFound)
+					return
+				}
+
+				var req api.TokenizeRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				if diff := cmp.Diff(tt.expectedReq, req); diff != "" {
+					t.Errorf("request mismatch (-want +got):\n%s", diff)
+				}
+
+				if err := json.NewEncoder(w).Encode(api.TokenizeResponse{Model: req.Model, Tokens: []int{1, 2, 3}}); err != nil {
+					t.Fatal(err)
+				}
+			}))
+			defer mockServer.Close()
+
+			t.Setenv("OLLAMA_HOST", mockServer.URL)
+
+			cmd := &cobra.Command{}
+			cmd.Flags().Bool("chat", false, "")
+			cmd.Flags().Bool("count", false, "")
+			for k, v := range tt.flags {
+				if err := cmd.Flags().Set(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd.SetContext(t.Context())
+
+			// Capture stdout
+			oldStdout := os.Stdout
+			r, w, _ := os.Pipe()
+			os.Stdout = w
+
+			err := TokenizeHandler(cmd, tt.args)
+
+			// Restore stdout and get output
+			w.Close()
+			os.Stdout = oldStdout
+			output, _ := io.ReadAll(r)
+
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got := string(output); got != tt.expectedOutput {
+				t.Errorf("expected output:\n%s\ngot:\n%s", tt.expectedOutput, got)
+			}
+		})
+	}
+}
+
 func TestCreateHandler(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -196,7 +196,7 @@ func ConvertModel(fsys fs.FS, f *os.File) error {
 		conv = &qwen2Model{}
 	case "Qwen2_5_VLForConditionalGeneration":
 		conv = &qwen25VLModel{}
-	case "BertModel":
+	case "BertModel", "BertForSequenceClassification":
 		conv = &bertModel{}
 	case "CohereForCausalLM":
 		conv = &commandrModel{}
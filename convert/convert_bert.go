@@ -3,6 +3,7 @@ package convert
 import (
 	"cmp"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"path/filepath"
 	"slices"
@@ -29,15 +30,33 @@ type bertModel struct {
 	LayerNormEpsilon      float32 `json:"layer_norm_epsilon"`
 	NormEpsilon           float32 `json:"norm_epsilon"`
 
+	ID2Label map[string]string `json:"id2label"`
+
 	PoolingType uint32
 }
 
+// classifier reports whether the model has a sequence classification head,
+// as used by cross-encoder rerankers
+func (p *bertModel) classifier() bool {
+	return slices.Contains(p.Architectures, "BertForSequenceClassification")
+}
+
 var (
 	_ ModelConverter = (*bertModel)(nil)
 	_ moreParser     = (*bertModel)(nil)
 )
 
 func (p *bertModel) parseMore(fsys fs.FS) error {
+	if p.classifier() {
+		if len(p.ID2Label) > 1 {
+			return fmt.Errorf("unsupported number of labels %d, rerankers must have a single label", len(p.ID2Label))
+		}
+
+		// rank pooling passes the CLS token through the classification head
+		p.PoolingType = 4
+		return nil
+	}
+
 	bts, err := fs.ReadFile(fsys, "modules.json")
 	if err != nil {
 		return err
@@ -133,13 +152,15 @@ func (p *bertModel) KV(t *Tokenizer) ggml.KV {
 }
 
 func (p *bertModel) Tensors(ts []Tensor) []*ggml.Tensor {
+	skip := []string{"embeddings.position_ids"}
+	if !p.classifier() {
+		// the pooler is only used by the classification head
+		skip = append(skip, "cls.weight", "cls.bias")
+	}
+
 	var out []*ggml.Tensor
 	for _, t := range ts {
-		if slices.Contains([]string{
-			"embeddings.position_ids",
-			"pooler.dense.weight",
-			"pooler.dense.bias",
-		}, t.Name()) {
+		if slices.Contains(skip, t.Name()) {
 			continue
 		}
 
@@ -156,6 +177,7 @@ func (p *bertModel) Tensors(ts []Tensor) []*ggml.Tensor {
 
 func (bertModel) Replacements() []string {
 	return []string{
+		"bert.", "",
 		"encoder.layer", "blk",
 		"encoder.layers", "blk",
 		"embeddings.word_embeddings", "token_embd",
@@ -170,5 +192,7 @@ func (bertModel) Replacements() []string {
 		"intermediate.dense", "ffn_up",
 		"output.dense", "ffn_down",
 		"output.LayerNorm", "layer_output_norm",
+		"pooler.dense", "cls",
+		"classifier", "cls.output",
 	}
 }
@@ -94,6 +94,21 @@ func Models() string {
 	return filepath.Join(home, ".ollama", "models")
 }
 
+// BatchDir returns the path to the directory that batch files and jobs are
+// stored in. It can be configured via the OLLAMA_BATCH_DIR environment variable.
+func BatchDir() string {
+	if s := Var("OLLAMA_BATCH_DIR"); s != "" {
+		return s
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	return filepath.Join(home, ".ollama", "batches")
+}
+
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
@@ -183,6 +198,8 @@ var (
 	NewEngine = Bool("OLLAMA_NEW_ENGINE")
 	// ContextLength sets the default context length
 	ContextLength = Uint("OLLAMA_CONTEXT_LENGTH", 4096)
+	// Metrics enables the Prometheus metrics endpoint at /metrics
+	Metrics = Bool("OLLAMA_METRICS")
 )
 
 func String(s string) func() string {
@@ -194,6 +211,24 @@ func String(s string) func() string {
 var (
 	LLMLibrary = String("OLLAMA_LLM_LIBRARY")
 
+	// TracesExporter selects where OpenTelemetry traces are sent, either
+	// "otlp" or "console". Tracing is disabled if it is unset.
+	TracesExporter = String("OTEL_TRACES_EXPORTER")
+
+	// APIKeysFile is the path to a JSON file of API keys that clients must
+	// present to use the server. Authentication is disabled if it is unset.
+	APIKeysFile = String("OLLAMA_API_KEYS_FILE")
+	// APIKey is the API key sent by clients such as the CLI
+	APIKey = String("OLLAMA_API_KEY")
+
+	// PreloadFile is the path to a JSON file of models to load when the
+	// server starts and keep loaded
+	PreloadFile = String("OLLAMA_PRELOAD_FILE")
+
+	// KvCacheDir is the directory that warmed prompts are persisted to.
+	// Persistence is disabled if it is unset.
+	KvCacheDir = String("OLLAMA_KV_CACHE_DIR")
+
 	CudaVisibleDevices    = String("CUDA_VISIBLE_DEVICES")
 	HipVisibleDevices     = String("HIP_VISIBLE_DEVICES")
 	RocrVisibleDevices    = String("ROCR_VISIBLE_DEVICES")
@@ -268,6 +303,13 @@ func AsMap() map[string]EnvVar {
 		"OLLAMA_MULTIUSER_CACHE":   {"OLLAMA_MULTIUSER_CACHE", MultiUserCache(), "Optimize prompt caching for multi-user scenarios"},
 		"OLLAMA_CONTEXT_LENGTH":    {"OLLAMA_CONTEXT_LENGTH", ContextLength(), "Context length to use unless otherwise specified (default: 4096)"},
 		"OLLAMA_NEW_ENGINE":        {"OLLAMA_NEW_ENGINE", NewEngine(), "Enable the new Ollama engine"},
+		"OLLAMA_METRICS":           {"OLLAMA_METRICS", Metrics(), "Expose Prometheus metrics at /metrics"},
+		"OTEL_TRACES_EXPORTER":     {"OTEL_TRACES_EXPORTER", TracesExporter(), "Export OpenTelemetry traces with \"otlp\" or \"console\""},
+		"OLLAMA_API_KEYS_FILE":     {"OLLAMA_API_KEYS_FILE", APIKeysFile(), "Path to a JSON file of API keys required to access the server"},
+		"OLLAMA_API_KEY":           {"OLLAMA_API_KEY", APIKey(), "API key sent to the server"},
+		"OLLAMA_PRELOAD_FILE":      {"OLLAMA_PRELOAD_FILE", PreloadFile(), "Path to a JSON file of models to load at startup and keep loaded"},
+		"OLLAMA_KV_CACHE_DIR":      {"OLLAMA_KV_CACHE_DIR", KvCacheDir(), "Directory to persist warmed prompts to"},
+		"OLLAMA_BATCH_DIR":         {"OLLAMA_BATCH_DIR", BatchDir(), "The path to the batch files directory"},
 
 		// Informational
 		"HTTP_PROXY":  {"HTTP_PROXY", String("HTTP_PROXY")(), "HTTP proxy"},
@@ -2,6 +2,7 @@ package kvcache
 
 import (
 	"errors"
+	"io"
 
 	"github.com/ollama/ollama/ml"
 	"github.com/ollama/ollama/model/input"
@@ -75,3 +76,17 @@ type Cache interface {
 	// removed by calling Remove(seq, 0, math.MaxInt32)
 	Remove(seq int, beginIndex, endIndex int32) error
 }
+
+// Serializer is implemented by caches that can write out the contents of a
+// sequence and restore them later, such as to avoid evaluating a long prompt
+// again after a restart.
+type Serializer interface {
+	// Save writes the entries of seq in the range [0, length) to w
+	Save(w io.Writer, seq int, length int32) error
+
+	// Load replaces the contents of seq with entries read from r, which must
+	// have been written by Save from a cache with the same configuration.
+	//
+	// If an error occurs, the contents of seq are removed.
+	Load(r io.Reader, seq int) error
+}
@@ -1,9 +1,12 @@
 package kvcache
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"math"
 	"slices"
 
@@ -168,10 +171,10 @@ func (c *Causal) StartForward(ctx ml.Context, batch input.Batch, reserve bool) e
 		c.updateSlidingWindow()
 
 		var err error
-		c.curLoc, err = c.findStartLoc()
+		c.curLoc, err = c.findStartLoc(c.curBatchSize)
 		if errors.Is(err, ErrKvCacheFull) {
 			c.defrag()
-			c.curLoc, err = c.findStartLoc()
+			c.curLoc, err = c.findStartLoc(c.curBatchSize)
 		}
 		if err != nil {
 			return err
@@ -224,13 +227,13 @@ func newRange() cellRange {
 	}
 }
 
-// Find the first contiguous block of at least curBatchSize
-func (c *Causal) findStartLoc() (int, error) {
+// Find the first contiguous block of at least size cells
+func (c *Causal) findStartLoc(size int) (int, error) {
 	var start, count int
 	for i := range c.cells {
 		if len(c.cells[i].sequences) == 0 {
 			count++
-			if count >= c.curBatchSize {
+			if count >= size {
 				return start, nil
 			}
 		} else {
@@ -239,7 +242,7 @@ func (c *Causal) findStartLoc() (int, error) {
 		}
 	}
 
-	return 0, fmt.Errorf("%w (cache: %v batch: %v)", ErrKvCacheFull, len(c.cells), c.curBatchSize)
+	return 0, fmt.Errorf("%w (cache: %v batch: %v)", ErrKvCacheFull, len(c.cells), size)
 }
 
 func (c *Causal) updateSlidingWindow() {
@@ -345,28 +348,8 @@ func (c *Causal) moveCells(ctx ml.Context, src, dst, length int) {
 			continue
 		}
 
-		kHeadDim := key.Dim(0)
-		numKVHeads := key.Dim(1)
-		rowSize := key.Stride(2)
-
-		kSrcView := key.View(ctx, rowSize*src, kHeadDim*numKVHeads*length)
-		kDstView := key.View(ctx, rowSize*dst, kHeadDim*numKVHeads*length)
-
-		value := c.values[i]
-		var vSrcView, vDstView ml.Tensor
-		if c.config.PermutedV {
-			vHeadDim := value.Dim(1)
-			elemSize := value.Stride(0)
-
-			vSrcView = value.View(ctx, elemSize*src, length, len(c.cells)*elemSize, vHeadDim*numKVHeads)
-			vDstView = value.View(ctx, elemSize*dst, length, len(c.cells)*elemSize, vHeadDim*numKVHeads)
-		} else {
-			vHeadDim := value.Dim(0)
-			rowSize := value.Stride(2)
-
-			vSrcView = value.View(ctx, rowSize*src, vHeadDim*numKVHeads*length)
-			vDstView = value.View(ctx, rowSize*dst, vHeadDim*numKVHeads*length)
-		}
+		kSrcView, vSrcView := c.cellViews(ctx, key, c.values[i], src, length)
+		kDstView, vDstView := c.cellViews(ctx, key, c.values[i], dst, length)
 
 		ctx.Forward(
 			kSrcView.Copy(ctx, kDstView),
@@ -375,6 +358,32 @@ func (c *Causal) moveCells(ctx ml.Context, src, dst, length int) {
 	}
 }
 
+// cellViews returns views of length cells starting at loc in the key and value
+// tensors of a layer. The tensors may hold any number of cells but must be laid
+// out in the same way as the cache's own.
+func (c *Causal) cellViews(ctx ml.Context, key, value ml.Tensor, loc, length int) (ml.Tensor, ml.Tensor) {
+	kHeadDim := key.Dim(0)
+	numKVHeads := key.Dim(1)
+	rowSize := key.Stride(2)
+
+	kView := key.View(ctx, rowSize*loc, kHeadDim*numKVHeads*length)
+
+	var vView ml.Tensor
+	if c.config.PermutedV {
+		vHeadDim := value.Dim(1)
+		elemSize := value.Stride(0)
+
+		vView = value.View(ctx, elemSize*loc, length, value.Stride(1), vHeadDim*numKVHeads)
+	} else {
+		vHeadDim := value.Dim(0)
+		rowSize := value.Stride(2)
+
+		vView = value.View(ctx, rowSize*loc, vHeadDim*numKVHeads*length)
+	}
+
+	return kView, vView
+}
+
 func (c *Causal) defrag() {
 	slog.Debug("defragmenting kv cache")
 
@@ -549,21 +558,7 @@ func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 		panic(fmt.Errorf("inconsistent batch sizes (layer: %v, batch size: %v layer batch size: %v)", c.curLayer, c.curBatchSize, batchSize))
 	}
 
-	if _, ok := c.ctxs[c.curLayer]; !ok {
-		c.ctxs[c.curLayer] = c.backend.NewContextSize(2).Layer(c.curLayer)
-	}
-
-	if _, ok := c.keys[c.curLayer]; !ok {
-		c.keys[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, kHeadDim, numKVHeads, len(c.cells))
-	}
-
-	if _, ok := c.values[c.curLayer]; !ok {
-		if c.config.PermutedV {
-			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, len(c.cells), vHeadDim, numKVHeads)
-		} else {
-			c.values[c.curLayer] = c.ctxs[c.curLayer].Zeros(c.DType, vHeadDim, numKVHeads, len(c.cells))
-		}
-	}
+	c.allocLayer(c.curLayer, kHeadDim, vHeadDim, numKVHeads)
 
 	rowSize := c.keys[c.curLayer].Stride(2)
 	ctx.Forward(key.Copy(ctx, c.keys[c.curLayer].View(ctx, rowSize*c.curLoc, kHeadDim*numKVHeads*batchSize)))
@@ -580,6 +575,30 @@ func (c *Causal) Put(ctx ml.Context, key, value ml.Tensor) {
 	}
 }
 
+// allocLayer creates the storage for the keys and values of layer, if it
+// doesn't exist yet
+func (c *Causal) allocLayer(layer, kHeadDim, vHeadDim, numKVHeads int) {
+	if _, ok := c.ctxs[layer]; !ok {
+		c.ctxs[layer] = c.backend.NewContextSize(2).Layer(layer)
+	}
+
+	if _, ok := c.keys[layer]; !ok {
+		c.keys[layer] = c.ctxs[layer].Zeros(c.DType, kHeadDim, numKVHeads, len(c.cells))
+	}
+
+	if _, ok := c.values[layer]; !ok {
+		if c.config.PermutedV {
+			c.values[layer] = c.ctxs[layer].Zeros(c.DType, len(c.cells), vHeadDim, numKVHeads)
+		} else {
+			c.values[layer] = c.ctxs[layer].Zeros(c.DType, vHeadDim, numKVHeads, len(c.cells))
+		}
+	}
+}
+
+// CopyPrefix makes the cells of srcSeq with positions below len also belong to
+// dstSeq. The cells are shared rather than copied, so a prompt common to many
+// sequences is only stored once. Each sequence gets its own copy of a shared
+// cell if it later needs to change it.
 func (c *Causal) CopyPrefix(srcSeq, dstSeq int, len int32) {
 	seqRange := newRange()
 
@@ -695,6 +714,12 @@ func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 	var offset int32
 	if endIndex != math.MaxInt32 {
 		offset = beginIndex - endIndex
+
+		if c.shiftFn != nil {
+			if err := c.unshare(seq, endIndex); err != nil {
+				return err
+			}
+		}
 	}
 
 	seqRange := newRange()
@@ -737,3 +762,366 @@ func (c *Causal) Remove(seq int, beginIndex, endIndex int32) error {
 
 	return nil
 }
+
+// sharedCells returns the cells of seq with positions of at least pos that
+// also belong to other sequences
+func (c *Causal) sharedCells(seq int, pos int32) []int {
+	var cells []int
+	for i, cell := range c.cells {
+		if cell.pos >= pos && len(cell.sequences) > 1 && slices.Contains(cell.sequences, seq) {
+			cells = append(cells, i)
+		}
+	}
+
+	return cells
+}
+
+// unshare gives seq its own copy of the cells returned by sharedCells so that
+// they can be shifted without changing the other sequences
+func (c *Causal) unshare(seq int, pos int32) error {
+	cells := c.sharedCells(seq, pos)
+	if len(cells) == 0 {
+		return nil
+	}
+
+	loc, err := c.findStartLoc(len(cells))
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		cells = c.sharedCells(seq, pos)
+		loc, err = c.findStartLoc(len(cells))
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("unsharing kv cache cells", "seq", seq, "cells", len(cells))
+
+	ctx := c.backend.NewContext()
+
+	layers := 0
+	for _, key := range c.keys {
+		if key != nil {
+			layers++
+		}
+	}
+
+	// each run of consecutive cells is copied in a single move, which uses
+	// the same number of graph nodes as in defrag
+	maxMoves := (ctx.MaxGraphNodes() - 2*layers) / (6 * max(layers, 1))
+	moves := 0
+
+	for start := 0; start < len(cells); {
+		end := start + 1
+		for end < len(cells) && cells[end] == cells[end-1]+1 {
+			end++
+		}
+
+		c.moveCells(ctx, cells[start], loc+start, end-start)
+		moves++
+		start = end
+
+		if moves >= maxMoves {
+			ctx.Compute()
+			ctx.Close()
+			ctx = c.backend.NewContext()
+
+			moves = 0
+		}
+	}
+
+	if moves > 0 {
+		ctx.Compute()
+	}
+	ctx.Close()
+
+	for i, src := range cells {
+		c.cells[loc+i] = cacheCell{pos: c.cells[src].pos, sequences: []int{seq}}
+		c.cells[src].sequences = slices.DeleteFunc(c.cells[src].sequences, func(s int) bool { return s == seq })
+	}
+
+	return nil
+}
+
+// causalMagic identifies data written by Causal.Save
+var causalMagic = [4]byte{'O', 'K', 'V', 'C'}
+
+// causalVersion is increased whenever the format written by Causal.Save changes
+const causalVersion = 1
+
+type causalHeader struct {
+	Magic     [4]byte
+	Version   uint32
+	DType     int32
+	PermutedV bool
+	NumCells  uint32
+	NumLayers uint32
+}
+
+type causalLayerHeader struct {
+	Layer      int32
+	KHeadDim   int32
+	VHeadDim   int32
+	NumKVHeads int32
+	KSize      uint64
+	VSize      uint64
+}
+
+// Save writes the cells of seq with positions in the range [0, length) to w,
+// followed by their keys and values for each layer
+func (c *Causal) Save(w io.Writer, seq int, length int32) error {
+	var cells []int
+	var positions []int32
+	if seqRange, ok := c.cellRanges[seq]; ok {
+		for i := seqRange.min; i <= seqRange.max; i++ {
+			if slices.Contains(c.cells[i].sequences, seq) && c.cells[i].pos < length {
+				cells = append(cells, i)
+				positions = append(positions, c.cells[i].pos)
+			}
+		}
+	}
+
+	var layers []int
+	if len(cells) > 0 {
+		for _, layer := range slices.Sorted(maps.Keys(c.keys)) {
+			if c.keys[layer] != nil {
+				layers = append(layers, layer)
+			}
+		}
+	}
+
+	header := causalHeader{
+		Magic:     causalMagic,
+		Version:   causalVersion,
+		DType:     int32(c.DType),
+		PermutedV: c.config.PermutedV,
+		NumCells:  uint32(len(cells)),
+		NumLayers: uint32(len(layers)),
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		key, value := c.keys[layer], c.values[layer]
+		k, v := c.readLayer(layer, cells)
+
+		vHeadDim := value.Dim(0)
+		if c.config.PermutedV {
+			vHeadDim = value.Dim(1)
+		}
+
+		layerHeader := causalLayerHeader{
+			Layer:      int32(layer),
+			KHeadDim:   int32(key.Dim(0)),
+			VHeadDim:   int32(vHeadDim),
+			NumKVHeads: int32(key.Dim(1)),
+			KSize:      uint64(len(k)),
+			VSize:      uint64(len(v)),
+		}
+
+		if err := binary.Write(w, binary.LittleEndian, layerHeader); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(k); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readLayer copies the keys and values of layer stored in cells, which must
+// be in ascending order, out of the cache as if they were contiguous
+func (c *Causal) readLayer(layer int, cells []int) ([]byte, []byte) {
+	key, value := c.keys[layer], c.values[layer]
+
+	outCtx := c.backend.NewContext()
+	defer outCtx.Close()
+
+	kOut := outCtx.Input().Empty(c.DType, key.Dim(0), key.Dim(1), len(cells))
+	var vOut ml.Tensor
+	if c.config.PermutedV {
+		vOut = outCtx.Input().Empty(c.DType, len(cells), value.Dim(1), value.Dim(2))
+	} else {
+		vOut = outCtx.Input().Empty(c.DType, value.Dim(0), value.Dim(1), len(cells))
+	}
+
+	// Each run of consecutive cells is copied with 6 tensors (2 views and a
+	// copy for each of k and v) plus the 4 tensors being copied between
+	ctx := c.backend.NewContext()
+	maxMoves := max((ctx.MaxGraphNodes()-4)/6, 1)
+	moves := 0
+
+	for start := 0; start < len(cells); {
+		end := start + 1
+		for end < len(cells) && cells[end] == cells[end-1]+1 {
+			end++
+		}
+
+		if moves >= maxMoves {
+			ctx.Compute()
+			ctx.Close()
+			ctx = c.backend.NewContext()
+
+			moves = 0
+		}
+
+		kSrcView, vSrcView := c.cellViews(ctx, key, value, cells[start], end-start)
+		kDstView, vDstView := c.cellViews(ctx, kOut, vOut, start, end-start)
+		ctx.Forward(
+			kSrcView.Copy(ctx, kDstView),
+			vSrcView.Copy(ctx, vDstView),
+		)
+		moves++
+
+		start = end
+	}
+
+	ctx.Compute(kOut, vOut)
+	ctx.Close()
+
+	return kOut.Bytes(), vOut.Bytes()
+}
+
+func (c *Causal) Load(r io.Reader, seq int) (err error) {
+	// removing everything from a sequence does not fail
+	_ = c.Remove(seq, 0, math.MaxInt32)
+
+	var header causalHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	if header.Magic != causalMagic || header.Version != causalVersion {
+		return errors.New("unsupported kv cache data")
+	}
+
+	if ml.DType(header.DType) != c.DType || header.PermutedV != c.config.PermutedV {
+		return fmt.Errorf("kv cache data does not match the cache configuration (type: %v permuted v: %v)", header.DType, header.PermutedV)
+	}
+
+	numCells := int(header.NumCells)
+	if numCells > len(c.cells) {
+		return fmt.Errorf("%w (cache: %v data: %v)", ErrKvCacheFull, len(c.cells), numCells)
+	}
+
+	positions := make([]int32, numCells)
+	if err := binary.Read(r, binary.LittleEndian, positions); err != nil {
+		return err
+	}
+
+	if numCells == 0 {
+		return nil
+	}
+
+	loc, err := c.findStartLoc(numCells)
+	if errors.Is(err, ErrKvCacheFull) {
+		c.defrag()
+		loc, err = c.findStartLoc(numCells)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = c.Remove(seq, 0, math.MaxInt32)
+		}
+	}()
+
+	for i, pos := range positions {
+		c.cells[loc+i] = cacheCell{pos: pos, sequences: []int{seq}}
+	}
+	c.cellRanges[seq] = cellRange{min: loc, max: loc + numCells - 1}
+
+	for range header.NumLayers {
+		var layerHeader causalLayerHeader
+		if err := binary.Read(r, binary.LittleEndian, &layerHeader); err != nil {
+			return err
+		}
+
+		if err := c.writeLayer(r, layerHeader, loc, numCells); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeLayer reads the keys and values of a layer described by header from r
+// into the length cells starting at loc
+func (c *Causal) writeLayer(r io.Reader, header causalLayerHeader, loc, length int) error {
+	layer := int(header.Layer)
+	kHeadDim := int(header.KHeadDim)
+	vHeadDim := int(header.VHeadDim)
+	numKVHeads := int(header.NumKVHeads)
+
+	if layer < 0 || kHeadDim <= 0 || vHeadDim <= 0 || numKVHeads <= 0 {
+		return fmt.Errorf("invalid kv cache layer %v", layer)
+	}
+
+	// no supported type uses more than 4 bytes per element
+	if header.KSize > uint64(kHeadDim*numKVHeads*length*4) || header.VSize > uint64(vHeadDim*numKVHeads*length*4) {
+		return fmt.Errorf("invalid size for kv cache layer %v", layer)
+	}
+
+	c.allocLayer(layer, kHeadDim, vHeadDim, numKVHeads)
+	key, value := c.keys[layer], c.values[layer]
+
+	cachedVHeadDim := value.Dim(0)
+	if c.config.PermutedV {
+		cachedVHeadDim = value.Dim(1)
+	}
+
+	if key.Dim(0) != kHeadDim || key.Dim(1) != numKVHeads || cachedVHeadDim != vHeadDim {
+		return fmt.Errorf("kv cache data does not match the shape of layer %v", layer)
+	}
+
+	k := make([]byte, header.KSize)
+	if _, err := io.ReadFull(r, k); err != nil {
+		return err
+	}
+
+	v := make([]byte, header.VSize)
+	if _, err := io.ReadFull(r, v); err != nil {
+		return err
+	}
+
+	ctx := c.backend.NewContext()
+	defer ctx.Close()
+
+	kIn, err := ctx.Input().FromBytes(c.DType, k, kHeadDim, numKVHeads, length)
+	if err != nil {
+		return err
+	}
+
+	var vIn ml.Tensor
+	if c.config.PermutedV {
+		vIn, err = ctx.Input().FromBytes(c.DType, v, length, vHeadDim, numKVHeads)
+	} else {
+		vIn, err = ctx.Input().FromBytes(c.DType, v, vHeadDim, numKVHeads, length)
+	}
+	if err != nil {
+		return err
+	}
+
+	kSrcView, vSrcView := c.cellViews(ctx, kIn, vIn, 0, length)
+	kDstView, vDstView := c.cellViews(ctx, key, value, loc, length)
+	ctx.Forward(
+		kSrcView.Copy(ctx, kDstView),
+		vSrcView.Copy(ctx, vDstView),
+	)
+	ctx.Compute()
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package kvcache
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"math"
 	"slices"
 	"testing"
@@ -332,6 +335,54 @@ func TestCopy(t *testing.T) {
 	testCache(t, backend, cache, tests)
 }
 
+func TestCopyShift(t *testing.T) {
+	backend := &testBackend{}
+	cache := NewCausalCache(func(ctx ml.Context, layer int, key, shift ml.Tensor) (ml.Tensor, error) {
+		return key.Add(ctx, shift), nil
+	})
+	defer cache.Close()
+
+	cache.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	tests := []testCase{
+		{
+			name:          "FirstBatch",
+			in:            []float32{1, 2, 3, 4},
+			inShape:       []int{1, 1, 4},
+			seqs:          []int{0, 0, 0, 0},
+			pos:           []int32{0, 1, 2, 3},
+			expected:      []float32{1, 2, 3, 4},
+			expectedShape: []int{1, 1, 4},
+			expectedMask:  []float32{0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, 0, float32(math.Inf(-1)), 0, 0, 0, 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+
+	cache.CopyPrefix(0, 1, 4)
+
+	// shifting seq 1 copies the shared cells that it changes, leaving seq 0 as it was
+	err := cache.Remove(1, 1, 2)
+	if err != nil {
+		panic(err)
+	}
+
+	tests = []testCase{
+		{
+			name:          "Shifted",
+			in:            []float32{5, 6},
+			inShape:       []int{1, 1, 2},
+			seqs:          []int{0, 1},
+			pos:           []int32{4, 3},
+			expected:      []float32{1, 2, 3, 4, 2, 3, 5, 6},
+			expectedShape: []int{1, 1, 8},
+			expectedMask:  []float32{0, 0, 0, 0, float32(math.Inf(-1)), float32(math.Inf(-1)), 0, float32(math.Inf(-1)), 0, float32(math.Inf(-1)), float32(math.Inf(-1)), float32(math.Inf(-1)), 0, 0, float32(math.Inf(-1)), 0},
+		},
+	}
+
+	testCache(t, backend, cache, tests)
+}
+
 func testCache(t *testing.T, backend ml.Backend, cache Cache, tests []testCase) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -366,6 +417,75 @@ func testCache(t *testing.T, backend ml.Backend, cache Cache, tests []testCase)
 	}
 }
 
+func TestSaveLoad(t *testing.T) {
+	backend := &testBackend{}
+	src := NewCausalCache(nil)
+	defer src.Close()
+
+	src.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	x := float32(math.Inf(-1))
+
+	// interleave two sequences so that the saved cells aren't contiguous
+	testCache(t, backend, src, []testCase{
+		{
+			name:          "Interleaved",
+			in:            []float32{1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 4},
+			inShape:       []int{2, 3, 4},
+			seqs:          []int{0, 1, 0, 1},
+			pos:           []int32{0, 0, 1, 1},
+			expected:      []float32{1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 3, 3, 4, 4, 4, 4, 4, 4},
+			expectedShape: []int{2, 3, 4},
+			expectedMask:  []float32{0, x, x, x, x, 0, x, x, 0, x, 0, x, x, 0, x, 0},
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := src.Save(&buf, 0, math.MaxInt32); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewCausalCache(nil)
+	defer dst.Close()
+
+	dst.Init(backend, ml.DTypeF16, 2, 16, 16)
+
+	if err := dst.Load(bytes.NewReader(buf.Bytes()), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	testCache(t, backend, dst, []testCase{
+		{
+			name:          "Restored",
+			in:            []float32{5, 5, 5, 5, 5, 5},
+			inShape:       []int{2, 3, 1},
+			seqs:          []int{1},
+			pos:           []int32{2},
+			expected:      []float32{1, 1, 1, 1, 1, 1, 3, 3, 3, 3, 3, 3, 5, 5, 5, 5, 5, 5},
+			expectedShape: []int{2, 3, 3},
+			expectedMask:  []float32{0, 0, 0},
+		},
+	})
+
+	// a failed load leaves the sequence empty
+	if err := dst.Load(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), 1); err == nil {
+		t.Fatal("expected error loading truncated data")
+	}
+
+	if _, ok := dst.cellRanges[1]; ok {
+		t.Error("expected sequence to be empty after failed load")
+	}
+
+	other := NewCausalCache(nil)
+	defer other.Close()
+
+	other.Init(backend, ml.DTypeQ80, 2, 16, 16)
+
+	if err := other.Load(bytes.NewReader(buf.Bytes()), 0); err == nil {
+		t.Fatal("expected error loading data for a different cache type")
+	}
+}
+
 func TestCanResume(t *testing.T) {
 	backend := &testBackend{}
 	windowSize := int32(4)
@@ -490,6 +610,19 @@ func (c *testContext) FromIntSlice(s []int32, shape ...int) (ml.Tensor, error) {
 	return out, nil
 }
 
+func (c *testContext) FromBytes(dtype ml.DType, s []byte, shape ...int) (ml.Tensor, error) {
+	t := c.Empty(dtype, shape...).(*testTensor)
+	if len(s) != len(t.data)*t.elementSize {
+		return nil, fmt.Errorf("invalid shape %v for %d bytes", shape, len(s))
+	}
+
+	if _, err := binary.Decode(s, binary.LittleEndian, t.data); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
 func (c *testContext) Arange(start, stop, step float32, dtype ml.DType) ml.Tensor {
 	s := make([]float32, 0, int((stop-start)/step))
 	for i := start; i < stop; i += step {
@@ -546,6 +679,11 @@ func (t *testTensor) DType() ml.DType {
 	return t.dtype
 }
 
+func (t *testTensor) Bytes() []byte {
+	b, _ := binary.Append(nil, binary.LittleEndian, t.data)
+	return b
+}
+
 func (t *testTensor) Floats() []float32 {
 	out := make([]float32, len(t.data))
 	copy(out, t.data)
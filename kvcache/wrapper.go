@@ -1,6 +1,7 @@
 package kvcache
 
 import (
+	"io"
 	"math"
 
 	"github.com/ollama/ollama/ml"
@@ -97,6 +98,40 @@ func (c *WrapperCache) CanResume(seq int, pos int32) bool {
 	return true
 }
 
+func (c *WrapperCache) Save(w io.Writer, seq int, length int32) error {
+	for _, cache := range c.caches {
+		s, ok := cache.(Serializer)
+		if !ok {
+			return ErrNotSupported
+		}
+
+		if err := s.Save(w, seq, length); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *WrapperCache) Load(r io.Reader, seq int) error {
+	for i, cache := range c.caches {
+		s, ok := cache.(Serializer)
+		if !ok {
+			return ErrNotSupported
+		}
+
+		if err := s.Load(r, seq); err != nil {
+			// the caches that were already loaded must not be used on their own
+			for j := range i {
+				_ = c.caches[j].Remove(seq, 0, math.MaxInt32)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *WrapperCache) Remove(seq int, beginIndex, endIndex int32) error {
 	// If the one of these fails, the caller is supposed to retry with endIndex set to math.MaxInt32, which should not fail
 	for _, cache := range c.caches {
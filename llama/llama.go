@@ -171,15 +171,27 @@ func (c *Context) KvCacheCanShift() bool {
 	return bool(C.llama_kv_self_can_shift(c.c))
 }
 
-// Get the embeddings for a sequence id
+// IsRank reports whether the context pools sequences through a classification
+// head, producing a single relevance score per sequence rather than an embedding
+func (c *Context) IsRank() bool {
+	return C.llama_pooling_type(c.c) == C.LLAMA_POOLING_TYPE_RANK
+}
+
+// Get the embeddings for a sequence id. For rank pooling, this is a single
+// relevance score.
 func (c *Context) GetEmbeddingsSeq(seqId int) []float32 {
 	e := unsafe.Pointer(C.llama_get_embeddings_seq(c.c, C.int(seqId)))
 	if e == nil {
 		return nil
 	}
 
-	embeddings := make([]float32, c.Model().NEmbd())
-	_ = copy(embeddings, unsafe.Slice((*float32)(e), c.Model().NEmbd()))
+	n := c.Model().NEmbd()
+	if c.IsRank() {
+		n = 1
+	}
+
+	embeddings := make([]float32, n)
+	_ = copy(embeddings, unsafe.Slice((*float32)(e), n))
 	return embeddings
 }
 
@@ -194,6 +206,18 @@ func (c *Context) GetEmbeddingsIth(i int) []float32 {
 	return embeddings
 }
 
+// GetLogitsIth returns the logits for the ith token of the last decoded batch
+func (c *Context) GetLogitsIth(i int) []float32 {
+	l := unsafe.Pointer(C.llama_get_logits_ith(c.c, C.int32_t(i)))
+	if l == nil {
+		return nil
+	}
+
+	logits := make([]float32, c.Model().NumVocab())
+	_ = copy(logits, unsafe.Slice((*float32)(l), len(logits)))
+	return logits
+}
+
 type ModelParams struct {
 	NumGpuLayers int
 	MainGpu      int
@@ -524,6 +548,9 @@ type SamplingParams struct {
 	TopP           float32
 	MinP           float32
 	TypicalP       float32
+	Mirostat       int
+	MirostatTau    float32
+	MirostatEta    float32
 	Temp           float32
 	RepeatLastN    int
 	PenaltyRepeat  float32
@@ -532,6 +559,20 @@ type SamplingParams struct {
 	PenalizeNl     bool
 	Seed           uint32
 	Grammar        string
+	LogitBias      map[int32]float32
+
+	DryMultiplier       float32
+	DryBase             float32
+	DryAllowedLength    int
+	DryPenaltyLastN     int
+	DrySequenceBreakers []string
+
+	XTCProbability float32
+	XTCThreshold   float32
+
+	// Samplers is the order samplers are applied in, or the default order
+	// if it's empty
+	Samplers []string
 }
 
 func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext, error) {
@@ -540,17 +581,76 @@ func NewSamplingContext(model *Model, params SamplingParams) (*SamplingContext,
 	cparams.top_p = C.float(params.TopP)
 	cparams.min_p = C.float(params.MinP)
 	cparams.typical_p = C.float(params.TypicalP)
+	cparams.mirostat = C.int32_t(params.Mirostat)
+	cparams.mirostat_tau = C.float(params.MirostatTau)
+	cparams.mirostat_eta = C.float(params.MirostatEta)
 	cparams.temp = C.float(params.Temp)
 	cparams.penalty_last_n = C.int32_t(params.RepeatLastN)
 	cparams.penalty_repeat = C.float(params.PenaltyRepeat)
 	cparams.penalty_freq = C.float(params.PenaltyFreq)
 	cparams.penalty_present = C.float(params.PenaltyPresent)
 	cparams.seed = C.uint32_t(params.Seed)
+	cparams.dry_multiplier = C.float(params.DryMultiplier)
+	cparams.dry_base = C.float(params.DryBase)
+	cparams.dry_allowed_length = C.int32_t(params.DryAllowedLength)
+	cparams.dry_penalty_last_n = C.int32_t(params.DryPenaltyLastN)
+	cparams.xtc_probability = C.float(params.XTCProbability)
+	cparams.xtc_threshold = C.float(params.XTCThreshold)
+
+	if n := len(params.DrySequenceBreakers); n > 0 {
+		breakers := (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(breakers))
+
+		breakersSlice := unsafe.Slice(breakers, n)
+		for i, b := range params.DrySequenceBreakers {
+			breakersSlice[i] = C.CString(b)
+			defer C.free(unsafe.Pointer(breakersSlice[i]))
+		}
+
+		cparams.dry_sequence_breakers = breakers
+		cparams.n_dry_sequence_breakers = C.size_t(n)
+	}
+
+	if n := len(params.Samplers); n > 0 {
+		samplers := (**C.char)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof((*C.char)(nil)))))
+		defer C.free(unsafe.Pointer(samplers))
+
+		samplersSlice := unsafe.Slice(samplers, n)
+		for i, name := range params.Samplers {
+			samplersSlice[i] = C.CString(name)
+			defer C.free(unsafe.Pointer(samplersSlice[i]))
+		}
+
+		cparams.samplers = samplers
+		cparams.n_samplers = C.size_t(n)
+	}
 
 	grammar := C.CString(params.Grammar)
 	defer C.free(unsafe.Pointer(grammar))
 
 	cparams.grammar = grammar
+
+	if len(params.LogitBias) > 0 {
+		n := len(params.LogitBias)
+		tokens := (*C.int32_t)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.int32_t(0)))))
+		defer C.free(unsafe.Pointer(tokens))
+		values := (*C.float)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.float(0)))))
+		defer C.free(unsafe.Pointer(values))
+
+		tokensSlice := unsafe.Slice(tokens, n)
+		valuesSlice := unsafe.Slice(values, n)
+		var i int
+		for id, bias := range params.LogitBias {
+			tokensSlice[i] = C.int32_t(id)
+			valuesSlice[i] = C.float(bias)
+			i++
+		}
+
+		cparams.logit_bias_tokens = tokens
+		cparams.logit_bias_values = values
+		cparams.n_logit_bias = C.size_t(n)
+	}
+
 	context := &SamplingContext{c: C.common_sampler_cinit(model.c, &cparams)}
 	if context.c == nil {
 		return nil, errors.New("unable to create sampling context")
@@ -682,3 +782,46 @@ func (g *Grammar) Accept(token int32) {
 
 	C.grammar_accept(g.c, C.llama_token(token))
 }
+
+// Penalties is llama.cpp's repeat, frequency and presence penalties sampler
+type Penalties struct {
+	c *C.struct_llama_sampler
+}
+
+func NewPenalties(lastN int, repeat, freq, present float32) *Penalties {
+	p := &Penalties{c: C.llama_sampler_init_penalties(C.int32_t(lastN), C.float(repeat), C.float(freq), C.float(present))}
+	runtime.SetFinalizer(p, func(p *Penalties) { C.llama_sampler_free(p.c) })
+	return p
+}
+
+func (p *Penalties) Accept(token int32) {
+	C.llama_sampler_accept(p.c, C.llama_token(token))
+}
+
+func (p *Penalties) Apply(tokens []TokenData) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	tds := make([]C.struct_llama_token_data, len(tokens))
+	for i, token := range tokens {
+		tds[i] = C.struct_llama_token_data{
+			id:    C.int32_t(token.ID),
+			logit: C.float(token.Logit),
+		}
+	}
+	tda := &C.llama_token_data_array{
+		data:     (*C.struct_llama_token_data)(unsafe.Pointer(&tds[0])),
+		size:     C.size_t(len(tokens)),
+		selected: C.int64_t(-1),
+		sorted:   C.bool(false),
+	}
+	var pinner runtime.Pinner
+	pinner.Pin(&tds[0])
+	defer pinner.Unpin()
+
+	C.llama_sampler_apply(p.c, tda)
+	for i := range tokens {
+		tokens[i].Logit = float32(tds[i].logit)
+	}
+}
@@ -14,6 +14,9 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.top_p = params->top_p;
         sparams.min_p = params->min_p;
         sparams.typ_p = params->typical_p;
+        sparams.mirostat = params->mirostat;
+        sparams.mirostat_tau = params->mirostat_tau;
+        sparams.mirostat_eta = params->mirostat_eta;
         sparams.temp = params->temp;
         sparams.penalty_last_n = params->penalty_last_n;
         sparams.penalty_repeat = params->penalty_repeat;
@@ -21,8 +24,23 @@ struct common_sampler *common_sampler_cinit(const struct llama_model *model, str
         sparams.penalty_present = params->penalty_present;
         sparams.seed = params->seed;
         sparams.grammar = params->grammar;
-        sparams.xtc_probability = 0.0;
-        sparams.xtc_threshold = 0.5;
+        for (size_t i = 0; i < params->n_logit_bias; i++) {
+            sparams.logit_bias.push_back({params->logit_bias_tokens[i], params->logit_bias_values[i]});
+        }
+        sparams.dry_multiplier = params->dry_multiplier;
+        sparams.dry_base = params->dry_base;
+        sparams.dry_allowed_length = params->dry_allowed_length;
+        sparams.dry_penalty_last_n = params->dry_penalty_last_n;
+        sparams.dry_sequence_breakers.clear();
+        for (size_t i = 0; i < params->n_dry_sequence_breakers; i++) {
+            sparams.dry_sequence_breakers.push_back(params->dry_sequence_breakers[i]);
+        }
+        sparams.xtc_probability = params->xtc_probability;
+        sparams.xtc_threshold = params->xtc_threshold;
+        if (params->n_samplers > 0) {
+            std::vector<std::string> names(params->samplers, params->samplers + params->n_samplers);
+            sparams.samplers = common_sampler_types_from_names(names, true);
+        }
         return common_sampler_init(model, sparams);
     } catch (const std::exception &err) {
         return nullptr;
@@ -15,6 +15,9 @@ extern "C"
         float top_p;
         float min_p;
         float typical_p;
+        int32_t mirostat;
+        float mirostat_tau;
+        float mirostat_eta;
         float temp;
         int32_t penalty_last_n;
         float penalty_repeat;
@@ -22,6 +25,19 @@ extern "C"
         float penalty_present;
         uint32_t seed;
         char *grammar;
+        int32_t *logit_bias_tokens;
+        float *logit_bias_values;
+        size_t n_logit_bias;
+        float dry_multiplier;
+        float dry_base;
+        int32_t dry_allowed_length;
+        int32_t dry_penalty_last_n;
+        const char **dry_sequence_breakers;
+        size_t n_dry_sequence_breakers;
+        float xtc_probability;
+        float xtc_threshold;
+        const char **samplers;
+        size_t n_samplers;
     };
 
     struct common_sampler *common_sampler_cinit(const struct llama_model *model, struct common_sampler_cparams *params);
@@ -15,22 +15,34 @@ import (
 )
 
 // This algorithm looks for a complete fit to determine if we need to unload other models
-func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (bool, uint64) {
+// A draft model, if any, has to fit on the GPUs along with the model
+func PredictServerFit(allGpus discover.GpuInfoList, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (bool, uint64) {
 	// Split up the GPUs by type and try them
 	var estimatedVRAM uint64
 	for _, gpus := range allGpus.ByLibrary() {
 		var layerCount int
 		estimate := EstimateGPULayers(gpus, f, projectors, opts, numParallel)
 		layerCount, estimatedVRAM = estimate.Layers, estimate.VRAMSize
+
+		var fits bool
 		if opts.NumGPU < 0 {
-			if layerCount > 0 && layerCount >= int(f.KV().BlockCount()+1) {
-				return true, estimatedVRAM
-			}
+			fits = layerCount > 0 && layerCount >= int(f.KV().BlockCount()+1)
 		} else {
-			if layerCount > 0 && layerCount >= opts.NumGPU {
-				return true, estimatedVRAM
+			fits = layerCount > 0 && layerCount >= opts.NumGPU
+		}
+
+		if fits && draft != "" {
+			layers, err := EstimateDraft(gpus, f, draft, opts, numParallel, &estimate)
+			if err != nil {
+				slog.Warn("unable to estimate draft model memory", "draft", draft, "error", err)
+			} else {
+				fits, estimatedVRAM = layers > 0, estimate.VRAMSize
 			}
 		}
+
+		if fits {
+			return true, estimatedVRAM
+		}
 	}
 	return false, estimatedVRAM
 }
@@ -129,17 +141,7 @@ func EstimateGPULayers(gpus []discover.GpuInfo, f *ggml.GGML, projectors []strin
 		slog.Warn("model missing blk.0 layer size")
 	}
 
-	var kvct string
-	if envconfig.FlashAttention() &&
-		discover.GetGPUInfo().FlashAttentionSupported() &&
-		f.SupportsFlashAttention() {
-		requested := strings.ToLower(envconfig.KvCacheType())
-		if requested != "" && f.SupportsKVCacheType(requested) {
-			kvct = requested
-		}
-	}
-
-	kv, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), numParallel, kvct)
+	kv, graphPartialOffload, graphFullOffload := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), numParallel, kvCacheType(f))
 
 	if len(kv) > 0 {
 		layerSize += kv[0]
@@ -415,6 +417,47 @@ func (m MemoryEstimate) LogValue() slog.Value {
 	return slog.GroupValue(attrs...)
 }
 
+// kvCacheType is the type of the KV cache that f will use
+func kvCacheType(f *ggml.GGML) string {
+	if envconfig.FlashAttention() &&
+		discover.GetGPUInfo().FlashAttentionSupported() &&
+		f.SupportsFlashAttention() {
+		requested := strings.ToLower(envconfig.KvCacheType())
+		if requested != "" && f.SupportsKVCacheType(requested) {
+			return requested
+		}
+	}
+
+	return ""
+}
+
+// draftMemoryRequirements returns the number of layers of the draft model in
+// filename and the memory it needs for its weights, KV cache and graph when
+// it's fully offloaded
+func draftMemoryRequirements(filename string, opts api.Options, numParallel int) (layers int, size uint64, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	f, err := ggml.Decode(file, 1024)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, layer := range f.Tensors().GroupLayers() {
+		size += layer.Size()
+	}
+
+	kv, _, graph := f.GraphSize(uint64(opts.NumCtx), uint64(min(opts.NumCtx, opts.NumBatch)), numParallel, kvCacheType(f))
+	for _, l := range kv {
+		size += l
+	}
+
+	return int(f.KV().BlockCount()) + 1, size + graph, nil
+}
+
 func projectorMemoryRequirements(filename string) (weights uint64) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"slices"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -129,3 +130,101 @@ func TestEstimateGPULayers(t *testing.T) {
 		})
 	}
 }
+
+func TestEstimateDraft(t *testing.T) {
+	t.Setenv("OLLAMA_KV_CACHE_TYPE", "")
+
+	f, err := os.CreateTemp(t.TempDir(), "draft")
+	require.NoError(t, err)
+	defer f.Close()
+
+	err = ggml.WriteGGUF(f, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.context_length":          uint32(32),
+		"llama.embedding_length":        uint32(64),
+		"llama.block_count":             uint32(1),
+		"llama.attention.head_count":    uint32(4),
+		"llama.attention.head_count_kv": uint32(4),
+		"tokenizer.ggml.tokens":         []string{" "},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "blk.0.attn.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+		{Name: "output.weight", Kind: uint32(0), Offset: uint64(0), Shape: []uint64{1, 1, 1, 1}, WriterTo: bytes.NewReader(make([]byte, 32))},
+	})
+	require.NoError(t, err)
+
+	target, err := LoadModel(f.Name(), 0)
+	require.NoError(t, err)
+
+	opts := api.DefaultOptions()
+	_, size, err := draftMemoryRequirements(f.Name(), opts, 1)
+	require.NoError(t, err)
+	require.NotZero(t, size)
+
+	gpus := func(free ...uint64) discover.GpuInfoList {
+		var l discover.GpuInfoList
+		for i, m := range free {
+			gpu := discover.GpuInfo{Library: "cuda"}
+			gpu.ID = fmt.Sprint(i)
+			gpu.FreeMemory = m
+			l = append(l, gpu)
+		}
+		return l
+	}
+
+	cases := []struct {
+		name     string
+		gpus     discover.GpuInfoList
+		offload  int
+		layers   int
+		gpuSizes []uint64
+	}{
+		{name: "cpu", gpus: discover.GpuInfoList{{Library: "cpu"}}, offload: 0, layers: 0},
+		{name: "fits", gpus: gpus(1000 + size), offload: 2, layers: 2, gpuSizes: []uint64{1000 + size}},
+		{name: "split", gpus: gpus(500+size, 500+size), offload: 2, layers: 2, gpuSizes: []uint64{500 + size/2, 500 + size/2}},
+		{name: "no room", gpus: gpus(1000 + size - 1), offload: 2, layers: 0, gpuSizes: []uint64{1000}},
+		{name: "partial offload", gpus: gpus(1000 + size), offload: 1, layers: 0, gpuSizes: []uint64{1000}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			estimate := MemoryEstimate{TotalSize: 2000, Layers: tt.offload}
+			for range tt.gpuSizes {
+				estimate.GPUSizes = append(estimate.GPUSizes, 1000/uint64(len(tt.gpuSizes)))
+				estimate.VRAMSize += 1000 / uint64(len(tt.gpuSizes))
+			}
+			vram, sizes := estimate.VRAMSize, slices.Clone(estimate.GPUSizes)
+
+			layers, err := EstimateDraft(tt.gpus, target, f.Name(), opts, 1, &estimate)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.layers, layers)
+			assert.Equal(t, 2000+size, estimate.TotalSize)
+			if tt.layers > 0 {
+				assert.Equal(t, vram+size, estimate.VRAMSize)
+				assert.Equal(t, tt.gpuSizes, estimate.GPUSizes)
+			} else {
+				assert.Equal(t, vram, estimate.VRAMSize)
+				assert.Equal(t, sizes, estimate.GPUSizes)
+			}
+		})
+	}
+	// the model only fits if its draft model does too
+	full := EstimateGPULayers(gpus(1<<30), target, nil, opts, 1)
+	for free := full.VRAMSize; ; free += 64 {
+		if free > 2*full.VRAMSize {
+			t.Fatal("model doesn't fit without a draft model")
+		}
+
+		if ok, _ := PredictServerFit(gpus(free), target, nil, nil, "", opts, 1); ok {
+			ok, _ := PredictServerFit(gpus(free), target, nil, nil, f.Name(), opts, 1)
+			assert.False(t, ok)
+
+			ok, vram := PredictServerFit(gpus(free+size), target, nil, nil, f.Name(), opts, 1)
+			assert.True(t, ok)
+			assert.Equal(t, full.VRAMSize+size, vram)
+			break
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package llm
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Priority determines the order in which requests waiting for a model or one
+// of its parallel slots are served
+type Priority int
+
+const (
+	// PriorityLow is for bulk work, such as batch jobs, that should give
+	// way to other requests
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	// PriorityHigh is for interactive requests that should jump ahead of
+	// other requests
+	PriorityHigh
+)
+
+// ParsePriority parses "low", "normal" or "high". An empty string is
+// PriorityNormal.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf("invalid priority %q, expected \"low\", \"normal\" or \"high\"", s)
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Requester identifies the client that made a request and its priority, so
+// that clients can be served fairly when requests have to wait
+type Requester struct {
+	Client   string
+	Priority Priority
+}
+
+type requesterKey struct{}
+
+// WithRequester returns a context carrying r
+func WithRequester(ctx context.Context, r Requester) context.Context {
+	return context.WithValue(ctx, requesterKey{}, r)
+}
+
+// RequesterFromContext returns the requester in ctx, or an anonymous client
+// with normal priority if there isn't one
+func RequesterFromContext(ctx context.Context) Requester {
+	r, _ := ctx.Value(requesterKey{}).(Requester)
+	return r
+}
+
+// slotQueue limits the number of requests using a runner's parallel slots.
+// Unlike a semaphore, waiting requests are admitted in priority order and
+// then to the client holding the fewest slots, so that a client with many
+// requests can't keep others waiting.
+type slotQueue struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	held    map[string]int
+	waiting []*slotWaiter
+	seq     uint64
+}
+
+type slotWaiter struct {
+	Requester
+	n   int
+	seq uint64
+
+	ready chan struct{}
+
+	// position holds the latest position in the queue, if it has changed
+	position     chan int
+	lastPosition int
+}
+
+func newSlotQueue(size int) *slotQueue {
+	return &slotQueue{size: size, held: make(map[string]int)}
+}
+
+// acquire waits for n slots. If the request has to wait, queued is called
+// with its position in the queue and again whenever it changes. The returned
+// function releases the slots.
+func (q *slotQueue) acquire(ctx context.Context, n int, queued func(position int)) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r := RequesterFromContext(ctx)
+	release := sync.OnceFunc(func() { q.release(r.Client, n) })
+
+	q.mu.Lock()
+	if len(q.waiting) == 0 && q.used+n <= q.size {
+		q.grant(r.Client, n)
+		q.mu.Unlock()
+		return release, nil
+	}
+
+	q.seq++
+	w := &slotWaiter{
+		Requester: r,
+		n:         n,
+		seq:       q.seq,
+		ready:     make(chan struct{}),
+		position:  make(chan int, 1),
+	}
+	q.waiting = append(q.waiting, w)
+	q.update()
+	q.mu.Unlock()
+
+	for {
+		select {
+		case <-w.ready:
+			return release, nil
+		case position := <-w.position:
+			if queued != nil {
+				queued(position)
+			}
+		case <-ctx.Done():
+			q.mu.Lock()
+			select {
+			case <-w.ready:
+				// the slots were granted as the context was canceled
+				q.mu.Unlock()
+				release()
+			default:
+				q.waiting = slices.DeleteFunc(q.waiting, func(o *slotWaiter) bool { return o == w })
+				q.update()
+				q.mu.Unlock()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *slotQueue) grant(client string, n int) {
+	q.used += n
+	q.held[client] += n
+}
+
+func (q *slotQueue) release(client string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.used -= n
+	q.held[client] -= n
+	if q.held[client] <= 0 {
+		delete(q.held, client)
+	}
+	q.update()
+}
+
+// update admits waiting requests while there are free slots and notifies
+// the rest of their new positions. q.mu must be held.
+func (q *slotQueue) update() {
+	for len(q.waiting) > 0 {
+		slices.SortFunc(q.waiting, func(a, b *slotWaiter) int {
+			return cmp.Or(
+				cmp.Compare(b.Priority, a.Priority),
+				cmp.Compare(q.held[a.Client], q.held[b.Client]),
+				cmp.Compare(a.seq, b.seq),
+			)
+		})
+
+		w := q.waiting[0]
+		if q.used+w.n > q.size {
+			break
+		}
+
+		q.grant(w.Client, w.n)
+		q.waiting = q.waiting[1:]
+		close(w.ready)
+	}
+
+	for i, w := range q.waiting {
+		if w.lastPosition == i+1 {
+			continue
+		}
+
+		w.lastPosition = i + 1
+		select {
+		case <-w.position:
+		default:
+		}
+		w.position <- w.lastPosition
+	}
+}
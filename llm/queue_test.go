@@ -0,0 +1,150 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	cases := map[string]Priority{
+		"":       PriorityNormal,
+		"normal": PriorityNormal,
+		"low":    PriorityLow,
+		"HIGH":   PriorityHigh,
+	}
+
+	for s, want := range cases {
+		got, err := ParsePriority(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("%q: expected %s, got %s", s, want, got)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("expected error for unknown priority")
+	}
+}
+
+func TestSlotQueue(t *testing.T) {
+	ctx := func(client string, priority Priority) context.Context {
+		return WithRequester(t.Context(), Requester{Client: client, Priority: priority})
+	}
+
+	t.Run("order", func(t *testing.T) {
+		q := newSlotQueue(2)
+
+		// the batch client takes every slot
+		var releases []func()
+		for range 2 {
+			release, err := q.acquire(ctx("batch", PriorityLow), 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			releases = append(releases, release)
+		}
+
+		type admission struct {
+			name    string
+			release func()
+		}
+
+		admitted := make(chan admission)
+		positions := make(map[string]int)
+		acquire := func(name, client string, priority Priority) {
+			queued := make(chan int, 1)
+			go func() {
+				release, err := q.acquire(ctx(client, priority), 1, func(position int) {
+					select {
+					case queued <- position:
+					default:
+					}
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				admitted <- admission{name, release}
+			}()
+
+			// wait until the request is queued so that arrival order is known
+			positions[name] = <-queued
+		}
+
+		acquire("batch 1", "batch", PriorityLow)
+		acquire("batch 2", "batch", PriorityLow)
+		acquire("other", "other", PriorityLow)
+		acquire("interactive", "user", PriorityHigh)
+
+		// a client that doesn't hold a slot is queued ahead of the batch
+		// client, and a high priority request ahead of both
+		if want := map[string]int{"batch 1": 1, "batch 2": 2, "other": 1, "interactive": 1}; !maps.Equal(positions, want) {
+			t.Errorf("expected positions %v, got %v", want, positions)
+		}
+
+		// free one slot at a time, most recently admitted first, so that
+		// requests are admitted in order
+		var order []string
+		for range 4 {
+			releases[len(releases)-1]()
+			releases = releases[:len(releases)-1]
+
+			a := <-admitted
+			order = append(order, a.name)
+			releases = append(releases, a.release)
+		}
+
+		if want := []string{"interactive", "other", "batch 1", "batch 2"}; !slices.Equal(order, want) {
+			t.Errorf("expected order %v, got %v", want, order)
+		}
+
+		for _, release := range releases {
+			release()
+		}
+
+		if q.used != 0 || len(q.held) != 0 {
+			t.Errorf("expected no slots in use, got used %d, held %v", q.used, q.held)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		q := newSlotQueue(1)
+		release, err := q.acquire(t.Context(), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cctx, cancel := context.WithCancel(t.Context())
+		errCh := make(chan error)
+		go func() {
+			_, err := q.acquire(cctx, 1, nil)
+			errCh <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		if err := <-errCh; !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+
+		release()
+
+		// the canceled request must not hold the slot
+		release, err = q.acquire(t.Context(), 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+
+		if q.used != 0 || len(q.waiting) != 0 || len(q.held) != 0 {
+			t.Errorf("expected empty queue, got used %d, waiting %d, held %v", q.used, len(q.waiting), q.held)
+		}
+	})
+}
@@ -3,7 +3,9 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,8 +25,6 @@ import (
 	"sync"
 	"time"
 
-	"golang.org/x/sync/semaphore"
-
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
@@ -33,6 +33,8 @@ import (
 	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/logutil"
 	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/sample"
+	"github.com/ollama/ollama/tracing"
 )
 
 type filteredEnv []string
@@ -67,6 +69,9 @@ type LlamaServer interface {
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
 	Embedding(ctx context.Context, input string) ([]float32, error)
+	Rerank(ctx context.Context, query, document string) (float32, error)
+	RerankOverhead(ctx context.Context) (int, error)
+	Warm(ctx context.Context, name, prompt string) (int, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
 	Close() error
@@ -74,6 +79,10 @@ type LlamaServer interface {
 	EstimatedTotal() uint64
 	EstimatedVRAMByGPU(gpuID string) uint64
 	Pid() int
+
+	// NumParallel is the number of requests the server can process at
+	// once, which bounds the completions of a single request
+	NumParallel() int
 }
 
 // llmServer is an instance of the llama.cpp server
@@ -102,7 +111,7 @@ type llmServer struct {
 	loadDuration time.Duration        // Record how long it took the model to load
 	loadProgress float32
 
-	sem *semaphore.Weighted
+	slots *slotQueue
 }
 
 // LoadModel will load a model from disk. The model must be in the GGML format.
@@ -127,7 +136,7 @@ func LoadModel(model string, maxArraySize int) (*ggml.GGML, error) {
 
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (LlamaServer, error) {
 	systemInfo := discover.GetSystemInfo()
 	systemTotalMemory := systemInfo.System.TotalMemory
 	systemFreeMemory := systemInfo.System.FreeMemory
@@ -207,6 +216,8 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 
 	kvct := strings.ToLower(envconfig.KvCacheType())
 
+	// the type of the cache actually used by the runner, empty for the default
+	var cacheType string
 	if fa {
 		slog.Info("enabling flash attention")
 		params = append(params, "--flash-attn")
@@ -215,6 +226,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		// Enable if the requested and kv cache type is supported by the model
 		if kvct != "" && f.SupportsKVCacheType(kvct) {
 			params = append(params, "--kv-cache-type", kvct)
+			cacheType = kvct
 		} else {
 			slog.Warn("kv cache type not supported by model", "type", kvct)
 		}
@@ -291,26 +303,37 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 		exe = eval
 	}
 
-	var llamaModel *llama.Model
-	var textProcessor model.TextProcessor
-	if envconfig.NewEngine() || f.KV().OllamaEngineRequired() {
-		textProcessor, err = model.NewTextProcessor(modelPath)
-		if err != nil {
-			// To prepare for opt-out mode, instead of treating this as an error, we fallback to the old runner
-			slog.Debug("model not yet supported by Ollama engine, switching to compatibility mode", "model", modelPath, "error", err)
-		}
-	}
-	if textProcessor == nil {
-		llamaModel, err = llama.LoadModelFromFile(modelPath, llama.ModelParams{VocabOnly: true})
-		if err != nil {
-			return nil, err
-		}
+	llamaModel, textProcessor, err := loadVocab(modelPath, f)
+	if err != nil {
+		return nil, err
 	}
 
 	if len(projectors) > 0 && llamaModel != nil {
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	if draft != "" {
+		if textProcessor != nil {
+			withDraft := estimate
+			layers, err := EstimateDraft(gpus, f, draft, opts, numParallel, &withDraft)
+			switch {
+			case err != nil:
+				return nil, fmt.Errorf("unable to load draft model: %w", err)
+			case runtime.GOOS != "darwin" && withDraft.TotalSize-withDraft.VRAMSize > systemFreeMemory+systemSwapFreeMemory:
+				slog.Warn("not enough system memory for draft model, ignoring", "draft", draft)
+			default:
+				estimate = withDraft
+				params = append(params, "--draft", draft, "--draft-n-gpu-layers", strconv.Itoa(layers))
+			}
+		} else {
+			slog.Warn("draft models are only supported by the Ollama engine, ignoring", "draft", draft)
+		}
+	}
+
+	if dir := envconfig.KvCacheDir(); dir != "" && textProcessor != nil {
+		params = append(params, "--kv-cache-dir", kvCacheDir(dir, modelPath, adapters, projectors, cacheType, fa))
+	}
+
 	// iterate through compatible GPU libraries such as 'cuda_v12', 'cuda_v11', 'rocm', etc.
 	// adding each library's respective path to the LD_LIBRARY_PATH, until finally running
 	// without any LD_LIBRARY_PATH flags
@@ -382,7 +405,7 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 			textProcessor: textProcessor,
 			estimate:      estimate,
 			numParallel:   numParallel,
-			sem:           semaphore.NewWeighted(int64(numParallel)),
+			slots:         newSlotQueue(numParallel),
 			totalLayers:   f.KV().BlockCount() + 1,
 			gpus:          gpus,
 			done:          make(chan error, 1),
@@ -468,6 +491,25 @@ func NewLlamaServer(gpus discover.GpuInfoList, modelPath string, f *ggml.GGML, a
 	}
 }
 
+// kvCacheDir returns the directory under dir that a runner persists prompts
+// to. Persisted prompts are only valid for the weights they were evaluated
+// with and the layout of the cache they were saved from, so the name includes
+// the digests of the model, its adapters and projectors as well as the cache
+// type and whether flash attention is enabled.
+func kvCacheDir(dir, modelPath string, adapters, projectors []string, cacheType string, fa bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "model %s\n", filepath.Base(modelPath))
+	for _, adapter := range adapters {
+		fmt.Fprintf(h, "adapter %s\n", filepath.Base(adapter))
+	}
+	for _, projector := range projectors {
+		fmt.Fprintf(h, "projector %s\n", filepath.Base(projector))
+	}
+	fmt.Fprintf(h, "cache %s\nflash attention %t\n", cmp.Or(cacheType, "f16"), fa)
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%x", filepath.Base(modelPath), h.Sum(nil)[:8]))
+}
+
 type ServerStatus int
 
 const ( // iota is reset to 0
@@ -678,6 +720,10 @@ ws ::= ([ \t\n] ws)?
 
 const maxBufferSize = 512 * format.KiloByte
 
+// MaxTopLogprobs is the maximum number of alternative tokens that can be
+// requested per generated token
+const MaxTopLogprobs = 20
+
 type ImageData struct {
 	Data []byte `json:"data"`
 	ID   int    `json:"id"`
@@ -689,6 +735,9 @@ type CompletionRequest struct {
 	Images  []ImageData
 	Options *api.Options
 
+	// N is the number of completions to generate from the prompt
+	N int `json:"n,omitempty"`
+
 	Grammar string // set before sending the request to the subprocess
 }
 
@@ -716,15 +765,69 @@ func (d DoneReason) String() string {
 }
 
 type CompletionResponse struct {
-	Content            string        `json:"content"`
-	DoneReason         DoneReason    `json:"done_reason"`
-	Done               bool          `json:"done"`
+	Index      int           `json:"index,omitempty"`
+	Content    string        `json:"content"`
+	Logprobs   []api.Logprob `json:"logprobs,omitempty"`
+	DoneReason DoneReason    `json:"done_reason"`
+	Done       bool          `json:"done"`
+
+	// PromptEvalCount is set in the first response of each completion, as
+	// well as in the final one
 	PromptEvalCount    int           `json:"prompt_eval_count"`
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
 	EvalCount          int           `json:"eval_count"`
 	EvalDuration       time.Duration `json:"eval_duration"`
+
+	// DraftCount is the number of tokens proposed by the draft model, of
+	// which DraftAcceptedCount were accepted
+	DraftCount         int `json:"draft_count,omitempty"`
+	DraftAcceptedCount int `json:"draft_accepted_count,omitempty"`
+
+	// StopSequence is the stop sequence that ended the completion, if any
+	StopSequence string `json:"stop_sequence,omitempty"`
+
+	// QueuePosition is set, without any other fields, while the request is
+	// waiting for other requests to finish
+	QueuePosition int `json:"-"`
 }
 
+// validateSampling checks that the options of the samplers that are disabled
+// by default are in range
+func validateSampling(opts *api.Options) error {
+	switch {
+	case opts.TypicalP < 0:
+		return errors.New("typical_p must not be negative")
+	case opts.Mirostat < 0 || opts.Mirostat > 2:
+		return errors.New("mirostat must be 0, 1 or 2")
+	case opts.Mirostat != 0 && (opts.MirostatTau <= 0 || opts.MirostatEta <= 0):
+		return errors.New("mirostat_tau and mirostat_eta must be positive")
+	case opts.DryMultiplier < 0:
+		return errors.New("dry_multiplier must not be negative")
+	case opts.DryMultiplier > 0 && opts.DryBase < 1:
+		return errors.New("dry_base must be at least 1")
+	case opts.DryAllowedLength < 0:
+		return errors.New("dry_allowed_length must not be negative")
+	case opts.DryPenaltyLastN < -1:
+		return errors.New("dry_penalty_last_n must be -1 or more")
+	case opts.XTCProbability < 0 || opts.XTCProbability > 1:
+		return errors.New("xtc_probability must be between 0 and 1")
+	case opts.XTCThreshold < 0 || opts.XTCThreshold > 1:
+		return errors.New("xtc_threshold must be between 0 and 1")
+	case opts.NumBeams < 0:
+		return errors.New("num_beams must not be negative")
+	}
+
+	if err := sample.ValidateSamplers(opts.Samplers); err != nil {
+		return fmt.Errorf("invalid samplers: %w", err)
+	}
+
+	return nil
+}
+
+// ErrInvalidFormat is returned by Completion when the format of a request
+// can't be used to constrain its output
+var ErrInvalidFormat = errors.New("invalid format")
+
 func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
 	slog.Debug("completion request", "images", len(req.Images), "prompt", len(req.Prompt), "format", string(req.Format))
 	slog.Log(ctx, logutil.LevelTrace, "completion request", "prompt", req.Prompt)
@@ -739,13 +842,29 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 			req.Grammar = grammarJSON
 		default:
 			if req.Format[0] != '{' {
-				return fmt.Errorf("invalid format: %q; expected \"json\" or a valid JSON Schema object", req.Format)
+				return fmt.Errorf("%w: %q; expected \"json\" or a valid JSON Schema object", ErrInvalidFormat, req.Format)
+			}
+
+			// The Ollama engine constrains sampling to the format directly,
+			// while llama.cpp needs a grammar.
+			if s.textProcessor != nil {
+				if err := sample.ValidateFormat(req.Format); err != nil {
+					return fmt.Errorf("%w: %w", ErrInvalidFormat, err)
+				}
+				break
+			}
+
+			if g, ok, err := sample.FormatGrammar(req.Format); err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidFormat, err)
+			} else if ok {
+				req.Grammar = g
+				break
 			}
 
 			// User provided a JSON schema
 			g := llama.SchemaToGrammar(req.Format)
 			if g == nil {
-				return fmt.Errorf("invalid JSON schema in format")
+				return fmt.Errorf("%w: invalid JSON schema", ErrInvalidFormat)
 			}
 			req.Grammar = string(g)
 		}
@@ -756,15 +875,46 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		req.Options = &opts
 	}
 
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	if req.Options.TopLogprobs < 0 || req.Options.TopLogprobs > MaxTopLogprobs {
+		return fmt.Errorf("top_logprobs must be between 0 and %d", MaxTopLogprobs)
+	}
+
+	if err := validateSampling(req.Options); err != nil {
+		return err
+	}
+
+	// each completion occupies one of the runner's parallel sequences
+	if req.N > s.numParallel {
+		return fmt.Errorf("n must not exceed the number of parallel requests (%d)", s.numParallel)
+	}
+	n := max(req.N, 1)
+
+	// as does each beam, though only the best completion is returned
+	if req.Options.NumBeams > 1 {
+		switch {
+		case s.textProcessor == nil:
+			return errors.New("num_beams is not supported by this model")
+		case req.N > 1:
+			return errors.New("n can't be combined with num_beams")
+		case req.Options.NumBeams > s.numParallel:
+			return fmt.Errorf("num_beams must not exceed the number of parallel requests (%d)", s.numParallel)
+		case req.Grammar != "":
+			return errors.New("num_beams can't be combined with a grammar, use a JSON schema format instead")
+		}
+	}
+
+	release, err := s.slots.acquire(ctx, max(n, req.Options.NumBeams), func(position int) {
+		fn(CompletionResponse{QueuePosition: position})
+	})
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
+			slog.Error("Failed to acquire slot", "error", err)
 		}
 		return err
 	}
-	defer s.sem.Release(1)
+	defer release()
 
 	// put an upper limit on num_predict to avoid the model running on forever
 	if req.Options.NumPredict < 0 || req.Options.NumPredict > 10*s.options.NumCtx {
@@ -794,6 +944,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		return fmt.Errorf("error creating POST request: %v", err)
 	}
 	serverReq.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, serverReq.Header)
 
 	res, err := http.DefaultClient.Do(serverReq)
 	if err != nil {
@@ -814,9 +965,12 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	buf := make([]byte, 0, maxBufferSize)
 	scanner.Buffer(buf, maxBufferSize)
 
-	// keep track of the last token generated, this is used to abort if the model starts looping
-	var lastToken string
-	var tokenRepeat int
+	// keep track of the last token generated for each completion, this is used to abort if the model starts looping
+	lastToken := make(map[int]string)
+	tokenRepeat := make(map[int]int)
+
+	// number of completions that have finished
+	var done int
 
 	for scanner.Scan() {
 		select {
@@ -839,28 +993,34 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				return fmt.Errorf("error unmarshalling llm prediction response: %v", err)
 			}
 			switch {
-			case strings.TrimSpace(c.Content) == lastToken:
-				tokenRepeat++
+			case strings.TrimSpace(c.Content) == lastToken[c.Index]:
+				tokenRepeat[c.Index]++
 			default:
-				lastToken = strings.TrimSpace(c.Content)
-				tokenRepeat = 0
+				lastToken[c.Index] = strings.TrimSpace(c.Content)
+				tokenRepeat[c.Index] = 0
 			}
 
 			// 30 picked as an arbitrary max token repeat limit, modify as needed
-			if tokenRepeat > 30 {
+			if tokenRepeat[c.Index] > 30 {
 				slog.Debug("prediction aborted, token repeat limit reached")
 				return ctx.Err()
 			}
 
-			if c.Content != "" {
+			if c.Content != "" || len(c.Logprobs) > 0 {
 				fn(CompletionResponse{
-					Content: c.Content,
+					Index:           c.Index,
+					Content:         c.Content,
+					Logprobs:        c.Logprobs,
+					PromptEvalCount: c.PromptEvalCount,
 				})
 			}
 
 			if c.Done {
 				fn(c)
-				return nil
+				done++
+				if done >= n {
+					return nil
+				}
 			}
 		}
 	}
@@ -894,15 +1054,16 @@ type EmbeddingResponse struct {
 func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
 	slog.Log(ctx, logutil.LevelTrace, "embedding request", "input", input)
 
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	release, err := s.slots.acquire(ctx, 1, nil)
+	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting embedding request due to client closing the connection")
 		} else {
-			slog.Error("Failed to acquire semaphore", "error", err)
+			slog.Error("Failed to acquire slot", "error", err)
 		}
 		return nil, err
 	}
-	defer s.sem.Release(1)
+	defer release()
 
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
@@ -922,6 +1083,7 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("error creating embed request: %w", err)
 	}
 	r.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, r.Header)
 
 	resp, err := http.DefaultClient.Do(r)
 	if err != nil {
@@ -947,6 +1109,169 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 	return e.Embedding, nil
 }
 
+type RerankRequest struct {
+	Query    string `json:"query"`
+	Document string `json:"document"`
+}
+
+type RerankResponse struct {
+	Score float32 `json:"score"`
+}
+
+// Rerank returns the raw relevance score of document to query, as computed by
+// the classification head of a reranking model
+func (s *llmServer) Rerank(ctx context.Context, query, document string) (float32, error) {
+	slog.Log(ctx, logutil.LevelTrace, "rerank request", "query", query, "document", document)
+
+	release, err := s.slots.acquire(ctx, 1, nil)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting rerank request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire slot", "error", err)
+		}
+		return 0, err
+	}
+	defer release()
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return 0, err
+	} else if status != ServerStatusReady {
+		return 0, fmt.Errorf("unexpected server status: %s", status)
+	}
+
+	data, err := json.Marshal(RerankRequest{Query: query, Document: document})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling rerank data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/rerank", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, fmt.Errorf("error creating rerank request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, r.Header)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, fmt.Errorf("do rerank request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading rerank response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		log.Printf("llm rerank error: %s", body)
+		return 0, fmt.Errorf("%s", body)
+	}
+
+	var rr RerankResponse
+	if err := json.Unmarshal(body, &rr); err != nil {
+		return 0, fmt.Errorf("unmarshal rerank response: %w", err)
+	}
+
+	return rr.Score, nil
+}
+
+type WarmRequest struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+}
+
+type WarmResponse struct {
+	Count int `json:"count"`
+}
+
+// RerankOverhead returns the number of special tokens that are added to a
+// query and document when they're encoded as a pair to be reranked
+func (s *llmServer) RerankOverhead(ctx context.Context) (int, error) {
+	s.llamaModelLock.Lock()
+	defer s.llamaModelLock.Unlock()
+
+	// only the llama engine supports reranking
+	if s.llamaModel == nil {
+		return 0, nil
+	}
+
+	tokens, err := s.llamaModel.Tokenize("", true, true)
+	if err != nil {
+		return 0, err
+	}
+
+	// the query and the document are each wrapped in special tokens, except
+	// that the document continues the query so it doesn't start a new sequence
+	n := 2 * len(tokens)
+	if s.llamaModel.AddBOSToken() && len(tokens) > 0 {
+		n--
+	}
+
+	return n, nil
+}
+
+// Warm evaluates prompt and persists its KV cache to disk under name, so that
+// requests starting with the same prompt don't need to evaluate it again, even
+// after the model is reloaded. It returns the number of tokens in prompt.
+func (s *llmServer) Warm(ctx context.Context, name, prompt string) (int, error) {
+	release, err := s.slots.acquire(ctx, 1, nil)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting warm request due to client closing the connection")
+		} else {
+			slog.Error("Failed to acquire slot", "error", err)
+		}
+		return 0, err
+	}
+	defer release()
+
+	// Make sure the server is ready
+	status, err := s.getServerStatusRetry(ctx)
+	if err != nil {
+		return 0, err
+	} else if status != ServerStatusReady {
+		return 0, fmt.Errorf("unexpected server status: %s", status)
+	}
+
+	data, err := json.Marshal(WarmRequest{Name: name, Prompt: prompt})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling warm data: %w", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d/warm", s.port), bytes.NewBuffer(data))
+	if err != nil {
+		return 0, fmt.Errorf("error creating warm request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, r.Header)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return 0, fmt.Errorf("do warm request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading warm response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		log.Printf("llm warm error: %s", body)
+		return 0, fmt.Errorf("%s", body)
+	}
+
+	var wr WarmResponse
+	if err := json.Unmarshal(body, &wr); err != nil {
+		return 0, fmt.Errorf("unmarshal warm response: %w", err)
+	}
+
+	return wr.Count, nil
+}
+
 type TokenizeRequest struct {
 	Content string `json:"content"`
 }
@@ -959,22 +1284,7 @@ func (s *llmServer) Tokenize(ctx context.Context, content string) ([]int, error)
 	s.llamaModelLock.Lock()
 	defer s.llamaModelLock.Unlock()
 
-	if s.llamaModel != nil {
-		return s.llamaModel.Tokenize(content, false, true)
-	}
-	if s.textProcessor != nil {
-		tokens, err := s.textProcessor.Encode(content, false)
-		if err != nil {
-			return nil, err
-		}
-		toks := make([]int, len(tokens))
-		for i, t := range tokens {
-			toks[i] = int(t)
-		}
-		return toks, nil
-	}
-	// not reached
-	return nil, fmt.Errorf("no tokenizer configured")
+	return tokenize(s.llamaModel, s.textProcessor, content)
 }
 
 type DetokenizeRequest struct {
@@ -989,26 +1299,7 @@ func (s *llmServer) Detokenize(ctx context.Context, tokens []int) (string, error
 	s.llamaModelLock.Lock()
 	defer s.llamaModelLock.Unlock()
 
-	if s.llamaModel != nil {
-		var resp string
-		for _, token := range tokens {
-			resp += s.llamaModel.TokenToPiece(token)
-		}
-		return resp, nil
-	}
-	if s.textProcessor != nil {
-		toks := make([]int32, len(tokens))
-		for i, t := range tokens {
-			toks[i] = int32(t)
-		}
-		content, err := s.textProcessor.Decode(toks)
-		if err != nil {
-			return "", err
-		}
-		return content, nil
-	}
-	// not reached
-	return "", fmt.Errorf("no tokenizer configured")
+	return detokenize(s.llamaModel, s.textProcessor, tokens)
 }
 
 func (s *llmServer) Close() error {
@@ -1036,6 +1327,43 @@ func (s *llmServer) Close() error {
 	return nil
 }
 
+// EstimateDraft adds the memory used by the draft model to estimate and
+// returns the number of its layers to offload. It's only offloaded, entirely,
+// if the target model is and the GPUs have room for it as well.
+func EstimateDraft(gpus discover.GpuInfoList, f *ggml.GGML, draft string, opts api.Options, numParallel int, estimate *MemoryEstimate) (int, error) {
+	layers, size, err := draftMemoryRequirements(draft, opts, numParallel)
+	if err != nil {
+		return 0, err
+	}
+
+	estimate.TotalSize += size
+	if gpus[0].Library == "cpu" || estimate.Layers < int(f.KV().BlockCount())+1 ||
+		estimate.VRAMSize == 0 || len(estimate.GPUSizes) != len(gpus) {
+		return 0, nil
+	}
+
+	// the draft model's layers are split between the GPUs like the target's
+	shares := make([]uint64, len(gpus))
+	for i, gpu := range gpus {
+		shares[i] = size * estimate.GPUSizes[i] / estimate.VRAMSize
+		if estimate.GPUSizes[i]+shares[i] > gpu.FreeMemory {
+			slog.Info("not enough memory to offload draft model", "gpu", gpu.ID, "required", format.HumanBytes2(estimate.GPUSizes[i]+shares[i]), "available", format.HumanBytes2(gpu.FreeMemory))
+			return 0, nil
+		}
+	}
+
+	estimate.GPUSizes = slices.Clone(estimate.GPUSizes)
+	for i := range gpus {
+		estimate.GPUSizes[i] += shares[i]
+	}
+	estimate.VRAMSize += size
+	return layers, nil
+}
+
+func (s *llmServer) NumParallel() int {
+	return s.numParallel
+}
+
 func (s *llmServer) EstimatedVRAM() uint64 {
 	return s.estimate.VRAMSize
 }
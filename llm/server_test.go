@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/ollama/ollama/api"
-	"golang.org/x/sync/semaphore"
 )
 
 func TestLLMServerCompletionFormat(t *testing.T) {
@@ -18,7 +18,7 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(t.Context())
 	s := &llmServer{
-		sem: semaphore.NewWeighted(1), // required to prevent nil panic
+		slots: newSlotQueue(1), // required to prevent nil panic
 	}
 
 	checkInvalid := func(format string) {
@@ -55,6 +55,10 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 		// JSON
 		`"json"`,
 		`{"type":"object"}`,
+
+		// regex and choices
+		`{"type":"regex","pattern":"[0-9]{4}-[0-9]{2}"}`,
+		`{"type":"choice","options":["positive","negative"]}`,
 	}
 	for _, valid := range valids {
 		err := s.Completion(ctx, CompletionRequest{
@@ -70,3 +74,75 @@ func TestLLMServerCompletionFormat(t *testing.T) {
 	}, nil)
 	checkValid(err)
 }
+
+func TestValidateSampling(t *testing.T) {
+	cases := []struct {
+		name string
+		fn   func(*api.Options)
+		want string
+	}{
+		{"defaults", func(*api.Options) {}, ""},
+		{"typical_p", func(o *api.Options) { o.TypicalP = -0.1 }, "typical_p"},
+		{"mirostat version", func(o *api.Options) { o.Mirostat = 3 }, "mirostat must be"},
+		{"mirostat tau", func(o *api.Options) { o.Mirostat, o.MirostatTau = 2, 0 }, "mirostat_tau"},
+		{"mirostat disabled", func(o *api.Options) { o.MirostatTau = 0 }, ""},
+		{"dry_multiplier", func(o *api.Options) { o.DryMultiplier = -1 }, "dry_multiplier"},
+		{"dry_base", func(o *api.Options) { o.DryMultiplier, o.DryBase = 0.8, 0.5 }, "dry_base"},
+		{"dry_allowed_length", func(o *api.Options) { o.DryAllowedLength = -1 }, "dry_allowed_length"},
+		{"dry_penalty_last_n", func(o *api.Options) { o.DryPenaltyLastN = -2 }, "dry_penalty_last_n"},
+		{"xtc_probability", func(o *api.Options) { o.XTCProbability = 1.5 }, "xtc_probability"},
+		{"xtc_threshold", func(o *api.Options) { o.XTCThreshold = -0.1 }, "xtc_threshold"},
+		{"samplers", func(o *api.Options) { o.Samplers = []string{"top_k", "temperature"} }, ""},
+		{"unknown sampler", func(o *api.Options) { o.Samplers = []string{"top_k", "top_a"} }, `unknown sampler "top_a"`},
+		{"duplicate sampler", func(o *api.Options) { o.Samplers = []string{"top_k", "top_k"} }, "more than once"},
+		{"num_beams", func(o *api.Options) { o.NumBeams = -1 }, "num_beams"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			c.fn(&opts)
+
+			err := validateSampling(&opts)
+			if c.want == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)) {
+				t.Fatalf("err = %v; want %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestKVCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	model := filepath.Join("blobs", "sha256-model")
+
+	base := kvCacheDir(dir, model, nil, nil, "", false)
+	if filepath.Dir(base) != dir || !strings.HasPrefix(filepath.Base(base), "sha256-model-") {
+		t.Fatalf("unexpected directory %s", base)
+	}
+
+	if got := kvCacheDir(dir, model, nil, nil, "f16", false); got != base {
+		t.Errorf("expected the default cache type to share %s, got %s", base, got)
+	}
+
+	// each variant of the model must not restore prompts persisted by another
+	variants := map[string]string{
+		"base":            base,
+		"adapter a":       kvCacheDir(dir, model, []string{filepath.Join("blobs", "sha256-a")}, nil, "", false),
+		"adapter b":       kvCacheDir(dir, model, []string{filepath.Join("blobs", "sha256-b")}, nil, "", false),
+		"projector":       kvCacheDir(dir, model, nil, []string{filepath.Join("blobs", "sha256-a")}, "", false),
+		"cache type":      kvCacheDir(dir, model, nil, nil, "q8_0", true),
+		"flash attention": kvCacheDir(dir, model, nil, nil, "", true),
+		"different model": kvCacheDir(dir, filepath.Join("blobs", "sha256-other"), nil, nil, "", false),
+	}
+
+	seen := make(map[string]string)
+	for name, got := range variants {
+		if other, ok := seen[got]; ok {
+			t.Errorf("%s and %s share %s", name, other, got)
+		}
+		seen[got] = name
+	}
+}
@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/model"
+)
+
+// Tokenizer converts between text and a model's tokens using only the
+// vocabulary in the model file, without loading the weights or starting a
+// runner
+type Tokenizer struct {
+	// llamaModel is a vocabulary only instance of the cgo llama.cpp model definition
+	// nil if this model is running with the Ollama engine
+	llamaModel     *llama.Model
+	llamaModelLock sync.Mutex
+
+	// textProcessor handles text encoding/decoding for the model in the Ollama engine
+	// nil if this model is running with the llama engine
+	textProcessor model.TextProcessor
+}
+
+// NewTokenizer loads the vocabulary of the model at modelPath, using the
+// same engine that a runner for the model would use
+func NewTokenizer(modelPath string, f *ggml.GGML) (*Tokenizer, error) {
+	llamaModel, textProcessor, err := loadVocab(modelPath, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokenizer{llamaModel: llamaModel, textProcessor: textProcessor}, nil
+}
+
+func (t *Tokenizer) Tokenize(ctx context.Context, content string) ([]int, error) {
+	t.llamaModelLock.Lock()
+	defer t.llamaModelLock.Unlock()
+
+	return tokenize(t.llamaModel, t.textProcessor, content)
+}
+
+func (t *Tokenizer) Detokenize(ctx context.Context, tokens []int) (string, error) {
+	t.llamaModelLock.Lock()
+	defer t.llamaModelLock.Unlock()
+
+	return detokenize(t.llamaModel, t.textProcessor, tokens)
+}
+
+func (t *Tokenizer) Close() {
+	t.llamaModelLock.Lock()
+	defer t.llamaModelLock.Unlock()
+
+	if t.llamaModel != nil {
+		llama.FreeModel(t.llamaModel)
+		t.llamaModel = nil
+	}
+}
+
+// loadVocab loads the vocabulary of a model for the Ollama engine if it
+// supports the model, or otherwise for the llama engine
+func loadVocab(modelPath string, f *ggml.GGML) (*llama.Model, model.TextProcessor, error) {
+	if envconfig.NewEngine() || f.KV().OllamaEngineRequired() {
+		textProcessor, err := model.NewTextProcessor(modelPath)
+		if err == nil {
+			return nil, textProcessor, nil
+		}
+
+		// To prepare for opt-out mode, instead of treating this as an error, we fallback to the old runner
+		slog.Debug("model not yet supported by Ollama engine, switching to compatibility mode", "model", modelPath, "error", err)
+	}
+
+	llamaModel, err := llama.LoadModelFromFile(modelPath, llama.ModelParams{VocabOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return llamaModel, nil, nil
+}
+
+func tokenize(llamaModel *llama.Model, textProcessor model.TextProcessor, content string) ([]int, error) {
+	if llamaModel != nil {
+		return llamaModel.Tokenize(content, false, true)
+	}
+	if textProcessor != nil {
+		tokens, err := textProcessor.Encode(content, false)
+		if err != nil {
+			return nil, err
+		}
+		toks := make([]int, len(tokens))
+		for i, t := range tokens {
+			toks[i] = int(t)
+		}
+		return toks, nil
+	}
+	// not reached
+	return nil, errors.New("no tokenizer configured")
+}
+
+func detokenize(llamaModel *llama.Model, textProcessor model.TextProcessor, tokens []int) (string, error) {
+	if llamaModel != nil {
+		var resp string
+		for _, token := range tokens {
+			resp += llamaModel.TokenToPiece(token)
+		}
+		return resp, nil
+	}
+	if textProcessor != nil {
+		toks := make([]int32, len(tokens))
+		for i, t := range tokens {
+			toks[i] = int32(t)
+		}
+		content, err := textProcessor.Decode(toks)
+		if err != nil {
+			return "", err
+		}
+		return content, nil
+	}
+	// not reached
+	return "", errors.New("no tokenizer configured")
+}
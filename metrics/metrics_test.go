@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounter("requests_total", "Number of requests.", "route", "status")
+	requests.Inc("/api/generate", "200")
+	requests.Inc("/api/generate", "200")
+	requests.Inc("/api/chat", "500")
+
+	loaded := r.NewGauge("loaded_models", "Number of loaded models.")
+	loaded.Set(3)
+	loaded.Add(-1)
+
+	duration := r.NewHistogram("duration_seconds", "Request duration.", []float64{0.5, 1}, "model")
+	duration.Observe(0.25, `say "hi"`)
+	duration.Observe(0.75, `say "hi"`)
+	duration.Observe(2, `say "hi"`)
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{route="/api/chat",status="500"} 1
+requests_total{route="/api/generate",status="200"} 2
+# HELP loaded_models Number of loaded models.
+# TYPE loaded_models gauge
+loaded_models 2
+# HELP duration_seconds Request duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{model="say \"hi\"",le="0.5"} 1
+duration_seconds_bucket{model="say \"hi\"",le="1"} 2
+duration_seconds_bucket{model="say \"hi\"",le="+Inf"} 3
+duration_seconds_sum{model="say \"hi\""} 3
+duration_seconds_count{model="say \"hi\""} 3
+`
+
+	if diff := cmp.Diff(want, sb.String()); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+
+	loaded.Reset()
+	sb.Reset()
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sb.String(), "loaded_models 2") {
+		t.Errorf("expected reset gauge to be removed, got:\n%s", sb.String())
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+
+	NewRegistry().NewCounter("requests_total", "Number of requests.", "route").Inc()
+}
@@ -92,6 +92,10 @@ type Context interface {
 	FromFloatSlice(s []float32, shape ...int) (Tensor, error)
 	FromIntSlice(s []int32, shape ...int) (Tensor, error)
 
+	// FromBytes creates a tensor of dtype from its raw data, such as that
+	// returned by Bytes. The length of s must match the size of the tensor.
+	FromBytes(dtype DType, s []byte, shape ...int) (Tensor, error)
+
 	// Arange creates a 1D tensor with values within an interval (start, stop] increased by step.
 	Arange(start, stop, step float32, dtype DType) Tensor
 
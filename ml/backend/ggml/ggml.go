@@ -716,6 +716,23 @@ func (c *Context) FromIntSlice(s []int32, shape ...int) (ml.Tensor, error) {
 	return t, nil
 }
 
+func (c *Context) FromBytes(dtype ml.DType, s []byte, shape ...int) (ml.Tensor, error) {
+	t, err := c.newTensor(dtype, shape)
+	if err != nil {
+		return nil, err
+	}
+
+	if n := int(C.ggml_nbytes(t.(*Tensor).t)); n != len(s) {
+		return nil, fmt.Errorf("invalid shape %v for %d bytes", shape, len(s))
+	}
+
+	if len(s) > 0 {
+		C.ggml_backend_tensor_set(t.(*Tensor).t, unsafe.Pointer(&s[0]), 0, C.ggml_nbytes(t.(*Tensor).t))
+	}
+
+	return t, nil
+}
+
 func (c Context) Arange(start, stop, step float32, dtype ml.DType) ml.Tensor {
 	switch dtype {
 	case ml.DTypeF32:
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"log/slog"
@@ -11,12 +11,15 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/types/model"
 )
 
@@ -36,19 +39,26 @@ type ErrorResponse struct {
 type Message struct {
 	Role      string     `json:"role"`
 	Content   any        `json:"content"`
+	Reasoning string     `json:"reasoning_content,omitempty"`
 	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	FinishReason *string         `json:"finish_reason"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	FinishReason *string         `json:"finish_reason"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs,omitempty"`
+}
+
+type ChoiceLogprobs struct {
+	Content []api.Logprob `json:"content"`
 }
 
 type CompleteChunkChoice struct {
@@ -82,19 +92,26 @@ type StreamOptions struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	StreamOptions    *StreamOptions  `json:"stream_options"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model             string             `json:"model"`
+	Messages          []Message          `json:"messages"`
+	Stream            bool               `json:"stream"`
+	StreamOptions     *StreamOptions     `json:"stream_options"`
+	MaxTokens         *int               `json:"max_tokens"`
+	Seed              *int               `json:"seed"`
+	Stop              any                `json:"stop"`
+	Temperature       *float64           `json:"temperature"`
+	FrequencyPenalty  *float64           `json:"frequency_penalty"`
+	PresencePenalty   *float64           `json:"presence_penalty"`
+	TopP              *float64           `json:"top_p"`
+	ResponseFormat    *ResponseFormat    `json:"response_format"`
+	Tools             []api.Tool         `json:"tools"`
+	ToolChoice        *api.ToolChoice    `json:"tool_choice"`
+	ParallelToolCalls *bool              `json:"parallel_tool_calls"`
+	Logprobs          *bool              `json:"logprobs"`
+	TopLogprobs       *int               `json:"top_logprobs"`
+	ReasoningEffort   *string            `json:"reasoning_effort"`
+	LogitBias         map[string]float64 `json:"logit_bias"`
+	N                 *int               `json:"n"`
 }
 
 type ChatCompletion struct {
@@ -119,18 +136,20 @@ type ChatCompletionChunk struct {
 
 // TODO (https://github.com/ollama/ollama/issues/5259): support []string, []int and [][]int
 type CompletionRequest struct {
-	Model            string         `json:"model"`
-	Prompt           string         `json:"prompt"`
-	FrequencyPenalty float32        `json:"frequency_penalty"`
-	MaxTokens        *int           `json:"max_tokens"`
-	PresencePenalty  float32        `json:"presence_penalty"`
-	Seed             *int           `json:"seed"`
-	Stop             any            `json:"stop"`
-	Stream           bool           `json:"stream"`
-	StreamOptions    *StreamOptions `json:"stream_options"`
-	Temperature      *float32       `json:"temperature"`
-	TopP             float32        `json:"top_p"`
-	Suffix           string         `json:"suffix"`
+	Model            string             `json:"model"`
+	Prompt           string             `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	Suffix           string             `json:"suffix"`
+	LogitBias        map[string]float64 `json:"logit_bias"`
+	N                *int               `json:"n"`
 }
 
 type Completion struct {
@@ -154,11 +173,11 @@ type CompletionChunk struct {
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
+	ID       string `json:"id,omitempty"`
 	Index    int    `json:"index"`
-	Type     string `json:"type"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
 }
@@ -198,6 +217,10 @@ func NewError(code int, message string) ErrorResponse {
 	switch code {
 	case http.StatusBadRequest:
 		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
 	case http.StatusNotFound:
 		etype = "not_found_error"
 	default:
@@ -243,17 +266,57 @@ func toToolCalls(tc []api.ToolCall) []ToolCall {
 	return toolCalls
 }
 
+// toToolCallDeltas converts the streamed parts of tool calls. Only the first
+// part of a call has its id, type and name.
+func toToolCallDeltas(deltas []api.ToolCallDelta) []ToolCall {
+	toolCalls := make([]ToolCall, len(deltas))
+	for i, d := range deltas {
+		toolCalls[i].Index = d.Index
+		if d.Name != "" {
+			toolCalls[i].ID = toolCallId()
+			toolCalls[i].Type = "function"
+			toolCalls[i].Function.Name = d.Name
+		}
+		toolCalls[i].Function.Arguments = d.Arguments
+	}
+	return toolCalls
+}
+
+func toChoiceLogprobs(logprobs []api.Logprob) *ChoiceLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	return &ChoiceLogprobs{Content: logprobs}
+}
+
+// addUsage adds the completion tokens of another choice to u. The prompt is
+// shared between choices so it is only counted once.
+func addUsage(u Usage, completionTokens int) Usage {
+	u.CompletionTokens += completionTokens
+	u.TotalTokens += completionTokens
+	return u
+}
+
+// chatChoices returns the completions in r, which is a single completion
+// unless more than one was requested
+func chatChoices(r api.ChatResponse) []api.ChatChoice {
+	if len(r.Choices) > 0 {
+		return r.Choices
+	}
+
+	return []api.ChatChoice{{Index: r.Index, Message: r.Message, DoneReason: r.DoneReason, Logprobs: r.Logprobs, EvalCount: r.EvalCount}}
+}
+
 func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
-	return ChatCompletion{
-		Id:                id,
-		Object:            "chat.completion",
-		Created:           r.CreatedAt.Unix(),
-		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
-		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+	rs := chatChoices(r)
+	choices := make([]Choice, len(rs))
+	usage := Usage{PromptTokens: r.PromptEvalCount, TotalTokens: r.PromptEvalCount}
+	for i, r := range rs {
+		toolCalls := toToolCalls(r.Message.ToolCalls)
+		choices[i] = Choice{
+			Index:   r.Index,
+			Message: Message{Role: r.Message.Role, Content: r.Message.Content, Reasoning: r.Message.Thinking, ToolCalls: toolCalls},
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -263,13 +326,25 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 				}
 				return nil
 			}(r.DoneReason),
-		}},
-		Usage: toUsage(r),
+			Logprobs: toChoiceLogprobs(r.Logprobs),
+		}
+
+		usage = addUsage(usage, r.EvalCount)
+	}
+
+	return ChatCompletion{
+		Id:                id,
+		Object:            "chat.completion",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices:           choices,
+		Usage:             usage,
 	}
 }
 
 func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChunk {
-	toolCalls := toToolCalls(r.Message.ToolCalls)
+	toolCalls := append(toToolCallDeltas(r.Message.ToolCallDeltas), toToolCalls(r.Message.ToolCalls)...)
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -277,8 +352,8 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Index: r.Index,
+			Delta: Message{Role: "assistant", Content: r.Message.Content, Reasoning: r.Message.Thinking, ToolCalls: toolCalls},
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					if toolCallSent {
@@ -288,6 +363,7 @@ func toChunk(id string, r api.ChatResponse, toolCallSent bool) ChatCompletionChu
 				}
 				return nil
 			}(r.DoneReason),
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 		}},
 	}
 }
@@ -300,24 +376,43 @@ func toUsageGenerate(r api.GenerateResponse) Usage {
 	}
 }
 
+// generateChoices returns the completions in r, which is a single completion
+// unless more than one was requested
+func generateChoices(r api.GenerateResponse) []api.GenerateChoice {
+	if len(r.Choices) > 0 {
+		return r.Choices
+	}
+
+	return []api.GenerateChoice{{Index: r.Index, Response: r.Response, DoneReason: r.DoneReason, EvalCount: r.EvalCount}}
+}
+
 func toCompletion(id string, r api.GenerateResponse) Completion {
-	return Completion{
-		Id:                id,
-		Object:            "text_completion",
-		Created:           r.CreatedAt.Unix(),
-		Model:             r.Model,
-		SystemFingerprint: "fp_ollama",
-		Choices: []CompleteChunkChoice{{
+	rs := generateChoices(r)
+	choices := make([]CompleteChunkChoice, len(rs))
+	usage := Usage{PromptTokens: r.PromptEvalCount, TotalTokens: r.PromptEvalCount}
+	for i, r := range rs {
+		choices[i] = CompleteChunkChoice{
 			Text:  r.Response,
-			Index: 0,
+			Index: r.Index,
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
 				}
 				return nil
 			}(r.DoneReason),
-		}},
-		Usage: toUsageGenerate(r),
+		}
+
+		usage = addUsage(usage, r.EvalCount)
+	}
+
+	return Completion{
+		Id:                id,
+		Object:            "text_completion",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices:           choices,
+		Usage:             usage,
 	}
 }
 
@@ -330,7 +425,7 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		SystemFingerprint: "fp_ollama",
 		Choices: []CompleteChunkChoice{{
 			Text:  r.Response,
-			Index: 0,
+			Index: r.Index,
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -397,7 +492,7 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 	for _, msg := range r.Messages {
 		switch content := msg.Content.(type) {
 		case string:
-			messages = append(messages, api.Message{Role: msg.Role, Content: content})
+			messages = append(messages, api.Message{Role: msg.Role, Content: content, Thinking: msg.Reasoning})
 		case []any:
 			for _, c := range content {
 				data, ok := c.(map[string]any)
@@ -423,24 +518,9 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 						}
 					}
 
-					types := []string{"jpeg", "jpg", "png"}
-					valid := false
-					for _, t := range types {
-						prefix := "data:image/" + t + ";base64,"
-						if strings.HasPrefix(url, prefix) {
-							url = strings.TrimPrefix(url, prefix)
-							valid = true
-							break
-						}
-					}
-
-					if !valid {
-						return nil, errors.New("invalid image input")
-					}
-
-					img, err := base64.StdEncoding.DecodeString(url)
+					img, err := fromImageURL(url)
 					if err != nil {
-						return nil, errors.New("invalid message format")
+						return nil, err
 					}
 
 					messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
@@ -508,6 +588,30 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	if r.TopLogprobs != nil {
+		if r.Logprobs == nil || !*r.Logprobs {
+			return nil, errors.New("logprobs must be set to true to use top_logprobs")
+		}
+
+		if *r.TopLogprobs < 0 || *r.TopLogprobs > llm.MaxTopLogprobs {
+			return nil, fmt.Errorf("top_logprobs must be between 0 and %d", llm.MaxTopLogprobs)
+		}
+
+		options["top_logprobs"] = *r.TopLogprobs
+	}
+
+	if r.Logprobs != nil && *r.Logprobs {
+		options["logprobs"] = true
+	}
+
+	if r.LogitBias != nil {
+		bias, err := fromLogitBias(r.LogitBias)
+		if err != nil {
+			return nil, err
+		}
+		options["logit_bias"] = bias
+	}
+
 	var format json.RawMessage
 	if r.ResponseFormat != nil {
 		switch strings.ToLower(strings.TrimSpace(r.ResponseFormat.Type)) {
@@ -521,16 +625,75 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		}
 	}
 
+	think, err := fromReasoningEffort(r.ReasoningEffort)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := fromN(r.N)
+	if err != nil {
+		return nil, err
+	}
+
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:             r.Model,
+		Messages:          messages,
+		Format:            format,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             r.Tools,
+		ToolChoice:        r.ToolChoice,
+		ParallelToolCalls: r.ParallelToolCalls,
+		Think:             think,
+		N:                 n,
 	}, nil
 }
 
+// fromImageURL decodes an image sent as a base64 data URL
+func fromImageURL(url string) (api.ImageData, error) {
+	types := []string{"jpeg", "jpg", "png"}
+	valid := false
+	for _, t := range types {
+		prefix := "data:image/" + t + ";base64,"
+		if strings.HasPrefix(url, prefix) {
+			url = strings.TrimPrefix(url, prefix)
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return nil, errors.New("invalid image input")
+	}
+
+	img, err := base64.StdEncoding.DecodeString(url)
+	if err != nil {
+		return nil, errors.New("invalid message format")
+	}
+
+	return img, nil
+}
+
+// fromReasoningEffort converts a reasoning effort to whether thinking is
+// enabled. The effort only toggles thinking since ollama models don't
+// support varying levels of effort.
+func fromReasoningEffort(effort *string) (*bool, error) {
+	if effort == nil {
+		return nil, nil
+	}
+
+	var think bool
+	switch *effort {
+	case "none":
+	case "minimal", "low", "medium", "high":
+		think = true
+	default:
+		return nil, fmt.Errorf("invalid reasoning_effort: %q", *effort)
+	}
+
+	return &think, nil
+}
+
 func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 	options := make(map[string]any)
 
@@ -573,15 +736,61 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
+	if r.LogitBias != nil {
+		bias, err := fromLogitBias(r.LogitBias)
+		if err != nil {
+			return api.GenerateRequest{}, err
+		}
+		options["logit_bias"] = bias
+	}
+
+	n, err := fromN(r.N)
+	if err != nil {
+		return api.GenerateRequest{}, err
+	}
+
 	return api.GenerateRequest{
 		Model:   r.Model,
 		Prompt:  r.Prompt,
 		Options: options,
 		Stream:  &r.Stream,
 		Suffix:  r.Suffix,
+		N:       n,
 	}, nil
 }
 
+// fromN validates the number of choices to generate for a request
+func fromN(n *int) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+
+	if *n < 1 {
+		return 0, fmt.Errorf("invalid n: %d, must be at least 1", *n)
+	}
+
+	return *n, nil
+}
+
+// fromLogitBias validates an OpenAI logit_bias map of token ids to biases
+// between -100 and 100 and converts it into the logit_bias option
+func fromLogitBias(logitBias map[string]float64) (map[string]any, error) {
+	bias := make(map[string]any, len(logitBias))
+	for k, v := range logitBias {
+		if _, err := strconv.ParseInt(k, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid token id in logit_bias: %q", k)
+		}
+
+		if v < -100 || v > 100 {
+			return nil, fmt.Errorf("logit_bias value for token %s must be between -100 and 100", k)
+		}
+
+		bias[k] = v
+	}
+
+	return bias, nil
+}
+
 type BaseWriter struct {
 	gin.ResponseWriter
 }
@@ -590,8 +799,20 @@ type ChatWriter struct {
 	stream        bool
 	streamOptions *StreamOptions
 	id            string
-	toolCallSent  bool
 	BaseWriter
+
+	// number of choices being generated
+	n int
+
+	// choices that have sent a tool call, by index
+	toolCallSent map[int]bool
+
+	// tool calls that were streamed as deltas, by choice and tool call index
+	toolCallStreamed map[[2]int]bool
+
+	// number of finished choices and their usage when streaming
+	done  int
+	usage Usage
 }
 
 type CompleteWriter struct {
@@ -599,6 +820,13 @@ type CompleteWriter struct {
 	streamOptions *StreamOptions
 	id            string
 	BaseWriter
+
+	// number of choices being generated
+	n int
+
+	// number of finished choices and their usage when streaming
+	done  int
+	usage Usage
 }
 
 type ListWriter struct {
@@ -638,15 +866,31 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 
+	// the OpenAI API has no way to report the queue position
+	if chatResponse.QueuePosition > 0 {
+		return len(data), nil
+	}
+
 	// chat chunk
 	if w.stream {
-		c := toChunk(w.id, chatResponse, w.toolCallSent)
+		// tool calls that were streamed as deltas aren't sent again once
+		// they're complete
+		for _, d := range chatResponse.Message.ToolCallDeltas {
+			if d.Name != "" {
+				w.toolCallStreamed[[2]int{chatResponse.Index, d.Index}] = true
+			}
+		}
+		chatResponse.Message.ToolCalls = slices.DeleteFunc(chatResponse.Message.ToolCalls, func(tc api.ToolCall) bool {
+			return w.toolCallStreamed[[2]int{chatResponse.Index, tc.Function.Index}]
+		})
+
+		c := toChunk(w.id, chatResponse, w.toolCallSent[chatResponse.Index])
 		d, err := json.Marshal(c)
 		if err != nil {
 			return 0, err
 		}
-		if !w.toolCallSent && len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
-			w.toolCallSent = true
+		if len(c.Choices) > 0 && len(c.Choices[0].Delta.ToolCalls) > 0 {
+			w.toolCallSent[chatResponse.Index] = true
 		}
 
 		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
@@ -656,8 +900,20 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		}
 
 		if chatResponse.Done {
+			// the stream ends once every choice is done
+			w.done++
+			if w.done == 1 {
+				w.usage = toUsage(chatResponse)
+			} else {
+				w.usage = addUsage(w.usage, chatResponse.EvalCount)
+			}
+
+			if w.done < w.n {
+				return len(data), nil
+			}
+
 			if w.streamOptions != nil && w.streamOptions.IncludeUsage {
-				u := toUsage(chatResponse)
+				u := w.usage
 				c.Usage = &u
 				c.Choices = []ChunkChoice{}
 				d, err := json.Marshal(c)
@@ -678,7 +934,7 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		return len(data), nil
 	}
 
-	// chat completion
+	// chat completion, with every choice in one response
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w.ResponseWriter).Encode(toChatCompletion(w.id, chatResponse))
 	if err != nil {
@@ -704,6 +960,11 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 
+	// the OpenAI API has no way to report the queue position
+	if generateResponse.QueuePosition > 0 {
+		return len(data), nil
+	}
+
 	// completion chunk
 	if w.stream {
 		c := toCompleteChunk(w.id, generateResponse)
@@ -722,8 +983,20 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		}
 
 		if generateResponse.Done {
+			// the stream ends once every choice is done
+			w.done++
+			if w.done == 1 {
+				w.usage = toUsageGenerate(generateResponse)
+			} else {
+				w.usage = addUsage(w.usage, generateResponse.EvalCount)
+			}
+
+			if w.done < w.n {
+				return len(data), nil
+			}
+
 			if w.streamOptions != nil && w.streamOptions.IncludeUsage {
-				u := toUsageGenerate(generateResponse)
+				u := w.usage
 				c.Usage = &u
 				c.Choices = []CompleteChunkChoice{}
 				d, err := json.Marshal(c)
@@ -744,7 +1017,7 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		return len(data), nil
 	}
 
-	// completion
+	// completion, with every choice in one response
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w.ResponseWriter).Encode(toCompletion(w.id, generateResponse))
 	if err != nil {
@@ -901,6 +1174,7 @@ func CompletionsMiddleware() gin.HandlerFunc {
 			stream:        req.Stream,
 			id:            fmt.Sprintf("cmpl-%d", rand.Intn(999)),
 			streamOptions: req.StreamOptions,
+			n:             max(genReq.N, 1),
 		}
 
 		c.Writer = w
@@ -980,10 +1254,13 @@ func ChatMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &ChatWriter{
-			BaseWriter:    BaseWriter{ResponseWriter: c.Writer},
-			stream:        req.Stream,
-			id:            fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
-			streamOptions: req.StreamOptions,
+			BaseWriter:       BaseWriter{ResponseWriter: c.Writer},
+			stream:           req.Stream,
+			id:               fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			streamOptions:    req.StreamOptions,
+			n:                max(chatReq.N, 1),
+			toolCallSent:     make(map[int]bool),
+			toolCallStreamed: make(map[[2]int]bool),
 		}
 
 		c.Writer = w
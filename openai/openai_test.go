@@ -235,6 +235,33 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "chat handler with tool_choice",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "What's the weather like in Paris?"}
+				],
+				"tool_choice": {"type": "function", "function": {"name": "get_weather"}},
+				"parallel_tool_calls": false
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "What's the weather like in Paris?",
+					},
+				},
+				ToolChoice:        &api.ToolChoice{Function: "get_weather"},
+				ParallelToolCalls: &False,
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
 		{
 			name: "chat handler with streaming tools",
 			body: `{
@@ -319,6 +346,187 @@ func TestChatMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "chat handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logprobs": true,
+				"top_logprobs": 5
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature":  1.0,
+					"top_p":        1.0,
+					"logprobs":     true,
+					"top_logprobs": 5.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with top_logprobs but no logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"top_logprobs": 5
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "logprobs must be set to true to use top_logprobs",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with reasoning",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"},
+					{"role": "assistant", "content": "Hi", "reasoning_content": "The user said hello"},
+					{"role": "user", "content": "How are you?"}
+				],
+				"reasoning_effort": "high"
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+					{
+						Role:     "assistant",
+						Content:  "Hi",
+						Thinking: "The user said hello",
+					},
+					{
+						Role:    "user",
+						Content: "How are you?",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				Think:  &True,
+			},
+		},
+		{
+			name: "chat handler with invalid reasoning effort",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"reasoning_effort": "extreme"
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid reasoning_effort: \"extreme\"",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with logit_bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Is the sky blue? Answer yes or no."}
+				],
+				"logit_bias": {"9642": 100, "2822": 100, "128001": -100}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Is the sky blue? Answer yes or no.",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+					"logit_bias": map[string]any{
+						"9642":   100.0,
+						"2822":   100.0,
+						"128001": -100.0,
+					},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with out of range logit_bias",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"logit_bias": {"9642": 101}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "logit_bias value for token 9642 must be between -100 and 100",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with n",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"n": 3
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				N:      3,
+			},
+		},
+		{
+			name: "chat handler with invalid n",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"n": 0
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid n: 0, must be at least 1",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "chat handler error forwarding",
 			body: `{
@@ -455,6 +663,60 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &True,
 			},
 		},
+		{
+			name: "completions handler with logit_bias",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"50256": -100}
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+					"logit_bias":        map[string]any{"50256": -100.0},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "completions handler with invalid logit_bias token",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"eos": -100}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid token id in logit_bias: \"eos\"",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "completions handler with n",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"n": 2
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream: &False,
+				N:      2,
+			},
+		},
 		{
 			name: "completions handler error forwarding",
 			body: `{
@@ -510,6 +772,164 @@ func TestCompletionsMiddleware(t *testing.T) {
 	}
 }
 
+func TestChatWriterChoices(t *testing.T) {
+	endpoint := func(c *gin.Context) {
+		rs := []api.ChatResponse{
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "b"}, Index: 1, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "a"}, Index: 0, Done: true, DoneReason: "length", Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 3}},
+		}
+
+		var req api.ChatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		// non-streamed completions are returned together, in order
+		if req.Stream != nil && !*req.Stream {
+			r := rs[1]
+			r.Choices = []api.ChatChoice{
+				{Index: 0, Message: rs[1].Message, DoneReason: rs[1].DoneReason, EvalCount: rs[1].EvalCount},
+				{Index: 1, Message: rs[0].Message, DoneReason: rs[0].DoneReason, EvalCount: rs[0].EvalCount},
+			}
+			c.JSON(http.StatusOK, r)
+			return
+		}
+
+		c.Status(http.StatusOK)
+		for _, r := range rs {
+			bts, _ := json.Marshal(r)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ChatMiddleware())
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	t.Run("non-streaming", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "n": 2}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		var completion ChatCompletion
+		if err := json.Unmarshal(resp.Body.Bytes(), &completion); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(completion.Choices) != 2 {
+			t.Fatalf("expected 2 choices, got %d", len(completion.Choices))
+		}
+
+		for i, want := range []struct {
+			index   int
+			content string
+		}{{0, "a"}, {1, "b"}} {
+			choice := completion.Choices[i]
+			if choice.Index != want.index || choice.Message.Content != want.content {
+				t.Errorf("choice %d: got index %d and content %q", i, choice.Index, choice.Message.Content)
+			}
+		}
+
+		if diff := cmp.Diff(Usage{PromptTokens: 5, CompletionTokens: 5, TotalTokens: 10}, completion.Usage); diff != "" {
+			t.Errorf("usage mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "n": 2, "stream": true, "stream_options": {"include_usage": true}}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+		if len(events) != 4 {
+			t.Fatalf("expected 2 chunks, usage and [DONE], got %q", events)
+		}
+
+		if events[3] != "data: [DONE]" {
+			t.Errorf("expected the stream to end after both choices, got %q", events[3])
+		}
+
+		var usage ChatCompletionChunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(events[2], "data: ")), &usage); err != nil {
+			t.Fatal(err)
+		}
+
+		if usage.Usage == nil || usage.Usage.CompletionTokens != 5 {
+			t.Errorf("expected usage summed over choices, got %+v", usage.Usage)
+		}
+	})
+}
+
+func TestChatWriterToolCallDeltas(t *testing.T) {
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		for _, r := range []api.ChatResponse{
+			{Model: "test-model", Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location": `}}}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", ToolCallDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `"Paris"}`}}, ToolCalls: []api.ToolCall{
+				{Function: api.ToolCallFunction{Index: 0, Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": "Paris"}}},
+				{Function: api.ToolCallFunction{Index: 1, Name: "get_time", Arguments: api.ToolCallFunctionArguments{}}},
+			}}},
+			{Model: "test-model", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop"},
+		} {
+			bts, _ := json.Marshal(r)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ChatMiddleware())
+	router.Handle(http.MethodPost, "/api/chat", endpoint)
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "test-model", "messages": [{"role": "user", "content": "Hello"}], "stream": true}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	var chunks []ChatCompletionChunk
+	for _, e := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+		if e == "data: [DONE]" {
+			break
+		}
+
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(e, "data: ")), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+
+	first := chunks[0].Choices[0].Delta.ToolCalls
+	if len(first) != 1 || !strings.HasPrefix(first[0].ID, "call_") || first[0].Type != "function" || first[0].Function.Name != "get_weather" || first[0].Function.Arguments != `{"location": ` {
+		t.Errorf("unexpected first delta %+v", first)
+	}
+
+	// the call that was streamed isn't sent again, but the one that wasn't is
+	second := chunks[1].Choices[0].Delta.ToolCalls
+	if len(second) != 2 || second[0].ID != "" || second[0].Function.Name != "" || second[0].Function.Arguments != `"Paris"}` {
+		t.Errorf("unexpected second delta %+v", second)
+	}
+
+	if second[1].Index != 1 || second[1].ID == "" || second[1].Function.Name != "get_time" || second[1].Function.Arguments != "{}" {
+		t.Errorf("unexpected complete tool call %+v", second[1])
+	}
+
+	if reason := chunks[2].Choices[0].FinishReason; reason == nil || *reason != "tool_calls" {
+		t.Errorf("expected finish reason tool_calls, got %v", reason)
+	}
+}
+
 func TestEmbeddingsMiddleware(t *testing.T) {
 	type testCase struct {
 		name string
@@ -0,0 +1,885 @@
+package openai
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"`
+	Instructions       *string           `json:"instructions"`
+	Tools              []ResponsesTool   `json:"tools"`
+	ToolChoice         any               `json:"tool_choice"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store"`
+	PreviousResponseId string            `json:"previous_response_id"`
+	MaxOutputTokens    *int              `json:"max_output_tokens"`
+	Temperature        *float64          `json:"temperature"`
+	TopP               *float64          `json:"top_p"`
+	Text               *ResponsesText    `json:"text"`
+	Reasoning          *ResponsesEffort  `json:"reasoning"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+// ResponsesTool is a tool the model may call. Only function tools are
+// supported.
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type ResponsesText struct {
+	Format *ResponsesTextFormat `json:"format,omitempty"`
+}
+
+type ResponsesTextFormat struct {
+	Type   string          `json:"type"`
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+	Strict *bool           `json:"strict,omitempty"`
+}
+
+type ResponsesEffort struct {
+	Effort *string `json:"effort"`
+}
+
+// ResponsesInputItem is an item of a request's input: a message, a function
+// call made by the model in a previous turn, the output of that call, or the
+// model's reasoning
+type ResponsesInputItem struct {
+	Type      string                 `json:"type"`
+	Role      string                 `json:"role"`
+	Content   json.RawMessage        `json:"content"`
+	CallId    string                 `json:"call_id"`
+	Name      string                 `json:"name"`
+	Arguments string                 `json:"arguments"`
+	Output    json.RawMessage        `json:"output"`
+	Summary   []ResponsesSummaryText `json:"summary"`
+}
+
+type Response struct {
+	Id                 string             `json:"id"`
+	Object             string             `json:"object"`
+	CreatedAt          int64              `json:"created_at"`
+	Status             string             `json:"status"`
+	Error              *Error             `json:"error"`
+	IncompleteDetails  *IncompleteDetails `json:"incomplete_details"`
+	Instructions       *string            `json:"instructions"`
+	MaxOutputTokens    *int               `json:"max_output_tokens"`
+	Model              string             `json:"model"`
+	Output             []any              `json:"output"`
+	ParallelToolCalls  bool               `json:"parallel_tool_calls"`
+	PreviousResponseId *string            `json:"previous_response_id"`
+	Store              bool               `json:"store"`
+	Temperature        *float64           `json:"temperature"`
+	TopP               *float64           `json:"top_p"`
+	ToolChoice         any                `json:"tool_choice"`
+	Tools              []ResponsesTool    `json:"tools"`
+	Usage              *ResponsesUsage    `json:"usage"`
+	Metadata           map[string]string  `json:"metadata"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type ResponsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+// ResponsesMessage is an output item holding the text generated by the model
+type ResponsesMessage struct {
+	Type    string                `json:"type"`
+	Id      string                `json:"id"`
+	Status  string                `json:"status"`
+	Role    string                `json:"role"`
+	Content []ResponsesOutputText `json:"content"`
+}
+
+type ResponsesOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+// ResponsesReasoning is an output item holding the model's thinking
+type ResponsesReasoning struct {
+	Type    string                 `json:"type"`
+	Id      string                 `json:"id"`
+	Summary []ResponsesSummaryText `json:"summary"`
+}
+
+type ResponsesSummaryText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// ResponsesFunctionCall is an output item holding a tool call
+type ResponsesFunctionCall struct {
+	Type      string `json:"type"`
+	Id        string `json:"id"`
+	CallId    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+type ResponseDeleted struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// responseId returns a random id for a response or output item, such as
+// "resp_" followed by 48 hex digits
+func responseId(prefix string) string {
+	b := make([]byte, 24)
+	rand.Read(b) //nolint:errcheck
+	return prefix + hex.EncodeToString(b)
+}
+
+// fromResponsesContent converts the content of an input message, which is
+// either a string or a list of text and image parts
+func fromResponsesContent(raw json.RawMessage) (string, []api.ImageData, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil, nil
+	}
+
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Refusal  string `json:"refusal"`
+		ImageURL string `json:"image_url"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, errors.New("invalid message content")
+	}
+
+	var texts []string
+	var images []api.ImageData
+	for _, p := range parts {
+		switch p.Type {
+		case "input_text", "output_text":
+			texts = append(texts, p.Text)
+		case "refusal":
+			texts = append(texts, p.Refusal)
+		case "input_image":
+			img, err := fromImageURL(p.ImageURL)
+			if err != nil {
+				return "", nil, err
+			}
+			images = append(images, img)
+		default:
+			return "", nil, fmt.Errorf("unsupported content type: %q", p.Type)
+		}
+	}
+
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// fromResponsesInput converts a request's input, which is either a string or
+// a list of input items, to messages
+func fromResponsesInput(raw json.RawMessage) ([]api.Message, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []api.Message{{Role: "user", Content: s}}, nil
+	}
+
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, errors.New("invalid input: must be a string or a list of items")
+	}
+
+	var messages []api.Message
+	// reasoning items precede the assistant message they belong to
+	var thinking string
+	for _, item := range items {
+		switch item.Type {
+		case "message", "":
+			content, images, err := fromResponsesContent(item.Content)
+			if err != nil {
+				return nil, err
+			}
+
+			role := item.Role
+			switch role {
+			case "developer":
+				role = "system"
+			case "user", "assistant", "system":
+			default:
+				return nil, fmt.Errorf("invalid message role: %q", item.Role)
+			}
+
+			msg := api.Message{Role: role, Content: content, Images: images}
+			if role == "assistant" {
+				msg.Thinking, thinking = thinking, ""
+			}
+			messages = append(messages, msg)
+		case "reasoning":
+			for _, s := range item.Summary {
+				thinking += s.Text
+			}
+		case "function_call":
+			var tc api.ToolCall
+			tc.Function.Name = item.Name
+			if err := json.Unmarshal([]byte(item.Arguments), &tc.Function.Arguments); err != nil {
+				return nil, errors.New("invalid tool call arguments")
+			}
+
+			// the calls and text of a turn are a single assistant message
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, tc)
+			} else {
+				messages = append(messages, api.Message{Role: "assistant", Thinking: thinking, ToolCalls: []api.ToolCall{tc}})
+				thinking = ""
+			}
+		case "function_call_output":
+			output, _, err := fromResponsesContent(item.Output)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, api.Message{Role: "tool", Content: output})
+		default:
+			return nil, fmt.Errorf("unsupported input item type: %q", item.Type)
+		}
+	}
+
+	return messages, nil
+}
+
+func fromResponsesTools(tools []ResponsesTool) ([]api.Tool, error) {
+	var apiTools []api.Tool
+	for _, t := range tools {
+		if t.Type != "function" {
+			return nil, fmt.Errorf("unsupported tool type: %q", t.Type)
+		}
+
+		tool := api.Tool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		if len(t.Parameters) > 0 {
+			if err := json.Unmarshal(t.Parameters, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("invalid parameters for tool %q: %w", t.Name, err)
+			}
+		}
+
+		apiTools = append(apiTools, tool)
+	}
+
+	return apiTools, nil
+}
+
+// fromResponsesRequest converts r to a chat request. history holds the
+// messages of the responses r continues from.
+func fromResponsesRequest(r ResponsesRequest, history []api.Message) (*api.ChatRequest, []api.Message, error) {
+	input, err := fromResponsesInput(r.Input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// instructions only apply to this response, so they aren't part of the
+	// history of later ones
+	var messages []api.Message
+	if r.Instructions != nil && *r.Instructions != "" {
+		messages = append(messages, api.Message{Role: "system", Content: *r.Instructions})
+	}
+	messages = append(messages, history...)
+	messages = append(messages, input...)
+
+	tools, err := fromResponsesTools(r.Tools)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	toolChoice, err := fromResponsesToolChoice(r.ToolChoice)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options := make(map[string]any)
+
+	if r.MaxOutputTokens != nil {
+		options["num_predict"] = *r.MaxOutputTokens
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	} else {
+		options["temperature"] = 1.0
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	} else {
+		options["top_p"] = 1.0
+	}
+
+	var format json.RawMessage
+	if r.Text != nil && r.Text.Format != nil {
+		switch r.Text.Format.Type {
+		case "json_object":
+			format = json.RawMessage(`"json"`)
+		case "json_schema":
+			format = r.Text.Format.Schema
+		}
+	}
+
+	var think *bool
+	if r.Reasoning != nil {
+		think, err = fromReasoningEffort(r.Reasoning.Effort)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &api.ChatRequest{
+		Model:             r.Model,
+		Messages:          messages,
+		Format:            format,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             tools,
+		ToolChoice:        toolChoice,
+		ParallelToolCalls: r.ParallelToolCalls,
+		Think:             think,
+	}, input, nil
+}
+
+// fromResponsesToolChoice converts a tool choice, which is either a mode or
+// a function of the form {"type": "function", "name": "..."}
+func fromResponsesToolChoice(v any) (*api.ToolChoice, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch v {
+		case api.ToolChoiceAuto, api.ToolChoiceNone, api.ToolChoiceRequired:
+			return &api.ToolChoice{Mode: v}, nil
+		}
+	case map[string]any:
+		if name, ok := v["name"].(string); ok && v["type"] == "function" && name != "" {
+			return &api.ToolChoice{Function: name}, nil
+		}
+	}
+
+	return nil, errors.New(`invalid tool_choice: expected "auto", "none", "required" or a function`)
+}
+
+type storedResponse struct {
+	response Response
+	owner    string
+
+	// messages holds the input and output of the response, but not those of
+	// the responses it continues from
+	messages []api.Message
+}
+
+// ResponseStore holds recent responses so that later requests can continue
+// from them with previous_response_id. The least recently used responses
+// are evicted once the store is full.
+type ResponseStore struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// owner identifies who a request is made by. Responses can only be
+	// retrieved, deleted or continued by their owner.
+	owner func(*gin.Context) string
+}
+
+// NewResponseStore returns a store that holds up to size responses. owner
+// identifies who each request is made by, or is nil if every request may
+// access every response.
+func NewResponseStore(size int, owner func(*gin.Context) string) *ResponseStore {
+	if owner == nil {
+		owner = func(*gin.Context) string { return "" }
+	}
+
+	return &ResponseStore{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		owner:   owner,
+	}
+}
+
+func (s *ResponseStore) put(r Response, owner string, messages []api.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[r.Id] = s.lru.PushFront(&storedResponse{response: r, owner: owner, messages: messages})
+	for s.lru.Len() > s.size {
+		e := s.lru.Back()
+		s.lru.Remove(e)
+		delete(s.entries, e.Value.(*storedResponse).response.Id)
+	}
+}
+
+// get returns the response id if it's owned by owner. Responses of other
+// owners are reported as not found so their ids aren't revealed.
+func (s *ResponseStore) get(id, owner string) (*storedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	if !ok || e.Value.(*storedResponse).owner != owner {
+		return nil, false
+	}
+
+	s.lru.MoveToFront(e)
+	return e.Value.(*storedResponse), true
+}
+
+func (s *ResponseStore) delete(id, owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[id]
+	ok = ok && e.Value.(*storedResponse).owner == owner
+	if ok {
+		s.lru.Remove(e)
+		delete(s.entries, id)
+	}
+
+	return ok
+}
+
+// history returns the messages of the response id and every response it
+// continues from, oldest first
+func (s *ResponseStore) history(id, owner string) ([]api.Message, error) {
+	var chain [][]api.Message
+	for id != "" {
+		r, ok := s.get(id, owner)
+		if !ok {
+			return nil, fmt.Errorf("previous response with id '%s' not found", id)
+		}
+
+		chain = append(chain, r.messages)
+		id = ""
+		if r.response.PreviousResponseId != nil {
+			id = *r.response.PreviousResponseId
+		}
+	}
+
+	var messages []api.Message
+	for i := len(chain) - 1; i >= 0; i-- {
+		messages = append(messages, chain[i]...)
+	}
+
+	return messages, nil
+}
+
+func (s *ResponseStore) RetrieveHandler(c *gin.Context) {
+	r, ok := s.get(c.Param("id"), s.owner(c))
+	if !ok {
+		c.JSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("response with id '%s' not found", c.Param("id"))))
+		return
+	}
+
+	c.JSON(http.StatusOK, r.response)
+}
+
+func (s *ResponseStore) DeleteHandler(c *gin.Context) {
+	if !s.delete(c.Param("id"), s.owner(c)) {
+		c.JSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("response with id '%s' not found", c.Param("id"))))
+		return
+	}
+
+	c.JSON(http.StatusOK, ResponseDeleted{Id: c.Param("id"), Object: "response", Deleted: true})
+}
+
+// ResponsesWriter converts chat responses to a response object, or to the
+// semantic events of the Responses API when streaming
+type ResponsesWriter struct {
+	BaseWriter
+	stream bool
+	store  *ResponseStore
+	owner  string
+
+	response Response
+	input    []api.Message
+	output   api.Message
+
+	// the reasoning and message items being generated, if any
+	reasoning *ResponsesReasoning
+	message   *ResponsesMessage
+
+	started  bool
+	sequence int
+}
+
+func (w *ResponsesWriter) event(typ string, fields map[string]any) error {
+	if !w.stream {
+		return nil
+	}
+
+	fields["type"] = typ
+	fields["sequence_number"] = w.sequence
+	w.sequence++
+
+	d, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", typ, d)))
+	return err
+}
+
+// addItem adds an item to the output and sends its output_item.added event
+func (w *ResponsesWriter) addItem(item any) error {
+	w.response.Output = append(w.response.Output, item)
+	return w.event("response.output_item.added", map[string]any{"output_index": len(w.response.Output) - 1, "item": item})
+}
+
+func (w *ResponsesWriter) itemDone(item any) error {
+	return w.event("response.output_item.done", map[string]any{"output_index": len(w.response.Output) - 1, "item": item})
+}
+
+func (w *ResponsesWriter) writeThinking(delta string) error {
+	if w.reasoning == nil {
+		if err := w.closeItems(); err != nil {
+			return err
+		}
+
+		w.reasoning = &ResponsesReasoning{Type: "reasoning", Id: responseId("rs_"), Summary: []ResponsesSummaryText{}}
+		if err := w.addItem(w.reasoning); err != nil {
+			return err
+		}
+
+		w.reasoning.Summary = append(w.reasoning.Summary, ResponsesSummaryText{Type: "summary_text"})
+		if err := w.event("response.reasoning_summary_part.added", map[string]any{
+			"item_id":       w.reasoning.Id,
+			"output_index":  len(w.response.Output) - 1,
+			"summary_index": 0,
+			"part":          w.reasoning.Summary[0],
+		}); err != nil {
+			return err
+		}
+	}
+
+	w.reasoning.Summary[0].Text += delta
+	w.output.Thinking += delta
+	return w.event("response.reasoning_summary_text.delta", map[string]any{
+		"item_id":       w.reasoning.Id,
+		"output_index":  len(w.response.Output) - 1,
+		"summary_index": 0,
+		"delta":         delta,
+	})
+}
+
+func (w *ResponsesWriter) writeContent(delta string) error {
+	if w.message == nil {
+		if err := w.closeItems(); err != nil {
+			return err
+		}
+
+		w.message = &ResponsesMessage{Type: "message", Id: responseId("msg_"), Status: "in_progress", Role: "assistant", Content: []ResponsesOutputText{}}
+		if err := w.addItem(w.message); err != nil {
+			return err
+		}
+
+		w.message.Content = append(w.message.Content, ResponsesOutputText{Type: "output_text", Annotations: []any{}})
+		if err := w.event("response.content_part.added", map[string]any{
+			"item_id":       w.message.Id,
+			"output_index":  len(w.response.Output) - 1,
+			"content_index": 0,
+			"part":          w.message.Content[0],
+		}); err != nil {
+			return err
+		}
+	}
+
+	w.message.Content[0].Text += delta
+	w.output.Content += delta
+	return w.event("response.output_text.delta", map[string]any{
+		"item_id":       w.message.Id,
+		"output_index":  len(w.response.Output) - 1,
+		"content_index": 0,
+		"delta":         delta,
+	})
+}
+
+func (w *ResponsesWriter) writeToolCalls(toolCalls []api.ToolCall) error {
+	if err := w.closeItems(); err != nil {
+		return err
+	}
+
+	for _, tc := range toToolCalls(toolCalls) {
+		item := &ResponsesFunctionCall{Type: "function_call", Id: responseId("fc_"), CallId: tc.ID, Name: tc.Function.Name, Status: "in_progress"}
+		if err := w.addItem(item); err != nil {
+			return err
+		}
+
+		item.Arguments = tc.Function.Arguments
+		item.Status = "completed"
+		for _, e := range []struct {
+			typ    string
+			fields map[string]any
+		}{
+			{"response.function_call_arguments.delta", map[string]any{"item_id": item.Id, "output_index": len(w.response.Output) - 1, "delta": item.Arguments}},
+			{"response.function_call_arguments.done", map[string]any{"item_id": item.Id, "output_index": len(w.response.Output) - 1, "arguments": item.Arguments}},
+		} {
+			if err := w.event(e.typ, e.fields); err != nil {
+				return err
+			}
+		}
+
+		if err := w.itemDone(item); err != nil {
+			return err
+		}
+	}
+
+	w.output.ToolCalls = append(w.output.ToolCalls, toolCalls...)
+	return nil
+}
+
+// closeItems finishes the reasoning or message item being generated
+func (w *ResponsesWriter) closeItems() error {
+	if r := w.reasoning; r != nil {
+		w.reasoning = nil
+		fields := map[string]any{"item_id": r.Id, "output_index": len(w.response.Output) - 1, "summary_index": 0}
+		if err := w.event("response.reasoning_summary_text.done", merge(fields, "text", r.Summary[0].Text)); err != nil {
+			return err
+		}
+		if err := w.event("response.reasoning_summary_part.done", merge(fields, "part", r.Summary[0])); err != nil {
+			return err
+		}
+		if err := w.itemDone(r); err != nil {
+			return err
+		}
+	}
+
+	if m := w.message; m != nil {
+		w.message = nil
+		m.Status = "completed"
+		fields := map[string]any{"item_id": m.Id, "output_index": len(w.response.Output) - 1, "content_index": 0}
+		if err := w.event("response.output_text.done", merge(fields, "text", m.Content[0].Text)); err != nil {
+			return err
+		}
+		if err := w.event("response.content_part.done", merge(fields, "part", m.Content[0])); err != nil {
+			return err
+		}
+		if err := w.itemDone(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// merge returns a copy of fields with key set to v
+func merge(fields map[string]any, key string, v any) map[string]any {
+	m := map[string]any{key: v}
+	for k, v := range fields {
+		m[k] = v
+	}
+	return m
+}
+
+func (w *ResponsesWriter) writeResponse(data []byte) (int, error) {
+	var chatResponse api.ChatResponse
+	err := json.Unmarshal(data, &chatResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	// the OpenAI API has no way to report the queue position
+	if chatResponse.QueuePosition > 0 {
+		return len(data), nil
+	}
+
+	if !w.started {
+		w.started = true
+		if err := w.event("response.created", map[string]any{"response": w.response}); err != nil {
+			return 0, err
+		}
+		if err := w.event("response.in_progress", map[string]any{"response": w.response}); err != nil {
+			return 0, err
+		}
+	}
+
+	if chatResponse.Message.Thinking != "" {
+		if err := w.writeThinking(chatResponse.Message.Thinking); err != nil {
+			return 0, err
+		}
+	}
+
+	if chatResponse.Message.Content != "" {
+		if err := w.writeContent(chatResponse.Message.Content); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(chatResponse.Message.ToolCalls) > 0 {
+		if err := w.writeToolCalls(chatResponse.Message.ToolCalls); err != nil {
+			return 0, err
+		}
+	}
+
+	if !chatResponse.Done {
+		return len(data), nil
+	}
+
+	if err := w.closeItems(); err != nil {
+		return 0, err
+	}
+
+	w.response.Status = "completed"
+	if chatResponse.DoneReason == "length" {
+		w.response.Status = "incomplete"
+		w.response.IncompleteDetails = &IncompleteDetails{Reason: "max_output_tokens"}
+	}
+
+	w.response.Usage = &ResponsesUsage{
+		InputTokens:  chatResponse.PromptEvalCount,
+		OutputTokens: chatResponse.EvalCount,
+		TotalTokens:  chatResponse.PromptEvalCount + chatResponse.EvalCount,
+	}
+
+	if w.response.Store {
+		w.store.put(w.response, w.owner, append(w.input, w.output))
+	}
+
+	if w.stream {
+		if err := w.event("response."+w.response.Status, map[string]any{"response": w.response}); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(w.response)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *ResponsesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// ResponsesMiddleware serves the Responses API with the chat handler.
+// Responses are saved to store, unless the request sets store to false, so
+// that later requests can continue from them.
+func ResponsesMiddleware(store *ResponseStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResponsesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if len(req.Input) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "missing required parameter: 'input'"))
+			return
+		}
+
+		owner := store.owner(c)
+		history, err := store.history(req.PreviousResponseId, owner)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, err.Error()))
+			return
+		}
+
+		chatReq, input, err := fromResponsesRequest(req, history)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		response := Response{
+			Id:                responseId("resp_"),
+			Object:            "response",
+			CreatedAt:         time.Now().Unix(),
+			Status:            "in_progress",
+			Instructions:      req.Instructions,
+			MaxOutputTokens:   req.MaxOutputTokens,
+			Model:             req.Model,
+			Output:            []any{},
+			ParallelToolCalls: req.ParallelToolCalls == nil || *req.ParallelToolCalls,
+			Store:             req.Store == nil || *req.Store,
+			Temperature:       req.Temperature,
+			TopP:              req.TopP,
+			ToolChoice:        req.ToolChoice,
+			Tools:             req.Tools,
+			Metadata:          req.Metadata,
+		}
+
+		if req.PreviousResponseId != "" {
+			response.PreviousResponseId = &req.PreviousResponseId
+		}
+
+		if response.ToolChoice == nil {
+			response.ToolChoice = "auto"
+		}
+
+		if response.Tools == nil {
+			response.Tools = []ResponsesTool{}
+		}
+
+		w := &ResponsesWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			stream:     req.Stream,
+			store:      store,
+			owner:      owner,
+			response:   response,
+			input:      input,
+			output:     api.Message{Role: "assistant"},
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
@@ -0,0 +1,423 @@
+package openai
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestResponsesMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.ChatRequest
+		err  string
+		code int
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	testCases := []testCase{
+		{
+			name: "string input",
+			body: `{"model": "test-model", "input": "Hello", "instructions": "Be brief", "max_output_tokens": 10}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Be brief"},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 10.0,
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "input items",
+			body: `{
+				"model": "test-model",
+				"input": [
+					{"role": "developer", "content": "Use tools"},
+					{"role": "user", "content": [{"type": "input_text", "text": "What's in this image?"}, {"type": "input_image", "image_url": "` + prefix + image + `"}]},
+					{"type": "reasoning", "id": "rs_1", "summary": [{"type": "summary_text", "text": "Checking"}]},
+					{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"city\":\"Paris\"}"},
+					{"type": "function_call_output", "call_id": "call_1", "output": "sunny"},
+					{"type": "message", "role": "assistant", "content": [{"type": "output_text", "text": "It's sunny"}]}
+				],
+				"tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}}],
+				"text": {"format": {"type": "json_object"}},
+				"reasoning": {"effort": "low"},
+				"stream": true
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "Use tools"},
+					{Role: "user", Content: "What's in this image?", Images: []api.ImageData{func() []byte {
+						img, _ := base64.StdEncoding.DecodeString(image)
+						return img
+					}()}},
+					{Role: "assistant", Thinking: "Checking", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+					{Role: "tool", Content: "sunny"},
+					{Role: "assistant", Content: "It's sunny"},
+				},
+				Tools: []api.Tool{func() api.Tool {
+					var tool api.Tool
+					json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}}}`), &tool)
+					return tool
+				}()},
+				Format: json.RawMessage(`"json"`),
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &True,
+				Think:  &True,
+			},
+		},
+		{
+			name: "tool choice",
+			body: `{"model": "test-model", "input": "Hello", "tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object", "properties": {}}}], "tool_choice": {"type": "function", "name": "get_weather"}, "parallel_tool_calls": false}`,
+			req: api.ChatRequest{
+				Model:    "test-model",
+				Messages: []api.Message{{Role: "user", Content: "Hello"}},
+				Tools: []api.Tool{func() api.Tool {
+					var tool api.Tool
+					json.Unmarshal([]byte(`{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {}}}}`), &tool)
+					return tool
+				}()},
+				ToolChoice:        &api.ToolChoice{Function: "get_weather"},
+				ParallelToolCalls: &False,
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "missing input",
+			body: `{"model": "test-model"}`,
+			err:  "missing required parameter: 'input'",
+		},
+		{
+			name: "unsupported tool",
+			body: `{"model": "test-model", "input": "Hello", "tools": [{"type": "web_search"}]}`,
+			err:  `unsupported tool type: "web_search"`,
+		},
+		{
+			name: "unknown previous response",
+			body: `{"model": "test-model", "input": "Hello", "previous_response_id": "resp_missing"}`,
+			err:  "previous response with id 'resp_missing' not found",
+			code: http.StatusNotFound,
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(ResponsesMiddleware(NewResponseStore(10, nil)), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/v1/responses", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			defer func() { capturedRequest = nil }()
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if tc.err != "" {
+				var errResp ErrorResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+
+				code := tc.code
+				if code == 0 {
+					code = http.StatusBadRequest
+				}
+
+				if resp.Code != code || errResp.Error.Message != tc.err {
+					t.Fatalf("expected error %q, got %d %+v", tc.err, resp.Code, errResp)
+				}
+				return
+			}
+
+			if diff := cmp.Diff(&tc.req, capturedRequest); diff != "" {
+				t.Fatalf("requests did not match: %+v", diff)
+			}
+		})
+	}
+}
+
+func TestResponsesWriter(t *testing.T) {
+	var responses []api.ChatResponse
+	var capturedRequest *api.ChatRequest
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		for _, r := range responses {
+			bts, _ := json.Marshal(r)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}
+
+	store := NewResponseStore(10, nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/v1/responses", ResponsesMiddleware(store), captureRequestMiddleware(&capturedRequest), endpoint)
+	router.GET("/v1/responses/:id", store.RetrieveHandler)
+	router.DELETE("/v1/responses/:id", store.DeleteHandler)
+
+	post := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body)
+		}
+
+		return resp
+	}
+
+	var first struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+		Output []struct {
+			Type    string                 `json:"type"`
+			Content []ResponsesOutputText  `json:"content"`
+			Summary []ResponsesSummaryText `json:"summary"`
+			Name    string                 `json:"name"`
+		} `json:"output"`
+		Usage ResponsesUsage `json:"usage"`
+	}
+
+	t.Run("non-streaming", func(t *testing.T) {
+		responses = []api.ChatResponse{
+			{Model: "test-model", Message: api.Message{Role: "assistant", Thinking: "Greeting", Content: "Hi!"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 2}},
+		}
+
+		resp := post(t, `{"model": "test-model", "input": "Hello", "instructions": "Be brief"}`)
+		if err := json.Unmarshal(resp.Body.Bytes(), &first); err != nil {
+			t.Fatal(err)
+		}
+
+		if first.Status != "completed" || len(first.Output) != 2 {
+			t.Fatalf("unexpected response %s", resp.Body)
+		}
+
+		if first.Output[0].Type != "reasoning" || first.Output[0].Summary[0].Text != "Greeting" {
+			t.Errorf("unexpected reasoning item %+v", first.Output[0])
+		}
+
+		if first.Output[1].Type != "message" || first.Output[1].Content[0].Text != "Hi!" {
+			t.Errorf("unexpected message item %+v", first.Output[1])
+		}
+
+		if first.Usage.InputTokens != 5 || first.Usage.OutputTokens != 2 || first.Usage.TotalTokens != 7 {
+			t.Errorf("unexpected usage %+v", first.Usage)
+		}
+	})
+
+	t.Run("previous response", func(t *testing.T) {
+		responses = []api.ChatResponse{
+			{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}}, Done: true, DoneReason: "length"},
+		}
+
+		resp := post(t, `{"model": "test-model", "input": "And the weather?", "previous_response_id": "`+first.Id+`"}`)
+
+		// the instructions of the first response are not carried over
+		want := []api.Message{
+			{Role: "user", Content: "Hello"},
+			{Role: "assistant", Content: "Hi!", Thinking: "Greeting"},
+			{Role: "user", Content: "And the weather?"},
+		}
+		if diff := cmp.Diff(want, capturedRequest.Messages); diff != "" {
+			t.Errorf("messages mismatch (-want +got):\n%s", diff)
+		}
+
+		var second Response
+		if err := json.Unmarshal(resp.Body.Bytes(), &second); err != nil {
+			t.Fatal(err)
+		}
+
+		if second.Status != "incomplete" || second.IncompleteDetails == nil || second.IncompleteDetails.Reason != "max_output_tokens" {
+			t.Errorf("expected an incomplete response, got %s", resp.Body)
+		}
+
+		post(t, `{"model": "test-model", "input": [{"type": "function_call_output", "call_id": "call_1", "output": "sunny"}], "previous_response_id": "`+second.Id+`", "store": false}`)
+		if n := len(capturedRequest.Messages); n != 5 || capturedRequest.Messages[3].ToolCalls == nil || capturedRequest.Messages[4].Role != "tool" {
+			t.Errorf("unexpected messages %+v", capturedRequest.Messages)
+		}
+
+		if len(store.entries) != 2 {
+			t.Errorf("expected 2 stored responses, got %d", len(store.entries))
+		}
+	})
+
+	t.Run("retrieve and delete", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/v1/responses/"+first.Id, nil))
+		if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), first.Id) {
+			t.Fatalf("unexpected retrieve response %d %s", resp.Code, resp.Body)
+		}
+
+		for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/v1/responses/"+first.Id, nil))
+			if resp.Code != code {
+				t.Errorf("expected status %d, got %d", code, resp.Code)
+			}
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		responses = []api.ChatResponse{
+			{Model: "test-model", QueuePosition: 1},
+			{Model: "test-model", Message: api.Message{Role: "assistant", Thinking: "Hmm"}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", Content: "!"}},
+			{Model: "test-model", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{}}}}}},
+			{Model: "test-model", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop"},
+		}
+
+		resp := post(t, `{"model": "test-model", "input": "Hello", "stream": true}`)
+
+		var types []string
+		var text string
+		for i, e := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+			name, data, ok := strings.Cut(e, "\n")
+			if !ok {
+				t.Fatalf("invalid event %q", e)
+			}
+
+			var event struct {
+				Type           string `json:"type"`
+				SequenceNumber int    `json:"sequence_number"`
+				Delta          string `json:"delta"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &event); err != nil {
+				t.Fatal(err)
+			}
+
+			if name != "event: "+event.Type || event.SequenceNumber != i {
+				t.Errorf("unexpected event %q", e)
+			}
+
+			if event.Type == "response.output_text.delta" {
+				text += event.Delta
+			}
+
+			types = append(types, event.Type)
+		}
+
+		if text != "Hi!" {
+			t.Errorf("expected text deltas to add up to %q, got %q", "Hi!", text)
+		}
+
+		want := []string{
+			"response.created",
+			"response.in_progress",
+			"response.output_item.added",
+			"response.reasoning_summary_part.added",
+			"response.reasoning_summary_text.delta",
+			"response.reasoning_summary_text.done",
+			"response.reasoning_summary_part.done",
+			"response.output_item.done",
+			"response.output_item.added",
+			"response.content_part.added",
+			"response.output_text.delta",
+			"response.output_text.delta",
+			"response.output_text.done",
+			"response.content_part.done",
+			"response.output_item.done",
+			"response.output_item.added",
+			"response.function_call_arguments.delta",
+			"response.function_call_arguments.done",
+			"response.output_item.done",
+			"response.completed",
+		}
+		if diff := cmp.Diff(want, types); diff != "" {
+			t.Errorf("events mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestResponseStoreOwner(t *testing.T) {
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		bts, _ := json.Marshal(api.ChatResponse{Model: "test-model", Message: api.Message{Role: "assistant", Content: "Hi!"}, Done: true, DoneReason: "stop"})
+		c.Writer.Write(append(bts, '\n'))
+	}
+
+	store := NewResponseStore(10, func(c *gin.Context) string { return c.GetHeader("X-Owner") })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/v1/responses", ResponsesMiddleware(store), endpoint)
+	router.GET("/v1/responses/:id", store.RetrieveHandler)
+	router.DELETE("/v1/responses/:id", store.DeleteHandler)
+
+	request := func(method, path, owner, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Owner", owner)
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := request(http.MethodPost, "/v1/responses", "alice", `{"model": "test-model", "input": "Hello"}`)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body)
+	}
+
+	var r Response
+	if err := json.Unmarshal(resp.Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	// other owners can't tell the response exists
+	for _, tt := range []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/v1/responses/" + r.Id, ""},
+		{http.MethodDelete, "/v1/responses/" + r.Id, ""},
+		{http.MethodPost, "/v1/responses", `{"model": "test-model", "input": "Again", "previous_response_id": "` + r.Id + `"}`},
+	} {
+		if resp := request(tt.method, tt.path, "bob", tt.body); resp.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status 404, got %d: %s", tt.method, tt.path, resp.Code, resp.Body)
+		}
+	}
+
+	if resp := request(http.MethodPost, "/v1/responses", "alice", `{"model": "test-model", "input": "Again", "previous_response_id": "`+r.Id+`"}`); resp.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", resp.Code, resp.Body)
+	}
+
+	if resp := request(http.MethodDelete, "/v1/responses/"+r.Id, "alice", ""); resp.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", resp.Code, resp.Body)
+	}
+}
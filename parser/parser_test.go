@@ -692,6 +692,15 @@ TEMPLATE some template
 		},
 		{
 			`FROM test
+DRAFT test-small
+`,
+			&api.CreateRequest{
+				From:  "test",
+				Draft: "test-small",
+			},
+		},
+		{
+			`FROM test
 LICENSE single license
 PARAMETER temperature 0.5
 MESSAGE user Hello
@@ -726,6 +735,16 @@ MESSAGE assistant Hi! How are you?
 				},
 			},
 		},
+		{
+			`FROM test
+PARAMETER logit_bias 128001 -100
+PARAMETER logit_bias 15 2.5
+`,
+			&api.CreateRequest{
+				From:       "test",
+				Parameters: map[string]any{"logit_bias": map[string]any{"128001": float64(-100), "15": float64(2.5)}},
+			},
+		},
 	}
 
 	for _, c := range cases {
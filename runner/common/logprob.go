@@ -0,0 +1,36 @@
+package common
+
+import (
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/sample"
+)
+
+// CalculateLogprob returns the log probability of the selected token along
+// with the topN most likely alternatives, using decode to convert token ids
+// into their text pieces
+func CalculateLogprob(logits []float32, selected int32, topN int, decode func(int32) string) api.Logprob {
+	logprob, top := sample.Logprobs(logits, selected, topN)
+
+	result := api.Logprob{TokenLogprob: tokenLogprob(decode(selected), logprob)}
+	if len(top) > 0 {
+		result.TopLogprobs = make([]api.TokenLogprob, len(top))
+		for i, t := range top {
+			result.TopLogprobs[i] = tokenLogprob(decode(t.ID), t.Logprob)
+		}
+	}
+
+	return result
+}
+
+func tokenLogprob(piece string, logprob float32) api.TokenLogprob {
+	bytes := make([]int, len(piece))
+	for i := range len(piece) {
+		bytes[i] = int(piece[i])
+	}
+
+	return api.TokenLogprob{
+		Token:   piece,
+		Logprob: float64(logprob),
+		Bytes:   bytes,
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ollama/ollama/tracing"
+)
+
+// SequenceSpans traces the phases of a sequence, such as prompt processing and
+// generation, as children of the request that created it. Sequences are
+// processed by the batch loop rather than the request handler, so a span is
+// kept open for the current phase instead of being tied to a function call.
+type SequenceSpans struct {
+	parent trace.SpanContext
+	span   trace.Span
+}
+
+// NewSequenceSpans starts tracing a sequence of the request in ctx with the
+// given phase
+func NewSequenceSpans(ctx context.Context, phase string, attrs ...attribute.KeyValue) *SequenceSpans {
+	s := &SequenceSpans{parent: trace.SpanContextFromContext(ctx)}
+	s.Phase(phase, attrs...)
+	return s
+}
+
+// Phase ends the current phase, if any, and starts the next one
+func (s *SequenceSpans) Phase(name string, attrs ...attribute.KeyValue) {
+	if s == nil {
+		return
+	}
+
+	if s.span != nil {
+		s.span.End()
+	}
+
+	_, s.span = tracing.Start(trace.ContextWithSpanContext(context.Background(), s.parent), name, attrs...)
+}
+
+// End ends the current phase, recording attrs on it
+func (s *SequenceSpans) End(attrs ...attribute.KeyValue) {
+	if s == nil || s.span == nil {
+		return
+	}
+
+	s.span.SetAttributes(attrs...)
+	s.span.End()
+	s.span = nil
+}
+
+// Link returns a link to the current phase, so that batches can be
+// associated with the sequences they process
+func (s *SequenceSpans) Link() (trace.Link, bool) {
+	if s == nil || s.span == nil || !s.span.SpanContext().IsValid() {
+		return trace.Link{}, false
+	}
+
+	return trace.Link{SpanContext: s.span.SpanContext()}, true
+}
@@ -181,6 +181,21 @@ func (c *InputCache) findBestCacheSlot(prompt []input) (*InputCacheSlot, int, er
 	return oldestSlot, longest, nil
 }
 
+// CopyCacheSlot replaces the contents of dst with the first numPast inputs of
+// src, allowing multiple sequences to share a prompt that has only been
+// processed once
+func (c *InputCache) CopyCacheSlot(src, dst *InputCacheSlot, numPast int) {
+	slog.Debug("copying cache slot", "src", src.Id, "dst", dst.Id, "inputs", numPast)
+
+	dst.Inputs = make([]input, numPast)
+	copy(dst.Inputs, src.Inputs[:numPast])
+	// This is only nil for unit tests
+	if c.lc != nil {
+		c.lc.KvCacheSeqRm(dst.Id, 0, -1)
+		c.lc.KvCacheSeqCp(src.Id, dst.Id, 0, numPast)
+	}
+}
+
 func countCommonPrefix(a []input, b []input) int {
 	var count int
 
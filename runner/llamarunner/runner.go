@@ -13,12 +13,15 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/semaphore"
 
 	"github.com/ollama/ollama/api"
@@ -27,6 +30,7 @@ import (
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/logutil"
 	"github.com/ollama/ollama/runner/common"
+	"github.com/ollama/ollama/tracing"
 )
 
 // input is an element of the prompt to process, either
@@ -54,11 +58,14 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -80,8 +87,29 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// return log probabilities for generated tokens along with the
+	// specified number of most likely alternatives
+	logprobs    bool
+	topLogprobs int
+
 	doneReason llm.DoneReason
 
+	// the stop sequence that ended the completion, if any
+	stopSequence string
+
+	// index of this completion when generating several for the same prompt
+	index int
+
+	// sequences waiting to copy this sequence's prompt from the cache once
+	// it has been processed, rather than evaluating it themselves
+	forks []*Sequence
+
+	// waiting for another sequence to process the prompt
+	waitingForPrompt bool
+
+	// traces prompt processing and generation
+	spans *common.SequenceSpans
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
@@ -95,6 +123,15 @@ type NewSequenceParams struct {
 	numKeep        int
 	samplingParams *llama.SamplingParams
 	embedding      bool
+	logprobs       bool
+	topLogprobs    int
+}
+
+// response is a chunk of generated text along with the log
+// probabilities of the tokens that make it up
+type response struct {
+	content  string
+	logprobs []api.Logprob
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -148,16 +185,108 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		samplingCtx:         sc,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		logprobs:            params.logprobs || params.topLogprobs > 0,
+		topLogprobs:         params.topLogprobs,
+	}, nil
+}
+
+// NewRerankSequence creates a sequence that scores document against query
+// with the model's classification head. The pair is encoded as the query
+// followed by the document, each wrapped in the model's special tokens.
+func (s *Server) NewRerankSequence(query, document string) (*Sequence, error) {
+	s.ready.Wait()
+
+	if !s.lc.IsRank() {
+		return nil, errors.New("this model does not support reranking")
+	}
+
+	startTime := time.Now()
+
+	q, err := s.lc.Model().Tokenize(query, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize query: %w", err)
+	}
+
+	d, err := s.lc.Model().Tokenize(document, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tokenize document: %w", err)
+	}
+
+	// the document continues the query, so it doesn't start a new sequence
+	if s.model.AddBOSToken() && len(d) > 0 {
+		d = d[1:]
+	}
+
+	// truncate the document, preserving its final (usually special) token
+	if discard := len(q) + len(d) - s.cache.numCtx; discard > 0 {
+		if discard >= len(d) {
+			return nil, fmt.Errorf("query length exceeds maximum context length (%d > %d)", len(q), s.cache.numCtx)
+		}
+
+		slog.Warn("truncating rerank document", "limit", s.cache.numCtx, "query", len(q), "document", len(d), "discard", discard)
+		d = append(d[:len(d)-discard-1], d[len(d)-1])
+	}
+
+	var inputs []input
+	for _, t := range append(q, d...) {
+		inputs = append(inputs, input{token: t})
+	}
+
+	return &Sequence{
+		inputs:              inputs,
+		numPromptInputs:     len(inputs),
+		startProcessingTime: startTime,
+		pendingResponses:    make([]string, 0),
+		responses:           make(chan response, 100),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+		embeddingOnly:       true,
 	}, nil
 }
 
+// fork creates a sequence that generates another completion for the same
+// prompt as seq. It doesn't evaluate the prompt itself but instead copies it
+// from seq's cache slot once seq has processed it.
+func (s *Server) fork(seq *Sequence, index int, samplingParams llama.SamplingParams) (*Sequence, error) {
+	sc, err := llama.NewSamplingContext(s.model, samplingParams)
+	if err != nil {
+		return nil, err
+	}
+	for _, input := range seq.inputs {
+		if input.embed == nil {
+			sc.Accept(input.token, false)
+		}
+	}
+
+	f := &Sequence{
+		inputs:              slices.Clone(seq.inputs),
+		numPromptInputs:     seq.numPromptInputs,
+		startProcessingTime: seq.startProcessingTime,
+		numPredict:          seq.numPredict,
+		pendingResponses:    make([]string, 0),
+		responses:           make(chan response, 100),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+		samplingCtx:         sc,
+		stop:                seq.stop,
+		numKeep:             seq.numKeep,
+		logprobs:            seq.logprobs,
+		topLogprobs:         seq.topLogprobs,
+		index:               index,
+		waitingForPrompt:    true,
+	}
+
+	seq.forks = append(seq.forks, f)
+	return f, nil
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
 // generating image embeddings for each image
@@ -274,7 +403,9 @@ func (s *Server) allNil() bool {
 
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -286,12 +417,12 @@ func flushPending(seq *Sequence) bool {
 		joined = joined[:len(joined)-1]
 	}
 
-	if len(joined) == 0 {
+	if len(joined) == 0 && len(logprobs) == 0 {
 		return true
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -303,11 +434,33 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 
 	flushPending(seq)
 	seq.doneReason = reason
+	seq.spans.End(attribute.String("done_reason", reason.String()), attribute.Int("generated", seq.numDecoded))
 	close(seq.responses)
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
 	s.seqsSem.Release(1)
+
+	// forks can't continue without the prompt they are waiting on
+	for _, f := range seq.forks {
+		if i := slices.Index(s.seqs, f); i != -1 {
+			s.removeSequence(i, reason)
+		}
+	}
+	seq.forks = nil
+}
+
+// startForks copies the processed prompt of seq into the cache slots of the
+// sequences forked from it. The last prompt input is left for each fork to
+// evaluate so that it has its own logits to sample from.
+func (s *Server) startForks(seq *Sequence) {
+	numPast := len(seq.cache.Inputs) - 1
+	for _, f := range seq.forks {
+		s.cache.CopyCacheSlot(seq.cache, f.cache, numPast)
+		f.inputs = slices.Clone(seq.cache.Inputs[numPast:])
+		f.waitingForPrompt = false
+	}
+	seq.forks = nil
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -370,7 +523,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		seqIdx = (seqIdx + 1) % len(s.seqs)
 		seq := s.seqs[seqIdx]
 
-		if seq == nil {
+		if seq == nil || seq.waitingForPrompt {
 			continue
 		}
 
@@ -433,13 +586,27 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		return nil
 	}
 
+	var links []trace.Link
+	for _, seq := range s.seqs {
+		if seq != nil && len(seq.pendingInputs) > 0 {
+			if link, ok := seq.spans.Link(); ok {
+				links = append(links, link)
+			}
+		}
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "processBatch",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("inputs", batch.NumTokens())))
+	defer span.End()
+
 	err := s.lc.Decode(batch)
 	if err != nil {
 		return fmt.Errorf("failed to decode batch: %w", err)
 	}
 
 	for i, seq := range s.seqs {
-		if seq == nil {
+		if seq == nil || seq.waitingForPrompt {
 			continue
 		}
 
@@ -454,6 +621,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		if len(seq.forks) > 0 {
+			s.startForks(seq)
+		}
+
 		seq.numDecoded += 1
 		if seq.numDecoded == 1 {
 			seq.startGenerationTime = time.Now()
@@ -471,6 +642,10 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			continue
 		}
 
+		if seq.numDecoded == 1 {
+			seq.spans.Phase("decode")
+		}
+
 		// sample a token
 		token := seq.samplingCtx.Sample(s.lc, seq.iBatch)
 		seq.samplingCtx.Accept(token, true)
@@ -491,6 +666,11 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 		seq.inputs = []input{{token: token}}
 
 		seq.pendingResponses = append(seq.pendingResponses, piece)
+		if seq.logprobs {
+			seq.pendingLogprobs = append(seq.pendingLogprobs, common.CalculateLogprob(s.lc.GetLogitsIth(seq.iBatch), int32(token), seq.topLogprobs, func(id int32) string {
+				return s.model.TokenToPiece(int(id))
+			}))
+		}
 		sequence := strings.Join(seq.pendingResponses, "")
 
 		if ok, stop := common.FindStop(sequence, seq.stop); ok {
@@ -500,6 +680,9 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			origLen := len(seq.pendingResponses)
 			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
 			newLen := len(seq.pendingResponses)
+			if len(seq.pendingLogprobs) > newLen {
+				seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
+			}
 
 			// Update the cache based on the tokens that will be returned:
 			// - We have 1 token more than is currently in the cache because
@@ -515,6 +698,7 @@ func (s *Server) processBatch(tokenBatch *llama.Batch, embedBatch *llama.Batch)
 			}
 			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
 
+			seq.stopSequence = stop
 			s.removeSequence(i, llm.DoneReasonStop)
 			continue
 		}
@@ -563,6 +747,9 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		TopP:           req.Options.TopP,
 		MinP:           req.Options.MinP,
 		TypicalP:       req.Options.TypicalP,
+		Mirostat:       req.Options.Mirostat,
+		MirostatTau:    req.Options.MirostatTau,
+		MirostatEta:    req.Options.MirostatEta,
 		Temp:           req.Options.Temperature,
 		RepeatLastN:    req.Options.RepeatLastN,
 		PenaltyRepeat:  req.Options.RepeatPenalty,
@@ -570,6 +757,24 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		PenaltyPresent: req.Options.PresencePenalty,
 		Seed:           uint32(req.Options.Seed),
 		Grammar:        req.Grammar,
+		LogitBias:      req.Options.LogitBias,
+
+		DryMultiplier:       req.Options.DryMultiplier,
+		DryBase:             req.Options.DryBase,
+		DryAllowedLength:    req.Options.DryAllowedLength,
+		DryPenaltyLastN:     req.Options.DryPenaltyLastN,
+		DrySequenceBreakers: req.Options.DrySequenceBreakers,
+
+		XTCProbability: req.Options.XTCProbability,
+		XTCThreshold:   req.Options.XTCThreshold,
+
+		Samplers: req.Options.Samplers,
+	}
+
+	n := max(req.N, 1)
+	if n > s.parallel {
+		http.Error(w, fmt.Sprintf("n must not exceed the number of parallel sequences (%d)", s.parallel), http.StatusBadRequest)
+		return
 	}
 
 	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
@@ -578,14 +783,33 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		numKeep:        req.Options.NumKeep,
 		samplingParams: &samplingParams,
 		embedding:      false,
+		logprobs:       req.Options.Logprobs,
+		topLogprobs:    req.Options.TopLogprobs,
 	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	// each additional completion gets its own sampling context, so that they
+	// can diverge, but shares the prompt evaluated by the first sequence
+	seqs := []*Sequence{seq}
+	for i := 1; i < n; i++ {
+		params := samplingParams
+		if req.Options.Seed != -1 {
+			params.Seed += uint32(i)
+		}
+
+		f, err := s.fork(seq, i, params)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+			return
+		}
+		seqs = append(seqs, f)
+	}
+
+	// Ensure there is a place to put the sequences, released when removed from s.seqs
+	if err := s.seqsSem.Acquire(r.Context(), int64(n)); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -595,65 +819,134 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.mu.Lock()
-	found := false
-	for i, sq := range s.seqs {
-		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
-			if err != nil {
-				s.mu.Unlock()
-				s.seqsSem.Release(1)
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
+	if err := s.addSequences(seqs); err != nil {
+		s.mu.Unlock()
+		s.seqsSem.Release(int64(n))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, seq := range seqs {
+		seq.spans = common.NewSequenceSpans(r.Context(), "prefill",
+			attribute.Int("index", seq.index), attribute.Int("inputs", seq.numPromptInputs))
+	}
+	s.cond.Signal()
+	s.mu.Unlock()
+
+	// forward the responses of all sequences, tagged with their index
+	type result struct {
+		seq  *Sequence
+		resp response
+		done bool
+	}
+
+	results := make(chan result)
+	for _, seq := range seqs {
+		go func() {
+			for resp := range seq.responses {
+				select {
+				case results <- result{seq: seq, resp: resp}:
+				case <-seq.quit:
+					return
+				}
 			}
 
-			s.seqs[i] = seq
-			s.cond.Signal()
-			found = true
-			break
-		}
+			select {
+			case results <- result{seq: seq, done: true}:
+			case <-seq.quit:
+			}
+		}()
 	}
-	s.mu.Unlock()
 
-	if !found {
-		s.seqsSem.Release(1)
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
-		return
+	quit := func() {
+		for _, seq := range seqs {
+			close(seq.quit)
+		}
 	}
 
-	for {
+	// the prompt has been processed by the time anything is generated, so
+	// it's counted in the first response of each sequence
+	counted := make([]bool, n)
+	for remaining := n; remaining > 0; {
 		select {
 		case <-r.Context().Done():
-			close(seq.quit)
+			quit()
 			return
-		case content, ok := <-seq.responses:
-			if ok {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
-				}); err != nil {
+		case res := <-results:
+			seq := res.seq
+			if !res.done {
+				resp := llm.CompletionResponse{
+					Index:    seq.index,
+					Content:  res.resp.content,
+					Logprobs: res.resp.logprobs,
+				}
+				if !counted[seq.index] {
+					counted[seq.index] = true
+					resp.PromptEvalCount = seq.numPromptInputs
+				}
+
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
 					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
-					close(seq.quit)
+					quit()
 					return
 				}
 
 				flusher.Flush()
-			} else {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Done:               true,
-					DoneReason:         seq.doneReason,
-					PromptEvalCount:    seq.numPromptInputs,
-					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
-					EvalCount:          seq.numDecoded,
-					EvalDuration:       time.Since(seq.startGenerationTime),
-				}); err != nil {
-					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
-				}
+				continue
+			}
 
+			if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
+				Index:              seq.index,
+				Done:               true,
+				DoneReason:         seq.doneReason,
+				StopSequence:       seq.stopSequence,
+				PromptEvalCount:    seq.numPromptInputs,
+				PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
+				EvalCount:          seq.numDecoded,
+				EvalDuration:       time.Since(seq.startGenerationTime),
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
+				quit()
 				return
 			}
+
+			flusher.Flush()
+			remaining--
 		}
 	}
 }
 
+// addSequences places seqs into free entries of s.seqs and loads a cache
+// slot for each of them. Either all of the sequences are added or none are.
+func (s *Server) addSequences(seqs []*Sequence) error {
+	var added []int
+	rollback := func() {
+		for _, i := range added {
+			s.seqs[i].cache.InUse = false
+			s.seqs[i] = nil
+		}
+	}
+
+	for _, seq := range seqs {
+		i := slices.Index(s.seqs, nil)
+		if i == -1 {
+			rollback()
+			return errors.New("could not find an available sequence")
+		}
+
+		var err error
+		seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs, true)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("failed to load cache: %w", err)
+		}
+
+		s.seqs[i] = seq
+		added = append(added, i)
+	}
+
+	return nil
+}
+
 func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	var req llm.EmbeddingRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -669,6 +962,55 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	embedding, ok := s.embed(w, r, seq)
+	if !ok {
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
+		Embedding: embedding,
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) rerank(w http.ResponseWriter, r *http.Request) {
+	var req llm.RerankRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("bad request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	seq, err := s.NewRerankSequence(req.Query, req.Document)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	score, ok := s.embed(w, r, seq)
+	if !ok {
+		return
+	}
+
+	if len(score) != 1 {
+		http.Error(w, fmt.Sprintf("unexpected rerank output size: %d", len(score)), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(&llm.RerankResponse{
+		Score: score[0],
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// embed schedules an embedding only sequence and waits for its output. If it
+// isn't successful, an error has already been written to w.
+func (s *Server) embed(w http.ResponseWriter, r *http.Request, seq *Sequence) ([]float32, bool) {
+	var err error
+
 	// Ensure there is a place to put the sequence, released when removed from s.seqs
 	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
 		if errors.Is(err, context.Canceled) {
@@ -676,7 +1018,7 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 		} else {
 			http.Error(w, fmt.Sprintf("Failed to acquire semaphore: %v", err), http.StatusInternalServerError)
 		}
-		return
+		return nil, false
 	}
 
 	s.mu.Lock()
@@ -688,8 +1030,9 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 				s.mu.Unlock()
 				s.seqsSem.Release(1)
 				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
-				return
+				return nil, false
 			}
+			seq.spans = common.NewSequenceSpans(r.Context(), "embed", attribute.Int("inputs", seq.numPromptInputs))
 			s.seqs[i] = seq
 			s.cond.Signal()
 			found = true
@@ -701,16 +1044,10 @@ func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
 	if !found {
 		s.seqsSem.Release(1)
 		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 
-	embedding := <-seq.embedding
-
-	if err := json.NewEncoder(w).Encode(&llm.EmbeddingResponse{
-		Embedding: embedding,
-	}); err != nil {
-		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
-	}
+	return <-seq.embedding, true
 }
 
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
@@ -844,6 +1181,12 @@ func Execute(args []string) error {
 		},
 	}
 
+	shutdown, err := tracing.Init(context.Background(), "ollama-runner")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
 	server.ready.Add(1)
 	go server.loadModel(params, *mpath, lpaths, *ppath, *kvSize, *kvCacheType, *flashAttention, *threads, *multiUserCache)
 
@@ -863,8 +1206,12 @@ func Execute(args []string) error {
 	defer listener.Close()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/embedding", server.embeddings)
-	mux.HandleFunc("/completion", server.completion)
+	mux.Handle("/embedding", tracing.Handler(http.HandlerFunc(server.embeddings)))
+	mux.Handle("/rerank", tracing.Handler(http.HandlerFunc(server.rerank)))
+	mux.Handle("/completion", tracing.Handler(http.HandlerFunc(server.completion)))
+	mux.HandleFunc("/warm", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "this model does not support warming prompts", http.StatusNotImplemented)
+	})
 	mux.HandleFunc("/health", server.health)
 
 	httpServer := http.Server{
@@ -0,0 +1,359 @@
+package ollamarunner
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/model/input"
+	"github.com/ollama/ollama/runner/common"
+)
+
+// beamSearch generates the most likely completion of a prompt by keeping the
+// best few hypotheses at each step rather than sampling one. Each hypothesis
+// is evaluated by one of the search's sequences, which share the prompt. When
+// a hypothesis is extended by more than one token, the extra ones are copied
+// into the cache slots of the hypotheses that were pruned.
+type beamSearch struct {
+	// seqs evaluate the hypotheses and the first one returns the result
+	seqs []*Sequence
+
+	// hyps is the hypothesis evaluated by each of seqs, or nil if the
+	// sequence isn't in use
+	hyps []*hypothesis
+
+	// logits of the next token of each hypothesis, once it's evaluated
+	logits [][]float32
+
+	// finished hypotheses, best first, up to one for each beam
+	finished []*hypothesis
+
+	// lengthPenalty is the exponent of the length that scores of finished
+	// hypotheses are divided by, so that values above 0 favor longer ones
+	lengthPenalty float64
+
+	// earlyStopping ends the search once there is a finished hypothesis for
+	// each beam, rather than once none of the others can score better
+	earlyStopping bool
+
+	// number of tokens generated by each hypothesis so far
+	length int
+}
+
+// hypothesis is a candidate completion of a beam search
+type hypothesis struct {
+	tokens   []int32
+	pieces   []string
+	logprobs []api.Logprob
+
+	// score is the sum of the log probabilities of tokens
+	score float64
+
+	// normalized is the score adjusted for length, once finished
+	normalized   float64
+	doneReason   llm.DoneReason
+	stopSequence string
+}
+
+// beamCandidate is a token that may extend the hypothesis of seqs[parent]
+type beamCandidate struct {
+	parent  int
+	token   int32
+	logprob float32
+	score   float64
+}
+
+func newBeamSearch(seqs []*Sequence, lengthPenalty float32, earlyStopping bool) *beamSearch {
+	b := &beamSearch{
+		seqs:          seqs,
+		hyps:          make([]*hypothesis, len(seqs)),
+		logits:        make([][]float32, len(seqs)),
+		lengthPenalty: float64(lengthPenalty),
+		earlyStopping: earlyStopping,
+	}
+
+	// the search starts from the prompt, which is evaluated by the first
+	// sequence
+	b.hyps[0] = &hypothesis{}
+	for _, seq := range seqs {
+		seq.beam = b
+	}
+
+	return b
+}
+
+// evaluated records the logits of the next token of the hypothesis of seq
+func (b *beamSearch) evaluated(seq *Sequence, logits []float32) {
+	if i := slices.Index(b.seqs, seq); i != -1 && b.hyps[i] != nil {
+		b.logits[i] = slices.Clone(logits)
+	}
+}
+
+// ready reports whether all of the hypotheses have been evaluated
+func (b *beamSearch) ready() bool {
+	for i, h := range b.hyps {
+		if h != nil && b.logits[i] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize returns score divided by length to the power of the length
+// penalty
+func (b *beamSearch) normalize(score float64, length int) float64 {
+	return score / math.Pow(float64(max(length, 1)), b.lengthPenalty)
+}
+
+// finish adds h to the finished hypotheses, unless there are already enough
+// that score better
+func (b *beamSearch) finish(h *hypothesis, reason llm.DoneReason) {
+	h.doneReason = reason
+	h.normalized = b.normalize(h.score, len(h.tokens))
+
+	i, _ := slices.BinarySearchFunc(b.finished, h.normalized, func(f *hypothesis, target float64) int {
+		return cmp.Compare(target, f.normalized)
+	})
+	b.finished = slices.Insert(b.finished, i, h)
+	if len(b.finished) > len(b.seqs) {
+		b.finished = b.finished[:len(b.seqs)]
+	}
+}
+
+// done reports whether the search can end, given the score of the best
+// hypothesis that hasn't finished
+func (b *beamSearch) done(best float64) bool {
+	if len(b.finished) < len(b.seqs) {
+		return false
+	}
+
+	if b.earlyStopping {
+		return true
+	}
+
+	return b.finished[len(b.finished)-1].normalized >= b.normalize(best, b.length)
+}
+
+// candidates returns the tokens that may extend each hypothesis, best first
+func (b *beamSearch) candidates() ([]beamCandidate, error) {
+	var candidates []beamCandidate
+	for i, h := range b.hyps {
+		if h == nil {
+			continue
+		}
+
+		// twice as many as there are beams, so that enough are left to
+		// continue with if some of them finish
+		tokens, err := b.seqs[i].sampler.Candidates(b.logits[i], 2*len(b.seqs))
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample token: %w", err)
+		}
+
+		for _, t := range tokens {
+			candidates = append(candidates, beamCandidate{
+				parent:  i,
+				token:   t.ID,
+				logprob: t.Logprob,
+				score:   h.score + float64(t.Logprob),
+			})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b beamCandidate) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	return candidates, nil
+}
+
+// stepBeams extends the hypotheses of b with their most likely next tokens
+// once all of them have been evaluated, or ends the search when they can't
+// improve on the ones that have finished
+func (s *Server) stepBeams(b *beamSearch) error {
+	primary := b.seqs[0]
+
+	select {
+	case <-primary.quit:
+		s.removeBeams(b, llm.DoneReasonConnectionClosed)
+		return nil
+	default:
+	}
+
+	if !b.ready() {
+		return nil
+	}
+
+	if b.length == 0 {
+		primary.startGenerationTime = time.Now()
+		primary.spans.Phase("decode")
+	}
+	b.length++
+
+	candidates, err := b.candidates()
+	if err != nil {
+		return err
+	}
+
+	tp := s.model.(model.TextProcessor)
+	decode := func(id int32) string {
+		p, _ := tp.Decode([]int32{id})
+		return p
+	}
+
+	var next []*hypothesis
+	var parents []int
+	for rank, c := range candidates {
+		if len(next) == len(b.seqs) {
+			break
+		}
+
+		parent := b.hyps[c.parent]
+		h := &hypothesis{
+			tokens:   append(slices.Clone(parent.tokens), c.token),
+			pieces:   slices.Clone(parent.pieces),
+			logprobs: slices.Clone(parent.logprobs),
+			score:    c.score,
+		}
+
+		// hypotheses only finish if they're among the best, as they would
+		// be if there were one candidate for each beam
+		if tp.Is(c.token, model.SpecialEOS) {
+			if rank < len(b.seqs) {
+				b.finish(h, llm.DoneReasonStop)
+			}
+			continue
+		}
+
+		piece, err := tp.Decode([]int32{c.token})
+		if err != nil {
+			return err
+		}
+
+		h.pieces = append(h.pieces, piece)
+		if primary.logprobs {
+			h.logprobs = append(h.logprobs, common.CalculateLogprob(b.logits[c.parent], c.token, primary.topLogprobs, decode))
+		}
+
+		if ok, stop := common.FindStop(strings.Join(h.pieces, ""), primary.stop); ok {
+			if rank < len(b.seqs) {
+				h.pieces, _ = common.TruncateStop(h.pieces, stop)
+				if len(h.logprobs) > len(h.pieces) {
+					h.logprobs = h.logprobs[:len(h.pieces)]
+				}
+				h.stopSequence = stop
+				b.finish(h, llm.DoneReasonStop)
+			}
+			continue
+		}
+
+		next = append(next, h)
+		parents = append(parents, c.parent)
+	}
+
+	// hypotheses that reach the length limit, or would need the context
+	// window to shift, finish where they are
+	if len(next) > 0 && (primary.numPredict > 0 && b.length >= primary.numPredict ||
+		int32(len(b.seqs[parents[0]].cache.Inputs))+1 > s.cache.numCtx) {
+		for _, h := range next {
+			b.finish(h, llm.DoneReasonLength)
+		}
+		next = nil
+	}
+
+	if len(next) == 0 || b.done(next[0].score) {
+		best := b.finished[0]
+		primary.pendingResponses = best.pieces
+		primary.pendingLogprobs = best.logprobs
+		primary.numPredicted = len(best.tokens)
+		primary.stopSequence = best.stopSequence
+		s.removeBeams(b, best.doneReason)
+		return nil
+	}
+
+	return s.reassignBeams(b, next, parents)
+}
+
+// reassignBeams moves the next hypotheses into the sequences of b. The first
+// hypothesis to extend each parent stays in its sequence and the others are
+// copied into the sequences of parents that weren't extended, which are
+// removed from the cache if they aren't needed.
+func (s *Server) reassignBeams(b *beamSearch, next []*hypothesis, parents []int) error {
+	seqs := make([]int, len(next))
+	extended := make([]bool, len(b.seqs))
+	for j, p := range parents {
+		if !extended[p] {
+			extended[p] = true
+			seqs[j] = p
+		} else {
+			seqs[j] = -1
+		}
+	}
+
+	var unused []int
+	for i := range b.seqs {
+		if !extended[i] {
+			unused = append(unused, i)
+		}
+	}
+
+	// copy the parents before any of them are advanced
+	for j, p := range parents {
+		if seqs[j] != -1 {
+			continue
+		}
+
+		src, dst := b.seqs[p], b.seqs[unused[0]]
+		sampler, err := src.sampler.Clone()
+		if err != nil {
+			return err
+		}
+
+		s.cache.CopyCacheSlot(src.cache, dst.cache, int32(len(src.cache.Inputs)))
+		dst.sampler = sampler
+		seqs[j] = unused[0]
+		unused = unused[1:]
+	}
+
+	for _, i := range unused {
+		seq := b.seqs[i]
+		if b.hyps[i] != nil {
+			if s.cache.cache != nil {
+				if err := s.cache.cache.Remove(seq.cache.Id, 0, math.MaxInt32); err != nil {
+					return fmt.Errorf("failed to remove pruned beam: %w", err)
+				}
+			}
+			seq.cache.Inputs = []input.Input{}
+		}
+
+		seq.inputs = nil
+		b.hyps[i] = nil
+	}
+
+	for j, h := range next {
+		i := seqs[j]
+		token := h.tokens[len(h.tokens)-1]
+
+		b.seqs[i].sampler.Choose(token)
+		b.seqs[i].inputs = []input.Input{{Token: token}}
+		b.hyps[i] = h
+	}
+
+	clear(b.logits)
+	return nil
+}
+
+// removeBeams removes the sequences of b, which flushes the pending response
+// of the first one
+func (s *Server) removeBeams(b *beamSearch, reason llm.DoneReason) {
+	for _, seq := range b.seqs {
+		if i := slices.Index(s.seqs, seq); i != -1 {
+			s.removeSequence(i, reason)
+		}
+	}
+}
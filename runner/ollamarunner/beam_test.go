@@ -0,0 +1,140 @@
+package ollamarunner
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/model/input"
+	"github.com/ollama/ollama/sample"
+)
+
+func TestBeamSearchFinish(t *testing.T) {
+	seqs := []*Sequence{{}, {}}
+
+	cases := []struct {
+		name          string
+		lengthPenalty float32
+		earlyStopping bool
+		want          []float64
+		done          bool
+	}{
+		// -4/2 and -3/1 are the best scores per token, and -3 per token
+		// for the unfinished hypothesis of length 2 can't beat them
+		{name: "length penalty", lengthPenalty: 1, want: []float64{-2, -3}, done: true},
+		// -3 and -4 are the best total scores, and -6 can't beat them
+		{name: "no length penalty", lengthPenalty: 0, want: []float64{-3, -4}, done: true},
+		{name: "early stopping", lengthPenalty: 1, earlyStopping: true, want: []float64{-2, -3}, done: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBeamSearch(seqs, tt.lengthPenalty, tt.earlyStopping)
+			b.length = 2
+
+			b.finish(&hypothesis{tokens: []int32{1}, score: -3}, llm.DoneReasonStop)
+			if b.done(-6) {
+				t.Fatal("expected the search to continue until every beam has finished")
+			}
+
+			b.finish(&hypothesis{tokens: []int32{1, 2}, score: -4}, llm.DoneReasonStop)
+			b.finish(&hypothesis{tokens: []int32{1, 2, 3}, score: -12}, llm.DoneReasonLength)
+
+			var got []float64
+			for _, h := range b.finished {
+				got = append(got, h.normalized)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("finished scores = %v, want %v", got, tt.want)
+			}
+
+			if b.done(-6) != tt.done {
+				t.Errorf("done = %v, want %v", !tt.done, tt.done)
+			}
+		})
+	}
+
+	// a hypothesis that may still score better keeps the search going
+	b := newBeamSearch(seqs, 1, false)
+	b.length = 2
+	b.finish(&hypothesis{tokens: []int32{1}, score: -3}, llm.DoneReasonStop)
+	b.finish(&hypothesis{tokens: []int32{1, 2}, score: -4}, llm.DoneReasonStop)
+	if b.done(-1) {
+		t.Error("expected the search to continue")
+	}
+}
+
+func TestReassignBeams(t *testing.T) {
+	t.Run("cache", func(t *testing.T) { testReassignBeams(t, &mockCache{}) })
+
+	// models without a KV cache only track the inputs of each sequence
+	t.Run("no cache", func(t *testing.T) { testReassignBeams(t, nil) })
+}
+
+func testReassignBeams(t *testing.T, cache kvcache.Cache) {
+	s := &Server{cache: &InputCache{
+		cache: cache,
+		slots: []InputCacheSlot{{Id: 0}, {Id: 1}, {Id: 2}},
+	}}
+
+	var seqs []*Sequence
+	for i := range s.cache.slots {
+		s.cache.slots[i].Inputs = []input.Input{{Token: 100}, {Token: int32(i)}}
+		seqs = append(seqs, &Sequence{
+			cache:   &s.cache.slots[i],
+			sampler: sample.NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, nil),
+		})
+	}
+
+	b := newBeamSearch(seqs, 1, false)
+	b.hyps[1] = &hypothesis{tokens: []int32{1}}
+	b.hyps[2] = &hypothesis{tokens: []int32{2}}
+
+	// the first hypothesis is extended twice and the last one is pruned
+	next := []*hypothesis{
+		{tokens: []int32{0, 10}},
+		{tokens: []int32{0, 11}},
+		{tokens: []int32{1, 12}},
+	}
+	if err := s.reassignBeams(b, next, []int{0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []struct {
+		cached []int32
+		input  int32
+		hyp    *hypothesis
+	}{
+		{[]int32{100, 0}, 10, next[0]},
+		{[]int32{100, 1}, 12, next[2]},
+		{[]int32{100, 0}, 11, next[1]},
+	} {
+		var cached []int32
+		for _, inp := range seqs[i].cache.Inputs {
+			cached = append(cached, inp.Token)
+		}
+
+		if !slices.Equal(cached, want.cached) {
+			t.Errorf("seq %d: cached %v, want %v", i, cached, want.cached)
+		}
+		if len(seqs[i].inputs) != 1 || seqs[i].inputs[0].Token != want.input {
+			t.Errorf("seq %d: inputs %v, want [%d]", i, seqs[i].inputs, want.input)
+		}
+		if b.hyps[i] != want.hyp {
+			t.Errorf("seq %d: unexpected hypothesis %v", i, b.hyps[i])
+		}
+	}
+
+	// hypotheses that aren't extended are removed from the cache
+	next = []*hypothesis{{tokens: []int32{0, 10, 20}}}
+	if err := s.reassignBeams(b, next, []int{0}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{1, 2} {
+		if b.hyps[i] != nil || len(seqs[i].inputs) != 0 || len(seqs[i].cache.Inputs) != 0 {
+			t.Errorf("seq %d: expected to be pruned", i)
+		}
+	}
+}
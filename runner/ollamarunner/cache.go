@@ -1,10 +1,18 @@
 package ollamarunner
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"math"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/ollama/ollama/kvcache"
@@ -28,10 +36,16 @@ type InputCache struct {
 	// optimize cache eviction for multiple users
 	multiUserCache bool
 
+	// directory that prompts are persisted to, or empty if disabled
+	dir string
+
+	// prompts in dir that can be restored into a cache slot
+	persisted []persistedPrompt
+
 	cache kvcache.Cache
 }
 
-func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, multiUserCache bool) (*InputCache, error) {
+func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots int, batchSize int, multiUserCache bool, dir string) (*InputCache, error) {
 	numCtx := kvSize / int32(numSlots)
 
 	if numCtx < 1 {
@@ -49,11 +63,24 @@ func NewInputCache(model model.Model, kvCacheType string, kvSize int32, numSlots
 		cache.Init(model.Backend(), kvCacheTypeFromStr(kvCacheType), numSlots, int(numCtx), batchSize)
 	}
 
+	var persisted []persistedPrompt
+	if _, ok := cache.(kvcache.Serializer); ok && dir != "" {
+		var err error
+		persisted, err = loadPersistedPrompts(dir)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dir = ""
+	}
+
 	return &InputCache{
 		numCtx:         numCtx,
 		enabled:        cache != nil,
 		slots:          slots,
 		multiUserCache: multiUserCache,
+		dir:            dir,
+		persisted:      persisted,
 		cache:          cache,
 	}, nil
 }
@@ -112,6 +139,10 @@ func (c *InputCache) LoadCacheSlot(prompt []input.Input) (*InputCacheSlot, []inp
 	slot.InUse = true
 	slot.lastUsed = time.Now()
 
+	if c.dir != "" {
+		numPast = c.restoreCacheSlot(slot, prompt, numPast)
+	}
+
 	if numPast == int32(len(prompt)) {
 		// Leave one input to sample so we can get a response
 		numPast--
@@ -146,12 +177,23 @@ func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot
 	longest := int32(-1)
 	var longestSlot *InputCacheSlot
 
+	// a slot that is in use may have more of the prompt, such as a system
+	// prompt shared by concurrent requests, which can be shared rather than
+	// evaluated again
+	var shared int32
+	var sharedSlot *InputCacheSlot
+
 	for i, s := range c.slots {
+		count := countCommonPrefix(s.Inputs, prompt)
+		if count > shared {
+			shared = count
+			sharedSlot = &c.slots[i]
+		}
+
 		if s.InUse {
 			continue
 		}
 
-		count := countCommonPrefix(s.Inputs, prompt)
 		if count > longest {
 			longest = count
 			longestSlot = &c.slots[i]
@@ -162,6 +204,11 @@ func (c *InputCache) findLongestCacheSlot(prompt []input.Input) (*InputCacheSlot
 		return nil, 0, errors.New("no available cache slots")
 	}
 
+	if shared > longest {
+		c.CopyCacheSlot(sharedSlot, longestSlot, shared)
+		return longestSlot, shared, nil
+	}
+
 	return longestSlot, longest, nil
 }
 
@@ -211,6 +258,19 @@ func (c *InputCache) findBestCacheSlot(prompt []input.Input) (*InputCacheSlot, i
 	return oldestSlot, longest, nil
 }
 
+// CopyCacheSlot replaces the contents of dst with the first numPast inputs of
+// src, allowing multiple sequences to share a prompt that has only been
+// processed once
+func (c *InputCache) CopyCacheSlot(src, dst *InputCacheSlot, numPast int32) {
+	slog.Debug("copying cache slot", "src", src.Id, "dst", dst.Id, "inputs", numPast)
+
+	dst.Inputs = make([]input.Input, numPast)
+	copy(dst.Inputs, src.Inputs[:numPast])
+	if c.cache != nil {
+		c.cache.CopyPrefix(src.Id, dst.Id, numPast)
+	}
+}
+
 func countCommonPrefix(a []input.Input, b []input.Input) int32 {
 	var count int32
 
@@ -299,3 +359,237 @@ func (c *InputCache) ShiftCacheSlot(slot *InputCacheSlot, numKeep int32) error {
 
 	return nil
 }
+
+// minRestoreInputs is how many more inputs a persisted prompt must have in
+// common with a new prompt than its cache slot before it is worth reading from
+// disk rather than evaluating them again
+const minRestoreInputs = 512
+
+// persistedPromptMagic identifies files written by SaveCacheSlot
+var persistedPromptMagic = [4]byte{'O', 'P', 'R', 'M'}
+
+type persistedPromptHeader struct {
+	Magic     [4]byte
+	NameLen   uint32
+	NumInputs uint32
+}
+
+// persistedPrompt is a prompt whose KV cache has been written to a file, from
+// which it can be restored into any cache slot
+type persistedPrompt struct {
+	name   string
+	path   string
+	inputs []input.Input
+}
+
+// readPersistedPrompt reads the header of a file written by SaveCacheSlot,
+// leaving r at the start of the KV cache data
+func readPersistedPrompt(r io.Reader) (string, []input.Input, error) {
+	var header persistedPromptHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return "", nil, err
+	}
+
+	if header.Magic != persistedPromptMagic {
+		return "", nil, errors.New("not a persisted prompt")
+	}
+
+	name := make([]byte, header.NameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", nil, err
+	}
+
+	tokens := make([]int32, header.NumInputs)
+	if err := binary.Read(r, binary.LittleEndian, tokens); err != nil {
+		return "", nil, err
+	}
+
+	inputs := make([]input.Input, len(tokens))
+	for i, token := range tokens {
+		inputs[i] = input.Input{Token: token}
+	}
+
+	return string(name), inputs, nil
+}
+
+// loadPersistedPrompts finds the prompts that have been persisted to dir.
+// Files that can't be read are skipped.
+func loadPersistedPrompts(dir string) ([]persistedPrompt, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var persisted []persistedPrompt
+	for _, e := range entries {
+		if !e.Type().IsRegular() || filepath.Ext(e.Name()) != ".kv" {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			slog.Warn("failed to open persisted prompt", "path", path, "error", err)
+			continue
+		}
+
+		name, inputs, err := readPersistedPrompt(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			slog.Warn("failed to read persisted prompt", "path", path, "error", err)
+			continue
+		}
+
+		slog.Debug("found persisted prompt", "name", name, "inputs", len(inputs))
+		persisted = append(persisted, persistedPrompt{name: name, path: path, inputs: inputs})
+	}
+
+	return persisted, nil
+}
+
+// SaveCacheSlot writes the inputs of slot and their KV cache to a file so that
+// they can be restored on a later cache miss, even by another runner process.
+// It replaces any prompt previously saved under the same name.
+func (c *InputCache) SaveCacheSlot(slot *InputCacheSlot, name string) error {
+	if c.dir == "" {
+		return errors.New("prompt persistence is not enabled or not supported by this model")
+	}
+
+	tokens := make([]int32, len(slot.Inputs))
+	for i, inp := range slot.Inputs {
+		if inp.Multimodal != nil {
+			return errors.New("prompts with images can't be persisted")
+		}
+		tokens[i] = inp.Token
+	}
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if err := binary.Write(h, binary.LittleEndian, tokens); err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))+".kv")
+
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	header := persistedPromptHeader{
+		Magic:     persistedPromptMagic,
+		NameLen:   uint32(len(name)),
+		NumInputs: uint32(len(tokens)),
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	if _, err := w.WriteString(name); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, tokens); err != nil {
+		return err
+	}
+
+	if err := c.cache.(kvcache.Serializer).Save(w, slot.Id, int32(len(tokens))); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	c.persisted = slices.DeleteFunc(c.persisted, func(p persistedPrompt) bool {
+		if p.path == path {
+			return true
+		}
+
+		if p.name == name {
+			if err := os.Remove(p.path); err != nil {
+				slog.Warn("failed to remove replaced prompt", "name", name, "path", p.path, "error", err)
+			}
+			return true
+		}
+
+		return false
+	})
+	c.persisted = append(c.persisted, persistedPrompt{name: name, path: path, inputs: slices.Clone(slot.Inputs)})
+
+	slog.Info("persisted prompt", "name", name, "inputs", len(tokens), "path", path)
+	return nil
+}
+
+// restoreCacheSlot loads the persisted prompt with the longest prefix in
+// common with prompt into slot, if that saves evaluating enough inputs
+// compared to the numPast inputs the slot already has. It returns the number
+// of inputs in the slot that can be used.
+func (c *InputCache) restoreCacheSlot(slot *InputCacheSlot, prompt []input.Input, numPast int32) int32 {
+	var best *persistedPrompt
+	longest := numPast + minRestoreInputs - 1
+	for i, p := range c.persisted {
+		if count := countCommonPrefix(p.inputs, prompt); count > longest {
+			longest = count
+			best = &c.persisted[i]
+		}
+	}
+
+	if best == nil {
+		return numPast
+	}
+
+	slog.Debug("restoring persisted prompt", "id", slot.Id, "name", best.name, "inputs", len(best.inputs), "used", longest)
+
+	if err := c.restore(slot, best); err != nil {
+		slog.Warn("failed to restore persisted prompt", "name", best.name, "path", best.path, "error", err)
+
+		// the slot's previous contents are gone and the file can't be used by this runner
+		slot.Inputs = []input.Input{}
+		c.persisted = slices.DeleteFunc(c.persisted, func(p persistedPrompt) bool { return p.path == best.path })
+		return 0
+	}
+
+	return longest
+}
+
+func (c *InputCache) restore(slot *InputCacheSlot, p *persistedPrompt) error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	_, inputs, err := readPersistedPrompt(r)
+	if err != nil {
+		return err
+	}
+
+	if countCommonPrefix(inputs, p.inputs) != int32(len(p.inputs)) || len(inputs) != len(p.inputs) {
+		return errors.New("persisted prompt has changed")
+	}
+
+	if err := c.cache.(kvcache.Serializer).Load(r, slot.Id); err != nil {
+		return err
+	}
+
+	slot.Inputs = slices.Clone(p.inputs)
+	return nil
+}
@@ -1,8 +1,13 @@
 package ollamarunner
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -203,7 +208,7 @@ func TestFindCacheSlot(t *testing.T) {
 				},
 			}},
 			prompt:  []input.Input{{Token: 1}, {Token: 2}},
-			longest: expected{result: 1, len: 1},
+			longest: expected{result: 1, len: 2},
 			best:    expected{result: 1, len: 2},
 		},
 	}
@@ -512,3 +517,125 @@ func TestShiftCacheSlot(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyCacheSlot(t *testing.T) {
+	c := InputCache{cache: &mockCache{}}
+	src := &InputCacheSlot{Id: 0, Inputs: []input.Input{{Token: 1}, {Token: 2}, {Token: 3}}}
+	dst := &InputCacheSlot{Id: 1, Inputs: []input.Input{{Token: 4}, {Token: 5}, {Token: 6}, {Token: 7}}}
+
+	c.CopyCacheSlot(src, dst, 2)
+
+	if !reflect.DeepEqual(dst.Inputs, []input.Input{{Token: 1}, {Token: 2}}) {
+		t.Errorf("CopyCacheSlot: dst inputs = %v, want first 2 inputs of src", dst.Inputs)
+	}
+
+	// the copy must not share memory with the source slot
+	src.Inputs[0].Token = 9
+	if dst.Inputs[0].Token != 1 {
+		t.Errorf("CopyCacheSlot: dst inputs changed with src")
+	}
+}
+
+// mockSerializerCache saves and loads the length of a sequence in place of its
+// contents
+type mockSerializerCache struct {
+	mockCache
+	loaded map[int]int32
+}
+
+func (m *mockSerializerCache) Save(w io.Writer, seq int, length int32) error {
+	return binary.Write(w, binary.LittleEndian, length)
+}
+
+func (m *mockSerializerCache) Load(r io.Reader, seq int) error {
+	var length int32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+
+	m.loaded[seq] = length
+	return nil
+}
+
+func TestPersistCacheSlot(t *testing.T) {
+	dir := t.TempDir()
+
+	inputs := func(n int) []input.Input {
+		inputs := make([]input.Input, n)
+		for i := range inputs {
+			inputs[i] = input.Input{Token: int32(i)}
+		}
+		return inputs
+	}
+
+	c := InputCache{
+		numCtx: 4096,
+		slots:  []InputCacheSlot{{Id: 0, Inputs: inputs(1000)}},
+		cache:  &mockSerializerCache{loaded: make(map[int]int32)},
+		dir:    dir,
+	}
+
+	if err := c.SaveCacheSlot(&c.slots[0], "agent"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new runner finds the prompt on disk
+	persisted, err := loadPersistedPrompts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(persisted) != 1 || persisted[0].name != "agent" || !reflect.DeepEqual(persisted[0].inputs, inputs(1000)) {
+		t.Fatalf("loadPersistedPrompts: got %v, want the saved prompt", persisted)
+	}
+
+	cache := &mockSerializerCache{loaded: make(map[int]int32)}
+	c = InputCache{
+		numCtx:    4096,
+		slots:     []InputCacheSlot{{Id: 0}},
+		cache:     cache,
+		dir:       dir,
+		persisted: persisted,
+	}
+
+	// too little in common to be worth restoring
+	_, remaining, err := c.LoadCacheSlot(inputs(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.slots[0].InUse = false
+
+	if len(remaining) != 100 || len(cache.loaded) != 0 {
+		t.Errorf("LoadCacheSlot: %d remaining and %v loaded, want 100 remaining and nothing loaded", len(remaining), cache.loaded)
+	}
+
+	slot, remaining, err := c.LoadCacheSlot(inputs(1010))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot.InUse = false
+
+	if len(remaining) != 10 || len(slot.Inputs) != 1000 || cache.loaded[0] != 1000 {
+		t.Errorf("LoadCacheSlot: %d remaining, %d in slot, %v loaded, want the persisted prompt restored", len(remaining), len(slot.Inputs), cache.loaded)
+	}
+
+	// saving a prompt with the same name replaces it
+	replaced := persisted[0].path
+	c.slots[0].Inputs = inputs(2000)
+	if err := c.SaveCacheSlot(&c.slots[0], "agent"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || len(c.persisted) != 1 || len(c.persisted[0].inputs) != 2000 {
+		t.Errorf("SaveCacheSlot: got files %v and %d persisted prompts, want only the new prompt", files, len(c.persisted))
+	}
+
+	if _, err := os.Stat(replaced); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("SaveCacheSlot: replaced prompt was not removed")
+	}
+}
@@ -0,0 +1,212 @@
+package ollamarunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"github.com/ollama/ollama/kvcache"
+	"github.com/ollama/ollama/ml"
+	"github.com/ollama/ollama/model"
+	"github.com/ollama/ollama/model/input"
+)
+
+// maxDraftTokens is the largest number of tokens proposed by the draft model
+// for each forward pass of the target model
+const maxDraftTokens = 4
+
+// maxVocabDifference is how many more tokens one of the draft and target
+// vocabularies may have than the other, as models of the same family are
+// often padded to different sizes
+const maxVocabDifference = 128
+
+// draftModel is a small model that shares the vocabulary of the target
+// model. It cheaply proposes the next few tokens, which the target model
+// then checks in a single forward pass, so that several tokens are generated
+// per pass when the draft model guesses correctly.
+type draftModel struct {
+	model model.Model
+	cache kvcache.Cache
+
+	// inputs are the tokens stored in the draft model's cache for each
+	// cache slot of the target model
+	inputs [][]int32
+
+	numCtx    int32
+	batchSize int
+}
+
+func newDraftModel(ctx context.Context, mpath string, params ml.BackendParams, target model.Model, kvCacheType string, numCtx int32, parallel, batchSize int) (*draftModel, error) {
+	m, err := model.New(mpath, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := compatibleVocabulary(m, target); err != nil {
+		return nil, err
+	}
+
+	cache := m.Config().Cache
+	if cache == nil {
+		return nil, errors.New("draft model does not support caching")
+	}
+	cache.Init(m.Backend(), kvCacheTypeFromStr(kvCacheType), parallel, int(numCtx), batchSize)
+
+	if err := m.Backend().Load(ctx, func(float32) {}); err != nil {
+		return nil, err
+	}
+
+	return &draftModel{
+		model:     m,
+		cache:     cache,
+		inputs:    make([][]int32, parallel),
+		numCtx:    numCtx,
+		batchSize: batchSize,
+	}, nil
+}
+
+// compatibleVocabulary checks that the tokens proposed by draft mean the same
+// thing to target
+func compatibleVocabulary(draft, target model.Model) error {
+	dv := draft.(model.TextProcessor).Vocabulary()
+	tv := target.(model.TextProcessor).Vocabulary()
+
+	if diff := len(dv.Values) - len(tv.Values); diff > maxVocabDifference || -diff > maxVocabDifference {
+		return fmt.Errorf("draft model vocabulary size %d is too different from %d", len(dv.Values), len(tv.Values))
+	}
+
+	for i := range min(len(dv.Values), len(tv.Values)) {
+		if dv.Values[i] != tv.Values[i] {
+			return fmt.Errorf("draft model token %d is %q but should be %q", i, dv.Values[i], tv.Values[i])
+		}
+	}
+
+	return nil
+}
+
+// propose returns up to n tokens that are likely to follow history, the
+// inputs of the target model's cache slot, including the next input to be
+// evaluated
+func (d *draftModel) propose(slot int, history []input.Input, n int) ([]int32, error) {
+	if n <= 0 || int32(len(history)+n) > d.numCtx {
+		return nil, nil
+	}
+
+	tokens := make([]int32, len(history))
+	for i, inp := range history {
+		if inp.Multimodal != nil {
+			return nil, nil
+		}
+		tokens[i] = inp.Token
+	}
+
+	// reuse the part of the history that is already in the cache, leaving at
+	// least one token to get logits from
+	numPast := min(int32(countCommonTokens(d.inputs[slot], tokens)), int32(len(tokens)-1))
+	if numPast > 0 && !d.cache.CanResume(slot, numPast) {
+		numPast = 0
+	}
+
+	if err := d.cache.Remove(slot, numPast, math.MaxInt32); err != nil {
+		if err := d.cache.Remove(slot, 0, math.MaxInt32); err != nil {
+			return nil, err
+		}
+		numPast = 0
+	}
+	d.inputs[slot] = d.inputs[slot][:numPast]
+
+	pending := tokens[numPast:]
+	var logits []float32
+	for len(pending) > 0 {
+		batch := pending[:min(len(pending), d.batchSize)]
+		pending = pending[len(batch):]
+
+		var err error
+		logits, err = d.forward(slot, batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// greedily pick each token, as the target model samples its own tokens
+	// and only keeps the ones that match
+	drafts := make([]int32, 0, n)
+	for {
+		token := argmax(logits)
+		drafts = append(drafts, token)
+		if len(drafts) == n || d.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+			return drafts, nil
+		}
+
+		var err error
+		logits, err = d.forward(slot, []int32{token})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// forward evaluates tokens following the inputs in slot and returns the
+// logits for the last of them
+func (d *draftModel) forward(slot int, tokens []int32) ([]float32, error) {
+	ctx := d.model.Backend().NewContext()
+	defer ctx.Close()
+
+	batch := input.Batch{Outputs: []int32{int32(len(tokens) - 1)}}
+	for i := range tokens {
+		batch.Positions = append(batch.Positions, int32(len(d.inputs[slot])+i))
+		batch.Sequences = append(batch.Sequences, slot)
+	}
+
+	t, err := model.Forward(ctx, d.model, tokens, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode draft batch: %w", err)
+	}
+
+	d.inputs[slot] = append(d.inputs[slot], tokens...)
+	return t.Floats(), nil
+}
+
+func countCommonTokens(a, b []int32) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return min(len(a), len(b))
+}
+
+func argmax(logits []float32) int32 {
+	var best int32
+	for i, l := range logits {
+		if l > logits[best] {
+			best = int32(i)
+		}
+	}
+
+	return best
+}
+
+// loadDraftModel loads the draft model at mpath for use with the loaded
+// target model, offloading numGPULayers of its layers, which the server only
+// sets if it has budgeted memory for them. Speculative decoding is disabled
+// if it can't be loaded.
+func (s *Server) loadDraftModel(ctx context.Context, mpath string, params ml.BackendParams, numGPULayers int, kvCacheType string) {
+	if !s.cache.enabled {
+		slog.Warn("model does not support caching, disabling draft model")
+		return
+	}
+
+	params.NumGPULayers = numGPULayers
+	draft, err := newDraftModel(ctx, mpath, params, s.model, kvCacheType, s.cache.numCtx, s.parallel, s.batchSize)
+	if err != nil {
+		slog.Warn("failed to load draft model, disabling speculative decoding", "draft", mpath, "error", err)
+		return
+	}
+
+	slog.Info("loaded draft model for speculative decoding", "draft", mpath)
+	s.draft = draft
+}
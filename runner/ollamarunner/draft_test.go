@@ -0,0 +1,85 @@
+package ollamarunner
+
+import (
+	"testing"
+)
+
+func TestCountCommonTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        []int32
+		b        []int32
+		expected int
+	}{
+		{
+			name:     "Equal",
+			a:        []int32{1, 2, 3},
+			b:        []int32{1, 2, 3},
+			expected: 3,
+		},
+		{
+			name:     "Prefix",
+			a:        []int32{1},
+			b:        []int32{1, 2, 3},
+			expected: 1,
+		},
+		{
+			name:     "Longer",
+			a:        []int32{1, 2, 3},
+			b:        []int32{1, 2},
+			expected: 2,
+		},
+		{
+			name:     "Diverged",
+			a:        []int32{1, 2, 3},
+			b:        []int32{1, 4, 3},
+			expected: 1,
+		},
+		{
+			name:     "Empty",
+			a:        []int32{},
+			b:        []int32{1, 2, 3},
+			expected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := countCommonTokens(tt.a, tt.b); result != tt.expected {
+				t.Errorf("countCommonTokens(%v, %v): have %v; want %v", tt.a, tt.b, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestArgmax(t *testing.T) {
+	tests := []struct {
+		name     string
+		logits   []float32
+		expected int32
+	}{
+		{
+			name:     "First",
+			logits:   []float32{3, 1, 2},
+			expected: 0,
+		},
+		{
+			name:     "Last",
+			logits:   []float32{-3, -1, 2},
+			expected: 2,
+		},
+		{
+			name:     "Tie",
+			logits:   []float32{1, 5, 5},
+			expected: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := argmax(tt.logits); result != tt.expected {
+				t.Errorf("argmax(%v): have %v; want %v", tt.logits, result, tt.expected)
+			}
+		})
+	}
+}
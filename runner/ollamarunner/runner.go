@@ -11,17 +11,21 @@ import (
 	"image"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/image/bmp"
 	"golang.org/x/sync/semaphore"
 
@@ -34,6 +38,7 @@ import (
 	"github.com/ollama/ollama/model/input"
 	"github.com/ollama/ollama/runner/common"
 	"github.com/ollama/ollama/sample"
+	"github.com/ollama/ollama/tracing"
 
 	_ "github.com/ollama/ollama/model/models"
 )
@@ -58,11 +63,14 @@ type Sequence struct {
 	// tokens that have been generated but not returned yet (e.g. for stop sequences)
 	pendingResponses []string
 
+	// log probabilities of pendingResponses, if requested
+	pendingLogprobs []api.Logprob
+
 	// input cache being used by this sequence
 	cache *InputCacheSlot
 
 	// channel to send responses over
-	responses chan string
+	responses chan response
 
 	// channel to stop decoding (such as if the remote connection is closed)
 	quit chan bool
@@ -85,21 +93,71 @@ type Sequence struct {
 	// true if an embedding are to be returned instead of text generation
 	embeddingOnly bool
 
+	// return log probabilities for generated tokens along with the
+	// specified number of most likely alternatives
+	logprobs    bool
+	topLogprobs int
+
 	doneReason llm.DoneReason
 
+	// the stop sequence that ended the completion, if any
+	stopSequence string
+
+	// index of this completion when generating several for the same prompt
+	index int
+
+	// sequences waiting to copy this sequence's prompt from the cache once
+	// it has been processed, rather than evaluating it themselves
+	forks []*Sequence
+
+	// waiting for another sequence to process the prompt
+	waitingForPrompt bool
+
+	// the prompt has multimodal inputs, which the draft model can't use
+	multimodal bool
+
+	// beam search that this sequence evaluates one of the hypotheses of,
+	// instead of sampling
+	beam *beamSearch
+
+	// tokens proposed by the draft model that are being checked by the
+	// inputs of the current batch
+	drafts []int32
+
+	// if set, the prompt is persisted under this name once it has been
+	// processed instead of generating from it
+	persist string
+
+	// error persisting the prompt, if any
+	persistErr error
+
+	// traces prompt processing and generation
+	spans *common.SequenceSpans
+
 	// Metrics
 	startProcessingTime time.Time
 	startGenerationTime time.Time
 	numPredicted        int
 	numPromptInputs     int
+	numDrafted          int
+	numDraftAccepted    int
 }
 
 type NewSequenceParams struct {
-	numPredict int
-	stop       []string
-	numKeep    int32
-	sampler    sample.Sampler
-	embedding  bool
+	numPredict  int
+	stop        []string
+	numKeep     int32
+	sampler     sample.Sampler
+	embedding   bool
+	logprobs    bool
+	topLogprobs int
+}
+
+// response is a chunk of generated text along with the log
+// probabilities of the tokens that make it up
+type response struct {
+	content  string
+	logprobs []api.Logprob
 }
 
 func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSequenceParams) (*Sequence, error) {
@@ -160,6 +218,14 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 
 	// TODO(jessegross): Ingest cached history for grammar
 
+	// seed the repetition penalty history with the prompt, as the llama
+	// engine does
+	for _, inp := range inputs {
+		if inp.Multimodal == nil {
+			params.sampler.Accept(inp.Token)
+		}
+	}
+
 	return &Sequence{
 		ctxs:                ctxs,
 		mmStore:             mmStore,
@@ -168,16 +234,54 @@ func (s *Server) NewSequence(prompt string, images []llm.ImageData, params NewSe
 		startProcessingTime: startTime,
 		numPredict:          params.numPredict,
 		pendingResponses:    make([]string, 0),
-		responses:           make(chan string, 100),
+		responses:           make(chan response, 100),
 		quit:                make(chan bool, 1),
 		embedding:           make(chan []float32, 1),
 		sampler:             params.sampler,
 		embeddingOnly:       params.embedding,
 		stop:                params.stop,
 		numKeep:             params.numKeep,
+		logprobs:            params.logprobs || params.topLogprobs > 0,
+		topLogprobs:         params.topLogprobs,
+		multimodal:          slices.ContainsFunc(inputs, func(inp input.Input) bool { return inp.Multimodal != nil }),
 	}, nil
 }
 
+// fork creates a sequence that generates another completion for the same
+// prompt as seq. It doesn't evaluate the prompt itself but instead copies it
+// from seq's cache slot once seq has processed it.
+func (seq *Sequence) fork(index int, sampler sample.Sampler) *Sequence {
+	for _, inp := range seq.inputs {
+		if inp.Multimodal == nil {
+			sampler.Accept(inp.Token)
+		}
+	}
+
+	f := &Sequence{
+		ctxs:                seq.ctxs,
+		mmStore:             seq.mmStore,
+		inputs:              slices.Clone(seq.inputs),
+		numPromptInputs:     seq.numPromptInputs,
+		startProcessingTime: seq.startProcessingTime,
+		numPredict:          seq.numPredict,
+		pendingResponses:    make([]string, 0),
+		responses:           make(chan response, 100),
+		quit:                make(chan bool, 1),
+		embedding:           make(chan []float32, 1),
+		sampler:             sampler,
+		stop:                seq.stop,
+		numKeep:             seq.numKeep,
+		logprobs:            seq.logprobs,
+		topLogprobs:         seq.topLogprobs,
+		index:               index,
+		waitingForPrompt:    true,
+		multimodal:          seq.multimodal,
+	}
+
+	seq.forks = append(seq.forks, f)
+	return f
+}
+
 // inputs processes the prompt and images into a list of inputs
 // by splitting the prompt on [img-<n>] tags, tokenizing text and
 // decoding images
@@ -266,6 +370,9 @@ type Server struct {
 	// loaded model
 	model model.Model
 
+	// draft model for speculative decoding, if any
+	draft *draftModel
+
 	// status for external health reporting - loading, ready to serve, etc.
 	status llm.ServerStatus
 
@@ -315,7 +422,9 @@ func (s *Server) allNil() bool {
 
 func flushPending(seq *Sequence) bool {
 	joined := strings.Join(seq.pendingResponses, "")
+	logprobs := seq.pendingLogprobs
 	seq.pendingResponses = []string{}
+	seq.pendingLogprobs = nil
 
 	// Check if there are any partial UTF-8 characters remaining.
 	// We already check and queue as we are generating but some may
@@ -327,12 +436,12 @@ func flushPending(seq *Sequence) bool {
 		joined = joined[:len(joined)-1]
 	}
 
-	if len(joined) == 0 {
+	if len(joined) == 0 && len(logprobs) == 0 {
 		return true
 	}
 
 	select {
-	case seq.responses <- joined:
+	case seq.responses <- response{content: joined, logprobs: logprobs}:
 		return true
 	case <-seq.quit:
 		return false
@@ -344,11 +453,40 @@ func (s *Server) removeSequence(seqIndex int, reason llm.DoneReason) {
 
 	flushPending(seq)
 	seq.doneReason = reason
+	seq.spans.End(attribute.String("done_reason", reason.String()), attribute.Int("generated", seq.numPredicted))
 	close(seq.responses)
 	close(seq.embedding)
 	seq.cache.InUse = false
 	s.seqs[seqIndex] = nil
 	s.seqsSem.Release(1)
+
+	// forks can't continue without the prompt they are waiting on
+	for _, f := range seq.forks {
+		if i := slices.Index(s.seqs, f); i != -1 {
+			s.removeSequence(i, reason)
+		}
+	}
+	seq.forks = nil
+}
+
+// startForks copies the processed prompt of seq into the cache slots of the
+// sequences forked from it. The last prompt input is left for each fork to
+// evaluate so that it has its own logits to sample from.
+func (s *Server) startForks(seq *Sequence) {
+	numPast := int32(len(seq.cache.Inputs)) - 1
+	for _, f := range seq.forks {
+		f.waitingForPrompt = false
+
+		// beams are copied from the hypotheses they extend instead
+		if f.beam != nil {
+			f.inputs = nil
+			continue
+		}
+
+		s.cache.CopyCacheSlot(seq.cache, f.cache, numPast)
+		f.inputs = slices.Clone(seq.cache.Inputs[numPast:])
+	}
+	seq.forks = nil
 }
 
 func (s *Server) run(ctx context.Context) {
@@ -386,7 +524,7 @@ func (s *Server) processBatch() error {
 		seqIdx = (seqIdx + 1) % len(s.seqs)
 		seq := s.seqs[seqIdx]
 
-		if seq == nil {
+		if seq == nil || seq.waitingForPrompt {
 			continue
 		}
 
@@ -401,6 +539,12 @@ func (s *Server) processBatch() error {
 			seq.cache.Inputs = []input.Input{}
 		}
 
+		if s.draft != nil && !seq.multimodal && seq.beam == nil && seq.numPredicted > 0 && len(seq.inputs) == 1 && len(seq.pendingInputs) == 0 {
+			if err := s.proposeDrafts(seq); err != nil {
+				return err
+			}
+		}
+
 		batchSize := s.batchSize
 
 		for i, inp := range seq.inputs {
@@ -457,8 +601,11 @@ func (s *Server) processBatch() error {
 			batch.Positions = append(batch.Positions, int32(len(seq.cache.Inputs)+len(seq.pendingInputs)))
 			batch.Sequences = append(batch.Sequences, seq.cache.Id)
 
-			seq.iBatch = len(batch.Outputs)
-			if i+1 == len(seq.inputs) {
+			if len(seq.pendingInputs) == 0 {
+				seq.iBatch = len(batch.Outputs)
+			}
+			// drafts are checked against the logits of the input before them
+			if i+1 == len(seq.inputs) || len(seq.drafts) > 0 {
 				batch.Outputs = append(batch.Outputs, int32(len(batchInputs)-1))
 			}
 			seq.pendingInputs = append(seq.pendingInputs, inp)
@@ -477,6 +624,20 @@ func (s *Server) processBatch() error {
 		return nil
 	}
 
+	var links []trace.Link
+	for _, seq := range s.seqs {
+		if seq != nil && len(seq.pendingInputs) > 0 {
+			if link, ok := seq.spans.Link(); ok {
+				links = append(links, link)
+			}
+		}
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "processBatch",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("inputs", len(batchInputs)), attribute.Int("outputs", len(batch.Outputs))))
+	defer span.End()
+
 	modelOutput, err := model.Forward(ctx, s.model, batchInputs, batch)
 	if err != nil {
 		return fmt.Errorf("failed to decode batch: %w", err)
@@ -484,13 +645,15 @@ func (s *Server) processBatch() error {
 
 	logits := modelOutput.Floats()
 
+	var searches []*beamSearch
 	for i, seq := range s.seqs {
-		if seq == nil {
+		if seq == nil || seq.waitingForPrompt {
 			continue
 		}
 
 		// After calling Forward, pending inputs are now in the cache
-		if len(seq.pendingInputs) > 0 {
+		evaluated := len(seq.pendingInputs) > 0
+		if evaluated {
 			seq.cache.Inputs = append(seq.cache.Inputs, seq.pendingInputs...)
 			seq.pendingInputs = []input.Input{}
 		}
@@ -503,6 +666,22 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
+		if len(seq.forks) > 0 {
+			s.startForks(seq)
+		}
+
+		// beams are extended together once all of them have been evaluated
+		if seq.beam != nil {
+			if evaluated {
+				vocabSize := len(logits) / len(batch.Outputs)
+				seq.beam.evaluated(seq, logits[seq.iBatch*vocabSize:(seq.iBatch+1)*vocabSize])
+			}
+			if !slices.Contains(searches, seq.beam) {
+				searches = append(searches, seq.beam)
+			}
+			continue
+		}
+
 		seq.numPredicted++
 		if seq.numPredicted == 1 {
 			seq.startGenerationTime = time.Now()
@@ -516,74 +695,189 @@ func (s *Server) processBatch() error {
 			continue
 		}
 
-		// sample a token
-		vocabSize := len(logits) / len(batch.Outputs)
+		// if done processing a prompt to persist, save it and return
+		if seq.persist != "" {
+			seq.persistErr = s.cache.SaveCacheSlot(seq.cache, seq.persist)
+			s.removeSequence(i, llm.DoneReasonStop)
+			continue
+		}
+
+		if seq.numPredicted == 1 {
+			seq.spans.Phase("decode")
+		}
 
-		token, err := seq.sampler.Sample(logits[seq.iBatch*vocabSize : (seq.iBatch+1)*vocabSize])
+		// sample a token, or several if the batch checked drafts
+		vocabSize := len(logits) / len(batch.Outputs)
+		tokens, err := s.sampleTokens(seq, logits, vocabSize)
 		if err != nil {
-			return fmt.Errorf("failed to sample token: %w", err)
+			return err
 		}
 
-		// if it's an end of sequence token, break
-		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
-			// TODO (jmorganca): we should send this back
-			// as it's important for the /api/generate context
-			// seq.responses <- piece
+		// each token is handled as if the tokens after it weren't in the cache yet
+		inputs := seq.cache.Inputs
+		for j, token := range tokens {
+			if j > 0 {
+				seq.numPredicted++
+			}
 
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
+			seq.cache.Inputs = inputs[:len(inputs)-len(tokens)+1+j]
+			seqLogits := logits[(seq.iBatch+j)*vocabSize : (seq.iBatch+j+1)*vocabSize]
+			if ok, err := s.emitToken(i, seq, token, seqLogits); err != nil {
+				return err
+			} else if !ok {
+				break
+			}
 		}
+	}
 
-		piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
-		if err != nil {
+	for _, b := range searches {
+		if err := s.stepBeams(b); err != nil {
 			return err
 		}
+	}
 
-		seq.inputs = []input.Input{{Token: token}}
+	return nil
+}
 
-		seq.pendingResponses = append(seq.pendingResponses, piece)
-		sequence := strings.Join(seq.pendingResponses, "")
+// proposeDrafts adds tokens proposed by the draft model to the inputs of seq,
+// which are all evaluated in the same batch as its next input
+func (s *Server) proposeDrafts(seq *Sequence) error {
+	n := min(maxDraftTokens, int(s.cache.numCtx)-len(seq.cache.Inputs)-1, s.batchSize-1)
+	if seq.numPredict > 0 {
+		n = min(n, seq.numPredict-seq.numPredicted-1)
+	}
 
-		if ok, stop := common.FindStop(sequence, seq.stop); ok {
-			slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+	drafts, err := s.draft.propose(seq.cache.Id, append(slices.Clone(seq.cache.Inputs), seq.inputs...), n)
+	if err != nil || len(drafts) == 0 {
+		return err
+	}
 
-			var tokenTruncated bool
-			origLen := len(seq.pendingResponses)
-			seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
-			newLen := len(seq.pendingResponses)
+	seq.inputs[0].SameBatch = len(drafts)
+	for _, token := range drafts {
+		seq.inputs = append(seq.inputs, input.Input{Token: token})
+	}
+	seq.drafts = drafts
 
-			// Update the cache based on the tokens that will be returned:
-			// - We have 1 token more than is currently in the cache because
-			// the last one generated wasn't submitted to Decode
-			// - Remove any stop sequences that we stripped out
-			// - If truncateStop removed a portion of a token, drop that
-			// - As defense-in-depth, if truncatedToken didn't find a stop token
-			// remove the extra one that we added to the cache len
-			tokenLen := len(seq.cache.Inputs) + 1
-			tokenLen -= origLen - newLen
-			if tokenTruncated || origLen == newLen {
-				tokenLen--
-			}
-			seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+	return nil
+}
 
-			s.removeSequence(i, llm.DoneReasonStop)
-			continue
+// sampleTokens samples the next token of seq from its logits in the batch. If
+// the batch checked drafts, sampling continues for as long as the sampled
+// tokens match the drafts and the rejected drafts are removed from the cache.
+// The sampled tokens are the same as if they had been generated one at a time.
+func (s *Server) sampleTokens(seq *Sequence, logits []float32, vocabSize int) ([]int32, error) {
+	drafts := seq.drafts
+	seq.drafts = nil
+
+	var tokens []int32
+	var accepted int
+	for j := range len(drafts) + 1 {
+		token, err := seq.sampler.Sample(logits[(seq.iBatch+j)*vocabSize : (seq.iBatch+j+1)*vocabSize])
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample token: %w", err)
 		}
+		seq.sampler.Accept(token)
+		tokens = append(tokens, token)
 
-		if common.ContainsStopSuffix(sequence, seq.stop) {
-			continue
+		if j == len(drafts) || token != drafts[j] {
+			break
 		}
 
-		if common.IncompleteUnicode(sequence) {
-			continue
+		accepted++
+		if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+			break
 		}
+	}
 
-		if !flushPending(seq) {
-			s.removeSequence(i, llm.DoneReasonConnectionClosed)
+	if len(drafts) > 0 {
+		seq.numDrafted += len(drafts)
+		seq.numDraftAccepted += accepted
+
+		// keep the drafts that were sampled, except for the last token,
+		// which is evaluated in the next batch like any other
+		numPast := len(seq.cache.Inputs) - len(drafts) + len(tokens) - 1
+		if err := s.cache.cache.Remove(seq.cache.Id, int32(numPast), math.MaxInt32); err != nil {
+			return nil, fmt.Errorf("failed to remove rejected drafts: %w", err)
 		}
+		seq.cache.Inputs = seq.cache.Inputs[:numPast]
 	}
 
-	return nil
+	return tokens, nil
+}
+
+// emitToken adds token, sampled from logits, to the response of seq, which is
+// at index i. It returns false if this finishes the sequence.
+func (s *Server) emitToken(i int, seq *Sequence, token int32, logits []float32) (bool, error) {
+	// if it's an end of sequence token, break
+	if s.model.(model.TextProcessor).Is(token, model.SpecialEOS) {
+		// TODO (jmorganca): we should send this back
+		// as it's important for the /api/generate context
+		// seq.responses <- piece
+
+		s.removeSequence(i, llm.DoneReasonStop)
+		return false, nil
+	}
+
+	piece, err := s.model.(model.TextProcessor).Decode([]int32{token})
+	if err != nil {
+		return false, err
+	}
+
+	seq.inputs = []input.Input{{Token: token}}
+
+	seq.pendingResponses = append(seq.pendingResponses, piece)
+	if seq.logprobs {
+		seq.pendingLogprobs = append(seq.pendingLogprobs, common.CalculateLogprob(logits, token, seq.topLogprobs, func(id int32) string {
+			p, _ := s.model.(model.TextProcessor).Decode([]int32{id})
+			return p
+		}))
+	}
+	sequence := strings.Join(seq.pendingResponses, "")
+
+	if ok, stop := common.FindStop(sequence, seq.stop); ok {
+		slog.Debug("hit stop token", "pending", seq.pendingResponses, "stop", stop)
+
+		var tokenTruncated bool
+		origLen := len(seq.pendingResponses)
+		seq.pendingResponses, tokenTruncated = common.TruncateStop(seq.pendingResponses, stop)
+		newLen := len(seq.pendingResponses)
+		if len(seq.pendingLogprobs) > newLen {
+			seq.pendingLogprobs = seq.pendingLogprobs[:newLen]
+		}
+
+		// Update the cache based on the tokens that will be returned:
+		// - We have 1 token more than is currently in the cache because
+		// the last one generated wasn't submitted to Decode
+		// - Remove any stop sequences that we stripped out
+		// - If truncateStop removed a portion of a token, drop that
+		// - As defense-in-depth, if truncatedToken didn't find a stop token
+		// remove the extra one that we added to the cache len
+		tokenLen := len(seq.cache.Inputs) + 1
+		tokenLen -= origLen - newLen
+		if tokenTruncated || origLen == newLen {
+			tokenLen--
+		}
+		seq.cache.Inputs = seq.cache.Inputs[:tokenLen]
+
+		seq.stopSequence = stop
+		s.removeSequence(i, llm.DoneReasonStop)
+		return false, nil
+	}
+
+	if common.ContainsStopSuffix(sequence, seq.stop) {
+		return true, nil
+	}
+
+	if common.IncompleteUnicode(sequence) {
+		return true, nil
+	}
+
+	if !flushPending(seq) {
+		s.removeSequence(i, llm.DoneReasonConnectionClosed)
+		return false, nil
+	}
+
+	return true, nil
 }
 
 func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
@@ -608,40 +902,116 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var grammar *sample.GrammarSampler
-	var err error
-	if req.Grammar != "" {
-		grammar, err = sample.NewGrammarSampler(s.model.(model.TextProcessor), req.Grammar)
-		if err != nil {
-			http.Error(w, "failed to load model vocabulary required for format", http.StatusInternalServerError)
+	n := max(req.N, 1)
+	if n > s.parallel {
+		http.Error(w, fmt.Sprintf("n must not exceed the number of parallel sequences (%d)", s.parallel), http.StatusBadRequest)
+		return
+	}
+
+	// each beam is evaluated by its own sequence, and the first one returns
+	// the completion
+	numBeams := max(req.Options.NumBeams, 1)
+	if numBeams > 1 {
+		switch {
+		case n > 1:
+			http.Error(w, "n can't be combined with num_beams", http.StatusBadRequest)
+			return
+		case numBeams > s.parallel:
+			http.Error(w, fmt.Sprintf("num_beams must not exceed the number of parallel sequences (%d)", s.parallel), http.StatusBadRequest)
+			return
+		case req.Grammar != "":
+			http.Error(w, "num_beams can't be combined with a grammar", http.StatusBadRequest)
 			return
 		}
-		defer grammar.Free()
 	}
 
-	sampler := sample.NewSampler(
-		req.Options.Temperature,
-		req.Options.TopK,
-		req.Options.TopP,
-		req.Options.MinP,
-		req.Options.Seed,
-		grammar,
-	)
-
-	seq, err := s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
-		numPredict: req.Options.NumPredict,
-		stop:       req.Options.Stop,
-		numKeep:    int32(req.Options.NumKeep),
-		sampler:    sampler,
-		embedding:  false,
-	})
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+	if err := sample.ValidateSamplers(req.Options.Samplers); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Ensure there is a place to put the sequence, released when removed from s.seqs
-	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+	// each completion gets its own sampler, so that they can diverge, but
+	// all of them share the prompt evaluated by the first sequence
+	seqs := make([]*Sequence, max(n, numBeams))
+	for i := range seqs {
+		var constraint sample.Constraint
+		var err error
+		if req.Grammar != "" {
+			grammar, err := sample.NewGrammarSampler(s.model.(model.TextProcessor), req.Grammar)
+			if err != nil {
+				http.Error(w, "failed to load model vocabulary required for format", http.StatusInternalServerError)
+				return
+			}
+			defer grammar.Free()
+			constraint = grammar
+		} else if format := bytes.TrimSpace(req.Format); len(format) > 0 && format[0] == '{' {
+			// the format is compiled once and its masks are shared by
+			// every sequence
+			constraint, err = sample.NewFormatSampler(s.model.(model.TextProcessor), format)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid format: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		seed := req.Options.Seed
+		if seed != -1 {
+			seed += i
+		}
+
+		sampler := sample.NewSampler(
+			req.Options.Temperature,
+			req.Options.TopK,
+			req.Options.TopP,
+			req.Options.MinP,
+			req.Options.RepeatLastN,
+			req.Options.RepeatPenalty,
+			req.Options.PresencePenalty,
+			req.Options.FrequencyPenalty,
+			req.Options.LogitBias,
+			seed,
+			constraint,
+			sample.WithTypicalP(req.Options.TypicalP),
+			sample.WithMirostat(req.Options.Mirostat, req.Options.MirostatTau, req.Options.MirostatEta),
+			sample.WithDRY(
+				s.model.(model.TextProcessor),
+				req.Options.DryMultiplier,
+				req.Options.DryBase,
+				req.Options.DryAllowedLength,
+				req.Options.DryPenaltyLastN,
+				req.Options.DrySequenceBreakers,
+			),
+			sample.WithXTC(req.Options.XTCProbability, req.Options.XTCThreshold),
+			sample.WithSamplers(req.Options.Samplers),
+		)
+		slog.Debug("sampler chain", "seq", i, "samplers", sampler.Chain(), "mirostat", req.Options.Mirostat, "seed", seed)
+
+		if i > 0 {
+			seqs[i] = seqs[0].fork(i, sampler)
+			continue
+		}
+
+		seqs[i], err = s.NewSequence(req.Prompt, req.Images, NewSequenceParams{
+			numPredict:  req.Options.NumPredict,
+			stop:        req.Options.Stop,
+			numKeep:     int32(req.Options.NumKeep),
+			sampler:     sampler,
+			embedding:   false,
+			logprobs:    req.Options.Logprobs,
+			topLogprobs: req.Options.TopLogprobs,
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if numBeams > 1 {
+		newBeamSearch(seqs, req.Options.LengthPenalty, req.Options.EarlyStopping)
+	}
+
+	// Ensure there is a place to put the sequences, released when removed from s.seqs
+	if err := s.seqsSem.Acquire(r.Context(), int64(len(seqs))); err != nil {
 		if errors.Is(err, context.Canceled) {
 			slog.Info("aborting completion request due to client closing the connection")
 		} else {
@@ -651,63 +1021,199 @@ func (s *Server) completion(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.mu.Lock()
-	found := false
-	for i, sq := range s.seqs {
-		if sq == nil {
-			seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
-			if err != nil {
-				s.mu.Unlock()
-				s.seqsSem.Release(1)
-				http.Error(w, fmt.Sprintf("Failed to load cache: %v", err), http.StatusInternalServerError)
+	if err := s.addSequences(seqs); err != nil {
+		s.mu.Unlock()
+		s.seqsSem.Release(int64(len(seqs)))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, seq := range seqs {
+		seq.spans = common.NewSequenceSpans(r.Context(), "prefill",
+			attribute.Int("index", seq.index), attribute.Int("inputs", seq.numPromptInputs))
+	}
+	s.cond.Signal()
+	s.mu.Unlock()
+
+	// forward the responses of all sequences, tagged with their index
+	type result struct {
+		seq  *Sequence
+		resp response
+		done bool
+	}
+
+	results := make(chan result)
+	for _, seq := range seqs[:n] {
+		go func() {
+			for resp := range seq.responses {
+				select {
+				case results <- result{seq: seq, resp: resp}:
+				case <-seq.quit:
+					return
+				}
+			}
+
+			select {
+			case results <- result{seq: seq, done: true}:
+			case <-seq.quit:
+			}
+		}()
+	}
+
+	quit := func() {
+		for _, seq := range seqs {
+			close(seq.quit)
+		}
+	}
+
+	// the prompt has been processed by the time anything is generated, so
+	// it's counted in the first response of each sequence
+	counted := make([]bool, n)
+	for remaining := n; remaining > 0; {
+		select {
+		case <-r.Context().Done():
+			quit()
+			return
+		case res := <-results:
+			seq := res.seq
+			if !res.done {
+				resp := llm.CompletionResponse{
+					Index:    seq.index,
+					Content:  res.resp.content,
+					Logprobs: res.resp.logprobs,
+				}
+				if !counted[seq.index] {
+					counted[seq.index] = true
+					resp.PromptEvalCount = seq.numPromptInputs
+				}
+
+				if err := json.NewEncoder(w).Encode(&resp); err != nil {
+					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+					quit()
+					return
+				}
+
+				flusher.Flush()
+				continue
+			}
+
+			if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
+				Index:              seq.index,
+				Done:               true,
+				DoneReason:         seq.doneReason,
+				StopSequence:       seq.stopSequence,
+				PromptEvalCount:    seq.numPromptInputs,
+				PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
+				EvalCount:          seq.numPredicted,
+				EvalDuration:       time.Since(seq.startGenerationTime),
+				DraftCount:         seq.numDrafted,
+				DraftAcceptedCount: seq.numDraftAccepted,
+			}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
+				quit()
 				return
 			}
 
-			s.seqs[i] = seq
-			s.cond.Signal()
-			found = true
-			break
+			flusher.Flush()
+			remaining--
 		}
 	}
-	s.mu.Unlock()
+}
+
+// warm processes a prompt and persists its KV cache to disk under the
+// requested name, without generating anything
+func (s *Server) warm(w http.ResponseWriter, r *http.Request) {
+	var req llm.WarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	seq, err := s.NewSequence(req.Prompt, nil, NewSequenceParams{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create new sequence: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(seq.inputs) >= int(s.cache.numCtx) {
+		http.Error(w, fmt.Sprintf("prompt of %d tokens does not fit in the context window of %d", len(seq.inputs), s.cache.numCtx), http.StatusBadRequest)
+		return
+	}
+	seq.persist = req.Name
 
-	if !found {
+	if err := s.seqsSem.Acquire(r.Context(), 1); err != nil {
+		if errors.Is(err, context.Canceled) {
+			slog.Info("aborting warm request due to client closing the connection")
+		} else {
+			http.Error(w, fmt.Sprintf("Failed to acquire semaphore: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	if err := s.addSequences([]*Sequence{seq}); err != nil {
+		s.mu.Unlock()
 		s.seqsSem.Release(1)
-		http.Error(w, "could not find an available sequence", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	seq.spans = common.NewSequenceSpans(r.Context(), "prefill", attribute.Int("inputs", seq.numPromptInputs))
+	s.cond.Signal()
+	s.mu.Unlock()
 
 	for {
 		select {
 		case <-r.Context().Done():
 			close(seq.quit)
 			return
-		case content, ok := <-seq.responses:
+		case _, ok := <-seq.responses:
 			if ok {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Content: content,
-				}); err != nil {
-					http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
-					close(seq.quit)
-					return
-				}
-
-				flusher.Flush()
-			} else {
-				if err := json.NewEncoder(w).Encode(&llm.CompletionResponse{
-					Done:               true,
-					DoneReason:         seq.doneReason,
-					PromptEvalCount:    seq.numPromptInputs,
-					PromptEvalDuration: seq.startGenerationTime.Sub(seq.startProcessingTime),
-					EvalCount:          seq.numPredicted,
-					EvalDuration:       time.Since(seq.startGenerationTime),
-				}); err != nil {
-					http.Error(w, fmt.Sprintf("failed to encode final response: %v", err), http.StatusInternalServerError)
-				}
+				continue
+			}
 
+			if seq.persistErr != nil {
+				http.Error(w, seq.persistErr.Error(), http.StatusInternalServerError)
 				return
 			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&llm.WarmResponse{Count: seq.numPromptInputs}); err != nil {
+				http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+}
+
+// addSequences places seqs into free entries of s.seqs and loads a cache
+// slot for each of them. Either all of the sequences are added or none are.
+func (s *Server) addSequences(seqs []*Sequence) error {
+	var added []int
+	rollback := func() {
+		for _, i := range added {
+			s.seqs[i].cache.InUse = false
+			s.seqs[i] = nil
+		}
+	}
+
+	for _, seq := range seqs {
+		i := slices.Index(s.seqs, nil)
+		if i == -1 {
+			rollback()
+			return errors.New("could not find an available sequence")
+		}
+
+		var err error
+		seq.cache, seq.inputs, err = s.cache.LoadCacheSlot(seq.inputs)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("failed to load cache: %w", err)
 		}
+
+		s.seqs[i] = seq
+		added = append(added, i)
 	}
+
+	return nil
 }
 
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
@@ -839,10 +1345,13 @@ func (s *Server) loadModel(
 	mpath string,
 	params ml.BackendParams,
 	lpath multiLPath,
+	draftPath string,
+	draftGPULayers int,
 	parallel int,
 	kvCacheType string,
 	kvSize int,
 	multiUserCache bool,
+	kvCacheDir string,
 ) {
 	var err error
 	s.model, err = model.New(mpath, params)
@@ -855,7 +1364,7 @@ func (s *Server) loadModel(
 		panic("loras are not yet implemented")
 	}
 
-	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, s.batchSize, multiUserCache)
+	s.cache, err = NewInputCache(s.model, kvCacheType, int32(kvSize), parallel, s.batchSize, multiUserCache, kvCacheDir)
 	if err != nil {
 		panic(err)
 	}
@@ -882,6 +1391,10 @@ func (s *Server) loadModel(
 		panic(err)
 	}
 
+	if draftPath != "" {
+		s.loadDraftModel(ctx, draftPath, params, draftGPULayers, kvCacheType)
+	}
+
 	s.status = llm.ServerStatusReady
 	s.ready.Done()
 }
@@ -902,6 +1415,9 @@ func Execute(args []string) error {
 	_ = fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	draftPath := fs.String("draft", "", "Path to draft model for speculative decoding")
+	draftGPULayers := fs.Int("draft-n-gpu-layers", 0, "Number of draft model layers to offload to GPU")
+	kvCacheDir := fs.String("kv-cache-dir", "", "Directory to persist prompts to")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -943,11 +1459,17 @@ func Execute(args []string) error {
 		FlashAttention: *flashAttention,
 	}
 
+	shutdown, err := tracing.Init(context.Background(), "ollama-runner")
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
 	server.ready.Add(1)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go server.loadModel(ctx, *mpath, params, lpaths, *parallel, *kvCacheType, *kvSize, *multiUserCache)
+	go server.loadModel(ctx, *mpath, params, lpaths, *draftPath, *draftGPULayers, *parallel, *kvCacheType, *kvSize, *multiUserCache, *kvCacheDir)
 
 	server.cond = sync.NewCond(&server.mu)
 
@@ -966,8 +1488,12 @@ func Execute(args []string) error {
 	mux.HandleFunc("POST /embedding", func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "this model does not support embeddings", http.StatusNotImplemented)
 	})
+	mux.HandleFunc("POST /rerank", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "this model does not support reranking", http.StatusNotImplemented)
+	})
 
-	mux.HandleFunc("POST /completion", server.completion)
+	mux.Handle("POST /completion", tracing.Handler(http.HandlerFunc(server.completion)))
+	mux.Handle("POST /warm", tracing.Handler(http.HandlerFunc(server.warm)))
 	mux.HandleFunc("GET /health", server.health)
 
 	httpServer := http.Server{
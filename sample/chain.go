@@ -0,0 +1,189 @@
+package sample
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// transform is a step of the sampler chain
+type transform struct {
+	// probs is set for transforms of probabilities sorted in descending order,
+	// rather than of logits
+	probs bool
+	// sorts is set for transforms that sort tokens in descending order
+	sorts bool
+	// penalty is set for transforms that penalize tokens from history. They
+	// can reorder tokens and are also applied when sampling greedily or with
+	// mirostat.
+	penalty bool
+
+	// enabled reports whether the transform changes tokens with the
+	// sampler's parameters
+	enabled func(*Sampler) bool
+	apply   func(*Sampler, []token) []token
+}
+
+// transforms are the samplers that can be ordered with WithSamplers, by the
+// names llama.cpp uses for them
+var transforms = map[string]transform{
+	"penalties": {
+		penalty: true,
+		enabled: func(s *Sampler) bool {
+			return s.repeatLastN != 0 && (s.repeatPenalty != 1 || s.frequencyPenalty != 0 || s.presencePenalty != 0)
+		},
+		apply: func(s *Sampler, ts []token) []token {
+			penalties(ts, s.recent(s.repeatLastN), s.repeatPenalty, s.frequencyPenalty, s.presencePenalty)
+			return ts
+		},
+	},
+	"dry": {
+		penalty: true,
+		enabled: func(s *Sampler) bool { return s.dry != nil },
+		apply: func(s *Sampler, ts []token) []token {
+			dry(ts, s.recent(s.dry.lastN), s.dry.multiplier, s.dry.base, s.dry.allowedLength, s.dry.breakers)
+			return ts
+		},
+	},
+	"top_k": {
+		sorts:   true,
+		enabled: func(s *Sampler) bool { return s.topK > 0 },
+		apply:   func(s *Sampler, ts []token) []token { return topK(ts, s.topK) },
+	},
+	"temperature": {
+		enabled: func(s *Sampler) bool { return true },
+		apply: func(s *Sampler, ts []token) []token {
+			temperature(ts, s.temperature)
+			return ts
+		},
+	},
+	"typical": {
+		probs:   true,
+		enabled: func(s *Sampler) bool { return s.typicalP < 1 },
+		apply:   func(s *Sampler, ts []token) []token { return typical(ts, s.typicalP) },
+	},
+	"top_p": {
+		probs:   true,
+		enabled: func(s *Sampler) bool { return s.topP < 1 },
+		apply:   func(s *Sampler, ts []token) []token { return topP(ts, s.topP) },
+	},
+	"min_p": {
+		probs:   true,
+		enabled: func(s *Sampler) bool { return s.minP > 0 },
+		apply:   func(s *Sampler, ts []token) []token { return minP(ts, s.minP) },
+	},
+	"xtc": {
+		probs:   true,
+		enabled: func(s *Sampler) bool { return s.xtc.probability > 0 },
+		apply: func(s *Sampler, ts []token) []token {
+			return xtc(ts, s.xtc.probability, s.xtc.threshold, s.random())
+		},
+	},
+}
+
+// DefaultSamplers is the order samplers are applied in unless it's set with
+// WithSamplers
+var DefaultSamplers = []string{"penalties", "dry", "top_k", "temperature", "typical", "top_p", "min_p", "xtc"}
+
+// ValidateSamplers checks that names are known samplers, each listed at most
+// once
+func ValidateSamplers(names []string) error {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := transforms[name]; !ok {
+			return fmt.Errorf("unknown sampler %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(transforms)), ", "))
+		}
+
+		if seen[name] {
+			return fmt.Errorf("sampler %q is listed more than once", name)
+		}
+		seen[name] = true
+	}
+
+	return nil
+}
+
+// WithSamplers applies samplers in the given order instead of
+// DefaultSamplers. Samplers that aren't listed aren't applied, even if their
+// parameters are set. Names should be checked with ValidateSamplers first;
+// unknown names are ignored.
+func WithSamplers(names []string) Option {
+	return func(s *Sampler) {
+		if len(names) > 0 {
+			s.samplers = names
+		}
+	}
+}
+
+// buildChain sets the chain of transforms that are applied with the
+// sampler's parameters. Only penalties are applied before sampling
+// greedily, and mirostat replaces the transforms that truncate tokens.
+func (s *Sampler) buildChain() {
+	names := s.samplers
+	if names == nil {
+		names = DefaultSamplers
+	}
+
+	s.chain = nil
+	for _, name := range names {
+		t, ok := transforms[name]
+		if !ok || !t.enabled(s) {
+			continue
+		}
+
+		switch {
+		case s.temperature == 0 && !t.penalty:
+			continue
+		case s.mirostat != nil && !t.penalty && name != "temperature":
+			continue
+		}
+
+		s.chain = append(s.chain, name)
+	}
+}
+
+// Chain returns the names of the transforms the sampler applies, in order,
+// after the logit bias and before the token is chosen greedily, with
+// mirostat, or at random
+func (s *Sampler) Chain() []string {
+	return slices.Clone(s.chain)
+}
+
+// applyChain applies the sampler's chain of transforms to tokens. Unless the
+// sampler is greedy, the remaining tokens are then normalized and sorted in
+// descending order.
+func (s *Sampler) applyChain(tokens []token) []token {
+	var sorted, probs bool
+	for _, name := range s.chain {
+		t := transforms[name]
+		switch {
+		case t.probs && !probs:
+			if !sorted {
+				tokens = topK(tokens, 0)
+				sorted = true
+			}
+			softmax(tokens)
+			probs = true
+		case !t.probs && probs:
+			// back to logits, which keeps the relative probabilities
+			for i := range tokens {
+				tokens[i].value = float32(math.Log(float64(tokens[i].value)))
+			}
+			probs = false
+		}
+
+		tokens = t.apply(s, tokens)
+		sorted = t.sorts || sorted && !t.penalty
+	}
+
+	if !probs && s.temperature != 0 {
+		if !sorted {
+			tokens = topK(tokens, 0)
+		}
+		softmax(tokens)
+	}
+
+	return tokens
+}
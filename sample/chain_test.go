@@ -0,0 +1,117 @@
+package sample
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	m := modelHelper(t)
+	cases := []struct {
+		desc    string
+		sampler Sampler
+		want    []string
+	}{
+		{
+			desc:    "defaults",
+			sampler: NewSampler(0.8, 40, 0.9, 0, 64, 1.1, 0, 0, nil, -1, nil),
+			want:    []string{"penalties", "top_k", "temperature", "top_p"},
+		},
+		{
+			desc:    "all samplers",
+			sampler: NewSampler(0.8, 40, 0.9, 0.05, 64, 1.1, 0, 0, nil, -1, nil, WithTypicalP(0.9), WithDRY(m, 0.8, 1.75, 2, -1, nil), WithXTC(0.5, 0.1)),
+			want:    DefaultSamplers,
+		},
+		{
+			desc:    "custom order",
+			sampler: NewSampler(0.8, 40, 0.9, 0.05, 64, 1.1, 0, 0, nil, -1, nil, WithTypicalP(0.9), WithSamplers([]string{"penalties", "top_k", "typical", "min_p", "temperature"})),
+			want:    []string{"penalties", "top_k", "typical", "min_p", "temperature"},
+		},
+		{
+			desc:    "greedy",
+			sampler: NewSampler(0, 40, 0.9, 0.05, 64, 1.1, 0, 0, nil, -1, nil),
+			want:    []string{"penalties"},
+		},
+		{
+			desc:    "mirostat",
+			sampler: NewSampler(0.8, 40, 0.9, 0.05, 0, 1, 0, 0, nil, -1, nil, WithMirostat(2, 5, 0.1)),
+			want:    []string{"temperature"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			if got := c.sampler.Chain(); !slices.Equal(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSamplerOrder(t *testing.T) {
+	// min_p keeps the first two tokens at temperature 1, and all of them
+	// once a high temperature flattens the distribution
+	logits := []float32{2, 1, 0}
+
+	sampled := func(order []string) map[int32]bool {
+		sampler := NewSampler(100, 0, 1, 0.3, 0, 1, 0, 0, nil, 42, nil, WithSamplers(order))
+		ids := make(map[int32]bool)
+		for range 100 {
+			id, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[id] = true
+		}
+		return ids
+	}
+
+	if ids := sampled([]string{"min_p", "temperature"}); ids[2] {
+		t.Errorf("expected min_p before temperature to exclude token 2, got %v", ids)
+	}
+
+	if ids := sampled([]string{"temperature", "min_p"}); !ids[2] {
+		t.Errorf("expected min_p after temperature to keep token 2, got %v", ids)
+	}
+}
+
+func TestSamplerOrderPenalties(t *testing.T) {
+	logits := []float32{2, 1, 0}
+
+	// penalties aren't applied unless they're in the chain
+	sampler := NewSampler(0, 0, 1, 0, 64, 1, 0, 10, nil, -1, nil, WithSamplers([]string{"top_k", "temperature"}))
+	sampler.Accept(0)
+	if got, err := sampler.Sample(logits); err != nil || got != 0 {
+		t.Errorf("expected token 0 without penalties, got %d, %v", got, err)
+	}
+
+	// penalties after top_k only apply to the tokens top_k keeps
+	sampler = NewSampler(1, 2, 1, 0, 64, 1, 0, 10, nil, 42, nil, WithSamplers([]string{"top_k", "penalties"}))
+	sampler.Accept(0)
+	if got, err := sampler.Sample(logits); err != nil || got != 1 {
+		t.Errorf("expected token 1 after penalties, got %d, %v", got, err)
+	}
+}
+
+func TestValidateSamplers(t *testing.T) {
+	if err := ValidateSamplers(DefaultSamplers); err != nil {
+		t.Errorf("expected default samplers to be valid, got %v", err)
+	}
+
+	cases := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"top_k", "top_n_sigma"}, `unknown sampler "top_n_sigma"`},
+		{[]string{"mirostat"}, `unknown sampler "mirostat"`},
+		{[]string{"top_k", "temperature", "top_k"}, `sampler "top_k" is listed more than once`},
+	}
+
+	for _, c := range cases {
+		err := ValidateSamplers(c.names)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: expected error containing %q, got %v", c.names, c.want, err)
+		}
+	}
+}
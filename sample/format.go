@@ -0,0 +1,424 @@
+package sample
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ollama/ollama/model"
+)
+
+// Formats other than a JSON schema that output can be constrained to
+const (
+	// formatRegex is output that matches a regular expression
+	formatRegex = "regex"
+	// formatChoice is output that is exactly one of a list of options
+	formatChoice = "choice"
+)
+
+// compileFormat compiles the format of a request into rules. Formats are a
+// JSON schema, or an object with a type of "regex" and a pattern or a type
+// of "choice" and options.
+func compileFormat(format []byte) (*rules, int32, error) {
+	e, ok, err := formatExpr(format)
+	if err != nil {
+		return nil, 0, err
+	} else if !ok {
+		return compileSchema(format)
+	}
+
+	var b ruleBuilder
+	return &b.rules, int32(b.ref(e)), nil
+}
+
+// formatExpr returns an expression for a regex or choice format, or false if
+// format is a JSON schema
+func formatExpr(format []byte) (expr, bool, error) {
+	var f struct {
+		// a schema's type can also be a list of types
+		Type    any      `json:"type"`
+		Pattern *string  `json:"pattern"`
+		Options []string `json:"options"`
+	}
+	if err := json.Unmarshal(format, &f); err != nil {
+		return nil, false, nil
+	}
+
+	switch f.Type {
+	case formatRegex:
+		if f.Pattern == nil || *f.Pattern == "" {
+			return nil, false, errors.New("regex format requires a pattern")
+		}
+
+		e, err := parseRegex(*f.Pattern)
+		if err != nil {
+			return nil, false, err
+		}
+		return e, true, nil
+	case formatChoice:
+		if len(f.Options) == 0 {
+			return nil, false, errors.New("choice format requires options")
+		}
+
+		var alts choice
+		for _, o := range f.Options {
+			alts = append(alts, literal(o))
+		}
+		return alts, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// FormatSampler constrains sampling to output in a format. The format is
+// compiled into rules over bytes, and the tokens that the rules allow in each
+// state are computed once and cached as a mask.
+type FormatSampler struct {
+	*compiledFormat
+	state int32
+}
+
+// compiledFormat is a format compiled for a vocabulary. The matcher and masks
+// are shared by every sampler of the format and are only added to.
+type compiledFormat struct {
+	vocab *vocabIndex
+	start int32
+
+	mu      sync.Mutex
+	matcher *matcher
+	masks   map[int32][]uint64
+}
+
+type formatKey struct {
+	vocab  *model.Vocabulary
+	format string
+}
+
+// maxFormats limits how many compiled formats are cached, since their masks
+// grow as they're used
+const maxFormats = 64
+
+// formats caches compiled formats by vocabulary and format, so that the
+// sequences of a request, and requests with the same format, only compile
+// it once and share its masks
+var (
+	formats     sync.Map
+	formatCount atomic.Int32
+)
+
+// NewFormatSampler returns a sampler that constrains the tokens of model to
+// output in format
+func NewFormatSampler(model model.TextProcessor, format []byte) (*FormatSampler, error) {
+	key := formatKey{vocab: model.Vocabulary(), format: string(format)}
+	if f, ok := formats.Load(key); ok {
+		return &FormatSampler{compiledFormat: f.(*compiledFormat), state: f.(*compiledFormat).start}, nil
+	}
+
+	r, root, err := compileFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	m, start := newMatcher(r, root)
+	f := &compiledFormat{
+		vocab:   vocabularyIndex(model),
+		matcher: m,
+		start:   start,
+		masks:   make(map[int32][]uint64),
+	}
+
+	if formatCount.Add(1) > maxFormats {
+		formats.Clear()
+		formatCount.Store(1)
+	}
+
+	actual, _ := formats.LoadOrStore(key, f)
+	f = actual.(*compiledFormat)
+	return &FormatSampler{compiledFormat: f, state: f.start}, nil
+}
+
+// ValidateFormat reports whether format can be used to constrain sampling
+func ValidateFormat(format []byte) error {
+	_, _, err := compileFormat(format)
+	return err
+}
+
+// Apply sets the logits of tokens that don't match the schema to -Inf
+func (s *FormatSampler) Apply(tokens []token) {
+	var mask []uint64
+	if s.state != stateDead {
+		s.mu.Lock()
+		mask = s.mask(s.state)
+		s.mu.Unlock()
+	}
+
+	for i := range tokens {
+		id := tokens[i].id
+		if mask == nil || int(id) >= len(s.vocab.byID) || mask[id/64]&(1<<(id%64)) == 0 {
+			tokens[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+// Accept advances the sampler past a token
+func (s *FormatSampler) Accept(id int32) {
+	if s.state == stateDead || int(id) >= len(s.vocab.byID) {
+		s.state = stateDead
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.vocab.byID[id] {
+		if s.state = s.matcher.step(s.state, b); s.state == stateDead {
+			return
+		}
+	}
+}
+
+// clone returns a copy of the sampler that advances independently. The
+// copies share the matcher and masks, which are only added to.
+func (s *FormatSampler) clone() Constraint {
+	c := *s
+	return &c
+}
+
+// mask returns a bitmap of the tokens that can follow state. s.mu must be
+// held.
+func (s *FormatSampler) mask(state int32) []uint64 {
+	if mask, ok := s.masks[state]; ok {
+		return mask
+	}
+
+	v := s.vocab
+	mask := make([]uint64, (len(v.byID)+63)/64)
+
+	// tokens are sorted so that each one only needs to be matched from
+	// where it stops sharing a prefix with the one before it. states[i] is
+	// the state after the first i bytes of the current token.
+	states := []int32{state}
+	for i, piece := range v.pieces {
+		if len(states) < v.lcp[i]+1 {
+			// the prefix shared with the token before can't be matched
+			continue
+		}
+
+		states = states[:v.lcp[i]+1]
+		for _, b := range piece[len(states)-1:] {
+			next := s.matcher.step(states[len(states)-1], b)
+			if next == stateDead {
+				break
+			}
+			states = append(states, next)
+		}
+
+		if len(states) == len(piece)+1 {
+			id := v.ids[i]
+			mask[id/64] |= 1 << (id % 64)
+		}
+	}
+
+	if s.matcher.complete(state) {
+		for _, id := range v.eos {
+			mask[id/64] |= 1 << (id % 64)
+		}
+	}
+
+	s.masks[state] = mask
+	return mask
+}
+
+// vocabIndex is a model's vocabulary sorted by the bytes of each token
+type vocabIndex struct {
+	pieces [][]byte
+	ids    []int32
+	// lcp is the length of the prefix that each piece shares with the one
+	// before it
+	lcp []int
+
+	byID [][]byte
+	eos  []int32
+}
+
+// vocabularies caches the index of each model's vocabulary
+var vocabularies sync.Map
+
+func vocabularyIndex(m model.TextProcessor) *vocabIndex {
+	vocab := m.Vocabulary()
+	if v, ok := vocabularies.Load(vocab); ok {
+		return v.(*vocabIndex)
+	}
+
+	v := &vocabIndex{byID: make([][]byte, len(vocab.Values))}
+	for i := range vocab.Values {
+		id := int32(i)
+		if m.Is(id, model.SpecialEOS) {
+			v.eos = append(v.eos, id)
+			continue
+		}
+
+		// control tokens can't be part of the output
+		if i < len(vocab.Types) && vocab.Types[i] == model.TOKEN_TYPE_CONTROL {
+			continue
+		}
+
+		piece, err := m.Decode([]int32{id})
+		if err != nil || piece == "" {
+			continue
+		}
+
+		v.byID[i] = []byte(piece)
+		v.ids = append(v.ids, id)
+	}
+
+	slices.SortFunc(v.ids, func(a, b int32) int {
+		return bytes.Compare(v.byID[a], v.byID[b])
+	})
+
+	v.pieces = make([][]byte, len(v.ids))
+	v.lcp = make([]int, len(v.ids))
+	for i, id := range v.ids {
+		v.pieces[i] = v.byID[id]
+		if i > 0 {
+			prev := v.pieces[i-1]
+			for v.lcp[i] < min(len(prev), len(v.pieces[i])) && prev[v.lcp[i]] == v.pieces[i][v.lcp[i]] {
+				v.lcp[i]++
+			}
+		}
+	}
+
+	actual, _ := vocabularies.LoadOrStore(vocab, v)
+	return actual.(*vocabIndex)
+}
+
+// FormatGrammar returns a GBNF grammar for a regex or choice format, for
+// runners that constrain sampling with llama.cpp. It returns false for JSON
+// schemas, which are converted to grammars separately.
+func FormatGrammar(format []byte) (string, bool, error) {
+	e, ok, err := formatExpr(format)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("root ::= ")
+	if err := writeGrammar(&sb, e); err != nil {
+		return "", false, err
+	}
+	sb.WriteString("\n")
+	return sb.String(), true, nil
+}
+
+// writeGrammar writes e as a GBNF expression. Grammars match characters
+// rather than bytes, so sets of bytes must only include ASCII.
+func writeGrammar(sb *strings.Builder, e expr) error {
+	switch e := e.(type) {
+	case literal:
+		sb.WriteByte('"')
+		for _, r := range string(e) {
+			switch {
+			case r == '"' || r == '\\':
+				sb.WriteByte('\\')
+				sb.WriteRune(r)
+			case r < 0x20 || r == 0x7f:
+				fmt.Fprintf(sb, `\x%02X`, r)
+			default:
+				sb.WriteRune(r)
+			}
+		}
+		sb.WriteByte('"')
+	case byteSet:
+		sb.WriteByte('[')
+		for lo := 0; lo < 256; lo++ {
+			if !e.has(byte(lo)) {
+				continue
+			}
+
+			if lo >= 0x80 {
+				return errors.New("grammars can't match bytes outside of ASCII")
+			}
+
+			hi := lo
+			for hi+1 < 0x80 && e.has(byte(hi+1)) {
+				hi++
+			}
+
+			writeGrammarChar(sb, byte(lo))
+			if hi > lo {
+				sb.WriteByte('-')
+				writeGrammarChar(sb, byte(hi))
+			}
+			lo = hi
+		}
+		sb.WriteByte(']')
+	case multibyte:
+		sb.WriteString(`[^\x00-\x7F]`)
+	case sequence:
+		switch len(e) {
+		case 0:
+			sb.WriteString(`""`)
+			return nil
+		case 1:
+			return writeGrammar(sb, e[0])
+		}
+
+		sb.WriteByte('(')
+		for i, e := range e {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			if err := writeGrammar(sb, e); err != nil {
+				return err
+			}
+		}
+		sb.WriteByte(')')
+	case choice:
+		if len(e) == 1 {
+			return writeGrammar(sb, e[0])
+		}
+
+		sb.WriteByte('(')
+		for i, e := range e {
+			if i > 0 {
+				sb.WriteString(" | ")
+			}
+			if err := writeGrammar(sb, e); err != nil {
+				return err
+			}
+		}
+		sb.WriteByte(')')
+	case repeat:
+		if err := writeGrammar(sb, e.e); err != nil {
+			return err
+		}
+
+		if e.max < 0 {
+			fmt.Fprintf(sb, "{%d,}", e.min)
+		} else {
+			fmt.Fprintf(sb, "{%d,%d}", e.min, e.max)
+		}
+	default:
+		return fmt.Errorf("grammars can't include %T", e)
+	}
+
+	return nil
+}
+
+// writeGrammarChar writes an ASCII character in a GBNF character class
+func writeGrammarChar(sb *strings.Builder, b byte) {
+	switch {
+	case b == ']' || b == '\\' || b == '^' || b == '-':
+		sb.WriteByte('\\')
+		sb.WriteByte(b)
+	case b < 0x20 || b == 0x7f:
+		fmt.Fprintf(sb, `\x%02X`, b)
+	default:
+		sb.WriteByte(b)
+	}
+}
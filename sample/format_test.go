@@ -0,0 +1,349 @@
+package sample
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/llama"
+	"github.com/ollama/ollama/model"
+)
+
+// matchFormat reports whether s is a complete match of format
+func matchFormat(t *testing.T, format, s string) bool {
+	t.Helper()
+
+	r, root, err := compileFormat([]byte(format))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, state := newMatcher(r, root)
+	for i := range len(s) {
+		if state = m.step(state, s[i]); state == stateDead {
+			return false
+		}
+	}
+
+	return m.complete(state)
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		desc    string
+		format  string
+		valid   []string
+		invalid []string
+	}{
+		{
+			desc:    "regex",
+			format:  `{"type": "regex", "pattern": "[0-9]{4}-(0[1-9]|1[0-2])"}`,
+			valid:   []string{"2024-01", "1999-12"},
+			invalid: []string{"2024-13", "x2024-01", "2024-01 ", `"2024-01"`},
+		},
+		{
+			desc:    "anchored regex",
+			format:  `{"type": "regex", "pattern": "^ID-\\w+$"}`,
+			valid:   []string{"ID-a1", "ID-A_b"},
+			invalid: []string{"ID-", "id-a1", "ID-a1$"},
+		},
+		{
+			desc:    "regex with raw characters",
+			format:  `{"type": "regex", "pattern": "\"[^\"\\n]*\"\\n"}`,
+			valid:   []string{"\"a\\b\"\n", "\"é\"\n"},
+			invalid: []string{"\"a\n\"\n"},
+		},
+		{
+			desc:    "choice",
+			format:  `{"type": "choice", "options": ["positive", "negative", "neutral"]}`,
+			valid:   []string{"positive", "negative", "neutral"},
+			invalid: []string{"pos", "positive.", `"positive"`},
+		},
+		{
+			desc:    "schema with a pattern",
+			format:  `{"type": "string", "pattern": "^a+$"}`,
+			valid:   []string{`"aaa"`},
+			invalid: []string{"aaa"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			for _, s := range c.valid {
+				if !matchFormat(t, c.format, s) {
+					t.Errorf("expected %q to match", s)
+				}
+			}
+
+			for _, s := range c.invalid {
+				if matchFormat(t, c.format, s) {
+					t.Errorf("expected %q not to match", s)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{`{"type": "regex"}`, "requires a pattern"},
+		{`{"type": "regex", "pattern": "(a"}`, "missing )"},
+		{`{"type": "regex", "pattern": "a(?!b)"}`, "lookarounds"},
+		{`{"type": "regex", "pattern": "a{-1}"}`, "invalid quantifier {-1}"},
+		{`{"type": "regex", "pattern": "a{2,1001}"}`, "exceeds the maximum count of 1000"},
+		{`{"type": "choice", "options": []}`, "requires options"},
+	}
+
+	for _, c := range cases {
+		err := ValidateFormat([]byte(c.format))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.format, c.want, err)
+		}
+
+		if _, _, err := FormatGrammar([]byte(c.format)); err == nil {
+			t.Errorf("%s: expected an error converting to a grammar", c.format)
+		}
+	}
+}
+
+func TestFormatGrammar(t *testing.T) {
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{`{"type": "choice", "options": ["yes", "no", "say \"maybe\""]}`, `root ::= ("yes" | "no" | "say \"maybe\"")` + "\n"},
+		{`{"type": "regex", "pattern": "^[a-c]\\d{2,}$"}`, `root ::= ([a-c] [0-9]{2,})` + "\n"},
+		{`{"type": "regex", "pattern": "[^a]?"}`, "root ::= ([\\x00-`b-\\x7F] | [^\\x00-\\x7F]){0,1}\n"},
+	}
+
+	tokenizer := modelHelper(t)
+	vocab := tokenizer.Vocabulary()
+	ids := make([]uint32, len(vocab.Values))
+	pieces := make([]string, len(vocab.Values))
+	for i := range vocab.Values {
+		pieces[i], _ = tokenizer.Decode([]int32{int32(i)})
+		ids[i] = uint32(i)
+	}
+
+	for _, c := range cases {
+		got, ok, err := FormatGrammar([]byte(c.format))
+		if err != nil || !ok {
+			t.Fatalf("%s: unexpected result %v, %v", c.format, ok, err)
+		}
+
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.format, got, c.want)
+		}
+
+		g := llama.NewGrammar(got, ids, pieces, vocab.EOS)
+		if g == nil {
+			t.Errorf("%s: llama.cpp failed to parse %q", c.format, got)
+			continue
+		}
+		g.Free()
+	}
+
+	if _, ok, err := FormatGrammar([]byte(`{"type": "object"}`)); ok || err != nil {
+		t.Errorf("expected schemas not to be converted, got %v, %v", ok, err)
+	}
+}
+
+func formatModelHelper(t testing.TB) model.TextProcessor {
+	t.Helper()
+
+	m := modelHelper(t)
+	m.Vocabulary().EOS = []int32{int32(len(m.Vocabulary().Values) - 1)}
+	return m
+}
+
+func TestFormatSampler(t *testing.T) {
+	m := formatModelHelper(t)
+	eos := m.Vocabulary().EOS[0]
+
+	schema := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "maxLength": 8},
+			"age": {"type": "integer"},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 3}
+		},
+		"required": ["name", "age", "tags"]
+	}`
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 5 {
+		s, err := NewFormatSampler(m, []byte(schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []int32
+		for len(ids) < 256 {
+			tokens := make([]token, len(m.Vocabulary().Values))
+			for i := range tokens {
+				tokens[i] = token{id: int32(i), value: rng.Float32()}
+			}
+
+			s.Apply(tokens)
+			best := tokens[0]
+			for _, tok := range tokens {
+				if tok.value > best.value {
+					best = tok
+				}
+			}
+
+			if math.IsInf(float64(best.value), -1) {
+				t.Fatalf("no tokens allowed after %v", ids)
+			}
+
+			if best.id == eos {
+				break
+			}
+
+			s.Accept(best.id)
+			ids = append(ids, best.id)
+		}
+
+		output, err := m.Decode(ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var v struct {
+			Name *string
+			Age  *int
+			Tags []string
+		}
+		if err := json.Unmarshal([]byte(output), &v); err != nil {
+			t.Fatalf("invalid output %q: %v", output, err)
+		}
+
+		if v.Name == nil || v.Age == nil || len([]rune(*v.Name)) > 8 || len(v.Tags) > 3 {
+			t.Errorf("output doesn't match the schema: %q", output)
+		}
+	}
+}
+
+func TestFormatSamplerChoice(t *testing.T) {
+	m := formatModelHelper(t)
+	eos := m.Vocabulary().EOS[0]
+	options := []string{"positive", "negative", "neutral"}
+
+	s, err := NewFormatSampler(m, []byte(`{"type": "choice", "options": ["positive", "negative", "neutral"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prefer the longest allowed token each time
+	var ids []int32
+	for {
+		tokens := make([]token, len(m.Vocabulary().Values))
+		for i := range tokens {
+			piece, _ := m.Decode([]int32{int32(i)})
+			tokens[i] = token{id: int32(i), value: float32(len(piece))}
+		}
+
+		s.Apply(tokens)
+		best := tokens[0]
+		for _, tok := range tokens {
+			if tok.value > best.value {
+				best = tok
+			}
+		}
+
+		if math.IsInf(float64(best.value), -1) {
+			t.Fatalf("no tokens allowed after %v", ids)
+		}
+
+		if best.id == eos {
+			break
+		}
+
+		s.Accept(best.id)
+		ids = append(ids, best.id)
+	}
+
+	output, err := m.Decode(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(options, output) {
+		t.Errorf("expected one of %v, got %q", options, output)
+	}
+}
+
+func TestFormatSamplerCache(t *testing.T) {
+	m := formatModelHelper(t)
+	format := []byte(`{"type": "choice", "options": ["yes", "no"]}`)
+
+	a, err := NewFormatSampler(m, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewFormatSampler(m, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// samplers of the same format share the compiled format, but not its
+	// state
+	if a.compiledFormat != b.compiledFormat {
+		t.Error("expected the format to be compiled once")
+	}
+
+	a.Accept(a.vocab.ids[0])
+	if b.state != b.start {
+		t.Error("expected samplers to advance independently")
+	}
+
+	c, err := NewFormatSampler(m, []byte(`{"type": "choice", "options": ["yes"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.compiledFormat == a.compiledFormat {
+		t.Error("expected different formats to be compiled separately")
+	}
+}
+
+func BenchmarkFormatSampler(b *testing.B) {
+	m := formatModelHelper(b)
+	schema := []byte(`{"type": "object", "properties": {"name": {"type": "string"}, "scores": {"type": "array", "items": {"type": "number"}}}, "required": ["name", "scores"]}`)
+	output := `{"name": "benchmark", "scores": [1.5, 2, 3e4]}`
+
+	// tokens of the output, one byte each
+	var ids []int32
+	for _, b := range []byte(output) {
+		for id, v := range m.Vocabulary().Values {
+			if piece, _ := m.Decode([]int32{int32(id)}); v != "" && piece == string(b) {
+				ids = append(ids, int32(id))
+				break
+			}
+		}
+	}
+
+	tokens := make([]token, len(m.Vocabulary().Values))
+	b.ResetTimer()
+	for b.Loop() {
+		s, err := NewFormatSampler(m, schema)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, id := range ids {
+			for i := range tokens {
+				tokens[i] = token{id: int32(i)}
+			}
+			s.Apply(tokens)
+			s.Accept(id)
+		}
+	}
+}
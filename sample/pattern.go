@@ -0,0 +1,449 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// charClass is a set of characters in a string. Characters outside of ASCII
+// are listed individually, or all of them are included with nonASCII.
+type charClass struct {
+	ascii    [128]bool
+	runes    []rune
+	nonASCII bool
+}
+
+func (c *charClass) add(lo, hi rune) error {
+	for r := lo; r <= hi; r++ {
+		if r < utf8.RuneSelf {
+			c.ascii[r] = true
+		} else if hi-lo > 256 {
+			return fmt.Errorf("character range %q-%q is too large", lo, hi)
+		} else {
+			c.runes = append(c.runes, r)
+		}
+	}
+
+	return nil
+}
+
+func (c *charClass) negate() {
+	for i := range c.ascii {
+		c.ascii[i] = !c.ascii[i]
+	}
+
+	// characters outside of ASCII can't be excluded individually
+	c.runes = nil
+	c.nonASCII = true
+}
+
+// expr returns an expression that matches the characters of the class. They
+// are matched as they're encoded in a JSON string unless raw is set.
+func (c *charClass) expr(raw bool) expr {
+	var plain byteSet
+	var alts choice
+	for i, ok := range c.ascii {
+		switch {
+		case !ok:
+		case raw:
+			plain.add(byte(i), byte(i))
+		case i == '"' || i == '\\':
+			alts = append(alts, literal(`\`+string(rune(i))))
+		case i < 0x20:
+			if escape, ok := controlEscapes[byte(i)]; ok {
+				alts = append(alts, literal(escape))
+			} else {
+				alts = append(alts, literal(fmt.Sprintf(`\u%04x`, i)))
+			}
+		default:
+			plain.add(byte(i), byte(i))
+		}
+	}
+
+	if plain != (byteSet{}) {
+		alts = append(alts, plain)
+	}
+
+	for _, r := range c.runes {
+		alts = append(alts, literal(string(r)))
+	}
+
+	if c.nonASCII {
+		alts = append(alts, multibyte{})
+	}
+
+	return alts
+}
+
+var controlEscapes = map[byte]string{'\b': `\b`, '\f': `\f`, '\n': `\n`, '\r': `\r`, '\t': `\t`}
+
+// patternParser parses a regular expression into an expression that matches
+// the same strings. Unless raw is set, the strings are matched as they're
+// encoded in JSON, as the patterns of a schema's strings are.
+type patternParser struct {
+	s   string
+	pos int
+	raw bool
+}
+
+// parsePattern parses the pattern of a JSON string. Patterns aren't anchored
+// unless they start with ^ and end with $.
+func parsePattern(s string) (expr, error) {
+	anyChars := repeat{e: anyChar(false), max: -1}
+
+	var start, end expr = anyChars, anyChars
+	if strings.HasPrefix(s, "^") {
+		s, start = s[1:], sequence{}
+	}
+	if strings.HasSuffix(s, "$") && !strings.HasSuffix(s, `\$`) {
+		s, end = s[:len(s)-1], sequence{}
+	}
+
+	e, err := (&patternParser{s: s}).parse()
+	if err != nil {
+		return nil, err
+	}
+
+	return sequence{start, e, end}, nil
+}
+
+// parseRegex parses a regular expression that all of the output must match,
+// whether or not it's anchored with ^ and $
+func parseRegex(s string) (expr, error) {
+	s = strings.TrimPrefix(s, "^")
+	if strings.HasSuffix(s, "$") && !strings.HasSuffix(s, `\$`) {
+		s = s[:len(s)-1]
+	}
+
+	return (&patternParser{s: s, raw: true}).parse()
+}
+
+func (p *patternParser) parse() (expr, error) {
+	e, err := p.alternation()
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", p.s, err)
+	}
+
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("invalid pattern %q: unexpected %q", p.s, p.s[p.pos])
+	}
+
+	return e, nil
+}
+
+// anyChar matches any character other than a line break, like . does
+func anyChar(raw bool) expr {
+	var c charClass
+	c.add('\n', '\n') //nolint:errcheck
+	c.negate()
+	return c.expr(raw)
+}
+
+func (p *patternParser) peek() (byte, bool) {
+	if p.pos < len(p.s) {
+		return p.s[p.pos], true
+	}
+	return 0, false
+}
+
+func (p *patternParser) alternation() (expr, error) {
+	var alts choice
+	for {
+		seq, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+
+		if c, ok := p.peek(); !ok || c != '|' {
+			return alts, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *patternParser) sequence() (expr, error) {
+	var seq sequence
+	for {
+		c, ok := p.peek()
+		if !ok || c == '|' || c == ')' {
+			return seq, nil
+		}
+
+		atom, err := p.atom()
+		if err != nil {
+			return nil, err
+		}
+
+		atom, err = p.quantifier(atom)
+		if err != nil {
+			return nil, err
+		}
+
+		seq = append(seq, atom)
+	}
+}
+
+func (p *patternParser) atom() (expr, error) {
+	c := p.s[p.pos]
+	switch c {
+	case '(':
+		p.pos++
+		if strings.HasPrefix(p.s[p.pos:], "?:") {
+			p.pos += 2
+		} else if strings.HasPrefix(p.s[p.pos:], "?") {
+			return nil, errors.New("lookarounds and named groups aren't supported")
+		}
+
+		e, err := p.alternation()
+		if err != nil {
+			return nil, err
+		}
+
+		if c, ok := p.peek(); !ok || c != ')' {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return e, nil
+	case '[':
+		p.pos++
+		class, err := p.class()
+		if err != nil {
+			return nil, err
+		}
+		return class.expr(p.raw), nil
+	case '.':
+		p.pos++
+		return anyChar(p.raw), nil
+	case '\\':
+		p.pos++
+		class, err := p.escape()
+		if err != nil {
+			return nil, err
+		}
+		return class.expr(p.raw), nil
+	case '^', '$':
+		return nil, fmt.Errorf("%q is only supported at the start or end of the pattern", c)
+	case '*', '+', '?', '{':
+		return nil, fmt.Errorf("unexpected quantifier %q", c)
+	default:
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		p.pos += size
+
+		var class charClass
+		class.add(r, r) //nolint:errcheck
+		return class.expr(p.raw), nil
+	}
+}
+
+// escape parses the escape sequence after a backslash
+func (p *patternParser) escape() (charClass, error) {
+	var class charClass
+	c, ok := p.peek()
+	if !ok {
+		return class, errors.New("trailing backslash")
+	}
+	p.pos++
+
+	switch c {
+	case 'd', 'D':
+		class.add('0', '9') //nolint:errcheck
+	case 'w', 'W':
+		class.add('a', 'z') //nolint:errcheck
+		class.add('A', 'Z') //nolint:errcheck
+		class.add('0', '9') //nolint:errcheck
+		class.add('_', '_') //nolint:errcheck
+	case 's', 'S':
+		for _, r := range " \t\n\r\f\v" {
+			class.add(r, r) //nolint:errcheck
+		}
+	case 'n':
+		class.add('\n', '\n') //nolint:errcheck
+	case 'r':
+		class.add('\r', '\r') //nolint:errcheck
+	case 't':
+		class.add('\t', '\t') //nolint:errcheck
+	case 'f':
+		class.add('\f', '\f') //nolint:errcheck
+	case 'v':
+		class.add('\v', '\v') //nolint:errcheck
+	case 'u':
+		if p.pos+4 > len(p.s) {
+			return class, errors.New(`invalid \u escape`)
+		}
+
+		n, err := strconv.ParseUint(p.s[p.pos:p.pos+4], 16, 32)
+		if err != nil {
+			return class, errors.New(`invalid \u escape`)
+		}
+		p.pos += 4
+		class.add(rune(n), rune(n)) //nolint:errcheck
+	default:
+		if c >= '0' && c <= '9' {
+			return class, errors.New("backreferences aren't supported")
+		}
+
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			return class, fmt.Errorf(`unsupported escape \%c`, c)
+		}
+
+		class.add(rune(c), rune(c)) //nolint:errcheck
+	}
+
+	if c == 'D' || c == 'W' || c == 'S' {
+		class.negate()
+	}
+
+	return class, nil
+}
+
+// class parses a character class after its opening bracket
+func (p *patternParser) class() (charClass, error) {
+	var class charClass
+	negate := strings.HasPrefix(p.s[p.pos:], "^")
+	if negate {
+		p.pos++
+	}
+
+	for first := true; ; first = false {
+		c, ok := p.peek()
+		if !ok {
+			return class, errors.New("missing ]")
+		}
+
+		if c == ']' && !first {
+			p.pos++
+			break
+		}
+
+		lo, err := p.classChar(&class)
+		if err != nil {
+			return class, err
+		}
+
+		if lo < 0 {
+			// a shorthand class like \d, which can't start a range
+			continue
+		}
+
+		if strings.HasPrefix(p.s[p.pos:], "-") && !strings.HasPrefix(p.s[p.pos:], "-]") {
+			p.pos++
+			hi, err := p.classChar(&class)
+			if err != nil {
+				return class, err
+			}
+
+			if hi < lo {
+				return class, fmt.Errorf("invalid character range %q-%q", lo, hi)
+			}
+
+			if err := class.add(lo, hi); err != nil {
+				return class, err
+			}
+		} else if err := class.add(lo, lo); err != nil {
+			return class, err
+		}
+	}
+
+	if negate {
+		class.negate()
+	}
+
+	return class, nil
+}
+
+// classChar parses a character in a class, returning -1 if it's a shorthand
+// class, which is added to class
+func (p *patternParser) classChar(class *charClass) (rune, error) {
+	if p.s[p.pos] != '\\' {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		p.pos += size
+		return r, nil
+	}
+
+	p.pos++
+	c, _ := p.peek()
+	escaped, err := p.escape()
+	if err != nil {
+		return 0, err
+	}
+
+	switch c {
+	case 'd', 'D', 'w', 'W', 's', 'S':
+		for i, ok := range escaped.ascii {
+			class.ascii[i] = class.ascii[i] || ok
+		}
+		class.nonASCII = class.nonASCII || escaped.nonASCII
+		return -1, nil
+	}
+
+	// a single character
+	for i, ok := range escaped.ascii {
+		if ok {
+			return rune(i), nil
+		}
+	}
+	return escaped.runes[0], nil
+}
+
+func (p *patternParser) quantifier(atom expr) (expr, error) {
+	c, ok := p.peek()
+	if !ok {
+		return atom, nil
+	}
+
+	var e repeat
+	switch c {
+	case '*':
+		p.pos++
+		e = repeat{e: atom, min: 0, max: -1}
+	case '+':
+		p.pos++
+		e = repeat{e: atom, min: 1, max: -1}
+	case '?':
+		p.pos++
+		e = repeat{e: atom, min: 0, max: 1}
+	case '{':
+		end := strings.IndexByte(p.s[p.pos:], '}')
+		if end < 0 {
+			return nil, errors.New("missing }")
+		}
+
+		bounds := p.s[p.pos+1 : p.pos+end]
+		lo, hi, comma := strings.Cut(bounds, ",")
+
+		var err error
+		e = repeat{e: atom}
+		if e.min, err = strconv.Atoi(lo); err != nil || e.min < 0 {
+			return nil, fmt.Errorf("invalid quantifier {%s}", bounds)
+		}
+
+		switch {
+		case !comma:
+			e.max = e.min
+		case hi == "":
+			e.max = -1
+		default:
+			if e.max, err = strconv.Atoi(hi); err != nil || e.max < e.min {
+				return nil, fmt.Errorf("invalid quantifier {%s}", bounds)
+			}
+		}
+
+		if e.min > maxRepeat || e.max > maxRepeat {
+			return nil, fmt.Errorf("quantifier {%s} exceeds the maximum count of %d", bounds, maxRepeat)
+		}
+		p.pos += end + 1
+	default:
+		return atom, nil
+	}
+
+	// lazy quantifiers match the same strings
+	if c, ok := p.peek(); ok && c == '?' {
+		p.pos++
+	}
+
+	return e, nil
+}
@@ -0,0 +1,345 @@
+package sample
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// rules are a context free grammar over bytes. Each rule has alternatives,
+// which are sequences of elements in elements that end with elementEnd.
+type rules struct {
+	elements     []element
+	alternatives [][]int32
+}
+
+type elementKind uint8
+
+const (
+	// elementEnd ends an alternative
+	elementEnd elementKind = iota
+	// elementBytes matches one byte from a set
+	elementBytes
+	// elementRule matches a rule
+	elementRule
+)
+
+type element struct {
+	kind  elementKind
+	rule  int32
+	bytes byteSet
+}
+
+// byteSet is a set of bytes
+type byteSet [4]uint64
+
+func (s *byteSet) add(lo, hi byte) {
+	for b := int(lo); b <= int(hi); b++ {
+		s[b/64] |= 1 << (b % 64)
+	}
+}
+
+func (s byteSet) has(b byte) bool {
+	return s[b/64]&(1<<(b%64)) != 0
+}
+
+// The expressions that rules are built from
+type (
+	// literal matches its bytes
+	literal string
+	// sequence matches each of its expressions in order
+	sequence []expr
+	// choice matches any one of its expressions
+	choice []expr
+	// ruleRef matches a rule, which allows rules to be recursive
+	ruleRef int32
+	// repeat matches its expression between min and max times, or at least
+	// min times if max is negative
+	repeat struct {
+		e        expr
+		min, max int
+	}
+	// multibyte matches any character that is encoded in more than one
+	// byte
+	multibyte struct{}
+)
+
+type expr any
+
+// maxRepeat is the largest count that a repeat can have, which is the same
+// limit as Go's regexp package. Each count up to it is expanded into the
+// rules, so larger counts are rejected.
+const maxRepeat = 1000
+
+func bytesIn(lo, hi byte) byteSet {
+	var s byteSet
+	s.add(lo, hi)
+	return s
+}
+
+func optional(e expr) expr {
+	return choice{e, sequence{}}
+}
+
+// ruleBuilder builds rules from expressions
+type ruleBuilder struct {
+	rules
+}
+
+// rule returns a new rule without any alternatives, which are added by
+// define. This allows a rule to be referenced before it's defined.
+func (b *ruleBuilder) rule() int32 {
+	b.alternatives = append(b.alternatives, nil)
+	return int32(len(b.alternatives) - 1)
+}
+
+// define adds the alternatives of e to rule
+func (b *ruleBuilder) define(rule int32, e expr) {
+	alts := []expr{e}
+	if c, ok := e.(choice); ok {
+		alts = c
+	}
+
+	for _, alt := range alts {
+		// nested rules are added to elements while the alternative is being
+		// flattened, so the alternative is appended once it's done
+		var elements []element
+		b.flatten(alt, &elements)
+		b.alternatives[rule] = append(b.alternatives[rule], int32(len(b.elements)))
+		b.elements = append(b.elements, elements...)
+		b.elements = append(b.elements, element{kind: elementEnd})
+	}
+}
+
+// ref returns a reference to a rule that matches e
+func (b *ruleBuilder) ref(e expr) ruleRef {
+	if r, ok := e.(ruleRef); ok {
+		return r
+	}
+
+	r := b.rule()
+	b.define(r, e)
+	return ruleRef(r)
+}
+
+func (b *ruleBuilder) flatten(e expr, elements *[]element) {
+	switch e := e.(type) {
+	case literal:
+		for i := range len(e) {
+			*elements = append(*elements, element{kind: elementBytes, bytes: bytesIn(e[i], e[i])})
+		}
+	case byteSet:
+		*elements = append(*elements, element{kind: elementBytes, bytes: e})
+	case sequence:
+		for _, e := range e {
+			b.flatten(e, elements)
+		}
+	case ruleRef:
+		*elements = append(*elements, element{kind: elementRule, rule: int32(e)})
+	case multibyte:
+		cont := bytesIn(0x80, 0xbf)
+		b.flatten(choice{
+			sequence{bytesIn(0xc2, 0xdf), cont},
+			sequence{bytesIn(0xe0, 0xef), cont, cont},
+			sequence{bytesIn(0xf0, 0xf4), cont, cont, cont},
+		}, elements)
+	case choice:
+		if len(e) == 1 {
+			b.flatten(e[0], elements)
+			return
+		}
+		b.flatten(b.ref(e), elements)
+	case repeat:
+		item := e.e
+		if _, ok := item.(byteSet); !ok {
+			item = b.ref(item)
+		}
+
+		for range e.min {
+			b.flatten(item, elements)
+		}
+
+		if e.max < 0 {
+			// r ::= item r | ""
+			r := b.rule()
+			b.define(r, choice{sequence{item, ruleRef(r)}, sequence{}})
+			b.flatten(ruleRef(r), elements)
+		} else if e.max > e.min {
+			// nested optional items, so that at most max are matched
+			var rest expr = sequence{}
+			for range e.max - e.min {
+				rest = b.ref(optional(sequence{item, rest}))
+			}
+			b.flatten(rest, elements)
+		}
+	default:
+		panic("sample: unknown expression")
+	}
+}
+
+// maxExpandDepth limits how many rules can be entered without matching a
+// byte, which guards against left recursive rules
+const maxExpandDepth = 256
+
+// matcher matches bytes against rules. A match is tracked as a set of
+// stacks of positions in the rules' elements, one for each way the bytes so
+// far could be matched. Stacks and sets of stacks are interned so that the
+// transitions between them can be cached.
+type matcher struct {
+	rules *rules
+
+	// interned stacks, where 0 is the empty stack of a complete match
+	frames   []frame
+	frameIDs map[frame]int32
+
+	// interned states, which are sets of stacks, and the state that each
+	// byte leads to from them
+	states   [][]int32
+	stateIDs map[string]int32
+	next     [][]int32
+
+	// stacks that each stack expands to
+	expanded map[int32][]int32
+}
+
+type frame struct {
+	pos, next int32
+}
+
+const (
+	// stateDead is the state after a byte that can't be matched
+	stateDead int32 = -1
+	// stateUnknown marks transitions that haven't been computed yet
+	stateUnknown int32 = -2
+)
+
+func newMatcher(r *rules, root int32) (*matcher, int32) {
+	m := &matcher{
+		rules:    r,
+		frames:   []frame{{pos: -1, next: -1}},
+		frameIDs: make(map[frame]int32),
+		stateIDs: make(map[string]int32),
+		expanded: make(map[int32][]int32),
+	}
+
+	// a stack that only matches the root rule
+	m.rules.elements = append(m.rules.elements, element{kind: elementRule, rule: root}, element{kind: elementEnd})
+	start := m.push(0, int32(len(m.rules.elements)-2))
+	return m, m.state(m.expand(start))
+}
+
+// push returns the stack with pos on top of next
+func (m *matcher) push(next, pos int32) int32 {
+	f := frame{pos: pos, next: next}
+	if id, ok := m.frameIDs[f]; ok {
+		return id
+	}
+
+	m.frames = append(m.frames, f)
+	id := int32(len(m.frames) - 1)
+	m.frameIDs[f] = id
+	return id
+}
+
+// pop returns the stack below the top of id, continuing with the element
+// after the top if its alternative doesn't end there
+func (m *matcher) pop(id int32) int32 {
+	f := m.frames[id]
+	if m.rules.elements[f.pos+1].kind == elementEnd {
+		return f.next
+	}
+	return m.push(f.next, f.pos+1)
+}
+
+// expand returns the stacks that id expands to by entering rules, all of
+// which have a byte set on top or are empty
+func (m *matcher) expand(id int32) []int32 {
+	if stacks, ok := m.expanded[id]; ok {
+		return stacks
+	}
+
+	var stacks []int32
+	m.expandInto(id, &stacks, 0)
+	slices.Sort(stacks)
+	stacks = slices.Compact(stacks)
+	m.expanded[id] = stacks
+	return stacks
+}
+
+func (m *matcher) expandInto(id int32, stacks *[]int32, depth int) {
+	if id == 0 {
+		*stacks = append(*stacks, 0)
+		return
+	}
+
+	f := m.frames[id]
+	e := m.rules.elements[f.pos]
+	switch e.kind {
+	case elementBytes:
+		*stacks = append(*stacks, id)
+	case elementRule:
+		if depth >= maxExpandDepth {
+			return
+		}
+
+		rest := m.pop(id)
+		for _, start := range m.rules.alternatives[e.rule] {
+			if m.rules.elements[start].kind == elementEnd {
+				m.expandInto(rest, stacks, depth+1)
+			} else {
+				m.expandInto(m.push(rest, start), stacks, depth+1)
+			}
+		}
+	}
+}
+
+// state returns the interned state for a sorted set of stacks
+func (m *matcher) state(stacks []int32) int32 {
+	key := make([]byte, 0, 4*len(stacks))
+	for _, id := range stacks {
+		key = binary.LittleEndian.AppendUint32(key, uint32(id))
+	}
+
+	if id, ok := m.stateIDs[string(key)]; ok {
+		return id
+	}
+
+	m.states = append(m.states, stacks)
+	next := make([]int32, 256)
+	for i := range next {
+		next[i] = stateUnknown
+	}
+	m.next = append(m.next, next)
+
+	id := int32(len(m.states) - 1)
+	m.stateIDs[string(key)] = id
+	return id
+}
+
+// step returns the state after matching b in state, or stateDead if b
+// can't be matched
+func (m *matcher) step(state int32, b byte) int32 {
+	if next := m.next[state][b]; next != stateUnknown {
+		return next
+	}
+
+	var stacks []int32
+	for _, id := range m.states[state] {
+		if id != 0 && m.rules.elements[m.frames[id].pos].bytes.has(b) {
+			stacks = append(stacks, m.expand(m.pop(id))...)
+		}
+	}
+
+	next := stateDead
+	if len(stacks) > 0 {
+		slices.Sort(stacks)
+		next = m.state(slices.Compact(stacks))
+	}
+
+	m.next[state][b] = next
+	return next
+}
+
+// complete reports whether the bytes matched so far are a complete match
+func (m *matcher) complete(state int32) bool {
+	return len(m.states[state]) > 0 && m.states[state][0] == 0
+}
@@ -1,10 +1,13 @@
 package sample
 
 import (
+	"bytes"
 	"errors"
 	"math"
 	"math/rand/v2"
 	"slices"
+	"strings"
+	"sync"
 
 	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/model"
@@ -22,7 +25,166 @@ type Sampler struct {
 	topP        float32
 	minP        float32
 	temperature float32
-	grammar     *GrammarSampler
+	grammar     Constraint
+
+	// repetition penalties applied to the last repeatLastN tokens of
+	// history, or all of it if repeatLastN is negative
+	repeatLastN      int
+	repeatPenalty    float32
+	presencePenalty  float32
+	frequencyPenalty float32
+	history          []int32
+
+	// logitBias is added to the logits of the given token ids
+	logitBias map[int32]float32
+
+	// samplers that are disabled unless they're set with an Option
+	typicalP float32
+	mirostat *mirostat
+	dry      *dryOptions
+	xtc      xtcOptions
+
+	// samplers is the order of transforms set with WithSamplers, and chain
+	// is the transforms that are applied with the sampler's parameters
+	samplers []string
+	chain    []string
+}
+
+// Option enables one of the samplers that are disabled by default
+type Option func(*Sampler)
+
+// WithTypicalP keeps the locally typical tokens up to a cumulative
+// probability of p. Values of 1 or more disable it.
+func WithTypicalP(p float32) Option {
+	return func(s *Sampler) {
+		s.typicalP = max(p, 0)
+	}
+}
+
+// WithMirostat samples with Mirostat version 1 or 2, which adjusts the number
+// of tokens considered to keep the surprise of generated text close to tau,
+// learning at a rate of eta. It replaces top-k, top-p, min-p, typical and XTC
+// sampling. A version of 0 disables it.
+func WithMirostat(version int, tau, eta float32) Option {
+	return func(s *Sampler) {
+		if version == 1 || version == 2 {
+			s.mirostat = &mirostat{version: version, tau: tau, eta: eta, mu: 2 * tau}
+		}
+	}
+}
+
+// WithDRY penalizes tokens that extend text repeated from the last lastN
+// tokens of history, or all of it if lastN is negative. The penalty is
+// multiplier * base^(length - allowedLength) for repetitions of at least
+// allowedLength tokens. Repetitions don't extend across tokens that contain
+// any of the breakers. A multiplier or lastN of 0 disables it.
+func WithDRY(model model.TextProcessor, multiplier, base float32, allowedLength, lastN int, breakers []string) Option {
+	return func(s *Sampler) {
+		if multiplier > 0 && lastN != 0 {
+			s.dry = &dryOptions{
+				multiplier:    multiplier,
+				base:          base,
+				allowedLength: allowedLength,
+				lastN:         lastN,
+				breakers:      breakerTokens(model, breakers),
+			}
+		}
+	}
+}
+
+// WithXTC excludes the most probable tokens with the given probability, when
+// more than one of them is at least threshold, so that output is less
+// predictable. A probability of 0 disables it.
+func WithXTC(probability, threshold float32) Option {
+	return func(s *Sampler) {
+		s.xtc = xtcOptions{probability: probability, threshold: threshold}
+	}
+}
+
+// mirostat is the state of Mirostat sampling for a sequence
+type mirostat struct {
+	version  int
+	tau, eta float32
+
+	// mu is the maximum surprise, which is adjusted after each token
+	mu float32
+	// surprise of the last sampled token, which updates mu once the token is
+	// accepted
+	surprise float32
+}
+
+type dryOptions struct {
+	multiplier, base     float32
+	allowedLength, lastN int
+	breakers             map[int32]bool
+}
+
+type xtcOptions struct {
+	probability, threshold float32
+}
+
+// breakers caches the tokens that contain sequence breakers by vocabulary
+// and breakers
+var breakers sync.Map
+
+type breakersKey struct {
+	vocab    *model.Vocabulary
+	breakers string
+}
+
+// breakerTokens returns the tokens of model that contain any of breakers
+func breakerTokens(m model.TextProcessor, strs []string) map[int32]bool {
+	key := breakersKey{m.Vocabulary(), strings.Join(strs, "\x00")}
+	if tokens, ok := breakers.Load(key); ok {
+		return tokens.(map[int32]bool)
+	}
+
+	tokens := make(map[int32]bool)
+	for id, piece := range vocabularyIndex(m).byID {
+		for _, b := range strs {
+			if b != "" && bytes.Contains(piece, []byte(b)) {
+				tokens[int32(id)] = true
+				break
+			}
+		}
+	}
+
+	actual, _ := breakers.LoadOrStore(key, tokens)
+	return actual.(map[int32]bool)
+}
+
+// Accept adds a token to the history used for repetition penalties. It
+// should be called with the prompt tokens and each generated token.
+func (s *Sampler) Accept(id int32) {
+	n := s.repeatLastN
+	if s.dry != nil && (n >= 0 && s.dry.lastN > n || s.dry.lastN < 0) {
+		n = s.dry.lastN
+	}
+
+	if n == 0 {
+		return
+	}
+
+	s.history = append(s.history, id)
+	if n > 0 && len(s.history) > n {
+		s.history = s.history[len(s.history)-n:]
+	}
+}
+
+// recent returns the last n tokens of history, or all of it if n is negative
+func (s *Sampler) recent(n int) []int32 {
+	if n < 0 || n > len(s.history) {
+		return s.history
+	}
+	return s.history[len(s.history)-n:]
+}
+
+// random returns a random number in [0, 1)
+func (s *Sampler) random() float32 {
+	if s.rng != nil {
+		return s.rng.Float32()
+	}
+	return rand.Float32()
 }
 
 func (s *Sampler) Sample(logits []float32) (int32, error) {
@@ -48,6 +210,7 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Apply(top)
 		if !math.IsInf(float64(top[0].value), -1) {
 			s.grammar.Accept(top[0].id)
+			s.updateMirostat()
 			return top[0].id, nil
 		}
 
@@ -66,9 +229,20 @@ func (s *Sampler) Sample(logits []float32) (int32, error) {
 		s.grammar.Accept(t.id)
 	}
 
+	s.updateMirostat()
 	return t.id, nil
 }
 
+// updateMirostat adjusts the maximum surprise of Mirostat sampling by how
+// far the surprise of the sampled token is from the target
+func (s *Sampler) updateMirostat() {
+	if s.mirostat == nil || s.temperature == 0 {
+		return
+	}
+
+	s.mirostat.mu -= s.mirostat.eta * (s.mirostat.surprise - s.mirostat.tau)
+}
+
 // greedy returns the highest probability token from the tokens
 func greedy(tokens []token) token {
 	max := tokens[0]
@@ -84,27 +258,26 @@ func greedy(tokens []token) token {
 // sample returns the highest probability token from the tokens
 // given sampler parameters. It also has side effects of modifying the tokens
 func (s *Sampler) sample(tokens []token) (token, error) {
+	n := len(tokens)
+	logitBias(tokens, s.logitBias)
+	tokens = s.applyChain(tokens)
+
 	if s.temperature == 0 {
 		return greedy(tokens), nil
 	}
 
-	// topK also sorts the tokens in descending order of logits
-	tokens = topK(tokens, s.topK)
-
-	// scale and normalize the tokens in place
-	temperature(tokens, s.temperature)
-	softmax(tokens)
-
-	tokens = topP(tokens, s.topP)
-	tokens = minP(tokens, s.minP)
-
-	var r float32
-	if s.rng != nil {
-		r = s.rng.Float32()
-	} else {
-		r = rand.Float32()
+	if s.mirostat != nil {
+		// mirostat chooses how many tokens to consider instead of the
+		// samplers that truncate tokens
+		if s.mirostat.version == 1 {
+			tokens = mirostatV1(tokens, s.mirostat.mu, n)
+		} else {
+			tokens = mirostatV2(tokens, s.mirostat.mu)
+		}
 	}
 
+	r := s.random()
+
 	// Calculate cumulative sum of probabilities
 	var sum float32
 	for i := range tokens {
@@ -123,11 +296,156 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	if math.IsNaN(float64(sum)) {
 		return token{}, errors.New("sample: logits sum to NaN, check model output")
 	}
+
+	if s.mirostat != nil {
+		// the surprise of the token among those that were considered
+		p := tokens[idx].value
+		if idx > 0 {
+			p -= tokens[idx-1].value
+		}
+		s.mirostat.surprise = -float32(math.Log2(float64(p / sum)))
+	}
+
 	return tokens[idx], nil
 }
 
+// Candidates returns the n most likely next tokens with their log
+// probabilities, after the logit bias, penalties and constraint are applied
+// but without truncating or rescaling the distribution. Beam search extends
+// hypotheses with them instead of sampling, then passes the chosen token to
+// Choose.
+func (s *Sampler) Candidates(logits []float32, n int) ([]TokenLogprob, error) {
+	if len(logits) == 0 {
+		return nil, errors.New("sample: no logits provided to sample")
+	}
+
+	tokens := make([]token, len(logits))
+	for i := range logits {
+		tokens[i].id = int32(i)
+		tokens[i].value = logits[i]
+	}
+
+	logitBias(tokens, s.logitBias)
+	for _, name := range s.chain {
+		if t := transforms[name]; t.penalty {
+			tokens = t.apply(s, tokens)
+		}
+	}
+
+	if s.grammar != nil {
+		s.grammar.Apply(tokens)
+	}
+
+	maxLogit := float32(math.Inf(-1))
+	for _, t := range tokens {
+		maxLogit = max(maxLogit, t.value)
+	}
+
+	if math.IsInf(float64(maxLogit), -1) {
+		return nil, errors.New("sample: no tokens are allowed")
+	}
+
+	var sum float64
+	for _, t := range tokens {
+		sum += math.Exp(float64(t.value - maxLogit))
+	}
+	logSum := float32(math.Log(sum)) + maxLogit
+
+	if math.IsNaN(float64(logSum)) {
+		return nil, errors.New("sample: logits sum to NaN, check model output")
+	}
+
+	tokens = topK(tokens, min(n, len(tokens)))
+
+	candidates := make([]TokenLogprob, 0, len(tokens))
+	for _, t := range tokens {
+		if !math.IsInf(float64(t.value), -1) {
+			candidates = append(candidates, TokenLogprob{ID: t.id, Logprob: t.value - logSum})
+		}
+	}
+
+	return candidates, nil
+}
+
+// Choose advances the sampler past a token chosen from Candidates
+func (s *Sampler) Choose(id int32) {
+	if s.grammar != nil {
+		s.grammar.Accept(id)
+	}
+	s.Accept(id)
+}
+
+// Clone returns a copy of the sampler that continues independently, such as
+// another hypothesis of beam search. It fails if the sampler's constraint
+// can't be copied, which is the case for grammars.
+func (s *Sampler) Clone() (Sampler, error) {
+	c := *s
+	c.history = slices.Clone(s.history)
+
+	if s.mirostat != nil {
+		m := *s.mirostat
+		c.mirostat = &m
+	}
+
+	if s.grammar != nil {
+		g, ok := s.grammar.(interface{ clone() Constraint })
+		if !ok {
+			return Sampler{}, errors.New("sample: grammars can't be cloned")
+		}
+		c.grammar = g.clone()
+	}
+
+	return c, nil
+}
+
+// TokenLogprob is the log probability of a single token
+type TokenLogprob struct {
+	ID      int32
+	Logprob float32
+}
+
+// Logprobs returns the log probability of the selected token and of the topN
+// most likely tokens, computed from the model's raw logits before any
+// sampling transforms are applied
+func Logprobs(logits []float32, selected int32, topN int) (float32, []TokenLogprob) {
+	if len(logits) == 0 || selected < 0 || int(selected) >= len(logits) {
+		return float32(math.Inf(-1)), nil
+	}
+
+	// log(sum(exp(x - max))) + max for numerical stability
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+	logSum := float32(math.Log(sum)) + maxLogit
+
+	if topN <= 0 {
+		return logits[selected] - logSum, nil
+	}
+
+	tokens := make([]token, len(logits))
+	for i := range logits {
+		tokens[i].id = int32(i)
+		tokens[i].value = logits[i]
+	}
+
+	tokens = topK(tokens, min(topN, len(tokens)))
+
+	top := make([]TokenLogprob, len(tokens))
+	for i, t := range tokens {
+		top[i] = TokenLogprob{ID: t.id, Logprob: t.value - logSum}
+	}
+
+	return logits[selected] - logSum, top
+}
+
 // TODO(parthsareen): update sampler interface to use json unmarshal https://github.com/ollama/ollama/issues/9278
-func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, grammar *GrammarSampler) Sampler {
+func NewSampler(temperature float32, topK int, topP float32, minP float32, repeatLastN int, repeatPenalty, presencePenalty, frequencyPenalty float32, logitBias map[int32]float32, seed int, grammar Constraint, opts ...Option) Sampler {
 	var rng *rand.Rand
 	if seed != -1 {
 		// PCG requires two parameters: sequence and stream
@@ -154,14 +472,40 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		minP = 1.0
 	}
 
-	return Sampler{
-		rng:         rng,
-		topK:        topK,
-		topP:        topP,
-		minP:        minP,
-		temperature: temperature,
-		grammar:     grammar,
+	if repeatPenalty <= 0.0 {
+		repeatPenalty = 1.0
+	}
+
+	s := Sampler{
+		rng:              rng,
+		topK:             topK,
+		topP:             topP,
+		minP:             minP,
+		temperature:      temperature,
+		grammar:          grammar,
+		repeatLastN:      repeatLastN,
+		repeatPenalty:    repeatPenalty,
+		presencePenalty:  presencePenalty,
+		frequencyPenalty: frequencyPenalty,
+		logitBias:        logitBias,
+		typicalP:         1.0,
+	}
+
+	for _, opt := range opts {
+		opt(&s)
 	}
+
+	s.buildChain()
+	return s
+}
+
+// Constraint restricts the tokens that can be sampled, such as to those that
+// match a grammar or a JSON schema
+type Constraint interface {
+	// Apply sets the logits of tokens that can't come next to -Inf
+	Apply(tokens []token)
+	// Accept advances the constraint past a sampled token
+	Accept(id int32)
 }
 
 type GrammarSampler struct {
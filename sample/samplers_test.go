@@ -6,6 +6,7 @@ import (
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/ollama/ollama/model"
@@ -13,7 +14,7 @@ import (
 
 func TestWeighted(t *testing.T) {
 	logits := []float32{-10, 3, -10, -10}
-	sampler := NewSampler(0, 0, 0, 0, 0, nil)
+	sampler := NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, nil)
 	got, err := sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -25,7 +26,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{-100, -10, 0, 10}
-	sampler = NewSampler(0, 0, 0, 0, 0, nil)
+	sampler = NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, nil)
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -39,7 +40,7 @@ func TestWeighted(t *testing.T) {
 	// Test very high p
 	logits = []float32{1.0, 0.9999999999999999, 0.5, 0.1}
 	// Use extremely small topP to filter out all tokens
-	sampler = NewSampler(1.0, 0, 1e-10, 0, 0, nil)
+	sampler = NewSampler(1.0, 0, 1e-10, 0, 0, 1, 0, 0, nil, 0, nil)
 	got, err = sampler.Sample(logits)
 	if err != nil {
 		t.Error(err)
@@ -52,7 +53,7 @@ func TestWeighted(t *testing.T) {
 	}
 
 	logits = []float32{float32(math.NaN()), float32(math.NaN()), float32(math.NaN())}
-	sampler = NewSampler(1, 0, 0.95, 0.05, 0, nil)
+	sampler = NewSampler(1, 0, 0.95, 0.05, 0, 1, 0, 0, nil, 0, nil)
 	got, err = sampler.Sample(logits)
 	if err == nil {
 		t.Errorf("expected error, got %d", got)
@@ -60,6 +61,239 @@ func TestWeighted(t *testing.T) {
 	}
 }
 
+func TestSamplerLogitBias(t *testing.T) {
+	logits := []float32{1.0, 3.0, 0.5, 0.1}
+
+	// ban the most likely token
+	sampler := NewSampler(0, 0, 0, 0, 0, 1, 0, 0, map[int32]float32{1: -100}, 0, nil)
+	if got, _ := sampler.Sample(logits); got != 0 {
+		t.Errorf("index mismatch: want 0, got %d", got)
+	}
+
+	// force an unlikely token even when sampling with temperature
+	sampler = NewSampler(1, 0, 1, 0, 0, 1, 0, 0, map[int32]float32{3: 100}, 42, nil)
+	for range 10 {
+		if got, _ := sampler.Sample(logits); got != 3 {
+			t.Errorf("index mismatch: want 3, got %d", got)
+		}
+	}
+}
+
+func TestSamplerPenalties(t *testing.T) {
+	logits := []float32{1.0, 0.95, 0.5, 0.1}
+
+	// token 0 is the most likely until it's penalized for repeating
+	sampler := NewSampler(0, 0, 0, 0, 64, 1.1, 0, 0, nil, 0, nil)
+	if got, _ := sampler.Sample(logits); got != 0 {
+		t.Fatalf("index mismatch: want 0, got %d", got)
+	}
+
+	sampler.Accept(0)
+	if got, _ := sampler.Sample(logits); got != 1 {
+		t.Errorf("index mismatch: want 1, got %d", got)
+	}
+
+	// token 0 falls out of the history window
+	sampler = NewSampler(0, 0, 0, 0, 1, 1.1, 0, 0, nil, 0, nil)
+	sampler.Accept(0)
+	sampler.Accept(2)
+	if got, _ := sampler.Sample(logits); got != 0 {
+		t.Errorf("index mismatch: want 0, got %d", got)
+	}
+
+	// repeat_last_n 0 disables penalties
+	sampler = NewSampler(0, 0, 0, 0, 0, 1.1, 0, 0, nil, 0, nil)
+	sampler.Accept(0)
+	if got, _ := sampler.Sample(logits); got != 0 {
+		t.Errorf("index mismatch: want 0, got %d", got)
+	}
+
+	// repeat_last_n -1 uses the whole history
+	sampler = NewSampler(0, 0, 0, 0, -1, 1.0, 0, 0.1, nil, 0, nil)
+	for range 100 {
+		sampler.Accept(2)
+	}
+	sampler.Accept(0)
+	if got, _ := sampler.Sample(logits); got != 1 {
+		t.Errorf("index mismatch: want 1, got %d", got)
+	}
+}
+
+func TestSamplerMirostat(t *testing.T) {
+	logits := []float32{4, 3, 2, 1, 0}
+
+	for _, version := range []int{1, 2} {
+		sampler := NewSampler(1, 0, 0, 0, 0, 1, 0, 0, nil, 42, nil, WithMirostat(version, 3, 0.5))
+		for range 10 {
+			mu := sampler.mirostat.mu
+			if _, err := sampler.Sample(logits); err != nil {
+				t.Fatal(err)
+			}
+
+			// mu moves towards the target surprise by the learning rate
+			want := mu - 0.5*(sampler.mirostat.surprise-3)
+			if math.Abs(float64(sampler.mirostat.mu-want)) > 1e-6 {
+				t.Errorf("mirostat v%d: mu = %f, want %f", version, sampler.mirostat.mu, want)
+			}
+		}
+	}
+
+	// mirostat is disabled by default and with version 0
+	if s := NewSampler(1, 0, 0, 0, 0, 1, 0, 0, nil, 42, nil, WithMirostat(0, 3, 0.5)); s.mirostat != nil {
+		t.Error("expected mirostat to be disabled")
+	}
+}
+
+func TestSamplerDRY(t *testing.T) {
+	m := modelHelper(t)
+	logits := make([]float32, len(m.Vocabulary().Values))
+	logits[100] = 1
+
+	// token 100 would repeat 10 11 12 100, while the breaker in the
+	// second sequence stops the repetition before it's long enough
+	sampler := NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, nil, WithDRY(m, 2, 1.75, 2, -1, []string{"*"}))
+	for _, id := range []int32{10, 11, 12, 100, 10, 11, 12} {
+		sampler.Accept(id)
+	}
+	if got, _ := sampler.Sample(logits); got == 100 {
+		t.Error("expected the repetition to be penalized")
+	}
+
+	star := int32(slices.Index(m.Vocabulary().Values, "*"))
+	sampler = NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, nil, WithDRY(m, 2, 1.75, 2, -1, []string{"*"}))
+	for _, id := range []int32{10, 11, 12, 100, star, 12} {
+		sampler.Accept(id)
+	}
+	if got, _ := sampler.Sample(logits); got != 100 {
+		t.Errorf("index mismatch: want 100, got %d", got)
+	}
+
+	// breakers are matched within tokens
+	breakers := breakerTokens(m, []string{"\n"})
+	if newline := int32(slices.Index(m.Vocabulary().Values, "Ċ")); !breakers[newline] {
+		t.Error("expected the newline token to be a breaker")
+	}
+	if double := int32(slices.Index(m.Vocabulary().Values, ".ĊĊ")); !breakers[double] {
+		t.Error("expected a token containing newlines to be a breaker")
+	}
+}
+
+func TestSamplerCandidates(t *testing.T) {
+	logits := []float32{1, 3, 0.4, 0.1}
+
+	// the logit bias and penalties apply, but not top_k
+	sampler := NewSampler(0.8, 1, 0.5, 0, 64, 2, 0, 0, map[int32]float32{3: -100}, 0, nil)
+	sampler.Accept(0)
+
+	candidates, err := sampler.Candidates(logits, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int32
+	for _, c := range candidates {
+		ids = append(ids, c.ID)
+	}
+	if !slices.Equal(ids, []int32{1, 0, 2}) {
+		t.Errorf("got candidates %v, want [1 0 2]", ids)
+	}
+
+	logSum := math.Log(math.Exp(0.5) + math.Exp(3) + math.Exp(0.4) + math.Exp(-99.9))
+	if want := 3 - logSum; math.Abs(float64(candidates[0].Logprob)-want) > 1e-5 {
+		t.Errorf("got logprob %f, want %f", candidates[0].Logprob, want)
+	}
+}
+
+func TestSamplerClone(t *testing.T) {
+	m := formatModelHelper(t)
+	vocab := m.Vocabulary().Values
+	logits := make([]float32, len(vocab))
+	y, n := int32(slices.Index(vocab, "y")), int32(slices.Index(vocab, "n"))
+
+	f, err := NewFormatSampler(m, []byte(`{"type": "choice", "options": ["yes", "no"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := func(s *Sampler, id int32) bool {
+		candidates, err := s.Candidates(logits, len(logits))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return slices.ContainsFunc(candidates, func(c TokenLogprob) bool { return c.ID == id })
+	}
+
+	sampler := NewSampler(0, 0, 0, 0, 64, 1.1, 0, 0, nil, 0, f)
+	clone, err := sampler.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the clone's constraint and history advance independently
+	clone.Choose(y)
+	if allowed(&clone, n) || !allowed(&sampler, n) {
+		t.Error("expected only the clone to be past the first token")
+	}
+	if len(clone.history) != 1 || len(sampler.history) != 0 {
+		t.Errorf("got histories %v and %v", clone.history, sampler.history)
+	}
+
+	g, err := NewGrammarSampler(m, `root ::= "yes"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Free()
+
+	sampler = NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, g)
+	if _, err := sampler.Clone(); err == nil {
+		t.Error("expected an error cloning a grammar")
+	}
+}
+
+func TestLogprobs(t *testing.T) {
+	logits := []float32{1, 2, 3, 0}
+
+	// log softmax of the logits
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l))
+	}
+	want := make([]float64, len(logits))
+	for i, l := range logits {
+		want[i] = float64(l) - math.Log(sum)
+	}
+
+	logprob, top := Logprobs(logits, 1, 0)
+	if math.Abs(float64(logprob)-want[1]) > 1e-5 {
+		t.Errorf("logprob mismatch: want %f, got %f", want[1], logprob)
+	}
+	if top != nil {
+		t.Errorf("expected no top logprobs, got %v", top)
+	}
+
+	logprob, top = Logprobs(logits, 3, 2)
+	if math.Abs(float64(logprob)-want[3]) > 1e-5 {
+		t.Errorf("logprob mismatch: want %f, got %f", want[3], logprob)
+	}
+	if len(top) != 2 {
+		t.Fatalf("expected 2 top logprobs, got %d", len(top))
+	}
+	for i, id := range []int32{2, 1} {
+		if top[i].ID != id {
+			t.Errorf("top %d: want id %d, got %d", i, id, top[i].ID)
+		}
+		if math.Abs(float64(top[i].Logprob)-want[id]) > 1e-5 {
+			t.Errorf("top %d: want logprob %f, got %f", i, want[id], top[i].Logprob)
+		}
+	}
+
+	// more alternatives than tokens
+	_, top = Logprobs(logits, 0, 10)
+	if len(top) != len(logits) {
+		t.Errorf("expected %d top logprobs, got %d", len(logits), len(top))
+	}
+}
+
 func modelHelper(t testing.TB) model.BytePairEncoding {
 	t.Helper()
 
@@ -152,8 +386,8 @@ func TestGrammar(t *testing.T) {
 
 func BenchmarkSample(b *testing.B) {
 	samplers := map[string]Sampler{
-		"Greedy":   NewSampler(0, 0, 0, 0, 0, nil), // Use NewSampler with temp=0 for greedy
-		"Weighted": NewSampler(0.5, 10, 0.9, 0.2, -1, nil),
+		"Greedy":   NewSampler(0, 0, 0, 0, 0, 1, 0, 0, nil, 0, nil), // Use NewSampler with temp=0 for greedy
+		"Weighted": NewSampler(0.5, 10, 0.9, 0.2, 0, 1, 0, 0, nil, -1, nil),
 	}
 
 	// Generate random logits for benchmarking
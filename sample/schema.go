@@ -0,0 +1,608 @@
+package sample
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// schemaKeywords are the keywords of a schema that are supported. Keywords
+// that only annotate a schema are accepted and ignored, as are constraints
+// on values that can't be enforced without changing the shape of the JSON,
+// like unknown string formats. Any others are rejected rather than
+// generating JSON that may not match.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"anyOf": true, "oneOf": true, "allOf": true, "$ref": true, "$defs": true, "definitions": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "prefixItems": true, "minItems": true, "maxItems": true,
+	"pattern": true, "minLength": true, "maxLength": true, "format": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"uniqueItems": true, "minProperties": true, "maxProperties": true,
+	"contentEncoding": true, "contentMediaType": true,
+}
+
+// stringFormats are the patterns of the string formats that are enforced.
+// Other formats are only annotations.
+var stringFormats = map[string]string{
+	"date":      `^[0-9]{4}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])$`,
+	"time":      `^([01][0-9]|2[0-3]):[0-5][0-9]:[0-5][0-9](\.[0-9]+)?(Z|[+-]([01][0-9]|2[0-3]):[0-5][0-9])$`,
+	"date-time": `^[0-9]{4}-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01])T([01][0-9]|2[0-3]):[0-5][0-9]:[0-5][0-9](\.[0-9]+)?(Z|[+-]([01][0-9]|2[0-3]):[0-5][0-9])$`,
+	"uuid":      `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`,
+}
+
+// schemaCompiler compiles a JSON schema into rules that match the JSON
+// values it describes
+type schemaCompiler struct {
+	ruleBuilder
+	root json.RawMessage
+
+	// rules that are shared, by name or by the reference they resolve
+	named map[string]ruleRef
+	refs  map[string]ruleRef
+}
+
+func compileSchema(schema []byte) (*rules, int32, error) {
+	c := schemaCompiler{
+		root:  schema,
+		named: make(map[string]ruleRef),
+		refs:  make(map[string]ruleRef),
+	}
+
+	e, err := c.compile(schema)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &c.rules, int32(c.ref(e)), nil
+}
+
+// shared returns the rule with name, defining it with fn the first time
+func (c *schemaCompiler) shared(name string, fn func() expr) ruleRef {
+	if r, ok := c.named[name]; ok {
+		return r
+	}
+
+	r := ruleRef(c.ruleBuilder.rule())
+	c.named[name] = r
+	c.define(int32(r), fn())
+	return r
+}
+
+// space matches the whitespace allowed after a value or punctuation
+func (c *schemaCompiler) space() expr {
+	return c.shared("space", func() expr {
+		indent := bytesIn(' ', ' ')
+		indent.add('\t', '\t')
+		return choice{sequence{}, literal(" "), sequence{literal("\n"), repeat{e: indent, max: 20}}}
+	})
+}
+
+// token matches punctuation followed by whitespace
+func (c *schemaCompiler) token(s string) expr {
+	return sequence{literal(s), c.space()}
+}
+
+func (c *schemaCompiler) compile(raw json.RawMessage) (expr, error) {
+	switch string(bytes.TrimSpace(raw)) {
+	case "true":
+		return c.any(), nil
+	case "false":
+		return nil, errors.New("schema false doesn't match any value")
+	}
+
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	for k := range s {
+		if !schemaKeywords[k] {
+			return nil, fmt.Errorf("unsupported schema keyword %q", k)
+		}
+	}
+
+	switch {
+	case s["$ref"] != nil:
+		var ref string
+		if err := json.Unmarshal(s["$ref"], &ref); err != nil {
+			return nil, fmt.Errorf("invalid $ref: %w", err)
+		}
+		return c.resolve(ref)
+	case s["const"] != nil:
+		return c.literal(s["const"])
+	case s["enum"] != nil:
+		var values []json.RawMessage
+		if err := json.Unmarshal(s["enum"], &values); err != nil || len(values) == 0 {
+			return nil, errors.New("enum must be a non-empty array")
+		}
+
+		var alts choice
+		for _, v := range values {
+			e, err := c.literal(v)
+			if err != nil {
+				return nil, err
+			}
+			alts = append(alts, e)
+		}
+		return alts, nil
+	case s["anyOf"] != nil || s["oneOf"] != nil:
+		var schemas []json.RawMessage
+		if err := json.Unmarshal(cmpOr(s["anyOf"], s["oneOf"]), &schemas); err != nil || len(schemas) == 0 {
+			return nil, errors.New("anyOf and oneOf must be non-empty arrays")
+		}
+
+		var alts choice
+		for _, schema := range schemas {
+			e, err := c.compile(schema)
+			if err != nil {
+				return nil, err
+			}
+			alts = append(alts, e)
+		}
+		return alts, nil
+	case s["allOf"] != nil:
+		var schemas []json.RawMessage
+		if err := json.Unmarshal(s["allOf"], &schemas); err != nil || len(schemas) != 1 {
+			return nil, errors.New("allOf is only supported with a single schema")
+		}
+		return c.compile(schemas[0])
+	}
+
+	var types []string
+	if t := s["type"]; t != nil {
+		if err := json.Unmarshal(t, &types); err != nil {
+			var single string
+			if err := json.Unmarshal(t, &single); err != nil {
+				return nil, fmt.Errorf("invalid type: %s", t)
+			}
+			types = []string{single}
+		}
+	} else if s["properties"] != nil || s["additionalProperties"] != nil {
+		types = []string{"object"}
+	} else if s["items"] != nil || s["prefixItems"] != nil {
+		types = []string{"array"}
+	} else if s["pattern"] != nil || s["minLength"] != nil || s["maxLength"] != nil {
+		types = []string{"string"}
+	} else {
+		return c.any(), nil
+	}
+
+	var alts choice
+	for _, t := range types {
+		var e expr
+		var err error
+		switch t {
+		case "object":
+			e, err = c.object(s)
+		case "array":
+			e, err = c.array(s)
+		case "string":
+			e, err = c.string(s)
+		case "number":
+			e = c.number()
+		case "integer":
+			e = c.integer()
+		case "boolean":
+			e = c.shared("boolean", func() expr { return sequence{choice{literal("true"), literal("false")}, c.space()} })
+		case "null":
+			e = c.token("null")
+		default:
+			err = fmt.Errorf("unsupported type %q", t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, e)
+	}
+
+	return alts, nil
+}
+
+func cmpOr(a, b json.RawMessage) json.RawMessage {
+	if a != nil {
+		return a
+	}
+	return b
+}
+
+// literal matches a JSON value exactly
+func (c *schemaCompiler) literal(raw json.RawMessage) (expr, error) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return sequence{literal(bytes.TrimSpace(b.Bytes())), c.space()}, nil
+}
+
+// resolve resolves a reference to a schema in the same document
+func (c *schemaCompiler) resolve(ref string) (expr, error) {
+	if r, ok := c.refs[ref]; ok {
+		return r, nil
+	}
+
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("unsupported $ref %q: only references within the schema are supported", ref)
+	}
+
+	schema := c.root
+	for _, key := range strings.Split(pointer, "/")[1:] {
+		key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(schema, &obj); err != nil || obj[key] == nil {
+			return nil, fmt.Errorf("unresolved $ref %q", ref)
+		}
+		schema = obj[key]
+	}
+
+	// the rule is added before it's compiled so that it can refer to itself
+	r := ruleRef(c.ruleBuilder.rule())
+	c.refs[ref] = r
+
+	e, err := c.compile(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	if e == r {
+		return nil, fmt.Errorf("$ref %q refers to itself", ref)
+	}
+
+	c.define(int32(r), e)
+	return r, nil
+}
+
+// any matches any JSON value
+func (c *schemaCompiler) any() expr {
+	return c.shared("value", func() expr {
+		value := c.named["value"]
+		return choice{
+			c.shared("object", func() expr {
+				member := sequence{c.plainString(), c.token(":"), value}
+				return sequence{c.token("{"), optional(sequence{member, repeat{e: sequence{c.token(","), member}, max: -1}}), c.token("}")}
+			}),
+			c.shared("array", func() expr {
+				return sequence{c.token("["), optional(sequence{value, repeat{e: sequence{c.token(","), value}, max: -1}}), c.token("]")}
+			}),
+			c.plainString(),
+			c.number(),
+			c.token("true"),
+			c.token("false"),
+			c.token("null"),
+		}
+	})
+}
+
+// char matches a character in a JSON string
+func (c *schemaCompiler) char() expr {
+	return c.shared("char", func() expr {
+		var plain byteSet
+		plain.add(0x20, 0x7f)
+		plain[0] &^= 1 << '"'
+		plain[1] &^= 1 << ('\\' - 64)
+
+		hex := choice{bytesIn('0', '9'), bytesIn('a', 'f'), bytesIn('A', 'F')}
+		return choice{
+			plain,
+			sequence{literal(`\`), choice{literal(`"`), literal(`\`), literal("/"), literal("b"), literal("f"), literal("n"), literal("r"), literal("t")}},
+			sequence{literal(`\u`), repeat{e: c.ref(hex), min: 4, max: 4}},
+			multibyte{},
+		}
+	})
+}
+
+func (c *schemaCompiler) plainString() expr {
+	return c.shared("string", func() expr {
+		return sequence{literal(`"`), repeat{e: c.char(), max: -1}, literal(`"`), c.space()}
+	})
+}
+
+func (c *schemaCompiler) string(s map[string]json.RawMessage) (expr, error) {
+	var pattern, format string
+	var minLength int
+	maxLength := -1
+	for k, v := range map[string]any{"pattern": &pattern, "format": &format} {
+		if raw := s[k]; raw != nil {
+			if err := json.Unmarshal(raw, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", k, err)
+			}
+		}
+	}
+
+	for k, v := range map[string]*int{"minLength": &minLength, "maxLength": &maxLength} {
+		if err := count(s, k, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if pattern == "" {
+		pattern = stringFormats[format]
+	}
+
+	if pattern != "" {
+		if s["minLength"] != nil || s["maxLength"] != nil {
+			return nil, errors.New("minLength and maxLength can't be combined with a pattern or format")
+		}
+
+		e, err := parsePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return sequence{literal(`"`), e, literal(`"`), c.space()}, nil
+	}
+
+	if minLength == 0 && maxLength < 0 {
+		return c.plainString(), nil
+	}
+
+	if maxLength >= 0 && maxLength < minLength {
+		return nil, errors.New("maxLength must not be less than minLength")
+	}
+
+	return sequence{literal(`"`), repeat{e: c.char(), min: minLength, max: maxLength}, literal(`"`), c.space()}, nil
+}
+
+// count reads the keyword k of s into v if it's set. Counts are repeated
+// in the rules, so they're limited to maxRepeat.
+func count(s map[string]json.RawMessage, k string, v *int) error {
+	raw := s[k]
+	if raw == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil || *v < 0 {
+		return fmt.Errorf("invalid %s: %s", k, raw)
+	}
+
+	if *v > maxRepeat {
+		return fmt.Errorf("%s exceeds the maximum of %d", k, maxRepeat)
+	}
+
+	return nil
+}
+
+func (c *schemaCompiler) integer() expr {
+	return c.shared("integer", func() expr {
+		return sequence{optional(literal("-")), c.integralPart(), c.space()}
+	})
+}
+
+func (c *schemaCompiler) number() expr {
+	return c.shared("number", func() expr {
+		digits := repeat{e: bytesIn('0', '9'), min: 1, max: -1}
+		return sequence{
+			optional(literal("-")),
+			c.integralPart(),
+			optional(sequence{literal("."), digits}),
+			optional(sequence{choice{literal("e"), literal("E")}, optional(choice{literal("-"), literal("+")}), digits}),
+			c.space(),
+		}
+	})
+}
+
+func (c *schemaCompiler) integralPart() expr {
+	return c.shared("integral-part", func() expr {
+		return choice{literal("0"), sequence{bytesIn('1', '9'), repeat{e: bytesIn('0', '9'), max: 15}}}
+	})
+}
+
+func (c *schemaCompiler) object(s map[string]json.RawMessage) (expr, error) {
+	var keys []string
+	properties := make(map[string]json.RawMessage)
+	if raw := s["properties"]; raw != nil {
+		var err error
+		if keys, err = orderedKeys(raw); err != nil {
+			return nil, fmt.Errorf("invalid properties: %w", err)
+		}
+
+		if err := json.Unmarshal(raw, &properties); err != nil {
+			return nil, fmt.Errorf("invalid properties: %w", err)
+		}
+	}
+
+	var required []string
+	if raw := s["required"]; raw != nil {
+		if err := json.Unmarshal(raw, &required); err != nil {
+			return nil, fmt.Errorf("invalid required: %w", err)
+		}
+	}
+
+	for _, k := range required {
+		if _, ok := properties[k]; !ok {
+			return nil, fmt.Errorf("required property %q isn't in properties", k)
+		}
+	}
+
+	// other properties are allowed if additionalProperties is a schema or
+	// true, or when no properties are listed and it isn't false
+	var additional expr
+	switch raw := s["additionalProperties"]; {
+	case raw == nil && len(keys) == 0:
+		additional = c.any()
+	case raw != nil && string(bytes.TrimSpace(raw)) != "false":
+		value, err := c.compile(raw)
+		if err != nil {
+			return nil, err
+		}
+		additional = sequence{c.plainString(), c.token(":"), value}
+	}
+
+	members := make([]expr, len(keys))
+	for i, k := range keys {
+		value, err := c.compile(properties[k])
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", k, err)
+		}
+
+		quoted, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := c.literal(quoted)
+		if err != nil {
+			return nil, err
+		}
+
+		members[i] = sequence{key, c.token(":"), value}
+	}
+
+	// properties come in the order they're listed, skipping optional ones,
+	// and are followed by any additional properties. rest[i] matches the
+	// members from i on, after at least one member if first is false.
+	rest := make(map[[2]int]expr)
+	var tail func(i int, first bool) expr
+	tail = func(i int, first bool) expr {
+		if e, ok := rest[[2]int{i, boolToInt(first)}]; ok {
+			return e
+		}
+
+		var sep expr = sequence{}
+		if !first {
+			sep = c.token(",")
+		}
+
+		var e expr = sequence{}
+		if i == len(members) {
+			if additional != nil {
+				e = optional(sequence{sep, additional, repeat{e: sequence{c.token(","), additional}, max: -1}})
+			}
+		} else {
+			e = sequence{sep, members[i], tail(i+1, false)}
+			if !slices.Contains(required, keys[i]) {
+				e = choice{e, tail(i+1, first)}
+			}
+		}
+
+		e = c.ref(e)
+		rest[[2]int{i, boolToInt(first)}] = e
+		return e
+	}
+
+	return sequence{c.token("{"), tail(0, true), c.token("}")}, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// orderedKeys returns the keys of a JSON object in the order they're listed
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("expected an object")
+	}
+
+	var keys []string
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, t.(string))
+
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+func (c *schemaCompiler) array(s map[string]json.RawMessage) (expr, error) {
+	var prefix []expr
+	if raw := s["prefixItems"]; raw != nil {
+		var schemas []json.RawMessage
+		if err := json.Unmarshal(raw, &schemas); err != nil {
+			return nil, fmt.Errorf("invalid prefixItems: %w", err)
+		}
+
+		for _, schema := range schemas {
+			e, err := c.compile(schema)
+			if err != nil {
+				return nil, err
+			}
+			prefix = append(prefix, e)
+		}
+	}
+
+	var item expr
+	switch raw := s["items"]; {
+	case raw == nil:
+		item = c.any()
+	case string(bytes.TrimSpace(raw)) != "false":
+		var err error
+		if item, err = c.compile(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	minItems, maxItems := 0, -1
+	for k, v := range map[string]*int{"minItems": &minItems, "maxItems": &maxItems} {
+		if err := count(s, k, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if item == nil && (maxItems < 0 || maxItems > len(prefix)) {
+		maxItems = len(prefix)
+	}
+
+	if maxItems >= 0 && maxItems < minItems {
+		return nil, errors.New("array can't have at least minItems and at most maxItems items")
+	}
+
+	// tail matches the items from i on, after at least one item if first
+	// is false
+	var tail func(i int, first bool) expr
+	tail = func(i int, first bool) expr {
+		var sep expr = sequence{}
+		if !first {
+			sep = c.token(",")
+		}
+
+		if i == maxItems {
+			return sequence{}
+		}
+
+		var e expr
+		if i < len(prefix) {
+			e = sequence{sep, prefix[i], tail(i+1, false)}
+		} else {
+			more := -1
+			if maxItems >= 0 {
+				more = maxItems - i - 1
+			}
+			e = sequence{sep, item, repeat{e: sequence{c.token(","), item}, min: max(minItems-i-1, 0), max: more}}
+		}
+
+		if i >= minItems {
+			e = optional(e)
+		}
+		return e
+	}
+
+	return sequence{c.token("["), tail(0, true), c.token("]")}, nil
+}
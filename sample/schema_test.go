@@ -0,0 +1,181 @@
+package sample
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	cases := []struct {
+		desc    string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{
+			desc:    "any value",
+			schema:  `{}`,
+			valid:   []string{`{"a": [1, true, null]}`, `"x"`, `-1.5e3`, `[]`},
+			invalid: []string{`{"a" 1}`, `[1,]`, `01`, `tru`},
+		},
+		{
+			desc:   "object with required properties",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}, "email": {"type": "string"}}, "required": ["name", "age"]}`,
+			valid: []string{
+				`{"name": "Ada", "age": 36}`,
+				`{"name":"Ada","age":36,"email":"ada@example.com"}`,
+				"{\n  \"name\": \"Ada\",\n  \"age\": 36\n}",
+			},
+			invalid: []string{
+				`{"name": "Ada"}`,
+				`{"age": 36, "name": "Ada"}`,
+				`{"name": "Ada", "age": 36.5}`,
+				`{"name": "Ada", "age": 36, "other": 1}`,
+			},
+		},
+		{
+			desc:    "optional properties",
+			schema:  `{"properties": {"a": {"type": "integer"}, "b": {"type": "integer"}}}`,
+			valid:   []string{`{}`, `{"a": 1}`, `{"b": 2}`, `{"a": 1, "b": 2}`},
+			invalid: []string{`{, "b": 2}`, `{"a": 1,}`},
+		},
+		{
+			desc:    "additional properties",
+			schema:  `{"type": "object", "properties": {"a": {"type": "integer"}}, "required": ["a"], "additionalProperties": {"type": "boolean"}}`,
+			valid:   []string{`{"a": 1}`, `{"a": 1, "b": true, "c": false}`},
+			invalid: []string{`{"a": 1, "b": 2}`},
+		},
+		{
+			desc:    "enum",
+			schema:  `{"enum": ["red", "green", 3, null]}`,
+			valid:   []string{`"red"`, `"green"`, `3`, `null`},
+			invalid: []string{`"blue"`, `"re"`, `4`},
+		},
+		{
+			desc:    "const",
+			schema:  `{"const": {"a": "<b>"}}`,
+			valid:   []string{`{"a":"<b>"}`},
+			invalid: []string{`{"a": "<b>"}`},
+		},
+		{
+			desc:    "array with min and max items",
+			schema:  `{"type": "array", "items": {"type": "integer"}, "minItems": 1, "maxItems": 3}`,
+			valid:   []string{`[1]`, `[1, 2]`, `[1, 2, 3]`},
+			invalid: []string{`[]`, `[1, 2, 3, 4]`, `["a"]`},
+		},
+		{
+			desc:    "tuple",
+			schema:  `{"type": "array", "prefixItems": [{"type": "string"}, {"type": "number"}], "items": false}`,
+			valid:   []string{`[]`, `["a"]`, `["a", 1.5]`},
+			invalid: []string{`[1]`, `["a", 1.5, 2]`},
+		},
+		{
+			desc:    "string length",
+			schema:  `{"type": "string", "minLength": 2, "maxLength": 3}`,
+			valid:   []string{`"ab"`, `"abc"`, `"\né"`, `"日本"`},
+			invalid: []string{`"a"`, `"abcd"`, `"a` + "\n" + `"`},
+		},
+		{
+			desc:    "pattern",
+			schema:  `{"type": "string", "pattern": "^[A-Z]{2}-\\d+$"}`,
+			valid:   []string{`"AB-1"`, `"XY-123"`},
+			invalid: []string{`"ab-1"`, `"AB-"`, `"AB-1x"`},
+		},
+		{
+			desc:    "unanchored pattern",
+			schema:  `{"type": "string", "pattern": "\\d"}`,
+			valid:   []string{`"a1b"`, `"1"`},
+			invalid: []string{`"ab"`},
+		},
+		{
+			desc:    "format",
+			schema:  `{"type": "string", "format": "date"}`,
+			valid:   []string{`"2024-02-29"`},
+			invalid: []string{`"2024-13-01"`, `"yesterday"`},
+		},
+		{
+			desc:    "multiple types",
+			schema:  `{"type": ["integer", "null"]}`,
+			valid:   []string{`1`, `null`},
+			invalid: []string{`"1"`, `1.0`},
+		},
+		{
+			desc:    "anyOf",
+			schema:  `{"anyOf": [{"type": "boolean"}, {"type": "array", "items": {"type": "boolean"}}]}`,
+			valid:   []string{`true`, `[false, true]`},
+			invalid: []string{`"true"`, `[1]`},
+		},
+		{
+			desc: "recursive $ref",
+			schema: `{
+				"$ref": "#/$defs/node",
+				"$defs": {
+					"node": {
+						"type": "object",
+						"properties": {"value": {"type": "integer"}, "children": {"type": "array", "items": {"$ref": "#/$defs/node"}}},
+						"required": ["value"]
+					}
+				}
+			}`,
+			valid:   []string{`{"value": 1}`, `{"value": 1, "children": [{"value": 2, "children": [{"value": 3}]}]}`},
+			invalid: []string{`{"value": 1, "children": [{}]}`},
+		},
+		{
+			desc:   "annotations",
+			schema: `{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "T", "description": "d", "type": "boolean", "default": true}`,
+			valid:  []string{`true`, `false`},
+		},
+		{
+			desc:    "unenforced constraints",
+			schema:  `{"type": "object", "properties": {"n": {"type": "integer", "minimum": 0, "exclusiveMaximum": 10}, "tags": {"type": "array", "uniqueItems": true}}, "minProperties": 1}`,
+			valid:   []string{`{"n": 20}`, `{"tags": [1, 1]}`, `{}`},
+			invalid: []string{`{"n": "20"}`},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			for _, s := range c.valid {
+				if !matchFormat(t, c.schema, s) {
+					t.Errorf("expected %s to match", s)
+				}
+			}
+
+			for _, s := range c.invalid {
+				if matchFormat(t, c.schema, s) {
+					t.Errorf("expected %s not to match", s)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	cases := []struct {
+		schema string
+		want   string
+	}{
+		{`{"not": {"type": "number"}}`, `unsupported schema keyword "not"`},
+		{`{"type": "object", "patternProperties": {}}`, `unsupported schema keyword "patternProperties"`},
+		{`{"type": "date"}`, `unsupported type "date"`},
+		{`{"$ref": "#/$defs/missing"}`, `unresolved $ref`},
+		{`{"$ref": "https://example.com/schema.json"}`, `unsupported $ref`},
+		{`{"$ref": "#"}`, `refers to itself`},
+		{`{"type": "string", "pattern": "(?=a)"}`, `lookarounds`},
+		{`{"type": "string", "pattern": "(a)\\1"}`, `backreferences`},
+		{`{"type": "object", "properties": {"a": {}}, "required": ["b"]}`, `required property "b"`},
+		{`{"type": "array", "minItems": 2, "maxItems": 1}`, `minItems`},
+		{`{"type": "array", "maxItems": 1001}`, `maxItems exceeds the maximum of 1000`},
+		{`{"type": "string", "minLength": -1}`, `invalid minLength`},
+		{`{"type": "string", "maxLength": 1000000000}`, `maxLength exceeds the maximum of 1000`},
+		{`{"type": "string", "pattern": "a{1001}"}`, `exceeds the maximum count of 1000`},
+		{`false`, `doesn't match any value`},
+	}
+
+	for _, c := range cases {
+		err := ValidateFormat([]byte(c.schema))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.schema, c.want, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package sample
 
 import (
+	"cmp"
 	"container/heap"
 	"math"
 	"slices"
@@ -128,3 +129,190 @@ func minP(ts []token, p float32) []token {
 	}
 	return ts
 }
+
+// logitBias adds a bias to the logits of the given token ids. It requires ts
+// to be indexed by token id, as it is before any sorting transforms are applied
+func logitBias(ts []token, bias map[int32]float32) {
+	for id, b := range bias {
+		if id >= 0 && int(id) < len(ts) {
+			ts[id].value += b
+		}
+	}
+}
+
+// penalties applies repeat, frequency and presence penalties to tokens that
+// appear in history, matching llama.cpp's penalties sampler. Positive logits
+// are divided by the repeat penalty and negative logits are multiplied by it
+// so that repeated tokens always become less likely.
+func penalties(ts []token, history []int32, repeatPenalty, frequencyPenalty, presencePenalty float32) {
+	if len(history) == 0 || (repeatPenalty == 1.0 && frequencyPenalty == 0.0 && presencePenalty == 0.0) {
+		return
+	}
+
+	counts := make(map[int32]int, len(history))
+	for _, id := range history {
+		counts[id]++
+	}
+
+	for i, t := range ts {
+		count, ok := counts[t.id]
+		if !ok {
+			continue
+		}
+
+		if t.value <= 0 {
+			ts[i].value *= repeatPenalty
+		} else {
+			ts[i].value /= repeatPenalty
+		}
+
+		ts[i].value -= float32(count)*frequencyPenalty + presencePenalty
+	}
+}
+
+// typical keeps the locally typical tokens, whose information content is
+// closest to the entropy of the distribution, up to a cumulative probability
+// of p. It requires ts to be normalized and returns them sorted in descending
+// order of probabilities.
+func typical(ts []token, p float32) []token {
+	if p >= 1.0 || len(ts) < 2 {
+		return ts
+	}
+
+	var entropy float64
+	for _, t := range ts {
+		if t.value > 0 {
+			entropy -= float64(t.value) * math.Log(float64(t.value))
+		}
+	}
+
+	shift := func(t token) float64 {
+		return math.Abs(-math.Log(float64(t.value)) - entropy)
+	}
+
+	slices.SortStableFunc(ts, func(a, b token) int {
+		return cmp.Compare(shift(a), shift(b))
+	})
+
+	var sum float32
+	n := len(ts)
+	for i, t := range ts {
+		sum += t.value
+		if sum > p {
+			n = i + 1
+			break
+		}
+	}
+
+	ts = ts[:n]
+	slices.SortStableFunc(ts, func(a, b token) int {
+		return cmp.Compare(b.value, a.value)
+	})
+	return ts
+}
+
+// mirostatV1 keeps the top k tokens, where k is estimated from how quickly
+// probabilities fall off so that the expected surprise of the next token is
+// mu. n is the size of the vocabulary. It requires ts to be normalized and
+// sorted in descending order of probabilities.
+func mirostatV1(ts []token, mu float32, n int) []token {
+	const m = 100
+
+	// estimate the exponent of the distribution from the most probable tokens
+	var sumTiBi, sumTiSq float64
+	for i := 0; i < m-1 && i < len(ts)-1 && ts[i+1].value > 0; i++ {
+		ti := math.Log(float64(i+2) / float64(i+1))
+		bi := math.Log(float64(ts[i].value / ts[i+1].value))
+		sumTiBi += ti * bi
+		sumTiSq += ti * ti
+	}
+
+	if sumTiSq == 0 {
+		return ts[:1]
+	}
+
+	s := sumTiBi / sumTiSq
+	epsilon := s - 1
+	k := math.Pow(epsilon*math.Pow(2, float64(mu))/(1-math.Pow(float64(n), -epsilon)), 1/s)
+	if math.IsNaN(k) || k > float64(len(ts)) {
+		return ts
+	}
+
+	return ts[:max(int(k), 1)]
+}
+
+// mirostatV2 keeps the tokens with a surprise, or negative log probability,
+// of at most mu. It requires ts to be normalized and sorted in descending
+// order of probabilities.
+func mirostatV2(ts []token, mu float32) []token {
+	for i, t := range ts {
+		if -math.Log2(float64(t.value)) > float64(mu) {
+			return ts[:max(i, 1)]
+		}
+	}
+
+	return ts
+}
+
+// dry penalizes tokens that would extend text repeated from history, so that
+// the longer the repetition the larger the penalty. Repetitions shorter than
+// allowedLength aren't penalized, and they can't extend across tokens in
+// breakers.
+func dry(ts []token, history []int32, multiplier, base float32, allowedLength int, breakers map[int32]bool) {
+	if multiplier == 0 || len(history) < 2 {
+		return
+	}
+
+	// the repeated text ends with the last token and starts after the last
+	// breaker
+	n := len(history)
+	suffix := 0
+	for suffix < n && !breakers[history[n-1-suffix]] {
+		suffix++
+	}
+
+	// lengths of the longest repetition that each token would extend
+	lengths := make(map[int32]int)
+	for end := range n - 1 {
+		next := history[end+1]
+		if breakers[next] {
+			continue
+		}
+
+		length := 0
+		for length < suffix && length <= end && history[end-length] == history[n-1-length] {
+			length++
+		}
+
+		if prev, ok := lengths[next]; !ok || length > prev {
+			lengths[next] = length
+		}
+	}
+
+	for i, t := range ts {
+		if length, ok := lengths[t.id]; ok && length >= allowedLength {
+			ts[i].value -= multiplier * float32(math.Pow(float64(base), float64(length-allowedLength)))
+		}
+	}
+}
+
+// xtc excludes the top choices: when more than one token has a probability
+// of at least threshold, all of them except the least likely are removed. r
+// is a random number that applies it with the given probability. It requires
+// ts to be sorted in descending order of probabilities.
+func xtc(ts []token, probability, threshold, r float32) []token {
+	if r >= probability {
+		return ts
+	}
+
+	n := 0
+	for n < len(ts) && ts[n].value >= threshold {
+		n++
+	}
+
+	if n < 2 {
+		return ts
+	}
+
+	return ts[n-1:]
+}
@@ -3,7 +3,10 @@ package sample
 import (
 	"math"
 	"math/rand/v2"
+	"slices"
 	"testing"
+
+	"github.com/ollama/ollama/llama"
 )
 
 // Helper to convert float32 slice to logit slice
@@ -295,6 +298,251 @@ func TestMinP(t *testing.T) {
 	}
 }
 
+func TestLogitBias(t *testing.T) {
+	input := []float32{1.0, 4.0, -2.0, 0.0}
+	tokens := toTokens(input)
+	logitBias(tokens, map[int32]float32{1: -100, 2: 5, 10: 1, -1: 1})
+	want := []float32{1.0, -96.0, 3.0, 0.0}
+	compareLogits(t, "logitBias", want, tokens)
+
+	tokens = toTokens(input)
+	logitBias(tokens, nil)
+	compareLogits(t, "logitBias(nil)", input, tokens)
+}
+
+func TestPenalties(t *testing.T) {
+	input := []float32{2.0, -1.0, 0.5, 3.0, 0.0}
+	history := []int32{0, 0, 1, 3, 4}
+
+	tests := []struct {
+		name             string
+		repeatPenalty    float32
+		frequencyPenalty float32
+		presencePenalty  float32
+		want             []float32
+	}{
+		{
+			name:          "repeat",
+			repeatPenalty: 1.1,
+			want:          []float32{2.0 / 1.1, -1.0 * 1.1, 0.5, 3.0 / 1.1, 0.0},
+		},
+		{
+			name:             "frequency and presence",
+			repeatPenalty:    1.0,
+			frequencyPenalty: 0.5,
+			presencePenalty:  0.25,
+			want:             []float32{0.75, -1.75, 0.5, 2.25, -0.75},
+		},
+		{
+			name:             "all",
+			repeatPenalty:    2.0,
+			frequencyPenalty: 0.5,
+			presencePenalty:  0.25,
+			want:             []float32{-0.25, -2.75, 0.5, 0.75, -0.75},
+		},
+		{
+			name:          "disabled",
+			repeatPenalty: 1.0,
+			want:          []float32{2.0, -1.0, 0.5, 3.0, 0.0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := toTokens(input)
+			penalties(tokens, history, tt.repeatPenalty, tt.frequencyPenalty, tt.presencePenalty)
+			compareLogits(t, tt.name, tt.want, tokens)
+		})
+	}
+
+	tokens := toTokens(input)
+	penalties(tokens, nil, 2.0, 0.5, 0.25)
+	compareLogits(t, "empty history", input, tokens)
+}
+
+// TestPenaltiesParity runs llama.cpp's penalties sampler, which is used by the
+// llama engine, on the same logits and history
+func TestPenaltiesParity(t *testing.T) {
+	tests := []struct {
+		name             string
+		repeatPenalty    float32
+		frequencyPenalty float32
+		presencePenalty  float32
+	}{
+		{name: "repeat", repeatPenalty: 1.1},
+		{name: "frequency", repeatPenalty: 1.0, frequencyPenalty: 0.5},
+		{name: "presence", repeatPenalty: 1.0, presencePenalty: 0.25},
+		{name: "all", repeatPenalty: 1.3, frequencyPenalty: 0.2, presencePenalty: 0.4},
+	}
+
+	r := rand.New(rand.NewPCG(42, 0))
+	logits := make([]float32, 64)
+	for i := range logits {
+		logits[i] = float32(r.NormFloat64() * 4)
+	}
+
+	history := make([]int32, 32)
+	for i := range history {
+		history[i] = int32(r.IntN(len(logits)))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := make([]llama.TokenData, len(logits))
+			for i, l := range logits {
+				want[i] = llama.TokenData{ID: int32(i), Logit: l}
+			}
+
+			p := llama.NewPenalties(len(history), tt.repeatPenalty, tt.frequencyPenalty, tt.presencePenalty)
+			for _, id := range history {
+				p.Accept(id)
+			}
+			p.Apply(want)
+
+			got := toTokens(logits)
+			penalties(got, history, tt.repeatPenalty, tt.frequencyPenalty, tt.presencePenalty)
+
+			for i := range want {
+				if math.Abs(float64(got[i].value-want[i].Logit)) > 1e-5 {
+					t.Errorf("token %d: llama.cpp %f, got %f", i, want[i].Logit, got[i].value)
+				}
+			}
+		})
+	}
+}
+
+func TestTypical(t *testing.T) {
+	probs := []float32{0.5, 0.3, 0.15, 0.05}
+
+	// token 1 is the closest to the entropy of the distribution, followed by
+	// tokens 0, 2 and 3
+	tests := []struct {
+		p    float32
+		want []int32
+	}{
+		{p: 1.0, want: []int32{0, 1, 2, 3}},
+		{p: 0.9, want: []int32{0, 1, 2}},
+		{p: 0.5, want: []int32{0, 1}},
+		{p: 0.2, want: []int32{1}},
+	}
+
+	for _, tt := range tests {
+		got := typical(toTokens(probs), tt.p)
+		ids := make([]int32, len(got))
+		for i, t := range got {
+			ids[i] = t.id
+		}
+
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("typical(%v): got %v, want %v", tt.p, ids, tt.want)
+		}
+	}
+}
+
+func TestMirostatV1(t *testing.T) {
+	// a Zipf distribution with an exponent of 1.5, which mirostat estimates
+	// from the most likely tokens
+	const n = 1000
+	probs := make([]float32, n)
+	var sum float64
+	for i := range probs {
+		sum += math.Pow(float64(i+1), -1.5)
+	}
+	for i := range probs {
+		probs[i] = float32(math.Pow(float64(i+1), -1.5) / sum)
+	}
+
+	// k = (epsilon * 2^mu / (1 - n^-epsilon))^(1/s) where epsilon = s - 1
+	for mu, want := range map[float32]int{5: 6, 10: 65, 0: 1} {
+		got := mirostatV1(toTokens(probs), mu, n)
+		if len(got) != want {
+			t.Errorf("mirostatV1(mu=%v): kept %d tokens, want %d", mu, len(got), want)
+		}
+	}
+
+	if got := mirostatV1(toTokens([]float32{1}), 5, n); len(got) != 1 {
+		t.Errorf("mirostatV1: single token: kept %d tokens", len(got))
+	}
+}
+
+func TestMirostatV2(t *testing.T) {
+	// surprises of 1, 2, 3 and 3 bits
+	probs := []float32{0.5, 0.25, 0.125, 0.125}
+
+	for mu, want := range map[float32]int{2.5: 2, 3: 4, 10: 4, 0.5: 1} {
+		got := mirostatV2(toTokens(probs), mu)
+		if len(got) != want {
+			t.Errorf("mirostatV2(mu=%v): kept %d tokens, want %d", mu, len(got), want)
+		}
+	}
+}
+
+func TestDRY(t *testing.T) {
+	input := make([]float32, 10)
+
+	tests := []struct {
+		name     string
+		history  []int32
+		breakers map[int32]bool
+		want     []float32
+	}{
+		{
+			name:    "repetition of the allowed length",
+			history: []int32{1, 2, 3, 9, 1, 2},
+			want:    []float32{0, 0, 0, -1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:    "longer repetition",
+			history: []int32{1, 2, 3, 4, 9, 1, 2, 3},
+			want:    []float32{0, 0, 0, 0, -2, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "repetition after a breaker",
+			history:  []int32{1, 2, 3, 4, 5, 1, 2, 3},
+			breakers: map[int32]bool{1: true},
+			want:     []float32{0, 0, 0, 0, -1, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "breakers aren't penalized",
+			history:  []int32{5, 6, 7, 5, 6},
+			breakers: map[int32]bool{7: true},
+			want:     []float32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:    "short repetition",
+			history: []int32{1, 2, 3, 1},
+			want:    []float32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := toTokens(input)
+			dry(tokens, tt.history, 1, 2, 2, tt.breakers)
+			compareLogits(t, tt.name, tt.want, tokens)
+		})
+	}
+
+	tokens := toTokens(input)
+	dry(tokens, []int32{1, 2, 3, 9, 1, 2}, 0, 2, 2, nil)
+	compareLogits(t, "disabled", input, tokens)
+}
+
+func TestXTC(t *testing.T) {
+	probs := []float32{0.4, 0.3, 0.2, 0.1}
+
+	got := xtc(toTokens(probs), 1, 0.25, 0.5)
+	compareLogits(t, "xtc(threshold=0.25)", []float32{0.3, 0.2, 0.1}, got)
+
+	// only one token is above the threshold
+	got = xtc(toTokens(probs), 1, 0.35, 0.5)
+	compareLogits(t, "xtc(threshold=0.35)", probs, got)
+
+	// the random number is above the probability
+	got = xtc(toTokens(probs), 0.5, 0.25, 0.5)
+	compareLogits(t, "xtc(probability=0.5)", probs, got)
+}
+
 func BenchmarkTransforms(b *testing.B) {
 	// Generate random logits
 	tokens := make([]token, 1<<16)
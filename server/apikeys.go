@@ -0,0 +1,385 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ollama/ollama/anthropic"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+// apiScope is a group of routes that an API key can be granted access to
+type apiScope string
+
+const (
+	// scopeInference allows running, listing and showing models
+	scopeInference apiScope = "inference"
+	// scopeModels allows creating, pulling, pushing, copying, deleting and
+	// pinning models
+	scopeModels apiScope = "models"
+)
+
+var apiScopes = []apiScope{scopeInference, scopeModels}
+
+// routeScopes maps routes to the scope required to use them. Routes that
+// aren't listed, such as /metrics, require a key with every scope.
+var routeScopes = map[string]apiScope{
+	"/api/generate":        scopeInference,
+	"/api/chat":            scopeInference,
+	"/api/embed":           scopeInference,
+	"/api/embeddings":      scopeInference,
+	"/api/rerank":          scopeInference,
+	"/api/tokenize":        scopeInference,
+	"/api/warm":            scopeInference,
+	"/api/detokenize":      scopeInference,
+	"/api/ps":              scopeInference,
+	"/api/tags":            scopeInference,
+	"/api/show":            scopeInference,
+	"/v1/chat/completions": scopeInference,
+	"/v1/completions":      scopeInference,
+	"/v1/embeddings":       scopeInference,
+	"/v1/models":           scopeInference,
+	"/v1/responses":        scopeInference,
+	"/v1/messages":         scopeInference,
+	"/v1/files":            scopeInference,
+	"/v1/batches":          scopeInference,
+	"/api/pull":            scopeModels,
+	"/api/push":            scopeModels,
+	"/api/create":          scopeModels,
+	"/api/copy":            scopeModels,
+	"/api/delete":          scopeModels,
+	"/api/pin":             scopeModels,
+	"/api/unpin":           scopeModels,
+}
+
+func routeScope(path string) (apiScope, bool) {
+	if scope, ok := routeScopes[path]; ok {
+		return scope, true
+	}
+
+	switch {
+	case strings.HasPrefix(path, "/v1/models/"),
+		strings.HasPrefix(path, "/v1/responses/"),
+		strings.HasPrefix(path, "/v1/files/"),
+		strings.HasPrefix(path, "/v1/batches/"):
+		return scopeInference, true
+	case strings.HasPrefix(path, "/api/blobs/"):
+		return scopeModels, true
+	}
+
+	return "", false
+}
+
+// apiKey is an entry in the keys file. Keys without scopes have every scope
+// and keys without models can use every model.
+type apiKey struct {
+	Name   string     `json:"name"`
+	Key    string     `json:"key"`
+	Scopes []apiScope `json:"scopes,omitempty"`
+	Models []string   `json:"models,omitempty"`
+
+	// MaxPriority is the highest priority that requests made with the key
+	// can ask for. It defaults to normal.
+	MaxPriority string `json:"max_priority,omitempty"`
+
+	hash        [sha256.Size]byte
+	patterns    []*regexp.Regexp
+	maxPriority llm.Priority
+}
+
+// id identifies the key by its name, or a prefix of its hash if it doesn't
+// have one
+func (k *apiKey) id() string {
+	return "key:" + cmp.Or(k.Name, hex.EncodeToString(k.hash[:4]))
+}
+
+func (k *apiKey) hasScope(scope apiScope) bool {
+	return len(k.Scopes) == 0 || slices.Contains(k.Scopes, scope)
+}
+
+// allows reports whether the key can use the model n. A nil key, which is
+// used when authentication is disabled, allows every model.
+func (k *apiKey) allows(n model.Name) bool {
+	if k == nil || len(k.patterns) == 0 {
+		return true
+	}
+
+	if !n.IsValid() {
+		return false
+	}
+
+	name := n.DisplayShortest()
+	return slices.ContainsFunc(k.patterns, func(re *regexp.Regexp) bool {
+		return re.MatchString(name)
+	})
+}
+
+// modelPattern compiles a model pattern such as "llama3.2", "qwen3:*" or
+// "hf.co/*". "*" matches any characters and patterns without a tag match
+// every tag.
+func modelPattern(s string) (*regexp.Regexp, error) {
+	if s == "" {
+		return nil, errors.New("empty model pattern")
+	}
+
+	if !strings.Contains(s[strings.LastIndex(s, "/")+1:], ":") {
+		s += ":*"
+	}
+
+	return regexp.Compile("(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, ".*") + "$")
+}
+
+type apiKeys []*apiKey
+
+// loadAPIKeys reads the keys file at path, which has the form:
+//
+//	{
+//	  "keys": [
+//	    {"name": "admin", "key": "..."},
+//	    {"name": "app", "key": "...", "scopes": ["inference"], "models": ["llama3.2", "qwen3:*"], "max_priority": "high"}
+//	  ]
+//	}
+//
+// No keys are returned if path is empty, which disables authentication.
+func loadAPIKeys(path string) (apiKeys, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %w", err)
+	}
+
+	var f struct {
+		Keys apiKeys `json:"keys"`
+	}
+	if err := json.Unmarshal(bts, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse api keys: %w", err)
+	}
+
+	if len(f.Keys) == 0 {
+		return nil, fmt.Errorf("no api keys in %s", path)
+	}
+
+	seen := make(map[[sha256.Size]byte]bool)
+	for i, k := range f.Keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("api key %d (%q) is empty", i, k.Name)
+		}
+
+		k.hash = sha256.Sum256([]byte(k.Key))
+		if seen[k.hash] {
+			return nil, fmt.Errorf("api key %d (%q) is a duplicate", i, k.Name)
+		}
+		seen[k.hash] = true
+
+		for _, scope := range k.Scopes {
+			if !slices.Contains(apiScopes, scope) {
+				return nil, fmt.Errorf("api key %d (%q) has unknown scope %q", i, k.Name, scope)
+			}
+		}
+
+		k.maxPriority, err = llm.ParsePriority(k.MaxPriority)
+		if err != nil {
+			return nil, fmt.Errorf("api key %d (%q) has invalid max_priority: %w", i, k.Name, err)
+		}
+
+		for _, m := range k.Models {
+			re, err := modelPattern(m)
+			if err != nil {
+				return nil, fmt.Errorf("api key %d (%q) has invalid model pattern %q: %w", i, k.Name, m, err)
+			}
+			k.patterns = append(k.patterns, re)
+		}
+	}
+
+	return f.Keys, nil
+}
+
+// lookup finds the key matching the bearer token in the request, or the
+// x-api-key header sent by Anthropic clients
+func (keys apiKeys) lookup(r *http.Request) *apiKey {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.Header.Get("X-Api-Key")
+	}
+
+	if strings.TrimSpace(token) == "" {
+		return nil
+	}
+
+	hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+
+	var match *apiKey
+	for _, k := range keys {
+		// compare every key so that timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			match = k
+		}
+	}
+
+	return match
+}
+
+// byID finds the key identified by id, as returned by apiKey.id
+func (keys apiKeys) byID(id string) *apiKey {
+	for _, k := range keys {
+		if k.id() == id {
+			return k
+		}
+	}
+
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the key used to authenticate the request, or nil
+// if authentication is disabled
+func apiKeyFromContext(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// requestedModels returns the names of the models used by r, leaving its
+// body to be read again by the handler
+func requestedModels(r *http.Request) ([]string, error) {
+	if name, ok := strings.CutPrefix(r.URL.Path, "/v1/models/"); ok {
+		return []string{name}, nil
+	}
+
+	// uploads can be large and don't name models, which batches check when
+	// they are created
+	if r.Body == nil || strings.HasPrefix(r.URL.Path, "/api/blobs/") || strings.HasPrefix(r.URL.Path, "/v1/files") {
+		return nil, nil
+	}
+
+	bts, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(bts))
+
+	if len(bytes.TrimSpace(bts)) == 0 {
+		return nil, nil
+	}
+
+	// the body is decoded loosely so that fields the handler would read as
+	// a model name, which json matches case insensitively, can't be hidden
+	// from the check by giving another field an unexpected type
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &req); err != nil {
+		return nil, errors.New("invalid request body")
+	}
+
+	fields := []string{"model", "name", "from", "source", "destination", "draft"}
+
+	// the name of a warmed prompt is not a model name
+	if r.URL.Path == "/api/warm" {
+		fields = slices.DeleteFunc(fields, func(f string) bool { return f == "name" })
+	}
+
+	var names []string
+	for k, v := range req {
+		i := slices.IndexFunc(fields, func(f string) bool { return strings.EqualFold(f, k) })
+		if i < 0 {
+			continue
+		}
+		field := fields[i]
+
+		var name *string
+		if err := json.Unmarshal(v, &name); err != nil {
+			return nil, fmt.Errorf("invalid %s: expected a string", field)
+		}
+
+		if name != nil && *name != "" {
+			names = append(names, *name)
+		}
+	}
+
+	return names, nil
+}
+
+// middleware requires requests to next to present an API key with the scope
+// of the route and access to the models it uses. "/" and /api/version are
+// left open so that clients can check the server is running.
+func (keys apiKeys) middleware(next http.Handler) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+
+	slog.Info("api key authentication enabled", "keys", len(keys))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// preflight requests never include credentials
+		if r.Method == http.MethodOptions || r.URL.Path == "/" || r.URL.Path == "/api/version" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		k := keys.lookup(r)
+		if k == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAuthError(w, r, http.StatusUnauthorized, "invalid or missing api key")
+			return
+		}
+
+		scopes := apiScopes
+		if scope, ok := routeScope(r.URL.Path); ok {
+			scopes = []apiScope{scope}
+		}
+
+		for _, scope := range scopes {
+			if !k.hasScope(scope) {
+				writeAuthError(w, r, http.StatusForbidden, "api key does not have access to this endpoint")
+				return
+			}
+		}
+
+		names, err := requestedModels(r)
+		if err != nil {
+			writeAuthError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		for _, name := range names {
+			if !k.allows(model.ParseName(name)) {
+				writeAuthError(w, r, http.StatusForbidden, fmt.Sprintf("api key does not have access to model '%s'", name))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)))
+	})
+}
+
+func writeAuthError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	var resp any = map[string]string{"error": msg}
+	switch {
+	case r.URL.Path == "/v1/messages":
+		resp = anthropic.NewError(code, msg)
+	case strings.HasPrefix(r.URL.Path, "/v1/"):
+		resp = openai.NewError(code, msg)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck
+}
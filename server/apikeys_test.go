@@ -0,0 +1,293 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/anthropic"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+func writeAPIKeys(t *testing.T, keys string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	cases := []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{"valid", `{"keys": [{"name": "a", "key": "a"}, {"name": "b", "key": "b", "scopes": ["inference"], "models": ["llama3.2"]}]}`, ""},
+		{"empty", `{"keys": []}`, "no api keys"},
+		{"empty key", `{"keys": [{"name": "a"}]}`, "is empty"},
+		{"duplicate", `{"keys": [{"name": "a", "key": "a"}, {"name": "b", "key": "a"}]}`, "is a duplicate"},
+		{"unknown scope", `{"keys": [{"name": "a", "key": "a", "scopes": ["admin"]}]}`, "unknown scope"},
+		{"empty pattern", `{"keys": [{"name": "a", "key": "a", "models": [""]}]}`, "invalid model pattern"},
+		{"invalid max priority", `{"keys": [{"name": "a", "key": "a", "max_priority": "urgent"}]}`, "invalid max_priority"},
+		{"invalid json", `{"keys": {}}`, "failed to parse"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadAPIKeys(writeAPIKeys(t, tt.keys))
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if keys, err := loadAPIKeys(""); err != nil || keys != nil {
+		t.Fatalf("expected no keys without a keys file, got %v, %v", keys, err)
+	}
+}
+
+func TestAPIKeyAllows(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys": [{"key": "k", "models": ["llama3.2", "qwen3:8b", "hf.co/*", "user/*:q4*"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"llama3.2":                 true,
+		"llama3.2:1b":              true,
+		"Llama3.2:latest":          true,
+		"llama3.1":                 false,
+		"qwen3:8b":                 true,
+		"qwen3":                    false,
+		"qwen3:14b":                false,
+		"hf.co/org/repo:Q4_K_M":    true,
+		"user/model:q4_0":          true,
+		"user/model:q8_0":          false,
+		"registry.ollama.ai/llama": false,
+	}
+
+	for name, want := range cases {
+		if got := keys[0].allows(model.ParseName(name)); got != want {
+			t.Errorf("%s: expected %t, got %t", name, want, got)
+		}
+	}
+
+	var k *apiKey
+	if !k.allows(model.ParseName("anything")) {
+		t.Error("expected nil key to allow every model")
+	}
+}
+
+func TestAPIKeysMiddleware(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys": [
+		{"name": "admin", "key": "admin"},
+		{"name": "app", "key": "app", "scopes": ["inference"], "models": ["llama3.2"]},
+		{"name": "ops", "key": "ops", "scopes": ["models"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// echo the body to check that it can still be read by the handler
+	h := keys.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if k := apiKeyFromContext(r.Context()); k != nil {
+			w.Header().Set("X-Key", k.Name)
+		}
+		io.Copy(w, r.Body) //nolint:errcheck
+	}))
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   string
+		status int
+		caller string
+	}{
+		{"missing key", http.MethodPost, "/api/generate", "", `{"model": "llama3.2"}`, http.StatusUnauthorized, ""},
+		{"invalid key", http.MethodPost, "/api/generate", "nope", `{"model": "llama3.2"}`, http.StatusUnauthorized, ""},
+		{"public", http.MethodGet, "/api/version", "", "", http.StatusOK, ""},
+		{"preflight", http.MethodOptions, "/api/chat", "", "", http.StatusOK, ""},
+		{"admin", http.MethodPost, "/api/generate", "admin", `{"model": "qwen3"}`, http.StatusOK, "admin"},
+		{"allowed model", http.MethodPost, "/api/chat", "app", `{"model": "llama3.2:3b"}`, http.StatusOK, "app"},
+		{"denied model", http.MethodPost, "/api/chat", "app", `{"model": "qwen3"}`, http.StatusForbidden, ""},
+		{"denied model mismatched field", http.MethodPost, "/api/chat", "app", `{"model": "qwen3", "messages": [], "from": 0}`, http.StatusBadRequest, ""},
+		{"denied model mismatched draft", http.MethodPost, "/api/generate", "app", `{"model": "qwen3", "draft": true}`, http.StatusBadRequest, ""},
+		{"denied model case", http.MethodPost, "/api/chat", "app", `{"model": "llama3.2", "Model": "qwen3"}`, http.StatusForbidden, ""},
+		{"denied model folded case", http.MethodPost, "/api/chat", "app", `{"model": "llama3.2", "ſource": "qwen3"}`, http.StatusForbidden, ""},
+		{"denied model invalid body", http.MethodPost, "/api/chat", "app", `{"model": "qwen3"`, http.StatusBadRequest, ""},
+		{"null field", http.MethodPost, "/api/chat", "app", `{"model": "llama3.2", "from": null}`, http.StatusOK, "app"},
+		{"openai allowed model", http.MethodPost, "/v1/chat/completions", "app", `{"model": "llama3.2"}`, http.StatusOK, "app"},
+		{"openai denied model", http.MethodPost, "/v1/chat/completions", "app", `{"model": "qwen3"}`, http.StatusForbidden, ""},
+		{"openai retrieve denied model", http.MethodGet, "/v1/models/qwen3", "app", "", http.StatusForbidden, ""},
+		{"list", http.MethodGet, "/api/tags", "app", "", http.StatusOK, "app"},
+		{"missing scope", http.MethodPost, "/api/pull", "app", `{"model": "llama3.2"}`, http.StatusForbidden, ""},
+		{"models scope", http.MethodPost, "/api/pull", "ops", `{"model": "llama3.2"}`, http.StatusOK, "ops"},
+		{"models scope inference", http.MethodPost, "/api/generate", "ops", `{"model": "llama3.2"}`, http.StatusForbidden, ""},
+		{"copy", http.MethodPost, "/api/copy", "ops", `{"source": "llama3.2", "destination": "qwen3"}`, http.StatusOK, "ops"},
+		{"unlisted route", http.MethodGet, "/metrics", "app", "", http.StatusForbidden, ""},
+		{"unlisted route admin", http.MethodGet, "/metrics", "admin", "", http.StatusOK, "admin"},
+		{"blobs", http.MethodPost, "/api/blobs/sha256:abc", "ops", "data", http.StatusOK, "ops"},
+		{"files", http.MethodPost, "/v1/files", "app", "--boundary", http.StatusOK, "app"},
+		{"batches", http.MethodGet, "/v1/batches/batch_abc", "app", "", http.StatusOK, "app"},
+		{"batches missing scope", http.MethodPost, "/v1/batches", "ops", `{"input_file_id": "file-abc"}`, http.StatusForbidden, ""},
+		{"responses denied model", http.MethodPost, "/v1/responses", "app", `{"model": "qwen3", "input": "Hello"}`, http.StatusForbidden, ""},
+		{"responses retrieve", http.MethodGet, "/v1/responses/resp_abc", "app", "", http.StatusOK, "app"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequestWithContext(t.Context(), tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.key != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if w.Code == http.StatusOK {
+				if w.Body.String() != tt.body {
+					t.Errorf("expected body %q, got %q", tt.body, w.Body.String())
+				}
+
+				if got := w.Header().Get("X-Key"); got != tt.caller {
+					t.Errorf("expected key %q, got %q", tt.caller, got)
+				}
+			}
+
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("expected WWW-Authenticate header")
+			}
+
+			if w.Code != http.StatusOK && strings.HasPrefix(tt.path, "/v1/") {
+				var resp openai.ErrorResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Error.Type != "permission_error" {
+					t.Errorf("expected permission_error, got %q", resp.Error.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeysPriority(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys": [
+		{"name": "app", "key": "app"},
+		{"name": "interactive", "key": "interactive", "max_priority": "high"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(requesterMiddleware())
+	r.GET("/api/tags", func(c *gin.Context) {
+		c.String(http.StatusOK, llm.RequesterFromContext(c.Request.Context()).Priority.String())
+	})
+
+	cases := []struct {
+		key      string
+		priority string
+		want     string
+	}{
+		{"app", "", "normal"},
+		{"app", "low", "low"},
+		{"app", "high", "normal"},
+		{"interactive", "high", "high"},
+		{"interactive", "low", "low"},
+	}
+
+	for _, tt := range cases {
+		for name, h := range map[string]http.Handler{"with keys": keys.middleware(r), "without keys": r} {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/api/tags", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			req.Header.Set("X-Ollama-Priority", tt.priority)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			// every priority is allowed when authentication is disabled
+			want := tt.want
+			if name == "without keys" {
+				want = cmp.Or(tt.priority, "normal")
+			}
+
+			if w.Body.String() != want {
+				t.Errorf("%s: %s with priority %q: got %q, want %q", name, tt.key, tt.priority, w.Body.String(), want)
+			}
+		}
+	}
+}
+
+func TestAPIKeysAnthropic(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys": [
+		{"name": "app", "key": "app", "scopes": ["inference"], "models": ["llama3.2"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := keys.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		name   string
+		key    string
+		body   string
+		status int
+		etype  string
+	}{
+		{"x-api-key", "app", `{"model": "llama3.2"}`, http.StatusOK, ""},
+		{"invalid key", "nope", `{"model": "llama3.2"}`, http.StatusUnauthorized, "authentication_error"},
+		{"denied model", "app", `{"model": "qwen3"}`, http.StatusForbidden, "permission_error"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/v1/messages", strings.NewReader(tt.body))
+			r.Header.Set("X-Api-Key", tt.key)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+
+			if tt.etype != "" {
+				var resp anthropic.ErrorResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.Type != "error" || resp.Error.Type != tt.etype {
+					t.Errorf("expected %s, got %+v", tt.etype, resp)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1141 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+// batchEndpoints are the endpoints that the requests of a batch can be sent
+// to, in either the OpenAI or the native format
+var batchEndpoints = []string{
+	"/v1/chat/completions",
+	"/v1/responses",
+	"/v1/completions",
+	"/v1/embeddings",
+	"/api/generate",
+	"/api/chat",
+	"/api/embed",
+}
+
+const (
+	// batchCompletionWindow is the only completion window supported, as in
+	// the OpenAI API
+	batchCompletionWindow = "24h"
+
+	// maxBatchRequests is the number of requests of a batch that are sent at
+	// the same time. Batch requests have a low priority, so they only use
+	// slots that other requests aren't waiting for.
+	maxBatchRequests = 8
+
+	// maxBatchErrors is the number of invalid lines reported for a batch
+	// input file
+	maxBatchErrors = 100
+
+	// batchRetryInterval is how long to wait before resending a request that
+	// was rejected because the server was busy
+	batchRetryInterval = 5 * time.Second
+
+	// batchSaveInterval is how often the progress of a running batch is saved
+	batchSaveInterval = 5 * time.Second
+)
+
+// storedFile is an uploaded or batch output file
+type storedFile struct {
+	openai.File
+
+	// Owner identifies the API key that created the file, if any. Files can
+	// only be used by their owner.
+	Owner string `json:"owner,omitempty"`
+}
+
+// batchJob is a batch and the state needed to run it
+type batchJob struct {
+	openai.Batch
+
+	Owner string `json:"owner,omitempty"`
+
+	// OutputFile and ErrorFile are the IDs that the output and error files
+	// will have. They are only reported in the batch once it has finished.
+	OutputFile string `json:"output_file"`
+	ErrorFile  string `json:"error_file"`
+
+	lastSaved time.Time
+
+	// cancel stops requests of the running batch from waiting to be retried
+	cancel context.CancelFunc
+}
+
+var (
+	errBatchRequestExpired   = &openai.BatchRequestError{Code: "batch_expired", Message: "This request could not be executed before the completion window expired."}
+	errBatchRequestCancelled = &openai.BatchRequestError{Code: "batch_cancelled", Message: "This request could not be executed before the batch was cancelled."}
+)
+
+func (b *batchJob) finished() bool {
+	return slices.Contains([]string{openai.BatchFailed, openai.BatchCompleted, openai.BatchExpired, openai.BatchCancelled}, b.Status)
+}
+
+// batchStore holds uploaded files and batches in a directory, with the layout:
+//
+//	files/<id>       content of a file
+//	files/<id>.json  metadata of a file
+//	batches/<id>.json
+//
+// Batches are run one at a time in the order they were created by sending
+// each request to handler, and are resumed when the server restarts.
+type batchStore struct {
+	dir     string
+	handler http.Handler
+
+	// keys are checked again before a batch is run, since the key that
+	// created it may have been removed or lost access to its models while
+	// it was queued or the server was down. It's nil if authentication is
+	// disabled.
+	keys apiKeys
+
+	mu      sync.Mutex
+	files   map[string]*storedFile
+	batches map[string]*batchJob
+
+	wake chan struct{}
+}
+
+func newBatchStore(dir string, handler http.Handler, keys apiKeys) (*batchStore, error) {
+	s := &batchStore{
+		dir:     dir,
+		handler: handler,
+		keys:    keys,
+		files:   make(map[string]*storedFile),
+		batches: make(map[string]*batchJob),
+		wake:    make(chan struct{}, 1),
+	}
+
+	if err := loadJSONFiles(filepath.Join(dir, "files"), s.files); err != nil {
+		return nil, err
+	}
+
+	if err := loadJSONFiles(filepath.Join(dir, "batches"), s.batches); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadJSONFiles reads each .json file in dir into m, keyed by its name
+func loadJSONFiles[T any](dir string, m map[string]*T) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		bts, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var v T
+		if err := json.Unmarshal(bts, &v); err != nil {
+			slog.Warn("skipping invalid batch metadata", "path", path, "error", err)
+			continue
+		}
+
+		m[filepath.Base(path[:len(path)-len(".json")])] = &v
+	}
+
+	return nil
+}
+
+// writeJSONFile atomically replaces the file at path with v
+func writeJSONFile(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(bts); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func newBatchID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b) //nolint:errcheck
+	return prefix + hex.EncodeToString(b)
+}
+
+func (s *batchStore) filePath(id string) string {
+	return filepath.Join(s.dir, "files", id)
+}
+
+func (s *batchStore) saveFile(f *storedFile) error {
+	return writeJSONFile(s.filePath(f.Id)+".json", f)
+}
+
+// saveBatch must be called with s.mu held
+func (s *batchStore) saveBatch(b *batchJob) error {
+	b.lastSaved = time.Now()
+	return writeJSONFile(filepath.Join(s.dir, "batches", b.Id+".json"), b)
+}
+
+// file returns the file with id if it is owned by owner
+func (s *batchStore) file(id, owner string) (*storedFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[id]
+	if !ok || f.Owner != owner {
+		return nil, false
+	}
+
+	return f, true
+}
+
+// batch returns a copy of the batch with id if it is owned by owner
+func (s *batchStore) batch(id, owner string) (openai.Batch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.batches[id]
+	if !ok || b.Owner != owner {
+		return openai.Batch{}, false
+	}
+
+	return b.Batch, true
+}
+
+// run runs batches until ctx is done
+func (s *batchStore) run(ctx context.Context) {
+	for {
+		if b := s.next(); b != nil {
+			s.runBatch(ctx, b)
+		} else {
+			select {
+			case <-ctx.Done():
+			case <-s.wake:
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next returns the oldest batch that hasn't finished
+func (s *batchStore) next() *batchJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var next *batchJob
+	for _, b := range s.batches {
+		if !b.finished() && (next == nil || b.CreatedAt < next.CreatedAt || (b.CreatedAt == next.CreatedAt && b.Id < next.Id)) {
+			next = b
+		}
+	}
+
+	return next
+}
+
+func (s *batchStore) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runBatch sends the requests of b that haven't been run yet and finalizes
+// it. It returns early, leaving b to be resumed, if ctx is done.
+func (s *batchStore) runBatch(ctx context.Context, b *batchJob) {
+	retry, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	b.cancel = cancel
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		b.cancel = nil
+		s.mu.Unlock()
+	}()
+
+	if errs, err := s.checkOwner(b); err != nil {
+		s.fail(b, err)
+		return
+	} else if len(errs) > 0 {
+		slog.Error("batch failed", "batch", b.Id, "error", errs[0].Message)
+		s.failWith(b, errs)
+		return
+	}
+
+	if err := s.sendRequests(ctx, retry, b); err != nil {
+		s.fail(b, err)
+		return
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := s.finalize(b); err != nil {
+		s.fail(b, err)
+	}
+}
+
+// checkOwner checks that the key that created b can still run each of its
+// requests, returning the errors that fail it otherwise
+func (s *batchStore) checkOwner(b *batchJob) ([]openai.BatchError, error) {
+	if s.keys == nil {
+		return nil, nil
+	}
+
+	key := s.keys.byID(b.Owner)
+	switch {
+	case key == nil:
+		return []openai.BatchError{{Code: "invalid_api_key", Message: "The API key that created the batch no longer exists."}}, nil
+	case !key.hasScope(scopeInference):
+		return []openai.BatchError{{Code: "permission_error", Message: "The API key that created the batch no longer has the inference scope."}}, nil
+	}
+
+	_, errs, err := validateBatchInput(s.filePath(b.InputFileId), b.Endpoint, key)
+	return errs, err
+}
+
+func (s *batchStore) fail(b *batchJob, err error) {
+	slog.Error("batch failed", "batch", b.Id, "error", err)
+	s.failWith(b, []openai.BatchError{{Code: "server_error", Message: err.Error()}})
+}
+
+func (s *batchStore) failWith(b *batchJob, errs []openai.BatchError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b.Status = openai.BatchFailed
+	b.FailedAt = time.Now().Unix()
+	b.Errors = &openai.BatchErrors{Object: "list", Data: errs}
+	if err := s.saveBatch(b); err != nil {
+		slog.Error("failed to save batch", "batch", b.Id, "error", err)
+	}
+}
+
+// sendRequests sends the requests of b that haven't been run yet. Requests
+// that can't be run stop waiting to be retried once retry is done.
+func (s *batchStore) sendRequests(ctx, retry context.Context, b *batchJob) error {
+	done, err := s.doneRequests(b)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(s.filePath(b.InputFileId))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(s.filePath(b.OutputFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	errOut, err := os.OpenFile(s.filePath(b.ErrorFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer errOut.Close()
+
+	s.mu.Lock()
+	if b.Status == openai.BatchInProgress {
+		slog.Info("running batch", "batch", b.Id, "requests", b.RequestCounts.Total, "done", len(done))
+	}
+	s.mu.Unlock()
+
+	var recordErr error
+	var recordOnce sync.Once
+	record := func(line openai.BatchRequestOutput) {
+		if err := s.record(b, line, out, errOut); err != nil {
+			recordOnce.Do(func() { recordErr = err })
+		}
+	}
+
+	var expired atomic.Bool
+	requests := make(chan openai.BatchRequestInput)
+	var wg sync.WaitGroup
+	for range maxBatchRequests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				resp, reqErr := s.send(ctx, retry, b, req)
+				if resp == nil && reqErr == nil {
+					// the server is shutting down, so the request is sent
+					// again when the batch resumes
+					continue
+				}
+
+				if reqErr == errBatchRequestExpired {
+					expired.Store(true)
+				}
+
+				record(openai.BatchRequestOutput{Id: newBatchID("batch_req_"), CustomId: req.CustomId, Response: resp, Error: reqErr})
+			}
+		}()
+	}
+
+	var readErr error
+	r := bufio.NewReader(in)
+	for ctx.Err() == nil {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			readErr = err
+			break
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var req openai.BatchRequestInput
+		if err := json.Unmarshal(line, &req); err != nil {
+			readErr = err
+			break
+		}
+
+		if done[req.CustomId] {
+			continue
+		}
+
+		stopped := s.stopped(b)
+		if stopped == errBatchRequestCancelled {
+			break
+		}
+
+		if stopped == errBatchRequestExpired {
+			expired.Store(true)
+			record(openai.BatchRequestOutput{
+				Id:       newBatchID("batch_req_"),
+				CustomId: req.CustomId,
+				Error:    errBatchRequestExpired,
+			})
+			continue
+		}
+
+		select {
+		case requests <- req:
+		case <-ctx.Done():
+		}
+	}
+
+	close(requests)
+	wg.Wait()
+
+	if expired.Load() {
+		s.mu.Lock()
+		if b.Status == openai.BatchInProgress {
+			b.Status = openai.BatchExpired
+			b.ExpiredAt = time.Now().Unix()
+		}
+		s.mu.Unlock()
+	}
+
+	return cmp.Or(readErr, recordErr)
+}
+
+// stopped returns the error for requests of b that haven't been run because
+// it's being cancelled or has expired, or nil if they can still be run
+func (s *batchStore) stopped(b *batchJob) *openai.BatchRequestError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case b.Status == openai.BatchCancelling:
+		return errBatchRequestCancelled
+	case time.Now().Unix() >= b.ExpiresAt:
+		return errBatchRequestExpired
+	default:
+		return nil
+	}
+}
+
+// doneRequests returns the custom IDs of the requests of b that have already
+// been run, which are in its output and error files
+func (s *batchStore) doneRequests(b *batchJob) (map[string]bool, error) {
+	done := make(map[string]bool)
+	for _, id := range []string{b.OutputFile, b.ErrorFile} {
+		f, err := os.Open(s.filePath(id))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				// a partly written last line is ignored and the request is
+				// sent again
+				break
+			}
+
+			var out openai.BatchRequestOutput
+			if err := json.Unmarshal(line, &out); err == nil {
+				done[out.CustomId] = true
+			}
+		}
+		f.Close()
+	}
+
+	return done, nil
+}
+
+// send sends req to the handler of its endpoint, retrying while the server
+// is busy until b is cancelled or expires. It returns nil for both the
+// response and the error if ctx is done before it completes.
+func (s *batchStore) send(ctx, retry context.Context, b *batchJob, req openai.BatchRequestInput) (*openai.BatchResponse, *openai.BatchRequestError) {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		return &openai.BatchResponse{StatusCode: http.StatusBadRequest, Body: mustMarshal(openai.NewError(http.StatusBadRequest, err.Error()))}, nil
+	}
+
+	// responses are written to the output file in one piece
+	body["stream"] = json.RawMessage("false")
+	delete(body, "stream_options")
+
+	bts, err := json.Marshal(body)
+	if err != nil {
+		return &openai.BatchResponse{StatusCode: http.StatusBadRequest, Body: mustMarshal(openai.NewError(http.StatusBadRequest, err.Error()))}, nil
+	}
+
+	for {
+		r, err := http.NewRequestWithContext(withBatch(ctx, b.Id), http.MethodPost, "http://localhost"+req.Url, bytes.NewReader(bts))
+		if err != nil {
+			return &openai.BatchResponse{StatusCode: http.StatusBadRequest, Body: mustMarshal(openai.NewError(http.StatusBadRequest, err.Error()))}, nil
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		w := &batchResponseWriter{header: make(http.Header), status: http.StatusOK}
+		s.handler.ServeHTTP(w, r)
+
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+
+		if w.status == http.StatusServiceUnavailable {
+			select {
+			case <-time.After(batchRetryInterval):
+			case <-retry.Done():
+			}
+
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+
+			if reqErr := s.stopped(b); reqErr != nil {
+				return nil, reqErr
+			}
+
+			continue
+		}
+
+		resp := bytes.TrimSpace(w.body.Bytes())
+		if !json.Valid(resp) {
+			resp = mustMarshal(string(resp))
+		}
+
+		return &openai.BatchResponse{StatusCode: w.status, RequestId: newBatchID("req_"), Body: resp}, nil
+	}
+}
+
+func mustMarshal(v any) json.RawMessage {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return bts
+}
+
+// record writes line to the output file if it succeeded and the error file
+// otherwise, and updates the request counts of b
+func (s *batchStore) record(b *batchJob, line openai.BatchRequestOutput, out, errOut io.Writer) error {
+	bts, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	bts = append(bts, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if line.Response != nil && line.Response.StatusCode < http.StatusBadRequest {
+		if _, err := out.Write(bts); err != nil {
+			return err
+		}
+		b.RequestCounts.Completed++
+	} else {
+		if _, err := errOut.Write(bts); err != nil {
+			return err
+		}
+		b.RequestCounts.Failed++
+	}
+
+	if time.Since(b.lastSaved) > batchSaveInterval {
+		return s.saveBatch(b)
+	}
+
+	return nil
+}
+
+// finalize registers the output and error files of b and marks it as
+// finished
+func (s *batchStore) finalize(b *batchJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b.Status == openai.BatchInProgress {
+		b.Status = openai.BatchFinalizing
+		b.FinalizingAt = time.Now().Unix()
+	}
+
+	for _, f := range []struct {
+		id, purpose string
+		set         *string
+	}{
+		{b.OutputFile, "batch_output", &b.OutputFileId},
+		{b.ErrorFile, "batch_output", &b.ErrorFileId},
+	} {
+		fi, err := os.Stat(s.filePath(f.id))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if fi.Size() == 0 {
+			os.Remove(s.filePath(f.id))
+			continue
+		}
+
+		name := "batch_" + b.Id + "_output.jsonl"
+		if f.id == b.ErrorFile {
+			name = "batch_" + b.Id + "_error.jsonl"
+		}
+
+		sf := &storedFile{
+			File: openai.File{
+				Id:        f.id,
+				Object:    "file",
+				Bytes:     fi.Size(),
+				CreatedAt: time.Now().Unix(),
+				Filename:  name,
+				Purpose:   f.purpose,
+			},
+			Owner: b.Owner,
+		}
+
+		if err := s.saveFile(sf); err != nil {
+			return err
+		}
+
+		s.files[f.id] = sf
+		*f.set = f.id
+	}
+
+	now := time.Now().Unix()
+	switch b.Status {
+	case openai.BatchCancelling:
+		b.Status = openai.BatchCancelled
+		b.CancelledAt = now
+	case openai.BatchFinalizing:
+		b.Status = openai.BatchCompleted
+		b.CompletedAt = now
+	}
+
+	slog.Info("batch finished", "batch", b.Id, "status", b.Status, "completed", b.RequestCounts.Completed, "failed", b.RequestCounts.Failed)
+	return s.saveBatch(b)
+}
+
+// batchResponseWriter collects the response to a batch request
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+type batchContextKey struct{}
+
+func withBatch(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, batchContextKey{}, id)
+}
+
+// batchFromContext returns the ID of the batch that a request was sent for,
+// if any
+func batchFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(batchContextKey{}).(string)
+	return id, ok
+}
+
+// validateBatchInput checks that each line of the file at path is a request
+// to endpoint for a model that key can use, and returns the number of
+// requests
+func validateBatchInput(path, endpoint string, key *apiKey) (int, []openai.BatchError, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	var total int
+	var errs []openai.BatchError
+	invalid := func(line int, code, format string, args ...any) {
+		if len(errs) < maxBatchErrors {
+			errs = append(errs, openai.BatchError{Code: code, Message: fmt.Sprintf(format, args...), Line: line})
+		}
+	}
+
+	ids := make(map[string]bool)
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			break
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return 0, nil, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		total++
+
+		var req openai.BatchRequestInput
+		if err := json.Unmarshal(line, &req); err != nil {
+			invalid(n, "invalid_json_line", "This line is not parseable as valid JSON.")
+			continue
+		}
+
+		switch {
+		case req.CustomId == "":
+			invalid(n, "missing_required_parameter", "custom_id is required.")
+		case ids[req.CustomId]:
+			invalid(n, "duplicate_custom_id", "The custom_id %q is used by more than one request.", req.CustomId)
+		case req.Method != http.MethodPost:
+			invalid(n, "invalid_method", "The method must be POST.")
+		case req.Url != endpoint:
+			invalid(n, "mismatched_endpoint", "The url %q does not match the batch endpoint %q.", req.Url, endpoint)
+		default:
+			var body struct {
+				Model string `json:"model"`
+			}
+			if err := json.Unmarshal(req.Body, &body); err != nil {
+				invalid(n, "invalid_request", "The body must be a JSON object.")
+			} else if body.Model == "" {
+				invalid(n, "missing_required_parameter", "The body must include a model.")
+			} else if !key.allows(model.ParseName(body.Model)) {
+				invalid(n, "model_not_found", "The API key does not have access to the model %q.", body.Model)
+			}
+		}
+
+		ids[req.CustomId] = true
+	}
+
+	if total == 0 {
+		errs = append(errs, openai.BatchError{Code: "empty_file", Message: "The input file has no requests."})
+	}
+
+	return total, errs, nil
+}
+
+func batchError(c *gin.Context, code int, message string) {
+	c.AbortWithStatusJSON(code, openai.NewError(code, message))
+}
+
+// keyOwner identifies the API key used for a request, which owns the files,
+// batches and responses it creates
+func keyOwner(c *gin.Context) string {
+	if k := apiKeyFromContext(c.Request.Context()); k != nil {
+		return k.id()
+	}
+
+	return ""
+}
+
+func (s *Server) CreateFileHandler(c *gin.Context) {
+	purpose := c.PostForm("purpose")
+	if purpose != "batch" {
+		batchError(c, http.StatusBadRequest, fmt.Sprintf("invalid purpose %q, expected \"batch\"", purpose))
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		batchError(c, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	src, err := fh.Open()
+	if err != nil {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer src.Close()
+
+	f := &storedFile{
+		File: openai.File{
+			Id:        newBatchID("file-"),
+			Object:    "file",
+			CreatedAt: time.Now().Unix(),
+			Filename:  filepath.Base(fh.Filename),
+			Purpose:   purpose,
+		},
+		Owner: keyOwner(c),
+	}
+
+	if err := s.batches.writeFile(f, src); err != nil {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, f.File)
+}
+
+// writeFile stores the content of f from r
+func (s *batchStore) writeFile(f *storedFile, r io.Reader) error {
+	path := s.filePath(f.Id)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	f.Bytes = n
+	if err := s.saveFile(f); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	s.mu.Lock()
+	s.files[f.Id] = f
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Server) ListFilesHandler(c *gin.Context) {
+	owner := keyOwner(c)
+	purpose := c.Query("purpose")
+
+	s.batches.mu.Lock()
+	data := []openai.File{}
+	for _, f := range s.batches.files {
+		if f.Owner == owner && (purpose == "" || f.Purpose == purpose) {
+			data = append(data, f.File)
+		}
+	}
+	s.batches.mu.Unlock()
+
+	slices.SortFunc(data, func(a, b openai.File) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), cmp.Compare(b.Id, a.Id))
+	})
+
+	c.JSON(http.StatusOK, openai.FileList{Object: "list", Data: data})
+}
+
+func (s *Server) GetFileHandler(c *gin.Context) {
+	f, ok := s.batches.file(c.Param("id"), keyOwner(c))
+	if !ok {
+		batchError(c, http.StatusNotFound, fmt.Sprintf("file %q not found", c.Param("id")))
+		return
+	}
+
+	c.JSON(http.StatusOK, f.File)
+}
+
+func (s *Server) GetFileContentHandler(c *gin.Context) {
+	f, ok := s.batches.file(c.Param("id"), keyOwner(c))
+	if !ok {
+		batchError(c, http.StatusNotFound, fmt.Sprintf("file %q not found", c.Param("id")))
+		return
+	}
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.File(s.batches.filePath(f.Id))
+}
+
+func (s *Server) DeleteFileHandler(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := s.batches.file(id, keyOwner(c)); !ok {
+		batchError(c, http.StatusNotFound, fmt.Sprintf("file %q not found", id))
+		return
+	}
+
+	s.batches.mu.Lock()
+	defer s.batches.mu.Unlock()
+
+	for _, b := range s.batches.batches {
+		if b.InputFileId == id && !b.finished() {
+			batchError(c, http.StatusBadRequest, fmt.Sprintf("file %q is the input of batch %q, which hasn't finished", id, b.Id))
+			return
+		}
+	}
+
+	if err := os.Remove(s.batches.filePath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := os.Remove(s.batches.filePath(id) + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	delete(s.batches.files, id)
+	c.JSON(http.StatusOK, openai.FileDeleted{Id: id, Object: "file", Deleted: true})
+}
+
+func (s *Server) CreateBatchHandler(c *gin.Context) {
+	var req openai.BatchRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		batchError(c, http.StatusBadRequest, "missing request body")
+		return
+	} else if err != nil {
+		batchError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !slices.Contains(batchEndpoints, req.Endpoint) {
+		batchError(c, http.StatusBadRequest, fmt.Sprintf("unsupported endpoint %q", req.Endpoint))
+		return
+	}
+
+	if req.CompletionWindow != batchCompletionWindow {
+		batchError(c, http.StatusBadRequest, fmt.Sprintf("invalid completion_window %q, expected %q", req.CompletionWindow, batchCompletionWindow))
+		return
+	}
+
+	owner := keyOwner(c)
+	f, ok := s.batches.file(req.InputFileId, owner)
+	if !ok {
+		batchError(c, http.StatusNotFound, fmt.Sprintf("file %q not found", req.InputFileId))
+		return
+	}
+
+	if f.Purpose != "batch" {
+		batchError(c, http.StatusBadRequest, fmt.Sprintf("file %q does not have purpose \"batch\"", req.InputFileId))
+		return
+	}
+
+	total, errs, err := validateBatchInput(s.batches.filePath(f.Id), req.Endpoint, apiKeyFromContext(c.Request.Context()))
+	if err != nil {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now()
+	b := &batchJob{
+		Batch: openai.Batch{
+			Id:               newBatchID("batch_"),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileId:      req.InputFileId,
+			CompletionWindow: req.CompletionWindow,
+			Status:           openai.BatchInProgress,
+			CreatedAt:        now.Unix(),
+			InProgressAt:     now.Unix(),
+			ExpiresAt:        now.Add(24 * time.Hour).Unix(),
+			RequestCounts:    openai.BatchRequestCounts{Total: total},
+			Metadata:         req.Metadata,
+		},
+		Owner:      owner,
+		OutputFile: newBatchID("file-"),
+		ErrorFile:  newBatchID("file-"),
+	}
+
+	if len(errs) > 0 {
+		b.Status = openai.BatchFailed
+		b.InProgressAt = 0
+		b.FailedAt = now.Unix()
+		b.Errors = &openai.BatchErrors{Object: "list", Data: errs}
+	}
+
+	s.batches.mu.Lock()
+	err = s.batches.saveBatch(b)
+	if err == nil {
+		s.batches.batches[b.Id] = b
+	}
+	s.batches.mu.Unlock()
+
+	if err != nil {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.batches.notify()
+	c.JSON(http.StatusOK, b.Batch)
+}
+
+func (s *Server) GetBatchHandler(c *gin.Context) {
+	b, ok := s.batches.batch(c.Param("id"), keyOwner(c))
+	if !ok {
+		batchError(c, http.StatusNotFound, fmt.Sprintf("batch %q not found", c.Param("id")))
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+// CancelBatchHandler stops sending the requests of a batch. Requests that
+// have already been sent complete and are included in its output.
+func (s *Server) CancelBatchHandler(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := s.batches.batch(id, keyOwner(c)); !ok {
+		batchError(c, http.StatusNotFound, fmt.Sprintf("batch %q not found", id))
+		return
+	}
+
+	s.batches.mu.Lock()
+	defer s.batches.mu.Unlock()
+
+	b := s.batches.batches[id]
+	if b.Status != openai.BatchInProgress {
+		batchError(c, http.StatusBadRequest, fmt.Sprintf("cannot cancel a batch with status %q", b.Status))
+		return
+	}
+
+	b.Status = openai.BatchCancelling
+	b.CancellingAt = time.Now().Unix()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	if err := s.batches.saveBatch(b); err != nil {
+		batchError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, b.Batch)
+}
+
+// ListBatchesHandler lists batches from newest to oldest, starting after the
+// batch in the "after" query parameter
+func (s *Server) ListBatchesHandler(c *gin.Context) {
+	limit := 20
+	if l := c.Query("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 100 {
+			batchError(c, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+	}
+
+	owner := keyOwner(c)
+
+	s.batches.mu.Lock()
+	data := []openai.Batch{}
+	for _, b := range s.batches.batches {
+		if b.Owner == owner {
+			data = append(data, b.Batch)
+		}
+	}
+	s.batches.mu.Unlock()
+
+	slices.SortFunc(data, func(a, b openai.Batch) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), cmp.Compare(b.Id, a.Id))
+	})
+
+	if after := c.Query("after"); after != "" {
+		i := slices.IndexFunc(data, func(b openai.Batch) bool { return b.Id == after })
+		if i < 0 {
+			batchError(c, http.StatusNotFound, fmt.Sprintf("batch %q not found", after))
+			return
+		}
+		data = data[i+1:]
+	}
+
+	list := openai.BatchList{Object: "list", Data: data}
+	if len(data) > limit {
+		list.Data = data[:limit]
+		list.HasMore = true
+	}
+
+	if len(list.Data) > 0 {
+		list.FirstId = list.Data[0].Id
+		list.LastId = list.Data[len(list.Data)-1].Id
+	}
+
+	c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/openai"
+)
+
+func TestBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_BATCH_DIR", t.TempDir())
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Content:    "Hi!",
+			Done:       true,
+			DoneReason: llm.DoneReasonStop,
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`,
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	h, err := s.GenerateRoutes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.batches.run(t.Context())
+
+	do := func(t *testing.T, method, path string, body any, v any) int {
+		t.Helper()
+
+		var r *http.Request
+		switch body := body.(type) {
+		case nil:
+			r = httptest.NewRequest(method, path, nil)
+		case string:
+			var b bytes.Buffer
+			mw := multipart.NewWriter(&b)
+			mw.WriteField("purpose", "batch")
+			fw, _ := mw.CreateFormFile("file", "input.jsonl")
+			fw.Write([]byte(body))
+			mw.Close()
+
+			r = httptest.NewRequest(method, path, &b)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+		default:
+			bts, _ := json.Marshal(body)
+			r = httptest.NewRequest(method, path, bytes.NewReader(bts))
+			r.Header.Set("Content-Type", "application/json")
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if v != nil {
+			if s, ok := v.(*string); ok {
+				*s = w.Body.String()
+			} else if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return w.Code
+	}
+
+	wait := func(t *testing.T, id string) openai.Batch {
+		t.Helper()
+
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var b openai.Batch
+			if code := do(t, http.MethodGet, "/v1/batches/"+id, nil, &b); code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+
+			if b.Status != openai.BatchInProgress && b.Status != openai.BatchFinalizing {
+				return b
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("batch %s is still %s", id, b.Status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	lines := func(t *testing.T, id string) []openai.BatchRequestOutput {
+		t.Helper()
+
+		var content string
+		if code := do(t, http.MethodGet, "/v1/files/"+id+"/content", nil, &content); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		var out []openai.BatchRequestOutput
+		sc := bufio.NewScanner(strings.NewReader(content))
+		for sc.Scan() {
+			var line openai.BatchRequestOutput
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, line)
+		}
+
+		return out
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		var f openai.File
+		if code := do(t, http.MethodPost, "/v1/files", strings.Join([]string{
+			`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "test", "messages": [{"role": "user", "content": "Hello"}]}}`,
+			`{"custom_id": "b", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "test", "messages": [{"role": "user", "content": "Hello"}], "stream": true}}`,
+			`{"custom_id": "c", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "missing", "messages": [{"role": "user", "content": "Hello"}]}}`,
+		}, "\n"), &f); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		var b openai.Batch
+		if code := do(t, http.MethodPost, "/v1/batches", openai.BatchRequest{
+			InputFileId:      f.Id,
+			Endpoint:         "/v1/chat/completions",
+			CompletionWindow: "24h",
+		}, &b); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		b = wait(t, b.Id)
+		if b.Status != openai.BatchCompleted {
+			t.Fatalf("expected status completed, got %s", b.Status)
+		}
+
+		if b.RequestCounts != (openai.BatchRequestCounts{Total: 3, Completed: 2, Failed: 1}) {
+			t.Errorf("unexpected request counts %+v", b.RequestCounts)
+		}
+
+		for _, line := range lines(t, b.OutputFileId) {
+			var resp openai.ChatCompletion
+			if err := json.Unmarshal(line.Response.Body, &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if line.Response.StatusCode != http.StatusOK || resp.Choices[0].Message.Content != "Hi!" {
+				t.Errorf("unexpected response for %s: %d %s", line.CustomId, line.Response.StatusCode, line.Response.Body)
+			}
+		}
+
+		errs := lines(t, b.ErrorFileId)
+		if len(errs) != 1 || errs[0].CustomId != "c" || errs[0].Response.StatusCode != http.StatusNotFound {
+			t.Errorf("unexpected errors %+v", errs)
+		}
+
+		if code := do(t, http.MethodPost, "/v1/batches/"+b.Id+"/cancel", nil, nil); code != http.StatusBadRequest {
+			t.Errorf("cancel: expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("native", func(t *testing.T) {
+		var f openai.File
+		do(t, http.MethodPost, "/v1/files", `{"custom_id": "a", "method": "POST", "url": "/api/chat", "body": {"model": "test", "messages": [{"role": "user", "content": "Hello"}]}}`, &f)
+
+		var b openai.Batch
+		do(t, http.MethodPost, "/v1/batches", openai.BatchRequest{InputFileId: f.Id, Endpoint: "/api/chat", CompletionWindow: "24h"}, &b)
+
+		b = wait(t, b.Id)
+		if b.Status != openai.BatchCompleted || b.ErrorFileId != "" {
+			t.Fatalf("unexpected batch %+v", b)
+		}
+
+		out := lines(t, b.OutputFileId)
+
+		var resp api.ChatResponse
+		if err := json.Unmarshal(out[0].Response.Body, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if !resp.Done || resp.Message.Content != "Hi!" {
+			t.Errorf("unexpected response %s", out[0].Response.Body)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var f openai.File
+		do(t, http.MethodPost, "/v1/files", strings.Join([]string{
+			`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "test"}}`,
+			`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "test"}}`,
+			`{"custom_id": "b", "method": "POST", "url": "/v1/embeddings", "body": {"model": "test"}}`,
+			`not json`,
+		}, "\n"), &f)
+
+		var b openai.Batch
+		if code := do(t, http.MethodPost, "/v1/batches", openai.BatchRequest{
+			InputFileId:      f.Id,
+			Endpoint:         "/v1/chat/completions",
+			CompletionWindow: "24h",
+		}, &b); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if b.Status != openai.BatchFailed || b.Errors == nil {
+			t.Fatalf("expected a failed batch, got %+v", b)
+		}
+
+		var codes []string
+		for _, e := range b.Errors.Data {
+			codes = append(codes, e.Code)
+		}
+
+		if strings.Join(codes, ",") != "duplicate_custom_id,mismatched_endpoint,invalid_json_line" {
+			t.Errorf("unexpected errors %+v", b.Errors.Data)
+		}
+
+		if code := do(t, http.MethodPost, "/v1/batches", openai.BatchRequest{
+			InputFileId:      f.Id,
+			Endpoint:         "/api/pull",
+			CompletionWindow: "24h",
+		}, nil); code != http.StatusBadRequest {
+			t.Errorf("unsupported endpoint: expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		var list openai.BatchList
+		if code := do(t, http.MethodGet, "/v1/batches?limit=2", nil, &list); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if len(list.Data) != 2 || !list.HasMore {
+			t.Errorf("unexpected list %+v", list)
+		}
+
+		if code := do(t, http.MethodGet, "/v1/batches?after=batch_missing", nil, nil); code != http.StatusNotFound {
+			t.Errorf("unknown after: expected status 404, got %d", code)
+		}
+
+		var files openai.FileList
+		do(t, http.MethodGet, "/v1/files?purpose=batch_output", nil, &files)
+		if len(files.Data) != 3 {
+			t.Errorf("expected 3 output files, got %d", len(files.Data))
+		}
+	})
+}
+
+func TestBatchSendStopsRetrying(t *testing.T) {
+	// the server is always too busy to run the request
+	busy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	s, err := newBatchStore(t.TempDir(), busy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := openai.BatchRequestInput{CustomId: "a", Method: http.MethodPost, Url: "/v1/chat/completions", Body: json.RawMessage(`{"model": "test"}`)}
+
+	t.Run("cancelled", func(t *testing.T) {
+		b := &batchJob{Batch: openai.Batch{Id: "batch_a", Status: openai.BatchInProgress, ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+		retry, cancel := context.WithCancel(t.Context())
+
+		done := make(chan *openai.BatchRequestError)
+		go func() {
+			resp, reqErr := s.send(t.Context(), retry, b, req)
+			if resp != nil {
+				t.Errorf("unexpected response %+v", resp)
+			}
+			done <- reqErr
+		}()
+
+		s.mu.Lock()
+		b.Status = openai.BatchCancelling
+		s.mu.Unlock()
+		cancel()
+
+		select {
+		case reqErr := <-done:
+			if reqErr != errBatchRequestCancelled {
+				t.Errorf("expected batch_cancelled, got %+v", reqErr)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("request is still being retried")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		b := &batchJob{Batch: openai.Batch{Id: "batch_b", Status: openai.BatchInProgress, ExpiresAt: time.Now().Add(-time.Second).Unix()}}
+		retry, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		if _, reqErr := s.send(t.Context(), retry, b, req); reqErr != errBatchRequestExpired {
+			t.Errorf("expected batch_expired, got %+v", reqErr)
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		b := &batchJob{Batch: openai.Batch{Id: "batch_c", Status: openai.BatchInProgress, ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		if resp, reqErr := s.send(ctx, ctx, b, req); resp != nil || reqErr != nil {
+			t.Errorf("expected the request to be left to resume, got %+v, %+v", resp, reqErr)
+		}
+	})
+}
+
+func TestBatchResumeChecksOwner(t *testing.T) {
+	keys, err := loadAPIKeys(writeAPIKeys(t, `{"keys": [
+		{"name": "app", "key": "app", "scopes": ["inference"], "models": ["llama3.2"]},
+		{"name": "ops", "key": "ops", "scopes": ["models"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		owner string
+		model string
+		code  string
+	}{
+		{"allowed", "key:app", "llama3.2", ""},
+		{"model no longer allowed", "key:app", "qwen3", "model_not_found"},
+		{"key removed", "key:old", "llama3.2", "invalid_api_key"},
+		{"missing scope", "key:ops", "llama3.2", "permission_error"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent int
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sent++
+				w.Write([]byte(`{}`))
+			})
+
+			// the batch was created before the server restarted with the
+			// current keys
+			dir := t.TempDir()
+			s, err := newBatchStore(dir, h, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := &storedFile{File: openai.File{Id: "file-a", Purpose: "batch"}, Owner: tt.owner}
+			if err := s.writeFile(f, strings.NewReader(`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "`+tt.model+`"}}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			b := &batchJob{
+				Batch: openai.Batch{
+					Id:          "batch_a",
+					Endpoint:    "/v1/chat/completions",
+					InputFileId: f.Id,
+					Status:      openai.BatchInProgress,
+					ExpiresAt:   time.Now().Add(time.Hour).Unix(),
+				},
+				Owner:      tt.owner,
+				OutputFile: "file-out",
+				ErrorFile:  "file-err",
+			}
+			if err := s.saveBatch(b); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = newBatchStore(dir, h, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b = s.next()
+			s.runBatch(t.Context(), b)
+
+			if tt.code == "" {
+				if b.Status != openai.BatchCompleted || sent != 1 {
+					t.Fatalf("expected a completed batch with 1 request, got %s with %d", b.Status, sent)
+				}
+				return
+			}
+
+			if b.Status != openai.BatchFailed || b.Errors == nil || b.Errors.Data[0].Code != tt.code {
+				t.Fatalf("expected a batch failed with %s, got %+v", tt.code, b.Batch)
+			}
+
+			if sent != 0 {
+				t.Errorf("expected no requests to be sent, got %d", sent)
+			}
+		})
+	}
+}
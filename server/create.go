@@ -36,6 +36,7 @@ var (
 	errUnknownType             = errors.New("unknown type")
 	errNeitherFromOrFiles      = errors.New("neither 'from' or 'files' was specified")
 	errFilePath                = errors.New("file path must be relative")
+	errDraftModel              = errors.New("invalid draft model")
 )
 
 func (s *Server) CreateHandler(c *gin.Context) {
@@ -128,6 +129,23 @@ func (s *Server) CreateHandler(c *gin.Context) {
 			baseLayers = append(baseLayers, adapterLayers...)
 		}
 
+		if r.Draft != "" {
+			draftLayer, err := newDraftLayer(r.Draft)
+			if errors.Is(err, errDraftModel) {
+				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+				return
+			} else if err != nil {
+				ch <- gin.H{"error": err.Error()}
+				return
+			}
+
+			// replace the draft model of the base model, if any
+			baseLayers = slices.DeleteFunc(baseLayers, func(layer *layerGGML) bool {
+				return layer.MediaType == "application/vnd.ollama.image.draft"
+			})
+			baseLayers = append(baseLayers, draftLayer)
+		}
+
 		if err := createModel(r, name, baseLayers, fn); err != nil {
 			if errors.Is(err, errBadTemplate) {
 				ch <- gin.H{"error": err.Error(), "status": http.StatusBadRequest}
@@ -154,6 +172,35 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// newDraftLayer creates a layer that references the weights of the existing
+// model name for use as a draft model in speculative decoding
+func newDraftLayer(name string) (*layerGGML, error) {
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		return nil, fmt.Errorf("%w: %q is not a valid model name", errDraftModel, name)
+	}
+
+	m, err := ParseNamedManifest(n)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: model %q not found, try pulling it first", errDraftModel, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, layer := range m.Layers {
+		if layer.MediaType == "application/vnd.ollama.image.model" {
+			layer, err := NewLayerFromLayer(layer.Digest, "application/vnd.ollama.image.draft", n.DisplayShortest())
+			if err != nil {
+				return nil, err
+			}
+
+			return &layerGGML{layer, nil}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q has no model weights", errDraftModel, name)
+}
+
 func convertModelFromFiles(files map[string]string, baseLayers []*layerGGML, isAdapter bool, fn func(resp api.ProgressResponse)) ([]*layerGGML, error) {
 	switch detectModelTypeFromFiles(files) {
 	case "safetensors":
@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
@@ -37,9 +38,14 @@ var (
 	errCapabilityInsert     = errors.New("insert")
 	errCapabilityVision     = errors.New("vision")
 	errCapabilityEmbedding  = errors.New("embedding")
+	errCapabilityThinking   = errors.New("thinking")
+	errCapabilityRerank     = errors.New("rerank")
 	errInsecureProtocol     = errors.New("insecure protocol http")
 )
 
+// poolingTypeRank is the value of the pooling_type key for reranking models
+const poolingTypeRank = 4
+
 type registryOptions struct {
 	Insecure bool
 	Username string
@@ -57,6 +63,8 @@ type Model struct {
 	ParentModel    string
 	AdapterPaths   []string
 	ProjectorPaths []string
+	DraftPath      string
+	DraftModel     string
 	System         string
 	License        []string
 	Digest         string
@@ -78,7 +86,13 @@ func (m *Model) Capabilities() []model.Capability {
 		f, err := ggml.Decode(r, 1024)
 		if err == nil {
 			if _, ok := f.KV()[fmt.Sprintf("%s.pooling_type", f.KV().Architecture())]; ok {
-				capabilities = append(capabilities, model.CapabilityEmbedding)
+				// rank pooling feeds the pooled output through a classification
+				// head, producing a relevance score rather than an embedding
+				if f.KV().Uint("pooling_type") == poolingTypeRank {
+					capabilities = append(capabilities, model.CapabilityRerank)
+				} else {
+					capabilities = append(capabilities, model.CapabilityEmbedding)
+				}
 			} else {
 				capabilities = append(capabilities, model.CapabilityCompletion)
 			}
@@ -106,6 +120,12 @@ func (m *Model) Capabilities() []model.Capability {
 		capabilities = append(capabilities, model.CapabilityInsert)
 	}
 
+	// Check for thinking capability
+	openingTag, closingTag := inferThinkingTags(m.Template.Template)
+	if openingTag != "" && closingTag != "" {
+		capabilities = append(capabilities, model.CapabilityThinking)
+	}
+
 	// Check for vision capability in projector-based models
 	if len(m.ProjectorPaths) > 0 {
 		capabilities = append(capabilities, model.CapabilityVision)
@@ -127,6 +147,8 @@ func (m *Model) CheckCapabilities(want ...model.Capability) error {
 		model.CapabilityInsert:     errCapabilityInsert,
 		model.CapabilityVision:     errCapabilityVision,
 		model.CapabilityEmbedding:  errCapabilityEmbedding,
+		model.CapabilityThinking:   errCapabilityThinking,
+		model.CapabilityRerank:     errCapabilityRerank,
 	}
 
 	for _, cap := range want {
@@ -170,6 +192,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.DraftModel != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "draft",
+			Args: m.DraftModel,
+		})
+	}
+
 	if m.Template != nil {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "template",
@@ -193,6 +222,13 @@ func (m *Model) String() string {
 					Args: fmt.Sprintf("%v", s),
 				})
 			}
+		case map[string]any:
+			for _, mk := range slices.Sorted(maps.Keys(v)) {
+				modelfile.Commands = append(modelfile.Commands, parser.Command{
+					Name: k,
+					Args: fmt.Sprintf("%s %v", mk, v[mk]),
+				})
+			}
 		default:
 			modelfile.Commands = append(modelfile.Commands, parser.Command{
 				Name: k,
@@ -307,6 +343,9 @@ func GetModel(name string) (*Model, error) {
 			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
+		case "application/vnd.ollama.image.draft":
+			model.DraftPath = filename
+			model.DraftModel = layer.From
 		case "application/vnd.ollama.image.prompt",
 			"application/vnd.ollama.image.template":
 			bts, err := os.ReadFile(filename)
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/metrics"
+)
+
+// Metrics are always collected but only exposed at /metrics when
+// OLLAMA_METRICS is set
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	metricRequests = metricsRegistry.NewCounter("ollama_requests_total",
+		"Number of API requests.", "route", "model", "status")
+	metricRequestDuration = metricsRegistry.NewHistogram("ollama_request_duration_seconds",
+		"Duration of API requests, including streaming the response.",
+		[]float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "route", "model")
+
+	metricPromptTokens = metricsRegistry.NewCounter("ollama_prompt_tokens_total",
+		"Number of prompt tokens evaluated.", "model")
+	metricGeneratedTokens = metricsRegistry.NewCounter("ollama_generated_tokens_total",
+		"Number of tokens generated.", "model")
+	metricPromptTokensPerSecond = metricsRegistry.NewHistogram("ollama_prompt_eval_tokens_per_second",
+		"Rate of prompt evaluation for each completion.",
+		[]float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}, "model")
+	metricGeneratedTokensPerSecond = metricsRegistry.NewHistogram("ollama_eval_tokens_per_second",
+		"Rate of token generation for each completion.",
+		[]float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500}, "model")
+
+	metricQueueDepth = metricsRegistry.NewGauge("ollama_scheduler_queue_depth",
+		"Number of requests waiting to be scheduled.")
+	metricLoadedModels = metricsRegistry.NewGauge("ollama_loaded_models",
+		"Number of models loaded in memory.")
+	metricModelVRAM = metricsRegistry.NewGauge("ollama_model_vram_bytes",
+		"Estimated VRAM used by a loaded model.", "model")
+	metricModelMemory = metricsRegistry.NewGauge("ollama_model_memory_bytes",
+		"Estimated total memory used by a loaded model.", "model")
+	metricModelLoadDuration = metricsRegistry.NewHistogram("ollama_model_load_duration_seconds",
+		"Time taken to load a model.",
+		[]float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "model")
+	metricModelEvictions = metricsRegistry.NewCounter("ollama_model_evictions_total",
+		"Number of times a model was unloaded to make room for another model or to be reloaded.", "model")
+)
+
+type metricsLabelsKey struct{}
+
+// metricsLabels holds labels of a request that are only known once it has
+// been handled
+type metricsLabels struct {
+	model string
+}
+
+// metricsMiddleware records the number and duration of requests to each route
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" || route == "/metrics" {
+			c.Next()
+			return
+		}
+
+		labels := &metricsLabels{}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), metricsLabelsKey{}, labels))
+
+		start := time.Now()
+		c.Next()
+
+		metricRequests.Inc(route, labels.model, strconv.Itoa(c.Writer.Status()))
+		metricRequestDuration.Observe(time.Since(start).Seconds(), route, labels.model)
+	}
+}
+
+// setMetricsModel labels the metrics of the request with the model serving it
+func setMetricsModel(ctx context.Context, model string) {
+	if labels, ok := ctx.Value(metricsLabelsKey{}).(*metricsLabels); ok {
+		labels.model = model
+	}
+}
+
+// metricsRunner records the token counts and rates of completions
+type metricsRunner struct {
+	llm.LlamaServer
+	model string
+}
+
+func (r metricsRunner) Completion(ctx context.Context, req llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+	return r.LlamaServer.Completion(ctx, req, func(cr llm.CompletionResponse) {
+		if cr.Done {
+			metricPromptTokens.Add(float64(cr.PromptEvalCount), r.model)
+			metricGeneratedTokens.Add(float64(cr.EvalCount), r.model)
+
+			if cr.PromptEvalDuration > 0 {
+				metricPromptTokensPerSecond.Observe(float64(cr.PromptEvalCount)/cr.PromptEvalDuration.Seconds(), r.model)
+			}
+
+			if cr.EvalDuration > 0 {
+				metricGeneratedTokensPerSecond.Observe(float64(cr.EvalCount)/cr.EvalDuration.Seconds(), r.model)
+			}
+		}
+
+		fn(cr)
+	})
+}
+
+func (s *Server) MetricsHandler(c *gin.Context) {
+	s.sched.collectMetrics()
+	metricsRegistry.ServeHTTP(c.Writer, c.Request)
+}
+
+// collectMetrics updates the metrics describing the current state of the
+// scheduler
+func (s *Scheduler) collectMetrics() {
+	metricQueueDepth.Set(float64(len(s.pendingReqCh) + int(s.waiting.Load())))
+
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+
+	metricLoadedModels.Set(float64(len(s.loaded)))
+
+	metricModelVRAM.Reset()
+	metricModelMemory.Reset()
+	for _, runner := range s.loaded {
+		if runner.model == nil {
+			continue
+		}
+
+		metricModelVRAM.Set(float64(runner.estimatedVRAM), runner.model.ShortName)
+		metricModelMemory.Set(float64(runner.estimatedTotal), runner.model.ShortName)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/discover"
+	"github.com/ollama/ollama/fs/ggml"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:               true,
+			DoneReason:         llm.DoneReasonStop,
+			PromptEvalCount:    10,
+			PromptEvalDuration: time.Second,
+			EvalCount:          4,
+			EvalDuration:       2 * time.Second,
+		},
+	}
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "metrics",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{ .Prompt }}`,
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	do := func(t *testing.T, router http.Handler, method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var b bytes.Buffer
+		if body != nil {
+			if err := json.NewEncoder(&b).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequestWithContext(t.Context(), method, path, &b))
+		return w
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		router, err := s.GenerateRoutes(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w := do(t, router, http.MethodGet, "/metrics", nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_METRICS", "1")
+
+		router, err := s.GenerateRoutes(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := do(t, router, http.MethodPost, "/api/generate", api.GenerateRequest{
+			Model:  "metrics",
+			Prompt: "Hello!",
+			Stream: &stream,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		s.sched.loadedMu.Lock()
+		s.sched.loaded["metrics"] = &runnerRef{
+			model:          &Model{ShortName: "metrics:latest"},
+			estimatedVRAM:  1024,
+			estimatedTotal: 2048,
+		}
+		s.sched.loadedMu.Unlock()
+
+		w = do(t, router, http.MethodGet, "/metrics", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		bts, err := io.ReadAll(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{
+			`ollama_requests_total{route="/api/generate",model="metrics:latest",status="200"} 1`,
+			`ollama_request_duration_seconds_count{route="/api/generate",model="metrics:latest"} 1`,
+			`ollama_prompt_tokens_total{model="metrics:latest"} 10`,
+			`ollama_generated_tokens_total{model="metrics:latest"} 4`,
+			`ollama_prompt_eval_tokens_per_second_sum{model="metrics:latest"} 10`,
+			`ollama_eval_tokens_per_second_sum{model="metrics:latest"} 2`,
+			`ollama_scheduler_queue_depth 0`,
+			`ollama_loaded_models 1`,
+			`ollama_model_vram_bytes{model="metrics:latest"} 1024`,
+			`ollama_model_memory_bytes{model="metrics:latest"} 2048`,
+		} {
+			if !strings.Contains(string(bts), want+"\n") {
+				t.Errorf("expected metrics to contain %q, got:\n%s", want, bts)
+			}
+		}
+	})
+}
@@ -44,7 +44,13 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	}
 
 	for _, layer := range m.Layers {
-		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, name.DisplayShortest())
+		from := name.DisplayShortest()
+		if layer.MediaType == "application/vnd.ollama.image.draft" {
+			// keep the name of the draft model rather than the base model
+			from = layer.From
+		}
+
+		layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, from)
 		if err != nil {
 			return nil, err
 		}
@@ -153,20 +159,33 @@ func parseObjects(s string) []map[string]any {
 	return objs
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
-// mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
-	// create a subtree from the node that ranges over .ToolCalls
-	tmpl := m.Template.Subtree(func(n parse.Node) bool {
+// toolCallFormat describes how a model's template renders tool calls
+type toolCallFormat struct {
+	// keys of the name and arguments of a tool call
+	name, arguments string
+
+	// text that comes before and after tool calls, such as [TOOL_CALLS] or
+	// <tool_call> and </tool_call>
+	prefixes, suffixes []string
+}
+
+// toolCallFormat returns the format of the JSON that the model's template
+// renders tool calls as
+func (m *Model) toolCallFormat() (toolCallFormat, bool) {
+	var f toolCallFormat
+
+	// find the node that ranges over .ToolCalls
+	isToolCalls := func(n parse.Node) bool {
 		if t, ok := n.(*parse.RangeNode); ok {
 			return slices.Contains(template.Identifiers(t.Pipe), "ToolCalls")
 		}
 
 		return false
-	})
+	}
 
+	tmpl := m.Template.Subtree(isToolCalls)
 	if tmpl == nil {
-		return nil, false
+		return f, false
 	}
 
 	var b bytes.Buffer
@@ -182,70 +201,183 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 			},
 		},
 	}); err != nil {
-		return nil, false
+		return f, false
 	}
 
 	templateObjects := parseObjects(b.String())
 	if len(templateObjects) == 0 {
-		return nil, false
+		return f, false
 	}
 
 	// find the keys that correspond to the name and arguments fields
-	var name, arguments string
 	for k, v := range templateObjects[0] {
 		switch v.(type) {
 		case string:
-			name = k
+			f.name = k
 		case map[string]any:
-			arguments = k
+			f.arguments = k
 		}
 	}
 
-	if name == "" || arguments == "" {
-		return nil, false
+	if f.name == "" || f.arguments == "" {
+		return f, false
 	}
 
-	responseObjects := parseObjects(s)
-	if len(responseObjects) == 0 {
-		return nil, false
+	// text rendered around each call
+	s := b.String()
+	f.addMarkers(s[:strings.Index(s, "{")], s[strings.LastIndex(s, "}")+1:])
+
+	// text around all of the calls, without the brackets of a JSON array
+	if before, after, ok := surroundingText(m.Template.Tree.Root, isToolCalls); ok {
+		before = strings.TrimRight(before, " \t\r\n[")
+		after, _, _ = strings.Cut(strings.TrimLeft(after, " \t\r\n]"), "\n")
+		f.addMarkers(before[strings.LastIndex(before, "\n")+1:], after)
 	}
 
-	// collect all nested objects
-	var collect func(any) []map[string]any
-	collect = func(obj any) (all []map[string]any) {
-		switch o := obj.(type) {
-		case map[string]any:
-			all = append(all, o)
-			for _, v := range o {
-				all = append(all, collect(v)...)
+	return f, true
+}
+
+func (f *toolCallFormat) addMarkers(prefix, suffix string) {
+	if prefix := strings.TrimSpace(prefix); prefix != "" && !slices.Contains(f.prefixes, prefix) {
+		f.prefixes = append(f.prefixes, prefix)
+	}
+
+	if suffix := strings.TrimSpace(suffix); suffix != "" && !slices.Contains(f.suffixes, suffix) {
+		f.suffixes = append(f.suffixes, suffix)
+	}
+}
+
+// surroundingText returns the text immediately before and after the first
+// node in the tree that matches fn
+func surroundingText(n parse.Node, fn func(parse.Node) bool) (before, after string, ok bool) {
+	switch t := n.(type) {
+	case *parse.ListNode:
+		for i, c := range t.Nodes {
+			if fn(c) {
+				if i > 0 {
+					if text, ok := t.Nodes[i-1].(*parse.TextNode); ok {
+						before = string(text.Text)
+					}
+				}
+
+				if i+1 < len(t.Nodes) {
+					if text, ok := t.Nodes[i+1].(*parse.TextNode); ok {
+						after = string(text.Text)
+					}
+				}
+
+				return before, after, true
+			}
+
+			if before, after, ok := surroundingText(c, fn); ok {
+				return before, after, true
 			}
-		case []any:
-			for _, v := range o {
-				all = append(all, collect(v)...)
+		}
+	case *parse.BranchNode:
+		for _, l := range []*parse.ListNode{t.List, t.ElseList} {
+			if l != nil {
+				if before, after, ok := surroundingText(l, fn); ok {
+					return before, after, true
+				}
 			}
 		}
+	case *parse.IfNode:
+		return surroundingText(&t.BranchNode, fn)
+	case *parse.WithNode:
+		return surroundingText(&t.BranchNode, fn)
+	case *parse.RangeNode:
+		return surroundingText(&t.BranchNode, fn)
+	}
 
-		return all
+	return "", "", false
+}
+
+// parseToolCalls attempts to parse the tool calls in a model's output. It
+// fails if the output ends with an incomplete tool call.
+func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+	f, ok := m.toolCallFormat()
+	if !ok {
+		return nil, false
 	}
 
-	var objs []map[string]any
-	for _, p := range responseObjects {
-		objs = append(objs, collect(p)...)
+	p := newToolParser(f, true, false)
+	_, toolCalls, _ := p.add(s)
+	_, rest, _ := p.finish()
+	toolCalls = append(toolCalls, rest...)
+	return toolCalls, len(toolCalls) > 0 && !p.truncated
+}
+
+// toolCallSchema returns a JSON schema for the tool calls the model must make
+// when choice forces it to call a tool, so that the calls can be enforced by
+// constrained decoding. The schema matches the JSON that the model's template
+// renders tool calls as, which is what the tool parser looks for. More than
+// one call is allowed when parallel is true, unless choice names a function.
+func (m *Model) toolCallSchema(tools []api.Tool, choice *api.ToolChoice, parallel bool) (json.RawMessage, error) {
+	f, ok := m.toolCallFormat()
+	if !ok {
+		return nil, errors.New("the model's template doesn't support forcing tool calls")
 	}
 
-	var toolCalls []api.ToolCall
-	for _, kv := range objs {
-		n, nok := kv[name].(string)
-		a, aok := kv[arguments].(map[string]any)
-		if nok && aok {
-			toolCalls = append(toolCalls, api.ToolCall{
-				Function: api.ToolCallFunction{
-					Name:      n,
-					Arguments: a,
-				},
-			})
+	var calls []any
+	for _, t := range tools {
+		if choice.Function != "" && t.Function.Name != choice.Function {
+			continue
 		}
+
+		params, err := toolParametersSchema(t)
+		if err != nil {
+			return nil, err
+		}
+
+		calls = append(calls, map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				f.name:      map[string]any{"const": t.Function.Name},
+				f.arguments: params,
+			},
+			"required":             []string{f.name, f.arguments},
+			"additionalProperties": false,
+		})
+	}
+
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("tool_choice function %q is not one of the tools", choice.Function)
+	}
+
+	var schema any = calls[0]
+	if len(calls) > 1 {
+		schema = map[string]any{"anyOf": calls}
+	}
+
+	if parallel && choice.Function == "" {
+		schema = map[string]any{"type": "array", "items": schema, "minItems": 1}
+	}
+
+	return json.Marshal(schema)
+}
+
+// toolParametersSchema returns the JSON schema of a tool's parameters,
+// without the fields that aren't set
+func toolParametersSchema(t api.Tool) (map[string]any, error) {
+	bts, err := json.Marshal(t.Function.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	var params map[string]any
+	if err := json.Unmarshal(bts, &params); err != nil {
+		return nil, err
+	}
+
+	for k, v := range params {
+		if v == nil || v == "" {
+			delete(params, k)
+		}
+	}
+
+	if _, ok := params["type"]; !ok {
+		params["type"] = "object"
 	}
 
-	return toolCalls, len(toolCalls) > 0
+	return params, nil
 }
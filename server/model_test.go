@@ -92,7 +92,8 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`,
 		},
 		{
 			Function: api.ToolCallFunction{
-				Name: "get_current_weather",
+				Index: 1,
+				Name:  "get_current_weather",
 				Arguments: api.ToolCallFunctionArguments{
 					"format":   "celsius",
 					"location": "Toronto, Canada",
@@ -136,6 +137,38 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`,
 	}
 }
 
+func TestToolCallFormat(t *testing.T) {
+	cases := []struct {
+		model string
+		want  toolCallFormat
+	}{
+		{"mistral", toolCallFormat{name: "name", arguments: "arguments", prefixes: []string{"[TOOL_CALLS]"}, suffixes: []string{"</s>"}}},
+		{"command-r-plus", toolCallFormat{name: "tool_name", arguments: "parameters", prefixes: []string{"Action: ```json"}, suffixes: []string{"```"}}},
+		{"firefunction", toolCallFormat{name: "name", arguments: "arguments", prefixes: []string{"functools"}}},
+		{"xlam", toolCallFormat{name: "name", arguments: "arguments", prefixes: []string{`{"tool_calls":`}, suffixes: []string{"}"}}},
+		{"nemotron", toolCallFormat{name: "name", arguments: "arguments", prefixes: []string{"<toolcall>"}, suffixes: []string{"</toolcall>"}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, filepath.Join("testdata", "tools"), tt.model+".gotmpl").String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			f, ok := m.toolCallFormat()
+			if !ok {
+				t.Fatal("expected a tool call format")
+			}
+
+			if diff := cmp.Diff(tt.want, f, cmp.AllowUnexported(toolCallFormat{})); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestParseObjects(t *testing.T) {
 	tests := []struct {
 		input string
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+// PinHandler loads a model and keeps it loaded, with the requested runner
+// options, until it is unpinned
+func (s *Server) PinHandler(c *gin.Context) {
+	var req api.PinRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.NumParallel < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "num_parallel must not be negative"})
+		return
+	}
+
+	if err := s.pin(c.Request.Context(), req); err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// UnpinHandler lets a pinned model be unloaded once it has been idle for the
+// default keep alive
+func (s *Server) UnpinHandler(c *gin.Context) {
+	var req api.UnpinRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Model == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	m, err := GetModel(req.Model)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found", req.Model)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !s.sched.unpin(m.ModelPath) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q is not pinned", req.Model)})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// pin pins the model in req and waits for it to load. The model is unpinned
+// again if it can't be loaded.
+func (s *Server) pin(ctx context.Context, req api.PinRequest) error {
+	if req.Model == "" {
+		return fmt.Errorf("model %w", errRequired)
+	}
+
+	m, err := GetModel(req.Model)
+	if err != nil {
+		return err
+	}
+
+	opts, err := modelOptions(m, req.Options)
+	if err != nil {
+		return err
+	}
+
+	s.sched.pin(m.ModelPath, opts.Runner, req.NumParallel)
+
+	// the runner is released when ctx is done and stays loaded while pinned
+	if _, _, _, err := s.scheduleRunner(ctx, req.Model, nil, req.Options, nil); err != nil {
+		s.sched.unpin(m.ModelPath)
+		return err
+	}
+
+	return nil
+}
+
+// loadPreload reads the list of models to pin at startup from the file at
+// path, which has the form:
+//
+//	{
+//	  "models": [
+//	    {"model": "llama3.2"},
+//	    {"model": "qwen3:8b", "options": {"num_ctx": 32768}, "num_parallel": 2}
+//	  ]
+//	}
+//
+// No models are returned if path is empty.
+func loadPreload(path string) ([]api.PinRequest, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preload list: %w", err)
+	}
+
+	var f struct {
+		Models []api.PinRequest `json:"models"`
+	}
+	if err := json.Unmarshal(bts, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse preload list: %w", err)
+	}
+
+	for i, m := range f.Models {
+		if m.Model == "" {
+			return nil, fmt.Errorf("preload model %d has no name", i)
+		}
+
+		if m.NumParallel < 0 {
+			return nil, fmt.Errorf("preload model %d (%q) has negative num_parallel", i, m.Model)
+		}
+	}
+
+	return f.Models, nil
+}
+
+// preload pins each of models in turn. Models that can't be loaded are
+// logged and skipped.
+func (s *Server) preload(ctx context.Context, models []api.PinRequest) {
+	for _, m := range models {
+		slog.Info("preloading model", "model", m.Model)
+
+		// cancel once the model has loaded to release the runner
+		pinCtx, cancel := context.WithCancel(ctx)
+		err := s.pin(pinCtx, m)
+		cancel()
+
+		if errors.Is(err, context.Canceled) {
+			return
+		} else if err != nil {
+			slog.Error("failed to preload model", "model", m.Model, "error", err)
+		}
+	}
+}
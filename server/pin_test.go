@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestLoadPreload(t *testing.T) {
+	cases := []struct {
+		name   string
+		models string
+		err    string
+	}{
+		{"valid", `{"models": [{"model": "llama3.2"}, {"model": "qwen3:8b", "options": {"num_ctx": 32768}, "num_parallel": 2}]}`, ""},
+		{"empty", `{"models": []}`, ""},
+		{"missing name", `{"models": [{"options": {"num_ctx": 8192}}]}`, "has no name"},
+		{"negative num_parallel", `{"models": [{"model": "llama3.2", "num_parallel": -1}]}`, "negative num_parallel"},
+		{"invalid json", `{"models": {}}`, "failed to parse"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "preload.json")
+			if err := os.WriteFile(path, []byte(tt.models), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := loadPreload(path)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if models, err := loadPreload(""); err != nil || models != nil {
+		t.Fatalf("expected no models without a preload file, got %v, %v", models, err)
+	}
+}
+
+func TestUnpin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := Server{sched: InitScheduler(t.Context())}
+
+	_, digest := createBinFile(t, nil, nil)
+	for _, name := range []string{"test", "test2"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:  name,
+			Files: map[string]string{"test.gguf": digest},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := createRequest(t, s.PinHandler, api.PinRequest{Model: "test", NumParallel: -1})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+
+	s.sched.pin(m.ModelPath, api.DefaultOptions().Runner, 1)
+
+	// pinned models can't be unloaded
+	w = createRequest(t, s.GenerateHandler, api.GenerateRequest{Model: "test", KeepAlive: &api.Duration{}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status code 409, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.ChatHandler, api.ChatRequest{Model: "test", KeepAlive: &api.Duration{}})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status code 409, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.UnpinHandler, api.UnpinRequest{Model: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	w = createRequest(t, s.UnpinHandler, api.UnpinRequest{Model: "test"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, actual %d", w.Code)
+	}
+
+	w = createRequest(t, s.UnpinHandler, api.UnpinRequest{Model: "missing"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status code 404, actual %d", w.Code)
+	}
+
+	// deleting the model unpins it once no other model uses its weights
+	s.sched.pin(m.ModelPath, api.DefaultOptions().Runner, 1)
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if _, ok := s.sched.pinnedModel(m.ModelPath); !ok {
+		t.Fatal("expected model to stay pinned while test2 uses its weights")
+	}
+
+	w = createRequest(t, s.DeleteHandler, api.DeleteRequest{Model: "test2"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	if _, ok := s.sched.pinnedModel(m.ModelPath); ok {
+		t.Fatal("expected deleted model to be unpinned")
+	}
+}
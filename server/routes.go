@@ -11,23 +11,26 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"os/signal"
-	"regexp"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/image/webp"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/ollama/ollama/anthropic"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
@@ -38,6 +41,7 @@ import (
 	"github.com/ollama/ollama/server/internal/client/ollama"
 	"github.com/ollama/ollama/server/internal/registry"
 	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/tracing"
 	"github.com/ollama/ollama/types/errtypes"
 	"github.com/ollama/ollama/types/model"
 	"github.com/ollama/ollama/version"
@@ -52,8 +56,9 @@ var useClient2 = experimentEnabled("client2")
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
-	sched *Scheduler
+	addr    net.Addr
+	sched   *Scheduler
+	batches *batchStore
 }
 
 func init() {
@@ -88,7 +93,10 @@ func modelOptions(model *Model, requestOpts map[string]any) (api.Options, error)
 
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.Capability, requestOpts map[string]any, keepAlive *api.Duration) (_ llm.LlamaServer, _ *Model, _ *api.Options, err error) {
+	ctx, span := tracing.Start(ctx, "scheduleRunner", attribute.String("model", name))
+	defer func() { tracing.End(span, err) }()
+
 	if name == "" {
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
@@ -111,6 +119,8 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, err
 	}
 
+	setMetricsModel(ctx, model.ShortName)
+
 	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
 	var runner *runnerRef
 	select {
@@ -119,6 +129,10 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []model.C
 		return nil, nil, nil, err
 	}
 
+	if envconfig.Metrics() {
+		return metricsRunner{runner.llama, model.ShortName}, model, &opts, nil
+	}
+
 	return runner.llama, model, &opts, nil
 }
 
@@ -164,7 +178,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	// expire the runner
 	if req.Prompt == "" && req.KeepAlive != nil && int(req.KeepAlive.Seconds()) == 0 {
-		s.sched.expireRunner(m)
+		if err := s.sched.expireRunner(m); errors.Is(err, errModelPinned) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model '%s' is pinned, unpin it to unload it", req.Model)})
+			return
+		}
 
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
@@ -181,10 +198,24 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if req.N < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "n must not be negative"})
+		return
+	}
+
+	// check n before loading the model, which may evict others
+	if limit := s.sched.maxParallel(m); req.N > limit {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("n must not exceed the number of parallel requests (%d)", limit)})
+		return
+	}
+
 	caps := []model.Capability{model.CapabilityCompletion}
 	if req.Suffix != "" {
 		caps = append(caps, model.CapabilityInsert)
 	}
+	if req.Think != nil && *req.Think {
+		caps = append(caps, model.CapabilityThinking)
+	}
 
 	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
@@ -195,6 +226,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	if req.N > r.NumParallel() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("n must not exceed the number of parallel requests (%d)", r.NumParallel())})
+		return
+	}
+
 	checkpointLoaded := time.Now()
 
 	// load the model
@@ -219,8 +255,8 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	}
 
 	prompt := req.Prompt
+	tmpl := m.Template
 	if !req.Raw {
-		tmpl := m.Template
 		if req.Template != "" {
 			tmpl, err = template.Parse(req.Template)
 			if err != nil {
@@ -253,6 +289,11 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			values.Messages = append(msgs, api.Message{Role: "user", Content: req.Prompt})
 		}
 
+		if req.Think != nil {
+			values.Think = *req.Think
+			values.IsThinkSet = true
+		}
+
 		var b bytes.Buffer
 		if req.Context != nil {
 			slog.Warn("the context field is deprecated and will be removed in a future version of Ollama")
@@ -272,27 +313,55 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		prompt = b.String()
 	}
 
+	// each completion is parsed independently of the others
+	n := max(req.N, 1)
+	thinkingStates := make([]*thinkingParser, n)
+	if req.Think != nil && *req.Think && tmpl != nil {
+		for i := range thinkingStates {
+			thinkingStates[i] = newThinkingParser(tmpl.Template, prompt)
+		}
+	}
+
 	ch := make(chan any)
 	go func() {
 		// TODO (jmorganca): avoid building the response twice both here and below
-		var sb strings.Builder
+		sbs := make([]strings.Builder, n)
 		defer close(ch)
+
+		// the prompt is counted in the first response of each completion,
+		// which the thinking parser may hold back
+		promptEvalCounts := make([]int, n)
 		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
 			Format:  req.Format,
 			Options: opts,
+			N:       req.N,
 		}, func(cr llm.CompletionResponse) {
+			if cr.QueuePosition > 0 {
+				ch <- api.GenerateResponse{Model: req.Model, CreatedAt: time.Now().UTC(), QueuePosition: cr.QueuePosition}
+				return
+			}
+
+			sb, thinkingState := &sbs[cr.Index], thinkingStates[cr.Index]
+			if !cr.Done && cr.PromptEvalCount > 0 {
+				promptEvalCounts[cr.Index] = cr.PromptEvalCount
+			}
+
 			res := api.GenerateResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Response:  cr.Content,
 				Done:      cr.Done,
+				Index:     cr.Index,
+				Logprobs:  cr.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
+					DraftCount:         cr.DraftCount,
+					DraftAcceptedCount: cr.DraftAcceptedCount,
 				},
 			}
 
@@ -300,6 +369,13 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				ch <- gin.H{"error": err.Error()}
 			}
 
+			if thinkingState != nil {
+				res.Thinking, res.Response = thinkingState.addContent(cr.Content)
+				if res.Thinking == "" && res.Response == "" && len(res.Logprobs) == 0 && !cr.Done {
+					return
+				}
+			}
+
 			if cr.Done {
 				res.DoneReason = cr.DoneReason.String()
 				res.TotalDuration = time.Since(checkpointStart)
@@ -313,29 +389,40 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 					}
 					res.Context = tokens
 				}
+			} else {
+				res.PromptEvalCount, promptEvalCounts[cr.Index] = promptEvalCounts[cr.Index], 0
 			}
 
 			ch <- res
 		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- completionError(err)
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
-		var r api.GenerateResponse
-		var sb strings.Builder
+		rs := make([]api.GenerateResponse, n)
+		sbs := make([]strings.Builder, n)
+		thinking := make([]strings.Builder, n)
+		logprobs := make([][]api.Logprob, n)
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
-				sb.WriteString(t.Response)
-				r = t
+				sbs[t.Index].WriteString(t.Response)
+				thinking[t.Index].WriteString(t.Thinking)
+				logprobs[t.Index] = append(logprobs[t.Index], t.Logprobs...)
+				rs[t.Index] = t
 			case gin.H:
 				msg, ok := t["error"].(string)
 				if !ok {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				c.JSON(status, gin.H{"error": msg})
 				return
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
@@ -343,8 +430,29 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			}
 		}
 
-		r.Response = sb.String()
-		c.JSON(http.StatusOK, r)
+		for i := range rs {
+			rs[i].Response = sbs[i].String()
+			rs[i].Thinking = thinking[i].String()
+			rs[i].Logprobs = logprobs[i]
+		}
+
+		res := rs[0]
+		if n > 1 {
+			res.Choices = make([]api.GenerateChoice, n)
+			for i, r := range rs {
+				res.Choices[i] = api.GenerateChoice{
+					Index:      r.Index,
+					Response:   r.Response,
+					Thinking:   r.Thinking,
+					DoneReason: r.DoneReason,
+					Context:    r.Context,
+					Logprobs:   r.Logprobs,
+					EvalCount:  r.EvalCount,
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, res)
 		return
 	}
 
@@ -490,6 +598,144 @@ func normalize(vec []float32) []float32 {
 	return vec
 }
 
+func (s *Server) RerankHandler(c *gin.Context) {
+	checkpointStart := time.Now()
+	var req api.RerankRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	case err != nil:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.TopN < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "top_n must not be negative"})
+		return
+	}
+
+	truncate := true
+
+	if req.Truncate != nil && !*req.Truncate {
+		truncate = false
+	}
+
+	name, err := getExistingName(model.ParseName(req.Model))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), []model.Capability{model.CapabilityRerank}, req.Options, req.KeepAlive)
+	if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	checkpointLoaded := time.Now()
+
+	if len(req.Documents) == 0 {
+		c.JSON(http.StatusOK, api.RerankResponse{Model: req.Model, Results: []api.RerankResult{}})
+		return
+	}
+
+	kvData, _, err := getModelData(m.ModelPath, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctxLen := min(opts.NumCtx, int(kvData.ContextLength()))
+
+	query, err := r.Tokenize(c.Request.Context(), req.Query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the special tokens that wrap the query and document take up context
+	// too, so documents are truncated to what's left after them
+	overhead, err := r.RerankOverhead(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(query)+overhead >= ctxLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query length exceeds maximum context length"})
+		return
+	}
+
+	var count int
+	documents := slices.Clone(req.Documents)
+	for i, d := range documents {
+		tokens, err := r.Tokenize(c.Request.Context(), d)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(query)+len(tokens)+overhead > ctxLen {
+			if !truncate {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "input length exceeds maximum context length"})
+				return
+			}
+
+			tokens = tokens[:ctxLen-len(query)-overhead]
+			documents[i], err = r.Detokenize(c.Request.Context(), tokens)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		count += len(query) + len(tokens) + overhead
+	}
+
+	var g errgroup.Group
+	results := make([]api.RerankResult, len(documents))
+	for i, d := range documents {
+		g.Go(func() error {
+			score, err := r.Rerank(c.Request.Context(), req.Query, d)
+			if err != nil {
+				return err
+			}
+			results[i] = api.RerankResult{Index: i, RelevanceScore: sigmoid(score)}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": strings.TrimSpace(err.Error())})
+		return
+	}
+
+	slices.SortStableFunc(results, func(a, b api.RerankResult) int {
+		return cmp.Compare(b.RelevanceScore, a.RelevanceScore)
+	})
+
+	if req.TopN > 0 && req.TopN < len(results) {
+		results = results[:req.TopN]
+	}
+
+	resp := api.RerankResponse{
+		Model:           req.Model,
+		Results:         results,
+		TotalDuration:   time.Since(checkpointStart),
+		LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+		PromptEvalCount: count,
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// sigmoid maps the raw score of a reranking model's classification head to a
+// relevance between 0 and 1
+func sigmoid(x float32) float64 {
+	return 1 / (1 + math.Exp(-float64(x)))
+}
+
 func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	var req api.EmbeddingRequest
 	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
@@ -535,6 +781,175 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+// tokenizer converts between text and a model's tokens
+type tokenizer interface {
+	Tokenize(context.Context, string) ([]int, error)
+	Detokenize(context.Context, []int) (string, error)
+}
+
+// tokenizers caches the vocabularies of models that aren't loaded, by the
+// path of the model's blob
+var tokenizers sync.Map
+
+// tokenizer returns a tokenizer for the named model along with a function to
+// release it. The runner is used if the model is already loaded, otherwise only
+// the model's vocabulary is loaded so that no weights have to be placed on the
+// GPU.
+func (s *Server) tokenizer(name string) (tokenizer, *Model, func(), error) {
+	m, err := GetModel(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if s.sched != nil {
+		if runner := s.sched.acquire(m.ModelPath); runner != nil {
+			return runner.llama, m, func() { s.sched.release(runner) }, nil
+		}
+	}
+
+	if t, ok := tokenizers.Load(m.ModelPath); ok {
+		return t.(*llm.Tokenizer), m, func() {}, nil
+	}
+
+	f, err := llm.LoadModel(m.ModelPath, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	t, err := llm.NewTokenizer(m.ModelPath, f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if actual, loaded := tokenizers.LoadOrStore(m.ModelPath, t); loaded {
+		t.Close()
+		t = actual.(*llm.Tokenizer)
+	}
+
+	return t, m, func() {}, nil
+}
+
+// handleTokenizerError writes the response for an error getting a tokenizer
+func handleTokenizerError(c *gin.Context, name string, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", name)})
+	case err.Error() == errtypes.InvalidModelNameErrMsg:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func (s *Server) TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Prompt != "" && len(req.Messages) > 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "only one of prompt or messages may be provided"})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	t, m, release, err := s.tokenizer(name.String())
+	if err != nil {
+		handleTokenizerError(c, req.Model, err)
+		return
+	}
+	defer release()
+
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		// render the messages the same way as the chat endpoint, but without
+		// truncating them to fit the context window so that the count is exact
+		msgs := append(m.Messages, req.Messages...)
+		if req.Messages[0].Role != "system" && m.System != "" {
+			msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+		}
+		msgs = filterThinkTags(msgs, m)
+
+		values := template.Values{Messages: msgs, Tools: req.Tools}
+		if req.Think != nil {
+			values.Think = *req.Think
+			values.IsThinkSet = true
+		}
+
+		var b bytes.Buffer
+		if err := m.Template.Execute(&b, values); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		prompt = b.String()
+	}
+
+	tokens, err := t.Tokenize(c.Request.Context(), prompt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if tokens == nil {
+		tokens = []int{}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Model: req.Model, Tokens: tokens})
+}
+
+func (s *Server) DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+
+	t, _, release, err := s.tokenizer(name.String())
+	if err != nil {
+		handleTokenizerError(c, req.Model, err)
+		return
+	}
+	defer release()
+
+	content, err := t.Detokenize(c.Request.Context(), req.Tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Model: req.Model, Content: content})
+}
+
 func (s *Server) PullHandler(c *gin.Context) {
 	var req api.PullRequest
 	err := c.ShouldBindJSON(&req)
@@ -702,6 +1117,13 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		return
 	}
 
+	// look up the weights before they're removed so that the model can
+	// be unpinned, as it can no longer be unpinned by name
+	var modelPath string
+	if model, err := GetModel(n.String()); err == nil {
+		modelPath = model.ModelPath
+	}
+
 	if err := m.Remove(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -711,6 +1133,11 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	// other models may still use the same weights
+	if _, err := os.Stat(modelPath); s.sched != nil && modelPath != "" && errors.Is(err, os.ErrNotExist) {
+		s.sched.unpin(modelPath)
+	}
 }
 
 func (s *Server) ShowHandler(c *gin.Context) {
@@ -806,6 +1233,10 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 			for _, nv := range val {
 				params = append(params, fmt.Sprintf("%-*s %#v", cs, k, nv))
 			}
+		case map[string]any:
+			for _, mk := range slices.Sorted(maps.Keys(val)) {
+				params = append(params, fmt.Sprintf("%-*s %s %v", cs, k, mk, val[mk]))
+			}
 		default:
 			params = append(params, fmt.Sprintf("%-*s %#v", cs, k, v))
 		}
@@ -881,8 +1312,14 @@ func (s *Server) ListHandler(c *gin.Context) {
 		return
 	}
 
+	key := apiKeyFromContext(c.Request.Context())
+
 	models := []api.ListModelResponse{}
 	for n, m := range ms {
+		if !key.allows(n) {
+			continue
+		}
+
 		var cf ConfigV2
 
 		if m.Config.Digest != "" {
@@ -1116,7 +1553,40 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	}
 }
 
+// requesterMiddleware identifies the client making a request and its
+// priority, from the X-Ollama-Priority header, so that the scheduler can
+// serve clients fairly. The priority is limited to the API key's maximum.
+func requesterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		priority, err := llm.ParsePriority(c.GetHeader("X-Ollama-Priority"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		client := c.ClientIP()
+		if key := apiKeyFromContext(c.Request.Context()); key != nil {
+			client = key.id()
+			priority = min(priority, key.maxPriority)
+		}
+
+		// batch requests only use slots that other requests aren't waiting for
+		if id, ok := batchFromContext(c.Request.Context()); ok {
+			client = "batch:" + id
+			priority = llm.PriorityLow
+		}
+
+		c.Request = c.Request.WithContext(llm.WithRequester(c.Request.Context(), llm.Requester{Client: client, Priority: priority}))
+		c.Next()
+	}
+}
+
 func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
+	keys, err := loadAPIKeys(envconfig.APIKeysFile())
+	if err != nil {
+		return nil, err
+	}
+
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowWildcard = true
 	corsConfig.AllowBrowserExtensions = true
@@ -1126,6 +1596,7 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 		"User-Agent",
 		"Accept",
 		"X-Requested-With",
+		"X-Ollama-Priority",
 
 		// OpenAI compatibility headers
 		"OpenAI-Beta",
@@ -1141,6 +1612,12 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 		"x-stainless-runtime",
 		"x-stainless-runtime-version",
 		"x-stainless-timeout",
+
+		// Anthropic compatibility headers
+		"x-api-key",
+		"anthropic-version",
+		"anthropic-beta",
+		"anthropic-dangerous-direct-browser-access",
 	}
 	corsConfig.AllowOrigins = envconfig.AllowedOrigins()
 
@@ -1149,8 +1626,15 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 	r.Use(
 		cors.New(corsConfig),
 		allowedHostsMiddleware(s.addr),
+		tracing.Middleware(),
+		requesterMiddleware(),
 	)
 
+	if envconfig.Metrics() {
+		r.Use(metricsMiddleware())
+		r.GET("/metrics", s.MetricsHandler)
+	}
+
 	// General
 	r.HEAD("/", func(c *gin.Context) { c.String(http.StatusOK, "Ollama is running") })
 	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "Ollama is running") })
@@ -1171,12 +1655,20 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
 	r.POST("/api/copy", s.CopyHandler)
 
+	// Residency
+	r.POST("/api/pin", s.PinHandler)
+	r.POST("/api/unpin", s.UnpinHandler)
+	r.POST("/api/warm", s.WarmHandler)
+
 	// Inference
 	r.GET("/api/ps", s.PsHandler)
 	r.POST("/api/generate", s.GenerateHandler)
 	r.POST("/api/chat", s.ChatHandler)
 	r.POST("/api/embed", s.EmbedHandler)
+	r.POST("/api/rerank", s.RerankHandler)
 	r.POST("/api/embeddings", s.EmbeddingsHandler)
+	r.POST("/api/tokenize", s.TokenizeHandler)
+	r.POST("/api/detokenize", s.DetokenizeHandler)
 
 	// Inference (OpenAI compatibility)
 	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
@@ -1185,6 +1677,32 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
 	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
 
+	// responses are kept in memory for previous_response_id, which clients
+	// use to continue recent conversations
+	responses := openai.NewResponseStore(1024, keyOwner)
+	r.POST("/v1/responses", openai.ResponsesMiddleware(responses), s.ChatHandler)
+	r.GET("/v1/responses/:id", responses.RetrieveHandler)
+	r.DELETE("/v1/responses/:id", responses.DeleteHandler)
+
+	// Inference (Anthropic compatibility)
+	r.POST("/v1/messages", anthropic.MessagesMiddleware(), s.ChatHandler)
+
+	// Batches (OpenAI compatibility)
+	r.POST("/v1/files", s.CreateFileHandler)
+	r.GET("/v1/files", s.ListFilesHandler)
+	r.GET("/v1/files/:id", s.GetFileHandler)
+	r.GET("/v1/files/:id/content", s.GetFileContentHandler)
+	r.DELETE("/v1/files/:id", s.DeleteFileHandler)
+	r.POST("/v1/batches", s.CreateBatchHandler)
+	r.GET("/v1/batches", s.ListBatchesHandler)
+	r.GET("/v1/batches/:id", s.GetBatchHandler)
+	r.POST("/v1/batches/:id/cancel", s.CancelBatchHandler)
+
+	s.batches, err = newBatchStore(envconfig.BatchDir(), r, keys)
+	if err != nil {
+		return nil, err
+	}
+
 	if rc != nil {
 		// wrap old with new
 		rs := &registry.Local{
@@ -1194,16 +1712,22 @@ func (s *Server) GenerateRoutes(rc *ollama.Registry) (http.Handler, error) {
 
 			Prune: PruneLayers,
 		}
-		return rs, nil
+		return keys.middleware(rs), nil
 	}
 
-	return r, nil
+	return keys.middleware(r), nil
 }
 
 func Serve(ln net.Listener) error {
 	slog.SetDefault(logutil.NewLogger(os.Stderr, envconfig.LogLevel()))
 	slog.Info("server config", "env", envconfig.Values())
 
+	shutdownTracing, err := tracing.Init(context.Background(), "ollama")
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	blobsDir, err := GetBlobsPath("")
 	if err != nil {
 		return err
@@ -1248,6 +1772,11 @@ func Serve(ln net.Listener) error {
 		return err
 	}
 
+	preload, err := loadPreload(envconfig.PreloadFile())
+	if err != nil {
+		return err
+	}
+
 	http.Handle("/", h)
 
 	ctx, done := context.WithCancel(context.Background())
@@ -1280,6 +1809,8 @@ func Serve(ln net.Listener) error {
 	}()
 
 	s.sched.Run(schedCtx)
+	go s.preload(schedCtx, preload)
+	go s.batches.run(schedCtx)
 
 	// register the experimental webp decoder
 	// so webp images can be used in multimodal inputs
@@ -1335,6 +1866,16 @@ func streamResponse(c *gin.Context, ch chan any) {
 			return false
 		}
 
+		// errors with a status are returned with it if nothing has been
+		// streamed yet
+		if h, ok := val.(gin.H); ok && !c.Writer.Written() {
+			if status, ok := h["status"].(int); ok {
+				c.Header("Content-Type", "application/json")
+				c.JSON(status, gin.H{"error": h["error"]})
+				return false
+			}
+		}
+
 		bts, err := json.Marshal(val)
 		if err != nil {
 			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
@@ -1353,9 +1894,15 @@ func streamResponse(c *gin.Context, ch chan any) {
 }
 
 func (s *Server) PsHandler(c *gin.Context) {
+	key := apiKeyFromContext(c.Request.Context())
+
 	models := []api.ProcessModelResponse{}
 
 	for _, v := range s.sched.loaded {
+		if !key.allows(model.ParseName(v.model.ShortName)) {
+			continue
+		}
+
 		model := v.model
 		modelDetails := api.ModelDetails{
 			Format:            model.Config.ModelFormat,
@@ -1374,6 +1921,7 @@ func (s *Server) PsHandler(c *gin.Context) {
 			Details:   modelDetails,
 			ExpiresAt: v.expiresAt,
 		}
+		_, mr.Pinned = s.sched.pinnedModel(v.modelPath)
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
 		// calculate the time w/ the sessionDuration instead.
@@ -1419,7 +1967,10 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			}
 			return
 		}
-		s.sched.expireRunner(model)
+		if err := s.sched.expireRunner(model); errors.Is(err, errModelPinned) {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("model '%s' is pinned, unpin it to unload it", req.Model)})
+			return
+		}
 
 		c.JSON(http.StatusOK, api.ChatResponse{
 			Model:      req.Model,
@@ -1431,10 +1982,37 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if req.N < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "n must not be negative"})
+		return
+	}
+
+	// the tools are left out of the prompt so that the model can't call them
+	if req.ToolChoice != nil && req.ToolChoice.Mode == api.ToolChoiceNone {
+		req.Tools = nil
+	}
+
+	if req.ToolChoice.Forced() {
+		if len(req.Tools) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "tool_choice requires tools"})
+			return
+		}
+
+		if len(req.Format) > 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format can't be used when tool_choice forces a tool call"})
+			return
+		}
+	}
+
+	parallel := req.ParallelToolCalls == nil || *req.ParallelToolCalls
+
 	caps := []model.Capability{model.CapabilityCompletion}
 	if len(req.Tools) > 0 {
 		caps = append(caps, model.CapabilityTools)
 	}
+	if req.Think != nil && *req.Think {
+		caps = append(caps, model.CapabilityThinking)
+	}
 
 	name := model.ParseName(req.Model)
 	if !name.IsValid() {
@@ -1447,6 +2025,16 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	// check n before loading the model, which may evict others
+	if req.N > 1 {
+		if m, err := GetModel(name.String()); err == nil {
+			if limit := s.sched.maxParallel(m); req.N > limit {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("n must not exceed the number of parallel requests (%d)", limit)})
+				return
+			}
+		}
+	}
+
 	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
 	if errors.Is(err, errCapabilityCompletion) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
@@ -1456,6 +2044,11 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	if req.N > r.NumParallel() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("n must not exceed the number of parallel requests (%d)", r.NumParallel())})
+		return
+	}
+
 	checkpointLoaded := time.Now()
 
 	if len(req.Messages) == 0 {
@@ -1475,94 +2068,154 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	}
 	msgs = filterThinkTags(msgs, m)
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools)
+	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, req.Think)
 	if err != nil {
 		slog.Error("chat prompt error", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	// forced tool calls are constrained to the JSON the model calls tools with
+	format := req.Format
+	if req.ToolChoice.Forced() {
+		format, err = m.toolCallSchema(req.Tools, req.ToolChoice, parallel)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// each completion is parsed independently of the others
+	n := max(req.N, 1)
+	thinkingStates := make([]*thinkingParser, n)
+	if req.Think != nil && *req.Think && m.Template != nil {
+		for i := range thinkingStates {
+			thinkingStates[i] = newThinkingParser(m.Template.Template, prompt)
+		}
+	}
+
+	// tool calls are parsed out of the content as it's generated
+	toolParsers := make([]*toolParser, n)
+	if len(req.Tools) > 0 {
+		if f, ok := m.toolCallFormat(); ok {
+			for i := range toolParsers {
+				toolParsers[i] = newToolParser(f, parallel, req.Stream == nil || *req.Stream)
+			}
+		}
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		var sb strings.Builder
-		var toolCallIndex int = 0
+		logprobsByIndex := make([][]api.Logprob, n)
+
+		// the prompt is counted in the first response of each completion,
+		// which the parsers may hold back
+		promptEvalCounts := make([]int, n)
 		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
 			Prompt:  prompt,
 			Images:  images,
-			Format:  req.Format,
+			Format:  format,
 			Options: opts,
+			N:       req.N,
 		}, func(r llm.CompletionResponse) {
+			if r.QueuePosition > 0 {
+				ch <- api.ChatResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant"}, QueuePosition: r.QueuePosition}
+				return
+			}
+
+			thinkingState, toolParser := thinkingStates[r.Index], toolParsers[r.Index]
+			if !r.Done && r.PromptEvalCount > 0 {
+				promptEvalCounts[r.Index] = r.PromptEvalCount
+			}
+
 			res := api.ChatResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Message:   api.Message{Role: "assistant", Content: r.Content},
 				Done:      r.Done,
+				Index:     r.Index,
+				Logprobs:  r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
+					DraftCount:         r.DraftCount,
+					DraftAcceptedCount: r.DraftAcceptedCount,
 				},
 			}
 
 			if r.Done {
 				res.DoneReason = r.DoneReason.String()
+				res.StopSequence = r.StopSequence
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 			}
 
-			// TODO: tool call checking and filtering should be moved outside of this callback once streaming
-			// however this was a simple change for now without reworking streaming logic of this (and other)
-			// handlers
-			if req.Stream != nil && !*req.Stream || len(req.Tools) == 0 {
-				ch <- res
-				return
+			if thinkingState != nil {
+				res.Message.Thinking, res.Message.Content = thinkingState.addContent(r.Content)
+				if res.Message.Thinking == "" && res.Message.Content == "" && len(res.Logprobs) == 0 && !r.Done {
+					return
+				}
 			}
 
-			// Streaming tool calls:
-			// If tools are recognized, use a flag to track the sending of a tool downstream
-			// This ensures that content is cleared from the message on the last chunk sent
-			sb.WriteString(r.Content)
-			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-				res.Message.ToolCalls = toolCalls
-				for i := range toolCalls {
-					toolCalls[i].Function.Index = toolCallIndex
-					toolCallIndex++
+			if toolParser != nil {
+				res.Message.Content, res.Message.ToolCalls, res.Message.ToolCallDeltas = toolParser.add(res.Message.Content)
+				if r.Done {
+					content, toolCalls, toolCallDeltas := toolParser.finish()
+					res.Message.Content += content
+					res.Message.ToolCalls = append(res.Message.ToolCalls, toolCalls...)
+					res.Message.ToolCallDeltas = append(res.Message.ToolCallDeltas, toolCallDeltas...)
 				}
-				res.Message.Content = ""
-				sb.Reset()
-				ch <- res
-				return
-			}
 
-			if r.Done {
-				// Send any remaining content if no tool calls were detected
-				if toolCallIndex == 0 {
-					res.Message.Content = sb.String()
+				// logprobs of output that is held back are sent with the
+				// next response
+				logprobs := &logprobsByIndex[r.Index]
+				*logprobs = append(*logprobs, res.Logprobs...)
+				if res.Message.Thinking == "" && res.Message.Content == "" && len(res.Message.ToolCalls) == 0 && len(res.Message.ToolCallDeltas) == 0 && !r.Done {
+					return
 				}
-				ch <- res
+
+				res.Logprobs, *logprobs = *logprobs, nil
+			}
+
+			if !r.Done {
+				res.PromptEvalCount, promptEvalCounts[r.Index] = promptEvalCounts[r.Index], 0
 			}
+
+			ch <- res
 		}); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			ch <- completionError(err)
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
-		var resp api.ChatResponse
-		var sb strings.Builder
+		resps := make([]api.ChatResponse, n)
+		sbs := make([]strings.Builder, n)
+		thinking := make([]strings.Builder, n)
+		logprobs := make([][]api.Logprob, n)
+		toolCalls := make([][]api.ToolCall, n)
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
-				sb.WriteString(t.Message.Content)
-				resp = t
+				sbs[t.Index].WriteString(t.Message.Content)
+				thinking[t.Index].WriteString(t.Message.Thinking)
+				logprobs[t.Index] = append(logprobs[t.Index], t.Logprobs...)
+				toolCalls[t.Index] = append(toolCalls[t.Index], t.Message.ToolCalls...)
+				resps[t.Index] = t
 			case gin.H:
 				msg, ok := t["error"].(string)
 				if !ok {
 					msg = "unexpected error format in response"
 				}
 
-				c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+				status, ok := t["status"].(int)
+				if !ok {
+					status = http.StatusInternalServerError
+				}
+
+				c.JSON(status, gin.H{"error": msg})
 				return
 			default:
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected response"})
@@ -1570,12 +2223,25 @@ func (s *Server) ChatHandler(c *gin.Context) {
 			}
 		}
 
-		resp.Message.Content = sb.String()
+		for i := range resps {
+			resps[i].Message.Content = sbs[i].String()
+			resps[i].Message.Thinking = thinking[i].String()
+			resps[i].Logprobs = logprobs[i]
+			resps[i].Message.ToolCalls = toolCalls[i]
+			resps[i].Message.ToolCallDeltas = nil
+		}
 
-		if len(req.Tools) > 0 {
-			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
-				resp.Message.ToolCalls = toolCalls
-				resp.Message.Content = ""
+		resp := resps[0]
+		if n > 1 {
+			resp.Choices = make([]api.ChatChoice, n)
+			for i, r := range resps {
+				resp.Choices[i] = api.ChatChoice{
+					Index:      r.Index,
+					Message:    r.Message,
+					DoneReason: r.DoneReason,
+					Logprobs:   r.Logprobs,
+					EvalCount:  r.EvalCount,
+				}
 			}
 		}
 
@@ -1586,13 +2252,23 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// completionError is the response for an error from a completion. Formats
+// that can't be used are rejected with a 400 status.
+func completionError(err error) gin.H {
+	if errors.Is(err, llm.ErrInvalidFormat) {
+		return gin.H{"error": err.Error(), "status": http.StatusBadRequest}
+	}
+
+	return gin.H{"error": err.Error()}
+}
+
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
 	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 	case errors.Is(err, context.Canceled):
 		c.JSON(499, gin.H{"error": "request canceled"})
-	case errors.Is(err, ErrMaxQueue):
+	case errors.Is(err, ErrMaxQueue), errors.Is(err, ErrPinned):
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 	case errors.Is(err, os.ErrNotExist):
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
@@ -1601,21 +2277,35 @@ func handleScheduleError(c *gin.Context, name string, err error) {
 	}
 }
 
-var thinkTagRegexp = regexp.MustCompile(`<think>(?s).*?</think>(\n)*`)
-
+// filterThinkTags removes the thinking from assistant messages before the
+// final user message so that reasoning from previous turns isn't fed back into
+// the model. The thinking tags are inferred from the model's template, falling
+// back to <think> and </think> for models known to emit them.
 func filterThinkTags(msgs []api.Message, m *Model) []api.Message {
-	if m.Config.ModelFamily == "qwen3" || model.ParseName(m.Name).Model == "deepseek-r1" {
-		finalUserIndex := -1
-		for i, msg := range msgs {
-			if msg.Role == "user" {
-				finalUserIndex = i
-			}
+	var openingTag, closingTag string
+	if m.Template != nil {
+		openingTag, closingTag = inferThinkingTags(m.Template.Template)
+	}
+
+	if openingTag == "" || closingTag == "" {
+		if m.Config.ModelFamily != "qwen3" && model.ParseName(m.Name).Model != "deepseek-r1" {
+			return msgs
 		}
 
-		for i, msg := range msgs {
-			if msg.Role == "assistant" && i < finalUserIndex {
-				msgs[i].Content = thinkTagRegexp.ReplaceAllString(msg.Content, "")
-			}
+		openingTag, closingTag = "<think>", "</think>"
+	}
+
+	finalUserIndex := -1
+	for i, msg := range msgs {
+		if msg.Role == "user" {
+			finalUserIndex = i
+		}
+	}
+
+	for i, msg := range msgs {
+		if msg.Role == "assistant" && i < finalUserIndex {
+			msgs[i].Content = stripThinking(msg.Content, openingTag, closingTag)
+			msgs[i].Thinking = ""
 		}
 	}
 	return msgs
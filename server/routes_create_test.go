@@ -664,6 +664,90 @@ func TestCreateLicenses(t *testing.T) {
 	}
 }
 
+func TestCreateDraft(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	for name, kv := range map[string]map[string]any{
+		"test":  nil,
+		"small": {"general.architecture": "small"},
+	} {
+		_, digest := createBinFile(t, kv, nil)
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:   name,
+			Files:  map[string]string{"test.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d", w.Code)
+		}
+	}
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test-draft",
+		From:   "test",
+		Draft:  "small",
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+	}
+
+	small, err := GetModel("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := GetModel("test-draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.DraftPath != small.ModelPath {
+		t.Errorf("expected draft path %s, actual %s", small.ModelPath, m.DraftPath)
+	}
+
+	if m.DraftModel != "small:latest" {
+		t.Errorf("expected draft model small:latest, actual %s", m.DraftModel)
+	}
+
+	// models created from a model with a draft model keep it
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test-draft2",
+		From:   "test-draft",
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	m, err = GetModel("test-draft2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.DraftPath != small.ModelPath {
+		t.Errorf("expected draft path %s, actual %s", small.ModelPath, m.DraftPath)
+	}
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:   "test-missing",
+		From:   "test",
+		Draft:  "missing",
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status code 400, actual %d", w.Code)
+	}
+}
+
 func TestCreateDetectTemplate(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -23,10 +26,20 @@ import (
 type mockRunner struct {
 	llm.LlamaServer
 
+	// numParallel is the number of parallel requests the runner was loaded
+	// with
+	numParallel int
+
 	// CompletionRequest is only valid until the next call to Completion
 	llm.CompletionRequest
 	llm.CompletionResponse
 	CompletionFn func(context.Context, llm.CompletionRequest, func(llm.CompletionResponse)) error
+
+	// warm is the last request passed to Warm
+	warm llm.WarmRequest
+
+	// rerankOverhead is the number of special tokens added to a rerank pair
+	rerankOverhead int
 }
 
 func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
@@ -38,6 +51,10 @@ func (m *mockRunner) Completion(ctx context.Context, r llm.CompletionRequest, fn
 	return nil
 }
 
+func (m *mockRunner) NumParallel() int {
+	return m.numParallel
+}
+
 func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error) {
 	for range strings.Fields(s) {
 		tokens = append(tokens, len(tokens))
@@ -46,8 +63,40 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ api.Options, _ int) (llm.LlamaServer, error) {
+func (mockRunner) Detokenize(_ context.Context, tokens []int) (string, error) {
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = fmt.Sprintf("t%d", t)
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// Warm records the prompt to warm and counts its words as tokens
+func (m *mockRunner) Warm(_ context.Context, name, prompt string) (int, error) {
+	m.warm = llm.WarmRequest{Name: name, Prompt: prompt}
+	return len(strings.Fields(prompt)), nil
+}
+
+// Rerank scores document by the number of its words that appear in query
+func (mockRunner) Rerank(_ context.Context, query, document string) (float32, error) {
+	var score float32
+	for _, w := range strings.Fields(document) {
+		if slices.Contains(strings.Fields(query), w) {
+			score++
+		}
+	}
+
+	return score, nil
+}
+
+func (m mockRunner) RerankOverhead(context.Context) (int, error) {
+	return m.rerankOverhead, nil
+}
+
+func newMockServer(mock *mockRunner) func(discover.GpuInfoList, string, *ggml.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(_ discover.GpuInfoList, _ string, _ *ggml.GGML, _, _ []string, _ string, _ api.Options, numParallel int) (llm.LlamaServer, error) {
+		mock.numParallel = numParallel
 		return mock, nil
 	}
 }
@@ -56,6 +105,7 @@ func TestGenerateChat(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	mock := mockRunner{
+		numParallel: 2,
 		CompletionResponse: llm.CompletionResponse{
 			Done:               true,
 			DoneReason:         llm.DoneReasonStop,
@@ -545,13 +595,15 @@ func TestGenerateChat(t *testing.T) {
 			return nil
 		}
 
+		streamRequest := true
+
 		w := createRequest(t, s.ChatHandler, api.ChatRequest{
 			Model: "test-system",
 			Messages: []api.Message{
 				{Role: "user", Content: "What's the weather in Seattle?"},
 			},
 			Tools:  tools,
-			Stream: &stream,
+			Stream: &streamRequest,
 		})
 
 		wg.Wait()
@@ -563,6 +615,7 @@ func TestGenerateChat(t *testing.T) {
 		// Read and validate the streamed responses
 		decoder := json.NewDecoder(w.Body)
 		var finalToolCall api.ToolCall
+		var arguments strings.Builder
 
 		for {
 			var resp api.ChatResponse
@@ -572,6 +625,17 @@ func TestGenerateChat(t *testing.T) {
 				t.Fatal(err)
 			}
 
+			for _, d := range resp.Message.ToolCallDeltas {
+				if d.Name != "" && d.Name != "get_weather" {
+					t.Errorf("unexpected tool call delta %+v", d)
+				}
+				arguments.WriteString(d.Arguments)
+			}
+
+			if resp.Message.Content != "" {
+				t.Errorf("unexpected content %q", resp.Message.Content)
+			}
+
 			if resp.Done {
 				if len(resp.Message.ToolCalls) != 1 {
 					t.Errorf("expected 1 tool call in final response, got %d", len(resp.Message.ToolCalls))
@@ -593,6 +657,387 @@ func TestGenerateChat(t *testing.T) {
 		if diff := cmp.Diff(finalToolCall, expectedToolCall); diff != "" {
 			t.Errorf("final tool call mismatch (-got +want):\n%s", diff)
 		}
+
+		if arguments.String() != `{"location":"Seattle, WA","unit":"celsius"}` {
+			t.Errorf("unexpected streamed arguments %q", arguments.String())
+		}
+	})
+
+	t.Run("messages with tool_choice", func(t *testing.T) {
+		var tools []api.Tool
+		if err := json.Unmarshal([]byte(`[
+			{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "required": ["location"], "properties": {"location": {"type": "string"}}}}},
+			{"type": "function", "function": {"name": "get_time", "parameters": {"type": "object", "properties": {}}}}
+		]`), &tools); err != nil {
+			t.Fatal(err)
+		}
+
+		mock.CompletionFn = nil
+		mock.CompletionResponse = llm.CompletionResponse{
+			Content:    `[{"name":"get_weather","arguments":{"location":"Seattle, WA"}},{"name":"get_time","arguments":{}}]`,
+			Done:       true,
+			DoneReason: llm.DoneReasonStop,
+		}
+
+		chat := func(t *testing.T, choice *api.ToolChoice, parallel *bool) (int, api.ChatResponse) {
+			t.Helper()
+
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:             "test-system",
+				Messages:          []api.Message{{Role: "user", Content: "What's the weather in Seattle?"}},
+				Tools:             tools,
+				ToolChoice:        choice,
+				ParallelToolCalls: parallel,
+				Stream:            &stream,
+			})
+
+			var resp api.ChatResponse
+			if w.Code == http.StatusOK {
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			return w.Code, resp
+		}
+
+		t.Run("required", func(t *testing.T) {
+			code, resp := chat(t, &api.ToolChoice{Mode: api.ToolChoiceRequired}, nil)
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+
+			var schema struct {
+				Type  string `json:"type"`
+				Items struct {
+					AnyOf []struct {
+						Properties struct {
+							Name struct {
+								Const string `json:"const"`
+							} `json:"name"`
+						} `json:"properties"`
+					} `json:"anyOf"`
+				} `json:"items"`
+			}
+			if err := json.Unmarshal(mock.CompletionRequest.Format, &schema); err != nil {
+				t.Fatal(err)
+			}
+
+			if schema.Type != "array" || len(schema.Items.AnyOf) != 2 || schema.Items.AnyOf[1].Properties.Name.Const != "get_time" {
+				t.Errorf("unexpected tool call schema %s", mock.CompletionRequest.Format)
+			}
+
+			if len(resp.Message.ToolCalls) != 2 {
+				t.Errorf("expected 2 tool calls, got %+v", resp.Message)
+			}
+		})
+
+		t.Run("function", func(t *testing.T) {
+			parallel := false
+			code, resp := chat(t, &api.ToolChoice{Function: "get_weather"}, &parallel)
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+
+			want := `{"additionalProperties":false,"properties":{"arguments":{"properties":{"location":{"description":"","type":"string"}},"required":["location"],"type":"object"},"name":{"const":"get_weather"}},"required":["name","arguments"],"type":"object"}`
+			if diff := cmp.Diff(want, string(mock.CompletionRequest.Format)); diff != "" {
+				t.Errorf("schema mismatch (-want +got):\n%s", diff)
+			}
+
+			// parallel tool calls are disabled
+			if len(resp.Message.ToolCalls) != 1 || resp.Message.ToolCalls[0].Function.Name != "get_weather" {
+				t.Errorf("expected 1 tool call, got %+v", resp.Message)
+			}
+		})
+
+		t.Run("none", func(t *testing.T) {
+			code, resp := chat(t, &api.ToolChoice{Mode: api.ToolChoiceNone}, nil)
+			if code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", code)
+			}
+
+			if strings.Contains(mock.CompletionRequest.Prompt, "get_weather") || mock.CompletionRequest.Format != nil {
+				t.Errorf("expected tools to be left out of the prompt, got %q", mock.CompletionRequest.Prompt)
+			}
+
+			if resp.Message.ToolCalls != nil || resp.Message.Content != mock.CompletionResponse.Content {
+				t.Errorf("expected content without tool calls, got %+v", resp.Message)
+			}
+		})
+
+		t.Run("unknown function", func(t *testing.T) {
+			if code, _ := chat(t, &api.ToolChoice{Function: "get_news"}, nil); code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", code)
+			}
+		})
+	})
+
+	t.Run("messages with logprobs (non-streaming)", func(t *testing.T) {
+		logprobs := []api.Logprob{
+			{TokenLogprob: api.TokenLogprob{Token: "Abra", Logprob: -0.5}},
+			{TokenLogprob: api.TokenLogprob{Token: " kadabra", Logprob: -0.25}},
+		}
+
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			fn(llm.CompletionResponse{Content: "Abra", Logprobs: logprobs[:1]})
+			fn(llm.CompletionResponse{Content: " kadabra", Logprobs: logprobs[1:]})
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop})
+			return nil
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream:  &stream,
+			Options: map[string]any{"logprobs": true},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Options.Logprobs {
+			t.Error("expected logprobs option to be passed to the runner")
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Abra kadabra" {
+			t.Errorf("expected content %q, got %q", "Abra kadabra", resp.Message.Content)
+		}
+
+		if diff := cmp.Diff(logprobs, resp.Logprobs); diff != "" {
+			t.Errorf("logprobs mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with n (non-streaming)", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			// completions are interleaved and may finish in any order
+			fn(llm.CompletionResponse{Index: 1, Content: "Hi"})
+			fn(llm.CompletionResponse{Index: 0, Content: "Hello"})
+			fn(llm.CompletionResponse{Index: 1, Done: true, DoneReason: llm.DoneReasonStop})
+			fn(llm.CompletionResponse{Index: 0, Content: " there"})
+			fn(llm.CompletionResponse{Index: 0, Done: true, DoneReason: llm.DoneReasonLength})
+			return nil
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+			N:      2,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.N != 2 {
+			t.Errorf("expected n to be passed to the runner, got %d", mock.CompletionRequest.N)
+		}
+
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("expected a single JSON object, got content type %q", ct)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "Hello there" {
+			t.Errorf("expected the first completion at the top level, got %q", resp.Message.Content)
+		}
+
+		resps := resp.Choices
+		if len(resps) != 2 {
+			t.Fatalf("expected 2 responses, got %d", len(resps))
+		}
+
+		for i, want := range []struct {
+			content    string
+			doneReason string
+		}{{"Hello there", "length"}, {"Hi", "stop"}} {
+			if resps[i].Index != i || resps[i].Message.Content != want.content || resps[i].DoneReason != want.doneReason {
+				t.Errorf("response %d: got index %d, content %q and done reason %q", i, resps[i].Index, resps[i].Message.Content, resps[i].DoneReason)
+			}
+		}
+	})
+
+	t.Run("messages with n above num_parallel", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+			N:      3,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"n must not exceed the number of parallel requests (2)"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with negative n", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+			N:      -1,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"n must not be negative"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("messages with invalid format", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			return fmt.Errorf("%w: maxLength exceeds the maximum of 1000", llm.ErrInvalidFormat)
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		for _, stream := range []bool{false, true} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model:    "test",
+				Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+				Format:   json.RawMessage(`{"type": "string", "maxLength": 1001}`),
+				Stream:   &stream,
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("stream %t: expected status 400, got %d", stream, w.Code)
+			}
+
+			if diff := cmp.Diff(w.Body.String(), `{"error":"invalid format: maxLength exceeds the maximum of 1000"}`); diff != "" {
+				t.Errorf("stream %t: mismatch (-got +want):\n%s", stream, diff)
+			}
+		}
+	})
+
+	t.Run("think without thinking capability", func(t *testing.T) {
+		think := true
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-system",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &stream,
+			Think:  &think,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"registry.ollama.ai/library/test-system:latest does not support thinking"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-thinking",
+		From:  "test",
+		Template: `
+{{- range $i, $_ := .Messages }}
+{{- .Role }}: {{ if and $.IsThinkSet .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}
+{{ end }}
+{{- if .IsThinkSet }}think: {{ .Think }}{{ end }}`,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("messages with thinking (streaming)", func(t *testing.T) {
+		mock.CompletionFn = func(ctx context.Context, r llm.CompletionRequest, fn func(r llm.CompletionResponse)) error {
+			// the first response, which counts the prompt, is held back
+			fn(llm.CompletionResponse{Content: "<thi", PromptEvalCount: 3})
+			for _, content := range []string{"nk>Let me", " think</th", "ink>\n\n", "Hello", "!"} {
+				fn(llm.CompletionResponse{Content: content})
+			}
+			fn(llm.CompletionResponse{Done: true, DoneReason: llm.DoneReasonStop, StopSequence: "\n", PromptEvalCount: 3})
+			return nil
+		}
+		defer func() { mock.CompletionFn = nil }()
+
+		think := true
+		streamRequest := true
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-thinking",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Stream: &streamRequest,
+			Think:  &think,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Prompt, "user: Hello!\nthink: true"); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		var thinking, content strings.Builder
+		var counts []int
+		decoder := json.NewDecoder(w.Body)
+		for {
+			var resp api.ChatResponse
+			if err := decoder.Decode(&resp); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Message.Thinking != "" && resp.Message.Content != "" {
+				t.Errorf("expected thinking and content in separate chunks, got %+v", resp.Message)
+			}
+
+			if resp.Done && resp.StopSequence != "\n" {
+				t.Errorf("expected stop sequence %q, got %q", "\n", resp.StopSequence)
+			}
+
+			counts = append(counts, resp.PromptEvalCount)
+
+			thinking.WriteString(resp.Message.Thinking)
+			content.WriteString(resp.Message.Content)
+		}
+
+		if thinking.String() != "Let me think" {
+			t.Errorf("expected thinking %q, got %q", "Let me think", thinking.String())
+		}
+
+		if content.String() != "Hello!" {
+			t.Errorf("expected content %q, got %q", "Hello!", content.String())
+		}
+
+		// the prompt is counted in the first and last chunks
+		if n := len(counts); n < 3 || counts[0] != 3 || counts[n-1] != 3 || slices.ContainsFunc(counts[1:n-1], func(c int) bool { return c != 0 }) {
+			t.Errorf("unexpected prompt eval counts %v", counts)
+		}
 	})
 }
 
@@ -968,3 +1413,468 @@ func TestGenerate(t *testing.T) {
 		}
 	})
 }
+
+func TestTokenize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockRunner
+	s := Server{
+		sched: &Scheduler{
+			loaded: make(map[string]*runnerRef),
+		},
+	}
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`,
+		System:   "You are a helpful assistant.",
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	m, err := GetModel("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokenize with the runner of the loaded model
+	runner := &runnerRef{llama: &mock, modelPath: m.ModelPath, sessionDuration: time.Hour}
+	s.sched.loaded[m.ModelPath] = runner
+	t.Cleanup(func() {
+		if runner.expireTimer != nil {
+			runner.expireTimer.Stop()
+		}
+	})
+
+	t.Run("prompt", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:  "test",
+			Prompt: "Why is the sky blue?",
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.TokenizeResponse{Model: "test", Tokens: []int{0, 1, 2, 3, 4}}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		// the runner is released once the request is done
+		if runner.refCount != 0 || runner.expireTimer == nil {
+			t.Errorf("expected the runner to be released, got ref count %d", runner.refCount)
+		}
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:    "test",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.TokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// "system: You are a helpful assistant. user: Hello! "
+		if len(resp.Tokens) != 8 {
+			t.Errorf("expected 8 tokens for the templated messages, got %d", len(resp.Tokens))
+		}
+	})
+
+	t.Run("prompt and messages", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:    "test",
+			Prompt:   "Hello!",
+			Messages: []api.Message{{Role: "user", Content: "Hello!"}},
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := createRequest(t, s.TokenizeHandler, api.TokenizeRequest{
+			Model:  "missing",
+			Prompt: "Hello!",
+		})
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("detokenize", func(t *testing.T) {
+		w := createRequest(t, s.DetokenizeHandler, api.DetokenizeRequest{
+			Model:  "test",
+			Tokens: []int{1, 2},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.DetokenizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(api.DetokenizeResponse{Model: "test", Content: "t1 t2"}, resp); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestRerank(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockRunner
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":      "bert",
+		"bert.block_count":          uint32(1),
+		"bert.context_length":       uint32(8),
+		"bert.embedding_length":     uint32(4096),
+		"bert.attention.head_count": uint32(32),
+		"bert.pooling_type":         uint32(4),
+		"tokenizer.ggml.tokens":     []string{""},
+		"tokenizer.ggml.scores":     []float32{0},
+		"tokenizer.ggml.token_type": []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:  "test",
+		Files:  map[string]string{"file.gguf": digest},
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	documents := []string{"grass is green", "the sky is blue", "water"}
+
+	t.Run("rerank", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{
+			Model:     "test",
+			Query:     "is the sky blue",
+			Documents: documents,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.RerankResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []api.RerankResult{
+			{Index: 1, RelevanceScore: sigmoid(4)},
+			{Index: 0, RelevanceScore: sigmoid(1)},
+			{Index: 2, RelevanceScore: sigmoid(0)},
+		}
+		if diff := cmp.Diff(want, resp.Results); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.PromptEvalCount != 20 {
+			t.Errorf("expected prompt eval count 20, got %d", resp.PromptEvalCount)
+		}
+	})
+
+	t.Run("top n", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{
+			Model:     "test",
+			Query:     "is the sky blue",
+			Documents: documents,
+			TopN:      1,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.RerankResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]api.RerankResult{{Index: 1, RelevanceScore: sigmoid(4)}}, resp.Results); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no truncation", func(t *testing.T) {
+		w := createRequest(t, s.RerankHandler, api.RerankRequest{
+			Model:     "test",
+			Query:     "is the sky blue",
+			Documents: []string{"the sky is blue because of rayleigh scattering"},
+			Truncate:  &[]bool{false}[0],
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("special tokens", func(t *testing.T) {
+		mock.rerankOverhead = 3
+		t.Cleanup(func() { mock.rerankOverhead = 0 })
+
+		// the query and document fill the context, leaving no room for the
+		// special tokens unless the document is truncated
+		req := api.RerankRequest{
+			Model:     "test",
+			Query:     "is the sky blue",
+			Documents: []string{"the sky is blue"},
+		}
+
+		w := createRequest(t, s.RerankHandler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp api.RerankResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		// one token of the document is left
+		if diff := cmp.Diff([]api.RerankResult{{Index: 0, RelevanceScore: sigmoid(0)}}, resp.Results); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+
+		if resp.PromptEvalCount != 8 {
+			t.Errorf("expected prompt eval count 8, got %d", resp.PromptEvalCount)
+		}
+
+		req.Truncate = &[]bool{false}[0]
+		if w := createRequest(t, s.RerankHandler, req); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		req.Query = "is the sky blue today"
+		req.Truncate = nil
+		if w := createRequest(t, s.RerankHandler, req); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for a query that leaves no room for the document, got %d", w.Code)
+		}
+	})
+
+	t.Run("not a reranker", func(t *testing.T) {
+		_, digest := createBinFile(t, ggml.KV{
+			"general.architecture":      "bert",
+			"bert.pooling_type":         uint32(1),
+			"tokenizer.ggml.tokens":     []string{""},
+			"tokenizer.ggml.scores":     []float32{0},
+			"tokenizer.ggml.token_type": []int32{0},
+		}, []*ggml.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Model:  "embed",
+			Files:  map[string]string{"file.gguf": digest},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		w = createRequest(t, s.RerankHandler, api.RerankRequest{
+			Model:     "embed",
+			Query:     "is the sky blue",
+			Documents: documents,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestWarm(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var mock mockRunner
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      discover.GetGPUInfo,
+			getCpuFn:      discover.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, _ *ggml.GGML, _ discover.GpuInfoList, _ int) {
+				req.successCh <- &runnerRef{
+					llama: &mock,
+				}
+			},
+		},
+	}
+
+	go s.sched.Run(t.Context())
+
+	_, digest := createBinFile(t, ggml.KV{
+		"general.architecture":          "llama",
+		"llama.block_count":             uint32(1),
+		"llama.context_length":          uint32(8192),
+		"llama.embedding_length":        uint32(4096),
+		"llama.attention.head_count":    uint32(32),
+		"llama.attention.head_count_kv": uint32(8),
+		"tokenizer.ggml.tokens":         []string{""},
+		"tokenizer.ggml.scores":         []float32{0},
+		"tokenizer.ggml.token_type":     []int32{0},
+	}, []*ggml.Tensor{
+		{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+	})
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model:    "test",
+		Files:    map[string]string{"file.gguf": digest},
+		Template: `{{- range .Messages }}{{ .Role }}: {{ .Content }} {{ end }}`,
+		System:   "You are a helpful agent.",
+		Stream:   &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OLLAMA_KV_CACHE_DIR", "")
+
+		w := createRequest(t, s.WarmHandler, api.WarmRequest{Model: "test", Name: "agent", Prompt: "hello"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Setenv("OLLAMA_KV_CACHE_DIR", t.TempDir())
+
+	cases := []struct {
+		name string
+		req  api.WarmRequest
+		code int
+		warm llm.WarmRequest
+	}{
+		{
+			name: "missing name",
+			req:  api.WarmRequest{Model: "test", Prompt: "hello"},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "missing prompt",
+			req:  api.WarmRequest{Model: "test", Name: "agent"},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "prompt and messages",
+			req:  api.WarmRequest{Model: "test", Name: "agent", Prompt: "hello", Messages: []api.Message{{Role: "user", Content: "hello"}}},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "missing model",
+			req:  api.WarmRequest{Model: "missing", Name: "agent", Prompt: "hello"},
+			code: http.StatusNotFound,
+		},
+		{
+			name: "prompt",
+			req:  api.WarmRequest{Model: "test", Name: "agent", Prompt: "a raw prompt"},
+			code: http.StatusOK,
+			warm: llm.WarmRequest{Name: "agent", Prompt: "a raw prompt"},
+		},
+		{
+			name: "messages",
+			req:  api.WarmRequest{Model: "test", Name: "agent", Messages: []api.Message{{Role: "user", Content: "hello"}}},
+			code: http.StatusOK,
+			warm: llm.WarmRequest{Name: "agent", Prompt: "system: You are a helpful agent. user: hello "},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.warm = llm.WarmRequest{}
+
+			w := createRequest(t, s.WarmHandler, tt.req)
+			if w.Code != tt.code {
+				t.Fatalf("expected status %d, got %d: %s", tt.code, w.Code, w.Body.String())
+			}
+
+			if diff := cmp.Diff(tt.warm, mock.warm); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var resp api.WarmResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.PromptEvalCount != len(strings.Fields(tt.warm.Prompt)) {
+				t.Errorf("expected %d tokens, got %d", len(strings.Fields(tt.warm.Prompt)), resp.PromptEvalCount)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
@@ -13,19 +14,24 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/discover"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/fs/ggml"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tracing"
 	"github.com/ollama/ollama/types/model"
 )
 
 type LlmRequest struct {
 	ctx             context.Context //nolint:containedctx
+	requester       llm.Requester
 	model           *Model
 	opts            api.Options
 	origNumCtx      int // Track the initial ctx request
@@ -41,11 +47,19 @@ type Scheduler struct {
 	expiredCh     chan *runnerRef
 	unloadedCh    chan any
 
+	// waiting is the number of requests that have been taken from
+	// pendingReqCh but not yet passed to processPending
+	waiting atomic.Int64
+
 	loaded   map[string]*runnerRef
 	loadedMu sync.Mutex
 
+	// pinned models are kept loaded until they are unpinned, by model path.
+	// It is guarded by loadedMu.
+	pinned map[string]pinnedModel
+
 	loadFn       func(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList, numParallel int)
-	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() discover.GpuInfoList
 	getCpuFn     func() discover.GpuInfoList
 	reschedDelay time.Duration
@@ -63,6 +77,11 @@ var defaultParallel = 2
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+var ErrPinned = errors.New("unable to load model, every loaded model that would need to be unloaded is pinned")
+
+// errModelPinned is returned when unloading a pinned model
+var errModelPinned = errors.New("model is pinned")
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
@@ -71,6 +90,7 @@ func InitScheduler(ctx context.Context) *Scheduler {
 		expiredCh:     make(chan *runnerRef, maxQueue),
 		unloadedCh:    make(chan any, maxQueue),
 		loaded:        make(map[string]*runnerRef),
+		pinned:        make(map[string]pinnedModel),
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      discover.GetGPUInfo,
 		getCpuFn:      discover.GetCPUInfo,
@@ -88,6 +108,7 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 
 	req := &LlmRequest{
 		ctx:             c,
+		requester:       llm.RequesterFromContext(c),
 		model:           model,
 		opts:            opts,
 		sessionDuration: sessionDuration,
@@ -95,6 +116,11 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 		errCh:           make(chan error, 1),
 	}
 
+	if len(s.pendingReqCh)+int(s.waiting.Load()) >= cap(s.pendingReqCh) {
+		req.errCh <- ErrMaxQueue
+		return req.successCh, req.errCh
+	}
+
 	select {
 	case s.pendingReqCh <- req:
 	default:
@@ -106,8 +132,13 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 // Returns immediately, spawns go routines for the scheduler which will shutdown when ctx is done
 func (s *Scheduler) Run(ctx context.Context) {
 	slog.Debug("starting llm scheduler")
+	next := make(chan *LlmRequest)
 	go func() {
-		s.processPending(ctx)
+		s.orderPending(ctx, next)
+	}()
+
+	go func() {
+		s.processPending(ctx, next)
 	}()
 
 	go func() {
@@ -115,13 +146,65 @@ func (s *Scheduler) Run(ctx context.Context) {
 	}()
 }
 
-func (s *Scheduler) processPending(ctx context.Context) {
+// orderPending takes requests from pendingReqCh and passes them to next one
+// at a time, highest priority first and otherwise taking turns between
+// clients, so that a client queuing many requests can't hold up the others
+func (s *Scheduler) orderPending(ctx context.Context, next chan<- *LlmRequest) {
+	var waiting []*LlmRequest
+
+	// turns records when each client was last served
+	var turn uint64
+	turns := make(map[string]uint64)
+
+	for {
+		var out chan<- *LlmRequest
+		var first *LlmRequest
+		if len(waiting) > 0 {
+			out = next
+			first = slices.MinFunc(waiting, func(a, b *LlmRequest) int {
+				return cmp.Or(
+					cmp.Compare(b.requester.Priority, a.requester.Priority),
+					cmp.Compare(turns[a.requester.Client], turns[b.requester.Client]),
+				)
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-s.pendingReqCh:
+			waiting = append(waiting, req)
+			s.waiting.Add(1)
+		case out <- first:
+			waiting = slices.DeleteFunc(waiting, func(req *LlmRequest) bool { return req == first })
+			turn++
+			turns[first.requester.Client] = turn
+			if len(waiting) == 0 {
+				clear(turns)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) processPending(ctx context.Context, next <-chan *LlmRequest) {
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Debug("shutting down scheduler pending loop")
 			return
-		case pending := <-s.pendingReqCh:
+		case pending := <-next:
+			s.waiting.Add(-1)
+
+			numParallel := int(envconfig.NumParallel())
+			if pin, ok := s.pinnedModel(pending.model.ModelPath); ok {
+				// use the options the model was pinned with so that
+				// requests don't cause it to be reloaded
+				pending.opts.Runner = pin.runner
+				if pin.numParallel > 0 {
+					numParallel = pin.numParallel
+				}
+			}
+
 			// Block other requests until we get this pending request running
 			pending.schedAttempts++
 			if pending.origNumCtx == 0 {
@@ -132,7 +215,11 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				slog.Debug("pending request cancelled or timed out, skipping scheduling")
 				continue
 			}
-			numParallel := int(envconfig.NumParallel())
+
+			_, span := tracing.Start(pending.ctx, "Scheduler.processPending",
+				attribute.String("model", pending.model.ShortName),
+				attribute.Int("attempt", int(pending.schedAttempts)))
+
 			// `mllama` is a snowflake and uses an encoder cache which cannot be used with num_parallel > 1
 			// ref: https://github.com/ollama/ollama/issues/4165
 			if slices.Contains(pending.model.Config.ModelFamilies, "mllama") && numParallel != 1 {
@@ -278,9 +365,9 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				}
 
 				if runnerToExpire == nil {
-					// Shouildn't happen
-					slog.Error("runner to expire was nil!")
-					continue
+					// every loaded model is pinned
+					pending.errCh <- ErrPinned
+					break
 				}
 				// Trigger an expiration to unload once it's done
 				runnerToExpire.refMu.Lock()
@@ -290,6 +377,9 @@ func (s *Scheduler) processPending(ctx context.Context) {
 					runnerToExpire.expireTimer = nil
 				}
 				runnerToExpire.sessionDuration = 0
+				if runnerToExpire.model != nil {
+					metricModelEvictions.Inc(runnerToExpire.model.ShortName)
+				}
 				if runnerToExpire.refCount <= 0 {
 					s.expiredCh <- runnerToExpire
 				}
@@ -298,15 +388,18 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				// Note: at this point we're queueing up all incoming requests, even if they were for
 				// a different model that's loaded and not scheduled to be removed.
 				slog.Debug("waiting for pending requests to complete and unload to occur", "runner", runnerToExpire)
+				span.AddEvent("waiting for unload")
 				select {
 				case <-ctx.Done():
 					slog.Debug("shutting down scheduler pending loop")
+					span.End()
 					return
 				case <-s.unloadedCh:
 					slog.Debug("unload completed", "runner", runnerToExpire)
 					continue
 				}
 			}
+			span.End()
 		case <-s.unloadedCh:
 			// An unload request when there are no pending request can be ignored
 			slog.Debug("ignoring unload event with no pending requests")
@@ -329,37 +422,7 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 				slog.Error("finished request signal received after model unloaded", "modelPath", finished.model.ModelPath)
 				continue
 			}
-			runner.refMu.Lock()
-			runner.refCount--
-			if runner.refCount <= 0 {
-				if runner.sessionDuration <= 0 {
-					slog.Debug("runner with zero duration has gone idle, expiring to unload", "runner", runner)
-					if runner.expireTimer != nil {
-						runner.expireTimer.Stop()
-						runner.expireTimer = nil
-					}
-					s.expiredCh <- runner
-				} else if runner.expireTimer == nil {
-					slog.Debug("runner with non-zero duration has gone idle, adding timer", "runner", runner, "duration", runner.sessionDuration)
-					runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
-						slog.Debug("timer expired, expiring to unload", "runner", runner)
-						runner.refMu.Lock()
-						defer runner.refMu.Unlock()
-						if runner.expireTimer != nil {
-							runner.expireTimer.Stop()
-							runner.expireTimer = nil
-						}
-						s.expiredCh <- runner
-					})
-					runner.expiresAt = time.Now().Add(runner.sessionDuration)
-				} else {
-					slog.Debug("runner with non-zero duration has gone idle, resetting timer", "runner", runner, "duration", runner.sessionDuration)
-					runner.expireTimer.Reset(runner.sessionDuration)
-					runner.expiresAt = time.Now().Add(runner.sessionDuration)
-				}
-			}
-			slog.Debug("after processing request finished event", "runner", runner, "refCount", runner.refCount)
-			runner.refMu.Unlock()
+			s.release(runner)
 		case runner := <-s.expiredCh:
 			slog.Debug("runner expired event received", "runner", runner)
 			runner.refMu.Lock()
@@ -403,6 +466,154 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 	}
 }
 
+// acquire takes a reference to the runner of the model at modelPath if it's
+// loaded and ready, so that it isn't unloaded until it's released. Unlike
+// GetRunner, it never loads the model.
+func (s *Scheduler) acquire(modelPath string) *runnerRef {
+	s.loadedMu.Lock()
+	runner := s.loaded[modelPath]
+	s.loadedMu.Unlock()
+	if runner == nil {
+		return nil
+	}
+
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	if runner.llama == nil || runner.loading {
+		return nil
+	}
+
+	runner.refCount++
+	if runner.expireTimer != nil {
+		runner.expireTimer.Stop()
+		runner.expireTimer = nil
+	}
+	return runner
+}
+
+// release drops a reference to runner, which expires once it's idle unless
+// it's pinned
+func (s *Scheduler) release(runner *runnerRef) {
+	_, pinned := s.pinnedModel(runner.modelPath)
+	runner.refMu.Lock()
+	defer runner.refMu.Unlock()
+	runner.refCount--
+	if runner.refCount <= 0 {
+		if pinned {
+			slog.Debug("pinned runner has gone idle, keeping loaded", "runner", runner)
+		} else {
+			s.expireIdle(runner)
+		}
+	}
+	slog.Debug("after processing request finished event", "runner", runner, "refCount", runner.refCount)
+}
+
+// expireIdle unloads an idle runner once its session duration has passed.
+// The refMu must already be held.
+func (s *Scheduler) expireIdle(runner *runnerRef) {
+	if runner.sessionDuration <= 0 {
+		slog.Debug("runner with zero duration has gone idle, expiring to unload", "runner", runner)
+		if runner.expireTimer != nil {
+			runner.expireTimer.Stop()
+			runner.expireTimer = nil
+		}
+		s.expiredCh <- runner
+	} else if runner.expireTimer == nil {
+		slog.Debug("runner with non-zero duration has gone idle, adding timer", "runner", runner, "duration", runner.sessionDuration)
+		runner.expireTimer = time.AfterFunc(runner.sessionDuration, func() {
+			slog.Debug("timer expired, expiring to unload", "runner", runner)
+			runner.refMu.Lock()
+			defer runner.refMu.Unlock()
+			if runner.expireTimer != nil {
+				runner.expireTimer.Stop()
+				runner.expireTimer = nil
+			}
+			s.expiredCh <- runner
+		})
+		runner.expiresAt = time.Now().Add(runner.sessionDuration)
+	} else {
+		slog.Debug("runner with non-zero duration has gone idle, resetting timer", "runner", runner, "duration", runner.sessionDuration)
+		runner.expireTimer.Reset(runner.sessionDuration)
+		runner.expiresAt = time.Now().Add(runner.sessionDuration)
+	}
+}
+
+type pinnedModel struct {
+	runner      api.Runner
+	numParallel int
+}
+
+// pin keeps the model at modelPath loaded, with the given runner options and
+// number of parallel requests, until it is unpinned. The model is loaded by
+// the next request for it.
+func (s *Scheduler) pin(modelPath string, runner api.Runner, numParallel int) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+
+	if s.pinned == nil {
+		s.pinned = make(map[string]pinnedModel)
+	}
+	s.pinned[modelPath] = pinnedModel{runner: runner, numParallel: numParallel}
+
+	if r := s.loaded[modelPath]; r != nil {
+		r.refMu.Lock()
+		if r.expireTimer != nil {
+			r.expireTimer.Stop()
+			r.expireTimer = nil
+		}
+		r.refMu.Unlock()
+	}
+}
+
+// unpin lets the model at modelPath be unloaded again, after the default
+// keep alive if it is idle. It reports whether the model was pinned.
+func (s *Scheduler) unpin(modelPath string) bool {
+	s.loadedMu.Lock()
+	_, ok := s.pinned[modelPath]
+	delete(s.pinned, modelPath)
+	runner := s.loaded[modelPath]
+	s.loadedMu.Unlock()
+
+	if ok && runner != nil {
+		runner.refMu.Lock()
+		defer runner.refMu.Unlock()
+
+		runner.sessionDuration = envconfig.KeepAlive()
+		if runner.refCount <= 0 {
+			s.expireIdle(runner)
+		}
+	}
+
+	return ok
+}
+
+func (s *Scheduler) pinnedModel(modelPath string) (pinnedModel, bool) {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	pin, ok := s.pinned[modelPath]
+	return pin, ok
+}
+
+// maxParallel is the most requests that m can run in parallel when it's
+// loaded with the configured settings. When the number of parallel requests
+// isn't configured it's picked at load time and may be lower.
+func (s *Scheduler) maxParallel(m *Model) int {
+	if slices.Contains(m.Config.ModelFamilies, "mllama") {
+		return 1
+	}
+
+	numParallel := int(envconfig.NumParallel())
+	if pin, ok := s.pinnedModel(m.ModelPath); ok && pin.numParallel > 0 {
+		numParallel = pin.numParallel
+	}
+
+	if numParallel <= 0 {
+		return defaultParallel
+	}
+
+	return numParallel
+}
+
 // Complete the pending request and send the runner back to the requester
 // Wires up a finished event after the request context is completed
 // Updates session duration, and resets expiration timer
@@ -429,11 +640,15 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 	if numParallel < 1 {
 		numParallel = 1
 	}
+	start := time.Now()
+	_, span := tracing.Start(req.ctx, "Scheduler.load",
+		attribute.String("model", req.model.ShortName),
+		attribute.Int("parallel", numParallel))
 	sessionDuration := envconfig.KeepAlive()
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -442,6 +657,7 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
 		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
+		tracing.End(span, err)
 		req.errCh <- err
 		return
 	}
@@ -476,12 +692,15 @@ func (s *Scheduler) load(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoLis
 		defer runner.refMu.Unlock()
 		if err = llama.WaitUntilRunning(req.ctx); err != nil {
 			slog.Error("error loading llama server", "error", err)
+			tracing.End(span, err)
 			req.errCh <- err
 			slog.Debug("triggering expiration for failed load", "runner", runner)
 			s.expiredCh <- runner
 			return
 		}
 		slog.Debug("finished setting up", "runner", runner)
+		metricModelLoadDuration.Observe(time.Since(start).Seconds(), req.model.ShortName)
+		span.End()
 		if runner.pid < 0 {
 			runner.pid = llama.Pid()
 		}
@@ -629,6 +848,7 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	defer cancel()
 	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
+		runner.model.DraftPath != req.model.DraftPath || // has the draft model changed?
 		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
 		runner.llama.Ping(ctx) != nil {
 		return true
@@ -773,7 +993,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 			req.opts.NumCtx = req.origNumCtx * p
 			if !envconfig.SchedSpread() {
 				for _, g := range sgl {
-					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
+					if ok, estimatedVRAM = llm.PredictServerFit([]discover.GpuInfo{g}, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, p); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
 						return []discover.GpuInfo{g}
@@ -789,7 +1009,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.GpuIn
 		// Now try all the GPUs
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, p); ok {
+			if ok, estimatedVRAM = llm.PredictServerFit(sgl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, p); ok {
 				slog.Info("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", sgl[0].Library, "parallel", p, "required", format.HumanBytes2(estimatedVRAM))
 				*numParallel = p
 				return sgl
@@ -812,7 +1032,7 @@ func pickBestPartialFitByLibrary(req *LlmRequest, f *ggml.GGML, gpus discover.Gp
 	var bestEstimate uint64
 	var bestFit int
 	for i, gl := range byLibrary {
-		_, estimatedVRAM := llm.PredictServerFit(gl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, *numParallel)
+		_, estimatedVRAM := llm.PredictServerFit(gl, f, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, *numParallel)
 		if estimatedVRAM > bestEstimate {
 			bestEstimate = estimatedVRAM
 			bestFit = i
@@ -826,11 +1046,13 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	s.loadedMu.Lock()
 	runnerList := make([]*runnerRef, 0, len(s.loaded))
 	for _, r := range s.loaded {
-		runnerList = append(runnerList, r)
+		if _, ok := s.pinned[r.modelPath]; !ok {
+			runnerList = append(runnerList, r)
+		}
 	}
 	s.loadedMu.Unlock()
 	if len(runnerList) == 0 {
-		slog.Debug("no loaded runner to unload")
+		slog.Debug("no unpinned runner to unload")
 		return nil
 	}
 
@@ -864,10 +1086,17 @@ func (s *Scheduler) unloadAllRunners() {
 	}
 }
 
-func (s *Scheduler) expireRunner(model *Model) {
+func (s *Scheduler) expireRunner(model *Model) error {
 	s.loadedMu.Lock()
 	runner, ok := s.loaded[model.ModelPath]
+	_, pinned := s.pinned[model.ModelPath]
 	s.loadedMu.Unlock()
+	if pinned {
+		// pinned models are only unloaded once they're unpinned
+		slog.Debug("not expiring pinned runner", "model", model.ModelPath)
+		return errModelPinned
+	}
+
 	if ok {
 		runner.refMu.Lock()
 		runner.expiresAt = time.Now()
@@ -881,6 +1110,8 @@ func (s *Scheduler) expireRunner(model *Model) {
 		}
 		runner.refMu.Unlock()
 	}
+
+	return nil
 }
 
 // If other runners are loaded, make sure the pending request will fit in system memory
@@ -888,6 +1119,11 @@ func (s *Scheduler) expireRunner(model *Model) {
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, f *ggml.GGML, gpus discover.GpuInfoList) *runnerRef {
 	slog.Debug("evaluating if CPU model load will fit in available system memory")
 	estimate := llm.EstimateGPULayers(gpus, f, req.model.ProjectorPaths, req.opts, req.opts.NumCtx/req.origNumCtx)
+	if req.model.DraftPath != "" {
+		if _, err := llm.EstimateDraft(gpus, f, req.model.DraftPath, req.opts, req.opts.NumCtx/req.origNumCtx, &estimate); err != nil {
+			slog.Warn("unable to estimate draft model memory", "draft", req.model.DraftPath, "error", err)
+		}
+	}
 	if estimate.TotalSize <= gpus[0].FreeMemory {
 		slog.Debug("cpu inference mode, model fits in available system memory", "model", format.HumanBytes2(estimate.TotalSize), "available", format.HumanBytes2(gpus[0].FreeMemory))
 		return nil
@@ -48,7 +48,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := discover.GpuInfoList{}
@@ -62,7 +62,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, f, gpus, 0)
@@ -103,7 +103,7 @@ type reqBundle struct {
 	f       *ggml.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
@@ -407,6 +407,57 @@ func TestGetRunner(t *testing.T) {
 	b.ctxDone()
 }
 
+func TestOrderPending(t *testing.T) {
+	ctx, done := context.WithTimeout(t.Context(), time.Second)
+	defer done()
+
+	t.Setenv("OLLAMA_MAX_QUEUE", "8")
+	s := InitScheduler(ctx)
+
+	request := func(client string, priority llm.Priority) *LlmRequest {
+		rctx := llm.WithRequester(ctx, llm.Requester{Client: client, Priority: priority})
+		s.GetRunner(rctx, &Model{ShortName: client}, api.DefaultOptions(), nil)
+		return <-s.pendingReqCh
+	}
+
+	// queue requests as if they arrived while another was being scheduled
+	var reqs []*LlmRequest
+	for _, r := range []struct {
+		client   string
+		priority llm.Priority
+	}{
+		{"batch", llm.PriorityLow},
+		{"a", llm.PriorityNormal},
+		{"a", llm.PriorityNormal},
+		{"b", llm.PriorityNormal},
+		{"interactive", llm.PriorityHigh},
+		{"a", llm.PriorityNormal},
+	} {
+		reqs = append(reqs, request(r.client, r.priority))
+	}
+
+	for _, req := range reqs {
+		s.pendingReqCh <- req
+	}
+
+	next := make(chan *LlmRequest)
+	go s.orderPending(ctx, next)
+
+	// wait for every request to be taken from pendingReqCh before ordering
+	require.Eventually(t, func() bool { return s.waiting.Load() == int64(len(reqs)) }, time.Second, time.Millisecond)
+
+	var order []*LlmRequest
+	for range reqs {
+		req := <-next
+		s.waiting.Add(-1)
+		order = append(order, req)
+	}
+
+	// high priority first, then taking turns between a and b, then low priority
+	require.Equal(t, []*LlmRequest{reqs[4], reqs[1], reqs[3], reqs[2], reqs[5], reqs[0]}, order)
+	require.Zero(t, s.waiting.Load())
+}
+
 func TestExpireRunner(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 20*time.Millisecond)
 	defer done()
@@ -423,7 +474,7 @@ func TestExpireRunner(t *testing.T) {
 	var f *ggml.GGML
 	gpus := discover.GpuInfoList{}
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, f, gpus, 0)
@@ -441,7 +492,7 @@ func TestExpireRunner(t *testing.T) {
 		s.loadedMu.Unlock()
 	}
 
-	s.expireRunner(&Model{ModelPath: "foo"})
+	require.NoError(t, s.expireRunner(&Model{ModelPath: "foo"}))
 
 	s.finishedReqCh <- req
 	s.processCompleted(ctx)
@@ -454,6 +505,80 @@ func TestExpireRunner(t *testing.T) {
 }
 
 // TODO - add one scenario that triggers the bogus finished event with positive ref count
+func TestPinnedRunner(t *testing.T) {
+	t.Setenv("OLLAMA_KEEP_ALIVE", "0")
+
+	ctx, done := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	req := &LlmRequest{
+		ctx:             ctx,
+		model:           &Model{ModelPath: "foo"},
+		opts:            api.DefaultOptions(),
+		successCh:       make(chan *runnerRef, 1),
+		errCh:           make(chan error, 1),
+		sessionDuration: &api.Duration{Duration: 0},
+	}
+
+	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+		return server, nil
+	}
+	s.pin("foo", req.opts.Runner, 1)
+	s.load(req, nil, discover.GpuInfoList{}, 0)
+
+	select {
+	case err := <-req.errCh:
+		t.Fatalf("expected no errors when loading, got '%s'", err.Error())
+	case <-req.successCh:
+	}
+
+	other := &runnerRef{modelPath: "bar", sessionDuration: 1, numParallel: 1}
+	s.loadedMu.Lock()
+	s.loaded["bar"] = other
+	s.loadedMu.Unlock()
+	require.Equal(t, other, s.findRunnerToUnload())
+
+	// neither an explicit unload nor a zero keep alive unloads the model
+	require.ErrorIs(t, s.expireRunner(&Model{ModelPath: "foo"}), errModelPinned)
+	s.finishedReqCh <- req
+	s.processCompleted(ctx)
+
+	s.loadedMu.Lock()
+	require.NotNil(t, s.loaded["foo"])
+	delete(s.loaded, "bar")
+	s.loadedMu.Unlock()
+	require.Nil(t, s.findRunnerToUnload())
+
+	require.True(t, s.unpin("foo"))
+	require.False(t, s.unpin("foo"))
+
+	ctx, done = context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer done()
+	s.processCompleted(ctx)
+
+	s.loadedMu.Lock()
+	require.Empty(t, s.loaded)
+	s.loadedMu.Unlock()
+}
+
+func TestMaxParallel(t *testing.T) {
+	s := InitScheduler(t.Context())
+	m := &Model{ModelPath: "foo"}
+
+	t.Setenv("OLLAMA_NUM_PARALLEL", "")
+	require.Equal(t, defaultParallel, s.maxParallel(m))
+
+	t.Setenv("OLLAMA_NUM_PARALLEL", "4")
+	require.Equal(t, 4, s.maxParallel(m))
+
+	s.pin("foo", api.Runner{}, 3)
+	require.Equal(t, 3, s.maxParallel(m))
+
+	m.Config.ModelFamilies = []string{"mllama"}
+	require.Equal(t, 1, s.maxParallel(m))
+}
+
 func TestPrematureExpired(t *testing.T) {
 	ctx, done := context.WithTimeout(t.Context(), 500*time.Millisecond)
 	defer done()
@@ -730,9 +855,9 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus discover.GpuInfoList, model string, f *ggml.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
-		return a.newServer(gpus, model, f, adapters, projectors, opts, numParallel)
+		return a.newServer(gpus, model, f, adapters, projectors, draft, opts, numParallel)
 	}
 	slog.Info("a")
 	s.pendingReqCh <- a.req
@@ -757,6 +882,8 @@ type mockLlm struct {
 	embeddingResp      []float32
 	embeddingRespErr   error
 	tokenizeResp       []int
+	rerankResp         float32
+	rerankRespErr      error
 	tokenizeRespErr    error
 	detokenizeResp     string
 	detonekizeRespErr  error
@@ -777,6 +904,18 @@ func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error
 	return s.embeddingResp, s.embeddingRespErr
 }
 
+func (s *mockLlm) Rerank(ctx context.Context, query, document string) (float32, error) {
+	return s.rerankResp, s.rerankRespErr
+}
+
+func (s *mockLlm) RerankOverhead(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (s *mockLlm) Warm(ctx context.Context, name, prompt string) (int, error) {
+	panic("not implemented")
+}
+
 func (s *mockLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
 	return s.tokenizeResp, s.tokenizeRespErr
 }
@@ -793,3 +932,4 @@ func (s *mockLlm) EstimatedVRAM() uint64                  { return s.estimatedVR
 func (s *mockLlm) EstimatedTotal() uint64                 { return s.estimatedTotal }
 func (s *mockLlm) EstimatedVRAMByGPU(gpuid string) uint64 { return s.estimatedVRAMByGPU[gpuid] }
 func (s *mockLlm) Pid() int                               { return -1 }
+func (s *mockLlm) NumParallel() int                       { return 1 }
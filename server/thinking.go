@@ -0,0 +1,265 @@
+package server
+
+import (
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+)
+
+type thinkingState int
+
+const (
+	// thinkingStateLookingForOpening means we're looking for the opening tag,
+	// skipping any leading whitespace
+	thinkingStateLookingForOpening thinkingState = iota
+	// thinkingStateThinking means we've seen the opening tag and are
+	// collecting thinking content until the closing tag
+	thinkingStateThinking
+	// thinkingStateThinkingDone means we've seen the closing tag and are
+	// skipping any whitespace that follows it before the regular content
+	thinkingStateThinkingDone
+	// thinkingStateContentStarted means all remaining output is regular content
+	thinkingStateContentStarted
+)
+
+func (s thinkingState) String() string {
+	switch s {
+	case thinkingStateLookingForOpening:
+		return "LookingForOpening"
+	case thinkingStateThinking:
+		return "Thinking"
+	case thinkingStateThinkingDone:
+		return "ThinkingDone"
+	case thinkingStateContentStarted:
+		return "ContentStarted"
+	default:
+		return "Unknown"
+	}
+}
+
+// thinkingParser splits streamed model output into thinking and regular
+// content based on the model's opening and closing thinking tags
+type thinkingParser struct {
+	state      thinkingState
+	openingTag string
+	closingTag string
+	acc        strings.Builder
+}
+
+// newThinkingParser returns a parser for the thinking tags rendered by the
+// template, or nil if the template doesn't render thinking. If the prompt
+// already ends with the opening tag, the model's output starts inside the
+// thinking block.
+func newThinkingParser(t *template.Template, prompt string) *thinkingParser {
+	openingTag, closingTag := inferThinkingTags(t)
+	if openingTag == "" || closingTag == "" {
+		return nil
+	}
+
+	p := &thinkingParser{openingTag: openingTag, closingTag: closingTag}
+	if strings.HasSuffix(strings.TrimRightFunc(prompt, unicode.IsSpace), openingTag) {
+		p.state = thinkingStateThinking
+	}
+
+	return p
+}
+
+// addContent adds content to the parser and returns the thinking and regular
+// content that can be emitted so far. Partial tags are held back until enough
+// content has been seen to disambiguate them.
+func (s *thinkingParser) addContent(content string) (string, string) {
+	s.acc.WriteString(content)
+
+	var thinkingSb, remainingSb strings.Builder
+
+	var thinking, remaining string
+	keepLooping := true
+	// we loop because we might pass through multiple parsing states in a single
+	// call to addContent, and we want to make sure callers don't have to wait
+	// for data that's already unambiguous
+	for keepLooping {
+		thinking, remaining, keepLooping = s.eat()
+		thinkingSb.WriteString(thinking)
+		remainingSb.WriteString(remaining)
+	}
+
+	return thinkingSb.String(), remainingSb.String()
+}
+
+// eat consumes as much of the accumulated content as possible for the current
+// state, returning the thinking and regular content along with whether the
+// parser transitioned to a new state and should be run again
+func (s *thinkingParser) eat() (string, string, bool) {
+	switch s.state {
+	case thinkingStateLookingForOpening:
+		trimmed := strings.TrimLeftFunc(s.acc.String(), unicode.IsSpace)
+		if strings.HasPrefix(trimmed, s.openingTag) {
+			after := strings.TrimLeftFunc(strings.TrimPrefix(trimmed, s.openingTag), unicode.IsSpace)
+			s.acc.Reset()
+			s.acc.WriteString(after)
+			s.state = thinkingStateThinking
+			return "", "", after != ""
+		} else if strings.HasPrefix(s.openingTag, trimmed) {
+			// partial opening tag or only whitespace, wait for more content
+			return "", "", false
+		}
+
+		// no opening tag, so the model isn't thinking
+		s.state = thinkingStateContentStarted
+		s.acc.Reset()
+		return "", trimmed, false
+	case thinkingStateThinking:
+		acc := s.acc.String()
+		if before, after, ok := strings.Cut(acc, s.closingTag); ok {
+			before = strings.TrimRightFunc(before, unicode.IsSpace)
+			after = strings.TrimLeftFunc(after, unicode.IsSpace)
+			s.acc.Reset()
+			if after == "" {
+				s.state = thinkingStateThinkingDone
+			} else {
+				s.state = thinkingStateContentStarted
+			}
+			return before, after, false
+		}
+
+		// hold back anything that could be the start of the closing tag,
+		// along with trailing whitespace that may precede it
+		thinking := acc[:len(acc)-overlap(acc, s.closingTag)]
+		trailing := len(thinking) - len(strings.TrimRightFunc(thinking, unicode.IsSpace))
+		thinking = thinking[:len(thinking)-trailing]
+		remaining := acc[len(thinking):]
+
+		s.acc.Reset()
+		s.acc.WriteString(remaining)
+		return thinking, "", false
+	case thinkingStateThinkingDone:
+		acc := strings.TrimLeftFunc(s.acc.String(), unicode.IsSpace)
+		s.acc.Reset()
+		if acc != "" {
+			s.state = thinkingStateContentStarted
+		}
+		return "", acc, false
+	case thinkingStateContentStarted:
+		acc := s.acc.String()
+		s.acc.Reset()
+		return "", acc, false
+	default:
+		panic("unknown thinking state")
+	}
+}
+
+// stripThinking removes a leading thinking block from content. Content that
+// doesn't start with a complete thinking block is returned unchanged.
+func stripThinking(content, openingTag, closingTag string) string {
+	if !strings.HasPrefix(strings.TrimLeftFunc(content, unicode.IsSpace), openingTag) {
+		return content
+	}
+
+	p := thinkingParser{openingTag: openingTag, closingTag: closingTag}
+	_, remaining := p.addContent(content)
+	if p.state != thinkingStateThinkingDone && p.state != thinkingStateContentStarted {
+		return content
+	}
+
+	return remaining
+}
+
+// overlap returns the length of the longest suffix of s that is a prefix of
+// delim
+func overlap(s, delim string) int {
+	n := min(len(delim), len(s))
+	for i := n; i > 0; i-- {
+		if strings.HasSuffix(s, delim[:i]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// inferThinkingTags returns the tags that surround the rendering of
+// .Thinking in the template, e.g. "<think>" and "</think>" for
+//
+//	{{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}
+//
+// Empty strings are returned if the template doesn't render thinking.
+func inferThinkingTags(t *template.Template) (string, string) {
+	if t == nil || t.Tree == nil {
+		return "", ""
+	}
+
+	var openingTag, closingTag string
+	var walk func(parse.Node) bool
+	walk = func(n parse.Node) bool {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			for i, c := range n.Nodes {
+				if a, ok := c.(*parse.ActionNode); ok && rendersThinking(a) {
+					if i > 0 {
+						if text, ok := n.Nodes[i-1].(*parse.TextNode); ok {
+							if fields := strings.Fields(string(text.Text)); len(fields) > 0 {
+								openingTag = fields[len(fields)-1]
+							}
+						}
+					}
+
+					if i+1 < len(n.Nodes) {
+						if text, ok := n.Nodes[i+1].(*parse.TextNode); ok {
+							if fields := strings.Fields(string(text.Text)); len(fields) > 0 {
+								closingTag = fields[0]
+							}
+						}
+					}
+
+					if openingTag != "" && closingTag != "" {
+						return true
+					}
+
+					openingTag, closingTag = "", ""
+				}
+
+				if walk(c) {
+					return true
+				}
+			}
+		case *parse.IfNode:
+			return walk(&n.BranchNode)
+		case *parse.WithNode:
+			return walk(&n.BranchNode)
+		case *parse.RangeNode:
+			return walk(&n.BranchNode)
+		case *parse.BranchNode:
+			if n.List != nil && walk(n.List) {
+				return true
+			}
+			if n.ElseList != nil && walk(n.ElseList) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	walk(t.Tree.Root)
+	return openingTag, closingTag
+}
+
+// rendersThinking reports whether the action prints the .Thinking field
+func rendersThinking(a *parse.ActionNode) bool {
+	for _, cmd := range a.Pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				if arg.Ident[len(arg.Ident)-1] == "Thinking" {
+					return true
+				}
+			case *parse.VariableNode:
+				if arg.Ident[len(arg.Ident)-1] == "Thinking" {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"testing"
+	"text/template"
+)
+
+func TestThinkingStreaming(t *testing.T) {
+	type step struct {
+		input          string
+		wantThinking   string
+		wantContent    string
+		wantStateAfter thinkingState
+	}
+
+	cases := []struct {
+		desc  string
+		steps []step
+	}{
+		{
+			desc: "content without a thinking tag",
+			steps: []step{
+				{input: "  abc", wantThinking: "", wantContent: "abc", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+		{
+			desc: "content before a thinking tag nerfs the thinking tag",
+			steps: []step{
+				{input: "  abc <think>def</think> ghi", wantThinking: "", wantContent: "abc <think>def</think> ghi", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+		{
+			desc: "building up a thinking tag partially",
+			steps: []step{
+				{input: "  <th", wantThinking: "", wantContent: "", wantStateAfter: thinkingStateLookingForOpening},
+				{input: "in", wantThinking: "", wantContent: "", wantStateAfter: thinkingStateLookingForOpening},
+				{input: "k>a", wantThinking: "a", wantContent: "", wantStateAfter: thinkingStateThinking},
+			},
+		},
+		{
+			desc: "partial closing tag",
+			steps: []step{
+				{input: "<think>abc</th", wantThinking: "abc", wantContent: "", wantStateAfter: thinkingStateThinking},
+				{input: "ink>def", wantThinking: "", wantContent: "def", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+		{
+			desc: "partial closing tag fakeout",
+			steps: []step{
+				{input: "<think>abc</th", wantThinking: "abc", wantContent: "", wantStateAfter: thinkingStateThinking},
+				{input: "ing>def", wantThinking: "</thing>def", wantContent: "", wantStateAfter: thinkingStateThinking},
+				{input: "ghi</thi", wantThinking: "ghi", wantContent: "", wantStateAfter: thinkingStateThinking},
+				{input: "nk>jkl", wantThinking: "", wantContent: "jkl", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+		{
+			desc: "whitespace after thinking tag",
+			steps: []step{
+				{input: "  <think>\n\nabc</think>\n\ndef", wantThinking: "abc", wantContent: "def", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+		{
+			desc: "whitespace after thinking tag (incremental)",
+			steps: []step{
+				{input: "  <think>\n\nabc</think>", wantThinking: "abc", wantContent: "", wantStateAfter: thinkingStateThinkingDone},
+				{input: "\n\ndef", wantThinking: "", wantContent: "def", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+		{
+			desc: "whitespace before closing tag is held back",
+			steps: []step{
+				{input: "<think>abc  ", wantThinking: "abc", wantContent: "", wantStateAfter: thinkingStateThinking},
+				{input: "def", wantThinking: "  def", wantContent: "", wantStateAfter: thinkingStateThinking},
+				{input: "\n</think>ghi", wantThinking: "", wantContent: "ghi", wantStateAfter: thinkingStateContentStarted},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			parser := thinkingParser{
+				openingTag: "<think>",
+				closingTag: "</think>",
+			}
+
+			for i, step := range c.steps {
+				thinking, content := parser.addContent(step.input)
+				if thinking != step.wantThinking {
+					t.Errorf("step %d: thinking = %q, want %q", i, thinking, step.wantThinking)
+				}
+				if content != step.wantContent {
+					t.Errorf("step %d: content = %q, want %q", i, content, step.wantContent)
+				}
+				if parser.state != step.wantStateAfter {
+					t.Errorf("step %d: state = %s, want %s", i, parser.state, step.wantStateAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestNewThinkingParser(t *testing.T) {
+	tmpl := template.Must(template.New("").Parse(`{{ range .Messages }}{{ if .Thinking }}<think>{{ .Thinking }}</think>{{ end }}{{ .Content }}{{ end }}`))
+
+	if p := newThinkingParser(tmpl, "hello"); p == nil || p.state != thinkingStateLookingForOpening {
+		t.Errorf("expected parser looking for the opening tag, got %+v", p)
+	}
+
+	p := newThinkingParser(tmpl, "hello<think>\n")
+	if p == nil || p.state != thinkingStateThinking {
+		t.Fatalf("expected parser already thinking, got %+v", p)
+	}
+
+	thinking, content := p.addContent("abc</think>def")
+	if thinking != "abc" || content != "def" {
+		t.Errorf("got thinking %q and content %q", thinking, content)
+	}
+
+	if p := newThinkingParser(template.Must(template.New("").Parse(`{{ .Prompt }}`)), ""); p != nil {
+		t.Errorf("expected nil parser for a template without thinking, got %+v", p)
+	}
+}
+
+func TestInferThinkingTags(t *testing.T) {
+	cases := []struct {
+		desc        string
+		tmplString  string
+		wantOpening string
+		wantClosing string
+	}{
+		{
+			desc: "qwen3 style",
+			tmplString: `
+{{- range $i, $_ := .Messages }}
+{{- $last := eq (len (slice $.Messages $i)) 1 -}}
+{{- if eq .Role "user" }}<|im_start|>user
+{{ .Content }}<|im_end|>
+{{ else if eq .Role "assistant" }}<|im_start|>assistant
+{{ if and $.IsThinkSet (and $last .Thinking) -}}
+<think>
+{{ .Thinking }}
+</think>
+{{ end -}}
+{{ .Content }}<|im_end|>
+{{ end }}
+{{- end }}`,
+			wantOpening: "<think>",
+			wantClosing: "</think>",
+		},
+		{
+			desc:        "custom tags",
+			tmplString:  `{{ range .Messages }}{{ if .Thinking }}[reasoning]{{ .Thinking }}[/reasoning]{{ end }}{{ .Content }}{{ end }}`,
+			wantOpening: "[reasoning]",
+			wantClosing: "[/reasoning]",
+		},
+		{
+			desc:        "no thinking",
+			tmplString:  `{{ range .Messages }}{{ .Content }}{{ end }}`,
+			wantOpening: "",
+			wantClosing: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			tmpl := template.Must(template.New("test").Parse(c.tmplString))
+			opening, closing := inferThinkingTags(tmpl)
+			if opening != c.wantOpening || closing != c.wantClosing {
+				t.Errorf("got (%q, %q), want (%q, %q)", opening, closing, c.wantOpening, c.wantClosing)
+			}
+		})
+	}
+}
+
+func TestStripThinking(t *testing.T) {
+	cases := []struct {
+		content string
+		want    string
+	}{
+		{content: "<think>abc</think>\n\ndef", want: "def"},
+		{content: "no thinking here", want: "no thinking here"},
+		{content: "<think>never closed", want: "<think>never closed"},
+		{content: "before <think>abc</think>", want: "before <think>abc</think>"},
+	}
+
+	for _, c := range cases {
+		if got := stripThinking(c.content, "<think>", "</think>"); got != c.want {
+			t.Errorf("stripThinking(%q) = %q, want %q", c.content, got, c.want)
+		}
+	}
+}
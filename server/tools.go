@@ -0,0 +1,427 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+type toolParserState int
+
+const (
+	// toolParserStateContent means the output is regular content, which is
+	// returned unless it could be the start of a tool call
+	toolParserStateContent toolParserState = iota
+	// toolParserStateBetween means we've seen text that comes before or
+	// between tool calls, such as a prefix or the brackets of an array, and
+	// are waiting to see if a tool call follows it
+	toolParserStateBetween
+	// toolParserStateCall means we're collecting a JSON object that may be a
+	// tool call
+	toolParserStateCall
+)
+
+func (s toolParserState) String() string {
+	switch s {
+	case toolParserStateContent:
+		return "Content"
+	case toolParserStateBetween:
+		return "Between"
+	case toolParserStateCall:
+		return "Call"
+	default:
+		return "Unknown"
+	}
+}
+
+// toolParser splits streamed model output into regular content and tool
+// calls in the format rendered by the model's template. Content is returned
+// as soon as it can't be part of a tool call, and the arguments of a tool
+// call are returned as deltas as they're generated.
+type toolParser struct {
+	format   toolCallFormat
+	parallel bool
+
+	// streaming is set when the arguments of tool calls are returned as
+	// deltas while they're generated
+	streaming bool
+
+	state toolParserState
+
+	// output that hasn't been returned yet and how much of it was scanned
+	buf []byte
+	pos int
+
+	// afterCall is set once a tool call has been parsed, after which the
+	// text between calls is dropped instead of being returned as content
+	afterCall bool
+
+	// index of the tool call being parsed
+	index int
+	call  toolCallScanner
+
+	// truncated is set by finish if the output ended in the middle of a
+	// tool call
+	truncated bool
+
+	content strings.Builder
+	calls   []api.ToolCall
+	deltas  []api.ToolCallDelta
+}
+
+// newToolParser returns a parser for tool calls in format. Only the first
+// tool call is returned when parallel is false, and tool calls are only
+// returned once they're complete unless streaming is true.
+func newToolParser(format toolCallFormat, parallel, streaming bool) *toolParser {
+	return &toolParser{format: format, parallel: parallel, streaming: streaming}
+}
+
+// add parses the next part of the output, returning the content, complete
+// tool calls and tool call deltas found so far
+func (p *toolParser) add(s string) (string, []api.ToolCall, []api.ToolCallDelta) {
+	p.buf = append(p.buf, s...)
+	for p.pos < len(p.buf) && p.step() {
+	}
+
+	if p.state == toolParserStateContent {
+		p.emit(p.pos)
+	}
+
+	p.stream()
+	return p.flush()
+}
+
+// finish returns whatever is left of the output once generation is done.
+// Incomplete tool calls are returned as content, unless some of their
+// arguments were already returned as deltas.
+func (p *toolParser) finish() (string, []api.ToolCall, []api.ToolCallDelta) {
+	switch {
+	case p.state == toolParserStateCall:
+		p.truncated = true
+		if p.call.sent == 0 {
+			p.emit(len(p.buf))
+		}
+	case p.state != toolParserStateBetween || !p.afterCall:
+		p.emit(len(p.buf))
+	}
+
+	p.buf, p.pos, p.state = nil, 0, toolParserStateContent
+	return p.flush()
+}
+
+func (p *toolParser) flush() (string, []api.ToolCall, []api.ToolCallDelta) {
+	content, calls, deltas := p.content.String(), p.calls, p.deltas
+	p.content.Reset()
+	p.calls, p.deltas = nil, nil
+	return content, calls, deltas
+}
+
+// emit returns the first n bytes of the buffer as content
+func (p *toolParser) emit(n int) {
+	p.content.Write(p.buf[:n])
+	p.drop(n)
+}
+
+// drop discards the first n bytes of the buffer
+func (p *toolParser) drop(n int) {
+	p.buf = p.buf[n:]
+	p.pos -= n
+}
+
+// step scans the output at the current position, returning false if more
+// output is needed to decide what it is
+func (p *toolParser) step() bool {
+	switch p.state {
+	case toolParserStateContent:
+		switch n := matchMarker(p.buf[p.pos:], p.format.prefixes); {
+		case n < 0:
+			return false
+		case n > 0:
+			p.emit(p.pos)
+			p.pos = n
+			p.state, p.afterCall = toolParserStateBetween, false
+			return true
+		}
+
+		switch p.buf[p.pos] {
+		case '{':
+			p.emit(p.pos)
+			p.startCall()
+		case '[':
+			p.emit(p.pos)
+			p.pos = 1
+			p.state, p.afterCall = toolParserStateBetween, false
+		default:
+			p.pos++
+		}
+	case toolParserStateBetween:
+		switch n := matchMarker(p.buf[p.pos:], p.format.prefixes, p.format.suffixes); {
+		case n < 0:
+			return false
+		case n > 0:
+			p.pos += n
+			return true
+		}
+
+		switch p.buf[p.pos] {
+		case ' ', '\t', '\r', '\n', ',', '[', ']':
+			p.pos++
+		case '{':
+			p.drop(p.pos)
+			p.startCall()
+		default:
+			if p.afterCall {
+				p.drop(p.pos)
+			} else {
+				// rescan everything after the first byte in case it
+				// contains the start of a tool call
+				p.emit(1)
+				p.pos = 0
+			}
+			p.state = toolParserStateContent
+		}
+	case toolParserStateCall:
+		done, ok := p.call.scan(p.buf, p.pos, p.format)
+		if !ok {
+			p.emit(1)
+			p.pos, p.state = 0, toolParserStateContent
+			return true
+		}
+
+		p.pos++
+		if done {
+			p.stream()
+			p.endCall()
+		}
+	}
+
+	return true
+}
+
+func (p *toolParser) startCall() {
+	p.pos, p.state = 0, toolParserStateCall
+	p.call = toolCallScanner{argsStart: -1, argsEnd: -1}
+}
+
+// endCall parses the complete object at the start of the buffer, returning it
+// as content if it isn't a tool call
+func (p *toolParser) endCall() {
+	var obj map[string]any
+	if err := json.Unmarshal(p.buf[:p.pos], &obj); err != nil {
+		p.emit(1)
+		p.pos, p.state = 0, toolParserStateContent
+		return
+	}
+
+	name, nok := obj[p.format.name].(string)
+	arguments, aok := obj[p.format.arguments].(map[string]any)
+	if !nok || !aok {
+		p.emit(1)
+		p.pos, p.state = 0, toolParserStateContent
+		return
+	}
+
+	if p.parallel || p.index == 0 {
+		p.calls = append(p.calls, api.ToolCall{
+			Function: api.ToolCallFunction{
+				Index:     p.index,
+				Name:      name,
+				Arguments: arguments,
+			},
+		})
+	}
+
+	p.index++
+	p.drop(p.pos)
+	p.state, p.afterCall = toolParserStateBetween, true
+}
+
+// stream adds a delta with the arguments of the current tool call that
+// haven't been returned yet. The first delta of a call includes its name.
+func (p *toolParser) stream() {
+	c := &p.call
+	if !p.streaming || p.state != toolParserStateCall || c.name == "" || c.argsStart < 0 || !p.parallel && p.index > 0 {
+		return
+	}
+
+	end := p.pos
+	if c.argsEnd >= 0 {
+		end = c.argsEnd
+	}
+
+	switch {
+	case c.sent == 0:
+		p.deltas = append(p.deltas, api.ToolCallDelta{Index: p.index, Name: c.name, Arguments: string(p.buf[c.argsStart:end])})
+	case end > c.sent:
+		p.deltas = append(p.deltas, api.ToolCallDelta{Index: p.index, Arguments: string(p.buf[c.sent:end])})
+	default:
+		return
+	}
+
+	c.sent = end
+}
+
+// matchMarker returns the length of the marker that s starts with, -1 if s
+// could be the start of a marker, or 0 if it can't
+func matchMarker(s []byte, markers ...[]string) int {
+	n := 0
+	for _, ms := range markers {
+		for _, m := range ms {
+			if bytes.HasPrefix(s, []byte(m)) {
+				return len(m)
+			} else if bytes.HasPrefix([]byte(m), s) {
+				n = -1
+			}
+		}
+	}
+
+	return n
+}
+
+const (
+	expectKey = iota
+	expectColon
+	expectValue
+	expectComma
+)
+
+// toolCallScanner scans a JSON object byte by byte, keeping track of the
+// name and the position of the arguments of a tool call
+type toolCallScanner struct {
+	depth    int
+	inString bool
+	escaped  bool
+	literal  bool
+
+	// what comes next in the top level object
+	expect int
+
+	// the current key and the start of the current key or value
+	key   string
+	start int
+
+	name string
+
+	// position of the arguments in the buffer and how much of them was sent
+	argsStart, argsEnd int
+	sent               int
+}
+
+// scan scans the byte at i of the object that starts at buf[0], returning
+// whether the object is done and false if it isn't valid
+func (s *toolCallScanner) scan(buf []byte, i int, f toolCallFormat) (done bool, ok bool) {
+	c := buf[i]
+	if s.inString {
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case c == '\\':
+			s.escaped = true
+		case c == '"':
+			s.inString = false
+			if s.depth == 1 {
+				s.end(buf, i+1, f)
+			}
+		}
+
+		return false, true
+	}
+
+	if s.literal {
+		switch c {
+		case ',', '}', ' ', '\t', '\r', '\n':
+			s.literal = false
+			s.end(buf, i, f)
+		default:
+			return false, true
+		}
+	}
+
+	switch c {
+	case ' ', '\t', '\r', '\n':
+	case '{', '[':
+		switch s.depth {
+		case 0:
+			s.expect = expectKey
+		case 1:
+			if s.expect != expectValue {
+				return false, false
+			}
+			s.begin(i, f)
+		}
+		s.depth++
+	case '}', ']':
+		s.depth--
+		switch s.depth {
+		case 0:
+			return true, c == '}' && s.expect == expectComma
+		case 1:
+			s.end(buf, i+1, f)
+		}
+	case '"':
+		if s.depth == 1 {
+			switch s.expect {
+			case expectKey:
+				s.start = i
+			case expectValue:
+				s.begin(i, f)
+			default:
+				return false, false
+			}
+		}
+		s.inString = true
+	case ':':
+		if s.depth == 1 {
+			if s.expect != expectColon {
+				return false, false
+			}
+			s.expect = expectValue
+		}
+	case ',':
+		if s.depth == 1 {
+			if s.expect != expectComma {
+				return false, false
+			}
+			s.expect = expectKey
+		}
+	default:
+		if s.depth == 1 {
+			if s.expect != expectValue {
+				return false, false
+			}
+			s.begin(i, f)
+			s.literal = true
+		}
+	}
+
+	return false, true
+}
+
+// begin marks the start of a value in the top level object
+func (s *toolCallScanner) begin(i int, f toolCallFormat) {
+	s.start = i
+	if s.key == f.arguments {
+		s.argsStart = i
+	}
+}
+
+// end handles the end of a key or value in the top level object
+func (s *toolCallScanner) end(buf []byte, i int, f toolCallFormat) {
+	if s.expect == expectKey {
+		s.key = ""
+		json.Unmarshal(buf[s.start:i], &s.key) //nolint:errcheck
+		s.expect = expectColon
+		return
+	}
+
+	switch s.key {
+	case f.name:
+		json.Unmarshal(buf[s.start:i], &s.name) //nolint:errcheck
+	case f.arguments:
+		s.argsEnd = i
+	}
+
+	s.expect = expectComma
+}
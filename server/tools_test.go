@@ -0,0 +1,219 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestToolParserStreaming(t *testing.T) {
+	type step struct {
+		input          string
+		wantContent    string
+		wantCalls      []api.ToolCall
+		wantDeltas     []api.ToolCallDelta
+		wantStateAfter toolParserState
+	}
+
+	format := toolCallFormat{
+		name:      "name",
+		arguments: "arguments",
+		prefixes:  []string{"<tool_call>"},
+		suffixes:  []string{"</tool_call>"},
+	}
+
+	weather := func(index int, location string) api.ToolCall {
+		return api.ToolCall{Function: api.ToolCallFunction{Index: index, Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": location}}}
+	}
+
+	cases := []struct {
+		desc     string
+		parallel bool
+		steps    []step
+	}{
+		{
+			desc: "content without tool calls",
+			steps: []step{
+				{input: "Hello", wantContent: "Hello", wantStateAfter: toolParserStateContent},
+				{input: " world", wantContent: " world", wantStateAfter: toolParserStateContent},
+			},
+		},
+		{
+			desc: "partial prefix is held back",
+			steps: []step{
+				{input: "Sure <tool", wantContent: "Sure ", wantStateAfter: toolParserStateContent},
+				{input: "box>", wantContent: "<toolbox>", wantStateAfter: toolParserStateContent},
+			},
+		},
+		{
+			desc: "prefix fakeout",
+			steps: []step{
+				{input: "<tool_call> is a tag", wantContent: "<tool_call> is a tag", wantStateAfter: toolParserStateContent},
+			},
+		},
+		{
+			desc: "braces in content",
+			steps: []step{
+				{input: "a {b} [c]", wantContent: "a {b} [c]", wantStateAfter: toolParserStateContent},
+			},
+		},
+		{
+			desc: "JSON that isn't a tool call",
+			steps: []step{
+				{input: `{"a": `, wantStateAfter: toolParserStateCall},
+				{input: `1} b`, wantContent: `{"a": 1} b`, wantStateAfter: toolParserStateContent},
+			},
+		},
+		{
+			desc:     "streamed arguments",
+			parallel: true,
+			steps: []step{
+				{input: "Let me check. <tool_call>\n", wantContent: "Let me check. ", wantStateAfter: toolParserStateBetween},
+				{input: `{"name": "get_`, wantStateAfter: toolParserStateCall},
+				{input: `weather", "arguments": {"loc`, wantDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"loc`}}, wantStateAfter: toolParserStateCall},
+				{input: `ation": "Paris"`, wantDeltas: []api.ToolCallDelta{{Index: 0, Arguments: `ation": "Paris"`}}, wantStateAfter: toolParserStateCall},
+				{input: "}}\n</tool_call>", wantCalls: []api.ToolCall{weather(0, "Paris")}, wantDeltas: []api.ToolCallDelta{{Index: 0, Arguments: "}"}}, wantStateAfter: toolParserStateBetween},
+			},
+		},
+		{
+			desc:     "arguments before the name",
+			parallel: true,
+			steps: []step{
+				{input: `{"arguments": {"location": "Paris"}, `, wantStateAfter: toolParserStateCall},
+				{input: `"name": "get_weather"}`, wantCalls: []api.ToolCall{weather(0, "Paris")}, wantDeltas: []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location": "Paris"}`}}, wantStateAfter: toolParserStateBetween},
+			},
+		},
+		{
+			desc:     "array of tool calls",
+			parallel: true,
+			steps: []step{
+				{
+					input:          `[{"name": "get_weather", "arguments": {"location": "Paris"}}, {"name": "get_weather", "arguments": {"location": "Rome"}}]`,
+					wantCalls:      []api.ToolCall{weather(0, "Paris"), weather(1, "Rome")},
+					wantDeltas:     []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location": "Paris"}`}, {Index: 1, Name: "get_weather", Arguments: `{"location": "Rome"}`}},
+					wantStateAfter: toolParserStateBetween,
+				},
+				{input: "\n\nDone", wantContent: "Done", wantStateAfter: toolParserStateContent},
+			},
+		},
+		{
+			desc: "only the first call without parallel calls",
+			steps: []step{
+				{
+					input:          `<tool_call>{"name": "get_weather", "arguments": {"location": "Paris"}}</tool_call><tool_call>{"name": "get_weather", "arguments": {"location": "Rome"}}</tool_call>`,
+					wantCalls:      []api.ToolCall{weather(0, "Paris")},
+					wantDeltas:     []api.ToolCallDelta{{Index: 0, Name: "get_weather", Arguments: `{"location": "Paris"}`}},
+					wantStateAfter: toolParserStateBetween,
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			p := newToolParser(format, c.parallel, true)
+			for i, step := range c.steps {
+				content, calls, deltas := p.add(step.input)
+				if content != step.wantContent {
+					t.Errorf("step %d: content mismatch: got %q, want %q", i, content, step.wantContent)
+				}
+				if diff := cmp.Diff(step.wantCalls, calls); diff != "" {
+					t.Errorf("step %d: calls mismatch (-want +got):\n%s", i, diff)
+				}
+				if diff := cmp.Diff(step.wantDeltas, deltas); diff != "" {
+					t.Errorf("step %d: deltas mismatch (-want +got):\n%s", i, diff)
+				}
+				if p.state != step.wantStateAfter {
+					t.Errorf("step %d: state mismatch: got %s, want %s", i, p.state, step.wantStateAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestToolParserByteByByte(t *testing.T) {
+	format := toolCallFormat{name: "name", arguments: "arguments", prefixes: []string{"[TOOL_CALLS]"}}
+	output := `Checking. [TOOL_CALLS] [{"name": "get_weather", "arguments": {"location": "Paris, \"FR\"", "days": 3}}, {"name": "get_time", "arguments": {}}] {"name": "incomplete`
+
+	p := newToolParser(format, true, true)
+	var content strings.Builder
+	var calls []api.ToolCall
+	args := map[int]string{}
+	collect := func(c string, tc []api.ToolCall, deltas []api.ToolCallDelta) {
+		content.WriteString(c)
+		calls = append(calls, tc...)
+		for _, d := range deltas {
+			args[d.Index] += d.Arguments
+		}
+	}
+
+	for i := range len(output) {
+		collect(p.add(output[i : i+1]))
+	}
+	collect(p.finish())
+
+	if content.String() != `Checking. {"name": "incomplete` {
+		t.Errorf("unexpected content %q", content.String())
+	}
+
+	want := []api.ToolCall{
+		{Function: api.ToolCallFunction{Index: 0, Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"location": `Paris, "FR"`, "days": float64(3)}}},
+		{Function: api.ToolCallFunction{Index: 1, Name: "get_time", Arguments: api.ToolCallFunctionArguments{}}},
+	}
+	if diff := cmp.Diff(want, calls); diff != "" {
+		t.Errorf("calls mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[int]string{0: `{"location": "Paris, \"FR\"", "days": 3}`, 1: `{}`}, args); diff != "" {
+		t.Errorf("streamed arguments mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestToolParserTruncated(t *testing.T) {
+	format := toolCallFormat{name: "name", arguments: "arguments", prefixes: []string{"[TOOL_CALLS]"}}
+	output := `[TOOL_CALLS] [{"name": "get_weather", "arguments": {"location": "Paris"}}, {"name": "get_weather", "arguments": {"location": "To`
+
+	cases := []struct {
+		streaming bool
+		content   string
+		deltas    map[int]string
+	}{
+		// the incomplete call was already streamed, so it isn't repeated
+		{true, "", map[int]string{0: `{"location": "Paris"}`, 1: `{"location": "To`}},
+		{false, `{"name": "get_weather", "arguments": {"location": "To`, map[int]string{}},
+	}
+
+	for _, tt := range cases {
+		p := newToolParser(format, true, tt.streaming)
+
+		deltas := map[int]string{}
+		_, calls, ds := p.add(output)
+		for _, d := range ds {
+			deltas[d.Index] += d.Arguments
+		}
+
+		content, rest, ds := p.finish()
+		for _, d := range ds {
+			deltas[d.Index] += d.Arguments
+		}
+
+		if content != tt.content {
+			t.Errorf("streaming %t: expected content %q, got %q", tt.streaming, tt.content, content)
+		}
+
+		if len(calls) != 1 || len(rest) != 0 {
+			t.Errorf("streaming %t: expected only the first call, got %v and %v", tt.streaming, calls, rest)
+		}
+
+		if diff := cmp.Diff(tt.deltas, deltas); diff != "" {
+			t.Errorf("streaming %t: deltas mismatch (-want +got):\n%s", tt.streaming, diff)
+		}
+
+		if !p.truncated {
+			t.Errorf("streaming %t: expected the output to be truncated", tt.streaming)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/types/model"
+)
+
+// WarmHandler evaluates a prompt and persists its KV cache to disk, so that
+// requests starting with the same prompt can skip evaluating it, even after
+// the model has been reloaded
+func (s *Server) WarmHandler(c *gin.Context) {
+	var req api.WarmRequest
+	if err := c.ShouldBindJSON(&req); errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if envconfig.KvCacheDir() == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "warming prompts requires OLLAMA_KV_CACHE_DIR to be set"})
+		return
+	}
+
+	if req.Name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	if (req.Prompt == "") == (len(req.Messages) == 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "exactly one of prompt or messages is required"})
+		return
+	}
+
+	caps := []model.Capability{model.CapabilityCompletion}
+	if len(req.Tools) > 0 {
+		caps = append(caps, model.CapabilityTools)
+	}
+
+	name := model.ParseName(req.Model)
+	if !name.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+	name, err := getExistingName(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", req.Model)})
+		return
+	}
+
+	r, m, opts, err := s.scheduleRunner(c.Request.Context(), name.String(), caps, req.Options, req.KeepAlive)
+	if errors.Is(err, errCapabilityCompletion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		return
+	} else if err != nil {
+		handleScheduleError(c, req.Model, err)
+		return
+	}
+
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		msgs := append(m.Messages, req.Messages...)
+		if req.Messages[0].Role != "system" && m.System != "" {
+			msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
+		}
+		msgs = filterThinkTags(msgs, m)
+
+		var images []llm.ImageData
+		prompt, images, err = chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools, nil)
+		if err != nil {
+			slog.Error("chat prompt error", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(images) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "prompts with images can't be warmed"})
+			return
+		}
+	}
+
+	count, err := r.Warm(c.Request.Context(), req.Name, prompt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, api.WarmResponse{PromptEvalCount: count})
+}
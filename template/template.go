@@ -168,6 +168,11 @@ type Values struct {
 	Prompt string
 	Suffix string
 
+	// Think is whether the request enabled thinking and IsThinkSet is whether
+	// the request set it at all, so templates can distinguish false from unset
+	Think      bool
+	IsThinkSet bool
+
 	// forceLegacy is a flag used to test compatibility with legacy templates
 	forceLegacy bool
 }
@@ -228,10 +233,12 @@ func (t *Template) Execute(w io.Writer, v Values) error {
 		})
 	} else if !v.forceLegacy && slices.Contains(t.Vars(), "messages") {
 		return t.Template.Execute(w, map[string]any{
-			"System":   system,
-			"Messages": messages,
-			"Tools":    v.Tools,
-			"Response": "",
+			"System":     system,
+			"Messages":   messages,
+			"Tools":      v.Tools,
+			"Response":   "",
+			"Think":      v.Think,
+			"IsThinkSet": v.IsThinkSet,
 		})
 	}
 
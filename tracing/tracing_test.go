@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestPropagation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	// the runner continues the trace injected by the server
+	runner := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "runner")
+		span.End()
+	})))
+	defer runner.Close()
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.POST("/api/generate", func(c *gin.Context) {
+		req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, runner.URL+"/completion", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Inject(c.Request.Context(), req.Header)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/api/generate", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	server, ok := spans["POST /api/generate"]
+	if !ok {
+		t.Fatalf("missing server span, got %v", spans)
+	}
+
+	completion, ok := spans["POST /completion"]
+	if !ok {
+		t.Fatalf("missing runner request span, got %v", spans)
+	}
+
+	if completion.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("expected runner request to be a child of the server request")
+	}
+
+	if spans["runner"].Parent().SpanID() != completion.SpanContext().SpanID() {
+		t.Errorf("expected runner span to be a child of the runner request")
+	}
+
+	if completion.SpanContext().TraceID() != server.SpanContext().TraceID() {
+		t.Errorf("expected a single trace, got %s and %s", server.SpanContext().TraceID(), completion.SpanContext().TraceID())
+	}
+}
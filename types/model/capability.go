@@ -8,6 +8,8 @@ const (
 	CapabilityInsert     = Capability("insert")
 	CapabilityVision     = Capability("vision")
 	CapabilityEmbedding  = Capability("embedding")
+	CapabilityThinking   = Capability("thinking")
+	CapabilityRerank     = Capability("rerank")
 )
 
 func (c Capability) String() string {